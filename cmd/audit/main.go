@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/harvester/node-manager/pkg/audit"
+)
+
+// harvester-node-manager-audit prints the changes of the audit log of the
+// node, it is run in the node-manager pod of the node, e.g.
+// `kubectl exec <pod> -- harvester-node-manager-audit --kind NodeConfig`
+func main() {
+	var auditLog, kind, name, section string
+
+	app := cli.NewApp()
+	app.Name = "harvester-node-manager-audit"
+	app.Usage = "Print the changes applied to the host, one JSON per line, and verify the audit log"
+	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:        "audit-log",
+			EnvVars:     []string{"AUDIT_LOG"},
+			Value:       audit.LogPath,
+			DefaultText: audit.LogPath,
+			Usage:       "Append-only log of the changes applied to the host",
+			Destination: &auditLog,
+		},
+		&cli.StringFlag{
+			Name:        "kind",
+			Usage:       "Only print the changes of the kind, e.g. NodeConfig",
+			Destination: &kind,
+		},
+		&cli.StringFlag{
+			Name:        "name",
+			Usage:       "Only print the changes of the objects with the name",
+			Destination: &name,
+		},
+		&cli.StringFlag{
+			Name:        "section",
+			Usage:       "Only print the changes of the section, e.g. ntpConfigs",
+			Destination: &section,
+		},
+	}
+	app.Action = func(_ *cli.Context) error {
+		f, err := os.Open(auditLog)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		changes, readErr := audit.ReadLog(f)
+		encoder := json.NewEncoder(os.Stdout)
+		for _, change := range changes {
+			if (kind != "" && change.Kind != kind) ||
+				(name != "" && change.Name != name) ||
+				(section != "" && change.Section != section) {
+				continue
+			}
+			if err := encoder.Encode(change); err != nil {
+				return err
+			}
+		}
+		if readErr != nil {
+			return fmt.Errorf("audit log %s is not intact: %v", auditLog, readErr)
+		}
+		return nil
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		logrus.Fatal(err)
+	}
+}
@@ -99,6 +99,9 @@ func runWebhookServer(ctx context.Context, cfg *rest.Config, options *config.Opt
 
 	var validators = []admission.Validator{
 		cloudinitValidator,
+		admitter.NewNodeConfigValidator(),
+		admitter.NewNodeConfigTemplateValidator(),
+		admitter.NewHostConfigChangeValidator(),
 	}
 
 	if err := webhookServer.RegisterValidators(validators...); err != nil {
@@ -107,6 +110,9 @@ func runWebhookServer(ctx context.Context, cfg *rest.Config, options *config.Opt
 
 	var mutators = []admission.Mutator{
 		mutator.NewCloudInitMutator(),
+		mutator.NewNodeConfigRequesterMutator(),
+		mutator.NewKsmtunedRequesterMutator(),
+		mutator.NewHugepageRequesterMutator(),
 	}
 
 	if err := webhookServer.RegisterMutators(mutators...); err != nil {
@@ -10,22 +10,26 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"sync"
 	"time"
 
 	"github.com/ehazlett/simplelog"
 	ctlnode "github.com/rancher/wrangler/v3/pkg/generated/controllers/core"
+	"github.com/rancher/wrangler/v3/pkg/leader"
 	"github.com/rancher/wrangler/v3/pkg/signals"
 	"github.com/rancher/wrangler/v3/pkg/start"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog"
 
+	"github.com/harvester/node-manager/pkg/audit"
+	"github.com/harvester/node-manager/pkg/controller/clockskew"
 	"github.com/harvester/node-manager/pkg/controller/cloudinit"
 	"github.com/harvester/node-manager/pkg/controller/hugepage"
 	"github.com/harvester/node-manager/pkg/controller/ksmtuned"
 	"github.com/harvester/node-manager/pkg/controller/nodeconfig"
+	"github.com/harvester/node-manager/pkg/controller/nodeconfigtemplate"
 	ctlnodeharvester "github.com/harvester/node-manager/pkg/generated/controllers/node.harvesterhci.io"
 	"github.com/harvester/node-manager/pkg/metrics"
 	"github.com/harvester/node-manager/pkg/monitor"
@@ -60,6 +64,14 @@ func main() {
 			Usage:       "Specify the node name",
 			Destination: &opt.NodeName,
 		},
+		&cli.StringFlag{
+			Name:        "namespace",
+			EnvVars:     []string{"POD_NAMESPACE"},
+			Value:       "harvester-system",
+			DefaultText: "harvester-system",
+			Usage:       "Namespace of the leader election lease",
+			Destination: &opt.Namespace,
+		},
 		&cli.StringFlag{
 			Name:        "profile-listen-address",
 			Value:       "0.0.0.0:6060",
@@ -93,8 +105,29 @@ func main() {
 			DefaultText: "2",
 			Destination: &opt.Threadiness,
 		},
+		&cli.DurationFlag{
+			Name:        "clock-skew-threshold",
+			EnvVars:     []string{"CLOCK_SKEW_THRESHOLD"},
+			Value:       500 * time.Millisecond,
+			DefaultText: "500ms",
+			Usage:       "Maximum tolerable clock skew between the nodes",
+			Destination: &opt.ClockSkewThreshold,
+		},
+		&cli.StringFlag{
+			Name:        "audit-log",
+			EnvVars:     []string{"AUDIT_LOG"},
+			Value:       audit.LogPath,
+			DefaultText: audit.LogPath,
+			Usage:       "Append-only log of the changes applied to the host",
+			Destination: &opt.AuditLog,
+		},
+		&cli.BoolFlag{
+			Name:        "audit-history",
+			EnvVars:     []string{"AUDIT_HISTORY"},
+			Usage:       "Copy the audit log to HostConfigChange objects",
+			Destination: &opt.AuditHistory,
+		},
 	}
-
 	app.Action = func(_ *cli.Context) error {
 		initProfiling(&opt)
 		initLogs(&opt)
@@ -142,7 +175,6 @@ func initLogs(opt *option.Option) {
 
 func run(opt *option.Option) error {
 	ctx := signals.SetupSignalContext()
-	mtx := &sync.Mutex{}
 
 	cfg, err := clientcmd.BuildConfigFromFlags(opt.MasterURL, opt.KubeConfig)
 	if err != nil {
@@ -161,10 +193,19 @@ func run(opt *option.Option) error {
 	nodecfg := nodectl.Node().V1beta1().NodeConfig()
 	nds := nodes.Core().V1().Node()
 	cloudinits := nodectl.Node().V1beta1().CloudInit()
+	nodecfgTemplates := nodectl.Node().V1beta1().NodeConfigTemplate()
 	events := nodes.Core().V1().Event()
 
+	recorder, err := audit.NewRecorder(opt.NodeName, opt.AuditLog)
+	if err != nil {
+		logrus.Fatalf("failed to open audit log: %v", err)
+	}
+	if opt.AuditHistory {
+		recorder.Publish(ctx, nodectl.Node().V1beta1().HostConfigChange())
+	}
+
 	hugectl := nodectl.Node().V1beta1().Hugepage()
-	if _, err = hugepage.Register(ctx, opt.NodeName, hugectl, nds); err != nil {
+	if _, err = hugepage.Register(ctx, opt.NodeName, hugectl, nds, recorder); err != nil {
 		logrus.Fatalf("failed to register hugepage controller: %v", err)
 	}
 
@@ -176,6 +217,7 @@ func run(opt *option.Option) error {
 			opt.NodeName,
 			kts,
 			nds,
+			recorder,
 		); err != nil {
 			logrus.Fatalf("failed to register ksmtuned controller: %s", err)
 		}
@@ -185,12 +227,13 @@ func run(opt *option.Option) error {
 			opt.NodeName,
 			nodecfg,
 			nds,
-			mtx,
+			events,
+			recorder,
 		); err != nil {
 			logrus.Fatalf("failed to register ksmtuned controller: %s", err)
 		}
 
-		cloudinit.Register(ctx, opt.NodeName, cloudinits, nds.Cache(), events)
+		cloudinit.Register(ctx, opt.NodeName, cloudinits, nds.Cache(), events, recorder)
 
 		if err := start.All(ctx, opt.Threadiness, nodectl, nodes); err != nil {
 			logrus.Fatalf("error starting, %s", err.Error())
@@ -198,7 +241,7 @@ func run(opt *option.Option) error {
 	}
 
 	// start monitoring
-	monitorTemplate := monitor.NewMonitorTemplate(ctx, mtx, nodecfg, nds, cloudinits, opt.NodeName)
+	monitorTemplate := monitor.NewMonitorTemplate(ctx, nodecfg, nds, cloudinits, opt.NodeName)
 	monitorNnumbers := len(utils.GetToMonitorServices())
 
 	monitorModules := make([]interface{}, 0, monitorNnumbers)
@@ -212,6 +255,21 @@ func run(opt *option.Option) error {
 
 	run(ctx)
 
+	// the controllers with a cluster wide view only run on one of the nodes
+	kubeClient, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("error building kubernetes client: %s", err.Error())
+	}
+	go leader.RunOrDie(ctx, opt.Namespace, "harvester-node-manager", kubeClient, func(ctx context.Context) {
+		logrus.Infof("Node %s is elected as the leader", opt.NodeName)
+		clockskew.Register(ctx, opt.NodeName, opt.ClockSkewThreshold, nodecfg, nds, events)
+		nodeconfigtemplate.Register(ctx, nodecfgTemplates, nodecfg, nds)
+
+		if err := start.All(ctx, opt.Threadiness, nodectl, nodes); err != nil {
+			logrus.Fatalf("error starting leader controllers, %s", err.Error())
+		}
+	})
+
 	<-ctx.Done()
 	return ksmtunedController.Ksmtuned.Stop()
 }
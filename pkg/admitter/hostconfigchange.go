@@ -0,0 +1,48 @@
+package admitter
+
+import (
+	"errors"
+	"reflect"
+
+	"github.com/harvester/webhook/pkg/server/admission"
+	admissionregv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+var (
+	errHostConfigChangeImmutable = errors.New("spec of HostConfigChange is immutable")
+)
+
+// HostConfigChange keeps the history copied from the audit logs unchanged,
+// the objects could still be deleted to prune the history.
+type HostConfigChange struct {
+	admission.DefaultValidator
+}
+
+func NewHostConfigChangeValidator() *HostConfigChange {
+	return &HostConfigChange{}
+}
+
+func (v *HostConfigChange) Update(_ *admission.Request, oldObj runtime.Object, newObj runtime.Object) error {
+	oldChange := oldObj.(*v1beta1.HostConfigChange)
+	newChange := newObj.(*v1beta1.HostConfigChange)
+	if !reflect.DeepEqual(oldChange.Spec, newChange.Spec) {
+		return errHostConfigChangeImmutable
+	}
+	return nil
+}
+
+func (v *HostConfigChange) Resource() admission.Resource {
+	return admission.Resource{
+		Names:      []string{v1beta1.HostConfigChangeResourceName},
+		Scope:      admissionregv1.ClusterScope,
+		APIGroup:   v1beta1.SchemeGroupVersion.Group,
+		APIVersion: v1beta1.SchemeGroupVersion.Version,
+		ObjectType: &v1beta1.HostConfigChange{},
+		OperationTypes: []admissionregv1.OperationType{
+			admissionregv1.Update,
+		},
+	}
+}
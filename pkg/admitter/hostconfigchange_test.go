@@ -0,0 +1,46 @@
+package admitter
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/harvester/webhook/pkg/server/admission"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+func TestHostConfigChangeValidation(t *testing.T) {
+	oldChange := &v1beta1.HostConfigChange{
+		ObjectMeta: v1.ObjectMeta{Name: "node1-0123456789abcdef"},
+		Spec: v1beta1.HostConfigChangeSpec{
+			Node:    "node1",
+			Object:  v1beta1.ChangeObjectReference{Kind: "NodeConfig", Namespace: "harvester-system", Name: "node1"},
+			Section: "timezone",
+			New:     `"Asia/Taipei"`,
+			Hash:    "0123456789abcdef",
+		},
+	}
+
+	tests := []struct {
+		name   string
+		update func(*v1beta1.HostConfigChange)
+		want   error
+	}{
+		{"unchanged", func(*v1beta1.HostConfigChange) {}, nil},
+		{"labels changed", func(c *v1beta1.HostConfigChange) { c.Labels = map[string]string{"a": "b"} }, nil},
+		{"value changed", func(c *v1beta1.HostConfigChange) { c.Spec.New = `"UTC"` }, errHostConfigChangeImmutable},
+		{"user changed", func(c *v1beta1.HostConfigChange) { c.Spec.User = "kubectl-edit" }, errHostConfigChangeImmutable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newChange := oldChange.DeepCopy()
+			tt.update(newChange)
+			got := NewHostConfigChangeValidator().Update(new(admission.Request), oldChange, newChange)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("want err=%v, got err=%v", tt.want, got)
+			}
+		})
+	}
+}
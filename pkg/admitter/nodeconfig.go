@@ -0,0 +1,610 @@
+package admitter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	// the webhook has no access to the host zoneinfo database
+	_ "time/tzdata"
+	"unicode"
+
+	"github.com/harvester/webhook/pkg/server/admission"
+	admissionregv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+var (
+	errNTPServersConflict     = errors.New("ntpServers and servers are mutually exclusive")
+	errNTPServerControlChars  = errors.New("ntp server contains control characters")
+	errNTPServerInvalid       = errors.New("ntp server is not a valid hostname or IP address")
+	errNTPServerDuplicated    = errors.New("ntp server is duplicated")
+	errNTPServerOptionInvalid = errors.New("ntp server option is empty or contains control characters")
+	errNTSNotSupported        = errors.New("nts is only supported by the chrony backend")
+	errSysctlKeyInvalid       = errors.New("sysctl key is invalid")
+	errSysctlValueInvalid     = errors.New("sysctl value is empty or contains control characters")
+	errSysctlConflict         = errors.New("sysctl is managed by another section")
+
+	errKernelModuleInvalid    = errors.New("kernel module name is invalid")
+	errKernelModuleConflict   = errors.New("kernel module is both loaded and blacklisted")
+	errKernelModuleParameters = errors.New("kernel module parameters are invalid")
+
+	errKernelArgInvalid    = errors.New("kernel arg is empty or contains whitespace, quotes or GRUB special characters")
+	errKernelArgDuplicated = errors.New("kernel arg is duplicated")
+	errKernelArgReserved   = errors.New("kernel arg is reserved by the boot config")
+
+	errTimezoneInvalid = errors.New("timezone is not a valid IANA time zone")
+
+	errDNSNameserverInvalid = errors.New("dns nameserver is not a valid IP address")
+	errDNSNameservers       = errors.New("dns nameservers are more than the resolver supports")
+	errDNSSearchInvalid     = errors.New("dns search domain is invalid")
+	errDNSOptionInvalid     = errors.New("dns option is invalid")
+
+	errHostAliasIPInvalid       = errors.New("host alias ip is not a valid IP address")
+	errHostAliasHostnameInvalid = errors.New("host alias hostname is invalid")
+	errHostAliasNoHostnames     = errors.New("host alias has no hostnames")
+
+	errProxyURLInvalid         = errors.New("proxy is not a valid http or https URL")
+	errNoProxyInvalid          = errors.New("noProxy contains whitespace, quotes or control characters")
+	errRegistryNameInvalid     = errors.New("registry name is empty or contains whitespace")
+	errRegistryNoEndpoints     = errors.New("registry mirror has no endpoints")
+	errRegistryEndpointInvalid = errors.New("registry mirror endpoint is not a valid http or https URL")
+	errRegistryRewriteInvalid  = errors.New("registry mirror rewrite is not a valid regular expression")
+	errRegistryCAFileInvalid   = errors.New("registry caFile is not an absolute path")
+
+	errCPUListInvalid           = errors.New("cpu list is invalid")
+	errCPUGovernorInvalid       = errors.New("cpu governor is invalid")
+	errCPUEnergyPerfPrefInvalid = errors.New("cpu energy performance preference is invalid")
+	errCPUMaxCStateInvalid      = errors.New("cpu max c-state is negative")
+
+	errCPUIsolationNoReserved   = errors.New("cpu isolation has no reserved cpus")
+	errCPUIsolationOverlap      = errors.New("cpu isolation reserved and isolated cpus overlap")
+	errCPUIsolationKernelArgSet = errors.New("kernel arg is managed by cpu isolation")
+
+	errSwapSizeInvalid      = errors.New("swap size is not positive")
+	errZramAlgorithmInvalid = errors.New("zram algorithm is invalid")
+	errSwapFilePathInvalid  = errors.New("swapfile path is not a clean absolute path on a persistent disk")
+
+	errJournaldSystemMaxUseInvalid = errors.New("journald systemMaxUse is not positive")
+	errJournaldRetentionInvalid    = errors.New("journald maxRetentionSec is less than 1s")
+
+	errSystemdUnitNameInvalid    = errors.New("systemd unit name is invalid")
+	errSystemdUnitDuplicated     = errors.New("systemd unit is listed more than once")
+	errSystemdUnitSettingInvalid = errors.New("systemd unit setting is invalid")
+	errSystemdUnitStateManaged   = errors.New("systemd unit state is managed by another section")
+
+	errDriftPolicySectionInvalid = errors.New("drift policy section does not write host files")
+	errDriftPolicyInvalid        = errors.New("drift policy is not enforce, report or ignore")
+
+	sysctlKeyRegexp    = regexp.MustCompile(`^[a-z0-9_]+([./][A-Za-z0-9_@:-]+)+$`)
+	kernelModuleRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	timezoneRegexp     = regexp.MustCompile(`^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$`)
+	dnsOptionRegexp    = regexp.MustCompile(`^[a-z0-9-]+(:[0-9]+)?$`)
+	// cpufreq names are lower case words, the preference could also be a
+	// raw value from 0 to 255
+	cpuPowerValueRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
+	zramAlgorithmRegexp = regexp.MustCompile(`^[a-z0-9-]+$`)
+	swapFilePathRegexp  = regexp.MustCompile(`^(/[A-Za-z0-9._-]+)+$`)
+	// the escaped unit names contain `\x2d` like sequences
+	systemdUnitNameRegexp    = regexp.MustCompile(`^[A-Za-z0-9:_.@\\-]+\.(service|socket|timer|path|mount|automount|swap|target|slice)$`)
+	systemdUnitSectionRegexp = regexp.MustCompile(`^[A-Z][A-Za-z0-9-]*$`)
+	systemdUnitKeyRegexp     = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+
+	// the units which are started, stopped or restarted by the other sections
+	sectionManagedSystemdUnits = []string{"systemd-timesyncd.service", "chronyd.service", "irqbalance.service"}
+
+	// the names of the NodeConfig handlers which write host files, the drift
+	// of their files is handled by the drift policies
+	driftPolicySections = []string{"cpu isolation", "journald", "systemd units", "kernel modules", "DNS", "host aliases", "container runtime", "NTP"}
+
+	// the args which select the root filesystem and the image to boot
+	reservedKernelArgs        = []string{"BOOT_IMAGE", "root", "init", "cos-img/filename"}
+	reservedKernelArgPrefixes = []string{"rd.cos.", "rd.immucore."}
+)
+
+// maxDNSNameservers is MAXNS of glibc, the others are ignored by the resolver
+const maxDNSNameservers = 3
+
+type NodeConfig struct {
+	admission.DefaultValidator
+}
+
+func NewNodeConfigValidator() *NodeConfig {
+	return &NodeConfig{}
+}
+
+func (v *NodeConfig) Create(_ *admission.Request, newObj runtime.Object) error {
+	newNodeConfig := newObj.(*v1beta1.NodeConfig)
+	return validateNodeConfigSpec(&newNodeConfig.Spec)
+}
+
+func (v *NodeConfig) Update(_ *admission.Request, _ runtime.Object, newObj runtime.Object) error {
+	newNodeConfig := newObj.(*v1beta1.NodeConfig)
+	return validateNodeConfigSpec(&newNodeConfig.Spec)
+}
+
+// validateNodeConfigSpec is shared by the NodeConfigs and the templates merged
+// into them.
+func validateNodeConfigSpec(spec *v1beta1.NodeConfigSpec) error {
+	if spec.NTPConfig != nil {
+		if err := validateNTPConfig(spec.NTPConfig); err != nil {
+			return err
+		}
+	}
+
+	if err := validateSysctl(spec.Sysctl, spec.LonghornConfig); err != nil {
+		return err
+	}
+
+	if spec.KernelModules != nil {
+		if err := validateKernelModules(spec.KernelModules); err != nil {
+			return err
+		}
+	}
+
+	if err := validateKernelArgs(spec.KernelArgs); err != nil {
+		return err
+	}
+
+	if spec.DNS != nil {
+		if err := validateDNSConfig(spec.DNS); err != nil {
+			return err
+		}
+	}
+
+	if err := validateHostAliases(spec.HostAliases); err != nil {
+		return err
+	}
+
+	if spec.ContainerRuntime != nil {
+		if err := validateContainerRuntime(spec.ContainerRuntime); err != nil {
+			return err
+		}
+	}
+
+	if spec.CPUPower != nil {
+		if err := validateCPUPower(spec.CPUPower); err != nil {
+			return err
+		}
+	}
+
+	if spec.CPUIsolation != nil {
+		if err := validateCPUIsolation(spec.CPUIsolation, spec.KernelArgs); err != nil {
+			return err
+		}
+	}
+
+	if spec.Swap != nil {
+		if err := validateSwap(spec.Swap); err != nil {
+			return err
+		}
+	}
+
+	if spec.Journald != nil {
+		if err := validateJournald(spec.Journald); err != nil {
+			return err
+		}
+	}
+
+	if err := validateSystemdUnits(spec.SystemdUnits); err != nil {
+		return err
+	}
+
+	if spec.Timezone != "" {
+		if err := validateTimezone(spec.Timezone); err != nil {
+			return err
+		}
+	}
+
+	return validateDriftPolicies(spec.DriftPolicies)
+}
+
+func validateDriftPolicies(policies map[string]v1beta1.DriftPolicy) error {
+	for section, policy := range policies {
+		if !slices.Contains(driftPolicySections, section) {
+			return fmt.Errorf("%w: %q", errDriftPolicySectionInvalid, section)
+		}
+		switch policy {
+		case v1beta1.DriftPolicyEnforce, v1beta1.DriftPolicyReport, v1beta1.DriftPolicyIgnore:
+		default:
+			return fmt.Errorf("%w: %q: %q", errDriftPolicyInvalid, section, policy)
+		}
+	}
+	return nil
+}
+
+func validateSysctl(sysctl map[string]string, longhornConfig *v1beta1.LonghornConfig) error {
+	for key, value := range sysctl {
+		if !sysctlKeyRegexp.MatchString(key) {
+			return fmt.Errorf("%w: %q", errSysctlKeyInvalid, key)
+		}
+		if strings.TrimSpace(value) == "" || hasControlChars(value) {
+			return fmt.Errorf("%w: %q: %q", errSysctlValueInvalid, key, value)
+		}
+	}
+
+	// the hugepages are allocated by the Longhorn V2 Data Engine
+	if longhornConfig != nil && longhornConfig.EnableV2DataEngine {
+		for _, key := range []string{"vm.nr_hugepages", "vm/nr_hugepages"} {
+			if _, found := sysctl[key]; found {
+				return fmt.Errorf("%w: %q is set by longhornConfig", errSysctlConflict, key)
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateNTPConfig(ntpConfig *v1beta1.NTPConfig) error {
+	if ntpConfig.NTPServers != "" && len(ntpConfig.Servers) > 0 {
+		return errNTPServersConflict
+	}
+
+	// The legacy string is validated as a whole first, so that injected
+	// newlines are caught before they are swallowed by the field split.
+	if hasControlChars(ntpConfig.NTPServers) {
+		return fmt.Errorf("%w: %q", errNTPServerControlChars, ntpConfig.NTPServers)
+	}
+
+	servers := ntpConfig.Servers
+	for _, address := range strings.Fields(ntpConfig.NTPServers) {
+		servers = append(servers, v1beta1.NTPServer{Address: address})
+	}
+
+	seen := make(map[string]struct{}, len(servers))
+	for _, server := range servers {
+		if err := validateNTPServerAddress(server.Address); err != nil {
+			return err
+		}
+
+		key := strings.ToLower(strings.TrimSuffix(server.Address, "."))
+		if _, found := seen[key]; found {
+			return fmt.Errorf("%w: %q", errNTPServerDuplicated, server.Address)
+		}
+		seen[key] = struct{}{}
+
+		if server.NTS && ntpConfig.Backend != v1beta1.NTPBackendChrony {
+			return fmt.Errorf("%w: %q", errNTSNotSupported, server.Address)
+		}
+
+		for _, option := range server.Options {
+			if strings.TrimSpace(option) == "" || hasControlChars(option) {
+				return fmt.Errorf("%w: %q", errNTPServerOptionInvalid, option)
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateNTPServerAddress(address string) error {
+	if hasControlChars(address) {
+		return fmt.Errorf("%w: %q", errNTPServerControlChars, address)
+	}
+
+	if net.ParseIP(address) != nil {
+		return nil
+	}
+
+	// hostnames are case-insensitive and may be written fully qualified
+	hostname := strings.ToLower(strings.TrimSuffix(address, "."))
+	if errs := validation.IsDNS1123Subdomain(hostname); len(errs) > 0 {
+		return fmt.Errorf("%w: %q: %s", errNTPServerInvalid, address, strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+func hasControlChars(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
+
+// kernel module names are compared with dashes and underscores folded, the
+// same way the kernel does.
+func normalizeKernelModule(module string) string {
+	return strings.ReplaceAll(module, "-", "_")
+}
+
+func validateKernelModules(kernelModules *v1beta1.KernelModulesConfig) error {
+	load := make(map[string]struct{}, len(kernelModules.Load))
+	for _, module := range kernelModules.Load {
+		if !kernelModuleRegexp.MatchString(module) {
+			return fmt.Errorf("%w: %q", errKernelModuleInvalid, module)
+		}
+		load[normalizeKernelModule(module)] = struct{}{}
+	}
+
+	for _, module := range kernelModules.Blacklist {
+		if !kernelModuleRegexp.MatchString(module) {
+			return fmt.Errorf("%w: %q", errKernelModuleInvalid, module)
+		}
+		if _, found := load[normalizeKernelModule(module)]; found {
+			return fmt.Errorf("%w: %q", errKernelModuleConflict, module)
+		}
+	}
+
+	for module, parameters := range kernelModules.Parameters {
+		if !kernelModuleRegexp.MatchString(module) {
+			return fmt.Errorf("%w: %q", errKernelModuleInvalid, module)
+		}
+		if hasControlChars(parameters) {
+			return fmt.Errorf("%w: %q: %q", errKernelModuleParameters, module, parameters)
+		}
+		for _, parameter := range strings.Fields(parameters) {
+			if name, _, found := strings.Cut(parameter, "="); !found || name == "" {
+				return fmt.Errorf("%w: %q: %q is not name=value", errKernelModuleParameters, module, parameter)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateKernelArgs rejects the args which would break the GRUB variable they
+// are written to, or the boot of the node.
+func validateKernelArgs(kernelArgs []string) error {
+	seen := make(map[string]struct{}, len(kernelArgs))
+	for _, arg := range kernelArgs {
+		if arg == "" || hasControlChars(arg) || strings.ContainsAny(arg, " \t\"'$\\;") {
+			return fmt.Errorf("%w: %q", errKernelArgInvalid, arg)
+		}
+		if _, found := seen[arg]; found {
+			return fmt.Errorf("%w: %q", errKernelArgDuplicated, arg)
+		}
+		seen[arg] = struct{}{}
+
+		name, _, _ := strings.Cut(arg, "=")
+		if slices.Contains(reservedKernelArgs, name) {
+			return fmt.Errorf("%w: %q", errKernelArgReserved, arg)
+		}
+		for _, prefix := range reservedKernelArgPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				return fmt.Errorf("%w: %q", errKernelArgReserved, arg)
+			}
+		}
+	}
+	return nil
+}
+
+// validateTimezone checks the timezone against the embedded zoneinfo database,
+// the node-manager checks it again against the host one before applying it.
+func validateTimezone(timezone string) error {
+	if !timezoneRegexp.MatchString(timezone) || timezone == "Local" {
+		return fmt.Errorf("%w: %q", errTimezoneInvalid, timezone)
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return fmt.Errorf("%w: %q", errTimezoneInvalid, timezone)
+	}
+	return nil
+}
+
+func validateDNSConfig(dns *v1beta1.DNSConfig) error {
+	if len(dns.Nameservers) > maxDNSNameservers {
+		return fmt.Errorf("%w: %d > %d", errDNSNameservers, len(dns.Nameservers), maxDNSNameservers)
+	}
+	for _, nameserver := range dns.Nameservers {
+		if net.ParseIP(nameserver) == nil {
+			return fmt.Errorf("%w: %q", errDNSNameserverInvalid, nameserver)
+		}
+	}
+
+	for _, domain := range dns.Search {
+		if errs := validation.IsDNS1123Subdomain(strings.ToLower(strings.TrimSuffix(domain, "."))); len(errs) > 0 {
+			return fmt.Errorf("%w: %q: %s", errDNSSearchInvalid, domain, strings.Join(errs, ", "))
+		}
+	}
+
+	for _, option := range dns.Options {
+		if !dnsOptionRegexp.MatchString(option) {
+			return fmt.Errorf("%w: %q", errDNSOptionInvalid, option)
+		}
+	}
+	return nil
+}
+
+func validateHostAliases(hostAliases []v1beta1.HostAlias) error {
+	for _, alias := range hostAliases {
+		if net.ParseIP(alias.IP) == nil {
+			return fmt.Errorf("%w: %q", errHostAliasIPInvalid, alias.IP)
+		}
+		if len(alias.Hostnames) == 0 {
+			return fmt.Errorf("%w: %q", errHostAliasNoHostnames, alias.IP)
+		}
+		for _, hostname := range alias.Hostnames {
+			if errs := validation.IsDNS1123Subdomain(strings.ToLower(hostname)); len(errs) > 0 {
+				return fmt.Errorf("%w: %q: %s", errHostAliasHostnameInvalid, hostname, strings.Join(errs, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validateContainerRuntime rejects the values which would break the rke2
+// environment files or registries.yaml, rke2 fails to start with them.
+func validateContainerRuntime(cfg *v1beta1.ContainerRuntimeConfig) error {
+	if cfg.Proxy != nil {
+		for _, proxy := range []string{cfg.Proxy.HTTPProxy, cfg.Proxy.HTTPSProxy} {
+			if proxy != "" && !isHTTPURL(proxy) {
+				return fmt.Errorf("%w: %q", errProxyURLInvalid, proxy)
+			}
+		}
+		if strings.ContainsAny(cfg.Proxy.NoProxy, " \t'\"") || hasControlChars(cfg.Proxy.NoProxy) {
+			return fmt.Errorf("%w: %q", errNoProxyInvalid, cfg.Proxy.NoProxy)
+		}
+	}
+
+	if cfg.Registries == nil {
+		return nil
+	}
+	for name, mirror := range cfg.Registries.Mirrors {
+		if name == "" || strings.ContainsFunc(name, unicode.IsSpace) {
+			return fmt.Errorf("%w: %q", errRegistryNameInvalid, name)
+		}
+		if len(mirror.Endpoints) == 0 {
+			return fmt.Errorf("%w: %q", errRegistryNoEndpoints, name)
+		}
+		for _, endpoint := range mirror.Endpoints {
+			if !isHTTPURL(endpoint) {
+				return fmt.Errorf("%w: %q", errRegistryEndpointInvalid, endpoint)
+			}
+		}
+		for expr := range mirror.Rewrite {
+			if _, err := regexp.Compile(expr); err != nil {
+				return fmt.Errorf("%w: %q: %v", errRegistryRewriteInvalid, expr, err)
+			}
+		}
+	}
+	for host, config := range cfg.Registries.Configs {
+		if host == "" || strings.ContainsFunc(host, unicode.IsSpace) {
+			return fmt.Errorf("%w: %q", errRegistryNameInvalid, host)
+		}
+		if config.CAFile != "" && !filepath.IsAbs(config.CAFile) {
+			return fmt.Errorf("%w: %q", errRegistryCAFileInvalid, config.CAFile)
+		}
+	}
+	return nil
+}
+
+func validateCPUPower(cpuPower *v1beta1.CPUPowerConfig) error {
+	if _, err := utils.ParseCPUList(cpuPower.CPUs); err != nil {
+		return fmt.Errorf("%w: %v", errCPUListInvalid, err)
+	}
+	if cpuPower.Governor != "" && !cpuPowerValueRegexp.MatchString(cpuPower.Governor) {
+		return fmt.Errorf("%w: %q", errCPUGovernorInvalid, cpuPower.Governor)
+	}
+	if cpuPower.EnergyPerformancePreference != "" && !cpuPowerValueRegexp.MatchString(cpuPower.EnergyPerformancePreference) {
+		return fmt.Errorf("%w: %q", errCPUEnergyPerfPrefInvalid, cpuPower.EnergyPerformancePreference)
+	}
+	if cpuPower.MaxCState != nil && *cpuPower.MaxCState < 0 {
+		return fmt.Errorf("%w: %d", errCPUMaxCStateInvalid, *cpuPower.MaxCState)
+	}
+	return nil
+}
+
+// cpuIsolationKernelArgs are generated from the cpuIsolation config, they
+// could not be set in kernelArgs at the same time.
+var cpuIsolationKernelArgs = []string{"irqaffinity", "isolcpus", "nohz_full", "rcu_nocbs"}
+
+func validateCPUIsolation(cpuIsolation *v1beta1.CPUIsolationConfig, kernelArgs []string) error {
+	reserved, err := utils.ParseCPUList(cpuIsolation.ReservedCPUs)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCPUListInvalid, err)
+	}
+	if len(reserved) == 0 {
+		return errCPUIsolationNoReserved
+	}
+	isolated, err := utils.ParseCPUList(cpuIsolation.IsolatedCPUs)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCPUListInvalid, err)
+	}
+	for _, cpu := range isolated {
+		if slices.Contains(reserved, cpu) {
+			return fmt.Errorf("%w: %d", errCPUIsolationOverlap, cpu)
+		}
+	}
+
+	for _, arg := range kernelArgs {
+		key, _, _ := strings.Cut(arg, "=")
+		if slices.Contains(cpuIsolationKernelArgs, key) {
+			return fmt.Errorf("%w: %q", errCPUIsolationKernelArgSet, arg)
+		}
+	}
+	return nil
+}
+
+// swapFileExcludedDirs are either not persistent or not backed by a disk
+var swapFileExcludedDirs = []string{"/boot", "/dev", "/etc", "/proc", "/run", "/sys", "/tmp"}
+
+func validateSwap(swap *v1beta1.SwapConfig) error {
+	if swap.Zram != nil {
+		if swap.Zram.Size.Sign() <= 0 {
+			return fmt.Errorf("%w: zram %s", errSwapSizeInvalid, swap.Zram.Size.String())
+		}
+		if swap.Zram.Algorithm != "" && !zramAlgorithmRegexp.MatchString(swap.Zram.Algorithm) {
+			return fmt.Errorf("%w: %q", errZramAlgorithmInvalid, swap.Zram.Algorithm)
+		}
+	}
+
+	if swap.File != nil {
+		if swap.File.Size.Sign() <= 0 {
+			return fmt.Errorf("%w: swapfile %s", errSwapSizeInvalid, swap.File.Size.String())
+		}
+		path := swap.File.Path
+		if !swapFilePathRegexp.MatchString(path) || filepath.Clean(path) != path {
+			return fmt.Errorf("%w: %q", errSwapFilePathInvalid, path)
+		}
+		for _, dir := range swapFileExcludedDirs {
+			if strings.HasPrefix(path, dir+"/") {
+				return fmt.Errorf("%w: %q", errSwapFilePathInvalid, path)
+			}
+		}
+	}
+	return nil
+}
+
+// validateJournald rejects the values journald would silently ignore or
+// misread, MaxRetentionSec is rendered in whole seconds.
+func validateJournald(journald *v1beta1.JournaldConfig) error {
+	if journald.SystemMaxUse != nil && journald.SystemMaxUse.Sign() <= 0 {
+		return fmt.Errorf("%w: %s", errJournaldSystemMaxUseInvalid, journald.SystemMaxUse.String())
+	}
+	if journald.MaxRetentionSec != nil && journald.MaxRetentionSec.Duration < time.Second {
+		return fmt.Errorf("%w: %s", errJournaldRetentionInvalid, journald.MaxRetentionSec.Duration)
+	}
+	return nil
+}
+
+// validateSystemdUnits rejects the settings which would break the drop-in,
+// the values could not span lines, a trailing backslash would continue the
+// line as well.
+func validateSystemdUnits(units []v1beta1.SystemdUnitConfig) error {
+	names := make(map[string]bool, len(units))
+	for _, unit := range units {
+		if !systemdUnitNameRegexp.MatchString(unit.Name) {
+			return fmt.Errorf("%w: %q", errSystemdUnitNameInvalid, unit.Name)
+		}
+		if names[unit.Name] {
+			return fmt.Errorf("%w: %q", errSystemdUnitDuplicated, unit.Name)
+		}
+		names[unit.Name] = true
+		if unit.State != "" && slices.Contains(sectionManagedSystemdUnits, unit.Name) {
+			return fmt.Errorf("%w: %q", errSystemdUnitStateManaged, unit.Name)
+		}
+
+		for _, setting := range unit.Settings {
+			if !systemdUnitSectionRegexp.MatchString(setting.Section) || !systemdUnitKeyRegexp.MatchString(setting.Key) ||
+				hasControlChars(setting.Value) || strings.HasSuffix(setting.Value, "\\") {
+				return fmt.Errorf("%w: %s [%s] %s=%q", errSystemdUnitSettingInvalid, unit.Name, setting.Section, setting.Key, setting.Value)
+			}
+		}
+	}
+	return nil
+}
+
+func (v *NodeConfig) Resource() admission.Resource {
+	return admission.Resource{
+		Names:      []string{v1beta1.NodeConfigResourceName},
+		Scope:      admissionregv1.NamespacedScope,
+		APIGroup:   v1beta1.SchemeGroupVersion.Group,
+		APIVersion: v1beta1.SchemeGroupVersion.Version,
+		ObjectType: &v1beta1.NodeConfig{},
+		OperationTypes: []admissionregv1.OperationType{
+			admissionregv1.Create,
+			admissionregv1.Update,
+		},
+	}
+}
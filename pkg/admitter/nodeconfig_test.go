@@ -0,0 +1,576 @@
+package admitter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/harvester/webhook/pkg/server/admission"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+func TestNodeConfigNTPValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		input *v1beta1.NTPConfig
+		want  error
+	}{
+		{"no ntp config", nil, nil},
+		{"empty legacy string", &v1beta1.NTPConfig{}, nil},
+		{"legacy string", &v1beta1.NTPConfig{NTPServers: "0.suse.pool.ntp.org 1.suse.pool.ntp.org"}, nil},
+		{"legacy string with IP addresses", &v1beta1.NTPConfig{NTPServers: "192.168.1.1 fd00::1"}, nil},
+		{"legacy string with newline", &v1beta1.NTPConfig{NTPServers: "0.suse.pool.ntp.org\nFallbackNTP=evil.example.com"}, errNTPServerControlChars},
+		{"legacy string with duplicate", &v1beta1.NTPConfig{NTPServers: "pool.ntp.org POOL.ntp.org"}, errNTPServerDuplicated},
+		{"legacy string with invalid hostname", &v1beta1.NTPConfig{NTPServers: "pool.ntp.org bad_host!"}, errNTPServerInvalid},
+		{"both legacy string and list", &v1beta1.NTPConfig{
+			NTPServers: "pool.ntp.org",
+			Servers:    []v1beta1.NTPServer{{Address: "time.example.com"}},
+		}, errNTPServersConflict},
+		{"server list", &v1beta1.NTPConfig{
+			Servers: []v1beta1.NTPServer{
+				{Address: "time.example.com.", Options: []string{"iburst", "minpoll 4"}},
+				{Address: "10.0.0.1"},
+			},
+		}, nil},
+		{"server list with empty address", &v1beta1.NTPConfig{
+			Servers: []v1beta1.NTPServer{{Address: ""}},
+		}, errNTPServerInvalid},
+		{"server list with control characters", &v1beta1.NTPConfig{
+			Servers: []v1beta1.NTPServer{{Address: "time.example.com\t"}},
+		}, errNTPServerControlChars},
+		{"server list with duplicate", &v1beta1.NTPConfig{
+			Servers: []v1beta1.NTPServer{{Address: "time.example.com"}, {Address: "time.example.com."}},
+		}, errNTPServerDuplicated},
+		{"server list with empty option", &v1beta1.NTPConfig{
+			Servers: []v1beta1.NTPServer{{Address: "time.example.com", Options: []string{" "}}},
+		}, errNTPServerOptionInvalid},
+		{"server list with option containing newline", &v1beta1.NTPConfig{
+			Servers: []v1beta1.NTPServer{{Address: "time.example.com", Options: []string{"iburst\nserver evil"}}},
+		}, errNTPServerOptionInvalid},
+		{"nts with chrony backend", &v1beta1.NTPConfig{
+			Backend: v1beta1.NTPBackendChrony,
+			Servers: []v1beta1.NTPServer{{Address: "time.cloudflare.com", Options: []string{"iburst"}, NTS: true}},
+		}, nil},
+		{"nts with default backend", &v1beta1.NTPConfig{
+			Servers: []v1beta1.NTPServer{{Address: "time.cloudflare.com", NTS: true}},
+		}, errNTSNotSupported},
+		{"nts with timesyncd backend", &v1beta1.NTPConfig{
+			Backend: v1beta1.NTPBackendTimesyncd,
+			Servers: []v1beta1.NTPServer{{Address: "time.cloudflare.com", NTS: true}},
+		}, errNTSNotSupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewNodeConfigValidator()
+			nodecfg := &v1beta1.NodeConfig{
+				ObjectMeta: v1.ObjectMeta{Name: "harvester-node-0", Namespace: "harvester-system"},
+				Spec:       v1beta1.NodeConfigSpec{NTPConfig: tt.input},
+			}
+
+			got := v.Create(new(admission.Request), nodecfg)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("create: want err=%v, got err=%v", tt.want, got)
+			}
+
+			got = v.Update(new(admission.Request), nodecfg.DeepCopy(), nodecfg)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("update: want err=%v, got err=%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNodeConfigSysctlValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		sysctl   map[string]string
+		longhorn *v1beta1.LonghornConfig
+		want     error
+	}{
+		{"no sysctl", nil, nil, nil},
+		{"valid sysctl", map[string]string{
+			"vm.swappiness":                    "10",
+			"net.core.somaxconn":               "4096",
+			"net.ipv4.tcp_rmem":                "4096 87380 6291456",
+			"net/ipv4/conf/eth0.100/rp_filter": "1",
+		}, nil, nil},
+		{"key without dot", map[string]string{"swappiness": "10"}, nil, errSysctlKeyInvalid},
+		{"key with path traversal", map[string]string{"vm/../../etc/passwd": "x"}, nil, errSysctlKeyInvalid},
+		{"key with space", map[string]string{"vm.swap piness": "10"}, nil, errSysctlKeyInvalid},
+		{"empty value", map[string]string{"vm.swappiness": " "}, nil, errSysctlValueInvalid},
+		{"value with newline", map[string]string{"vm.swappiness": "10\n"}, nil, errSysctlValueInvalid},
+		{"nr_hugepages without longhorn", map[string]string{"vm.nr_hugepages": "1024"}, nil, nil},
+		{"nr_hugepages with longhorn", map[string]string{"vm.nr_hugepages": "1024"},
+			&v1beta1.LonghornConfig{EnableV2DataEngine: true, HugepagesToAllocate: 1024}, errSysctlConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewNodeConfigValidator()
+			nodecfg := &v1beta1.NodeConfig{
+				ObjectMeta: v1.ObjectMeta{Name: "harvester-node-0", Namespace: "harvester-system"},
+				Spec:       v1beta1.NodeConfigSpec{Sysctl: tt.sysctl, LonghornConfig: tt.longhorn},
+			}
+
+			got := v.Create(new(admission.Request), nodecfg)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("create: want err=%v, got err=%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNodeConfigKernelModulesValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		input *v1beta1.KernelModulesConfig
+		want  error
+	}{
+		{"no kernel modules", nil, nil},
+		{"valid kernel modules", &v1beta1.KernelModulesConfig{
+			Load:       []string{"vfio_pci", "nvme-tcp"},
+			Blacklist:  []string{"nouveau"},
+			Parameters: map[string]string{"kvm_intel": "nested=1 ept=1"},
+		}, nil},
+		{"invalid module name", &v1beta1.KernelModulesConfig{Load: []string{"../vfio"}}, errKernelModuleInvalid},
+		{"invalid blacklisted module name", &v1beta1.KernelModulesConfig{Blacklist: []string{"nouveau;reboot"}}, errKernelModuleInvalid},
+		{"loaded and blacklisted", &v1beta1.KernelModulesConfig{
+			Load:      []string{"nvme-tcp"},
+			Blacklist: []string{"nvme_tcp"},
+		}, errKernelModuleConflict},
+		{"parameter without value", &v1beta1.KernelModulesConfig{
+			Parameters: map[string]string{"kvm_intel": "nested"},
+		}, errKernelModuleParameters},
+		{"parameter with newline", &v1beta1.KernelModulesConfig{
+			Parameters: map[string]string{"kvm_intel": "nested=1\ninstall kvm_intel /bin/sh"},
+		}, errKernelModuleParameters},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewNodeConfigValidator()
+			nodecfg := &v1beta1.NodeConfig{
+				ObjectMeta: v1.ObjectMeta{Name: "harvester-node-0", Namespace: "harvester-system"},
+				Spec:       v1beta1.NodeConfigSpec{KernelModules: tt.input},
+			}
+
+			got := v.Create(new(admission.Request), nodecfg)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("create: want err=%v, got err=%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNodeConfigKernelArgsValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []string
+		want  error
+	}{
+		{"no kernel args", nil, nil},
+		{"valid kernel args", []string{"intel_iommu=on", "iommu=pt", "isolcpus=2-7", "mitigations=off"}, nil},
+		{"empty kernel arg", []string{""}, errKernelArgInvalid},
+		{"kernel arg with space", []string{"quiet splash"}, errKernelArgInvalid},
+		{"kernel arg with GRUB variable", []string{"console=${tty}"}, errKernelArgInvalid},
+		{"kernel arg with quote", []string{`acpi_osi="Linux"`}, errKernelArgInvalid},
+		{"duplicated kernel arg", []string{"iommu=pt", "iommu=pt"}, errKernelArgDuplicated},
+		{"root kernel arg", []string{"root=/dev/sda1"}, errKernelArgReserved},
+		{"cos kernel arg", []string{"rd.cos.oemlabel=COS_OEM"}, errKernelArgReserved},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewNodeConfigValidator()
+			nodecfg := &v1beta1.NodeConfig{
+				ObjectMeta: v1.ObjectMeta{Name: "harvester-node-0", Namespace: "harvester-system"},
+				Spec:       v1beta1.NodeConfigSpec{KernelArgs: tt.input},
+			}
+
+			got := v.Create(new(admission.Request), nodecfg)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("create: want err=%v, got err=%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNodeConfigTimezoneValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  error
+	}{
+		{"no timezone", "", nil},
+		{"UTC", "UTC", nil},
+		{"valid timezone", "Asia/Taipei", nil},
+		{"valid nested timezone", "America/Argentina/Buenos_Aires", nil},
+		{"unknown timezone", "Mars/Olympus_Mons", errTimezoneInvalid},
+		{"relative path", "../../etc/passwd", errTimezoneInvalid},
+		{"local timezone", "Local", errTimezoneInvalid},
+		{"timezone with quote", "Asia/Taipei'; reboot", errTimezoneInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewNodeConfigValidator()
+			nodecfg := &v1beta1.NodeConfig{
+				ObjectMeta: v1.ObjectMeta{Name: "harvester-node-0", Namespace: "harvester-system"},
+				Spec:       v1beta1.NodeConfigSpec{Timezone: tt.input},
+			}
+
+			got := v.Create(new(admission.Request), nodecfg)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("create: want err=%v, got err=%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNodeConfigDNSValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		input *v1beta1.DNSConfig
+		want  error
+	}{
+		{"no dns", nil, nil},
+		{"valid dns", &v1beta1.DNSConfig{
+			Nameservers: []string{"10.0.0.53", "2001:db8::53"},
+			Search:      []string{"example.com", "lab.example.com."},
+			Options:     []string{"ndots:2", "rotate", "single-request-reopen"},
+		}, nil},
+		{"hostname nameserver", &v1beta1.DNSConfig{Nameservers: []string{"dns.example.com"}}, errDNSNameserverInvalid},
+		{"too many nameservers", &v1beta1.DNSConfig{Nameservers: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}}, errDNSNameservers},
+		{"invalid search domain", &v1beta1.DNSConfig{Search: []string{"example com"}}, errDNSSearchInvalid},
+		{"invalid option", &v1beta1.DNSConfig{Options: []string{`ndots:2"`}}, errDNSOptionInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewNodeConfigValidator()
+			nodecfg := &v1beta1.NodeConfig{
+				ObjectMeta: v1.ObjectMeta{Name: "harvester-node-0", Namespace: "harvester-system"},
+				Spec:       v1beta1.NodeConfigSpec{DNS: tt.input},
+			}
+
+			got := v.Create(new(admission.Request), nodecfg)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("create: want err=%v, got err=%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNodeConfigHostAliasesValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []v1beta1.HostAlias
+		want  error
+	}{
+		{"no host aliases", nil, nil},
+		{"valid host aliases", []v1beta1.HostAlias{
+			{IP: "10.0.0.10", Hostnames: []string{"registry.example.com", "registry"}},
+			{IP: "2001:db8::10", Hostnames: []string{"Mirror.example.com"}},
+		}, nil},
+		{"invalid ip", []v1beta1.HostAlias{{IP: "10.0.0", Hostnames: []string{"registry"}}}, errHostAliasIPInvalid},
+		{"no hostnames", []v1beta1.HostAlias{{IP: "10.0.0.10"}}, errHostAliasNoHostnames},
+		{"invalid hostname", []v1beta1.HostAlias{{IP: "10.0.0.10", Hostnames: []string{"registry'; reboot"}}}, errHostAliasHostnameInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewNodeConfigValidator()
+			nodecfg := &v1beta1.NodeConfig{
+				ObjectMeta: v1.ObjectMeta{Name: "harvester-node-0", Namespace: "harvester-system"},
+				Spec:       v1beta1.NodeConfigSpec{HostAliases: tt.input},
+			}
+
+			got := v.Create(new(admission.Request), nodecfg)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("create: want err=%v, got err=%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNodeConfigContainerRuntimeValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		input *v1beta1.ContainerRuntimeConfig
+		want  error
+	}{
+		{"no container runtime", nil, nil},
+		{"valid container runtime", &v1beta1.ContainerRuntimeConfig{
+			Proxy: &v1beta1.ProxyConfig{
+				HTTPProxy:  "http://proxy.example.com:3128",
+				HTTPSProxy: "https://proxy.example.com:3129",
+				NoProxy:    "localhost,127.0.0.1,10.0.0.0/8,.svc,.cluster.local",
+			},
+			Registries: &v1beta1.RegistriesConfig{
+				Mirrors: map[string]v1beta1.RegistryMirror{
+					"docker.io": {
+						Endpoints: []string{"https://mirror.example.com:5000"},
+						Rewrite:   map[string]string{"^rancher/(.*)": "mirrored/rancher/$1"},
+					},
+				},
+				Configs: map[string]v1beta1.RegistryConfig{
+					"mirror.example.com:5000": {CAFile: "/etc/ssl/certs/mirror.pem"},
+				},
+			},
+		}, nil},
+		{"invalid http proxy", &v1beta1.ContainerRuntimeConfig{Proxy: &v1beta1.ProxyConfig{HTTPProxy: "proxy.example.com:3128"}}, errProxyURLInvalid},
+		{"invalid https proxy", &v1beta1.ContainerRuntimeConfig{Proxy: &v1beta1.ProxyConfig{HTTPSProxy: "socks5://proxy.example.com"}}, errProxyURLInvalid},
+		{"invalid no proxy", &v1beta1.ContainerRuntimeConfig{Proxy: &v1beta1.ProxyConfig{NoProxy: "localhost, 127.0.0.1"}}, errNoProxyInvalid},
+		{"invalid mirror name", &v1beta1.ContainerRuntimeConfig{Registries: &v1beta1.RegistriesConfig{
+			Mirrors: map[string]v1beta1.RegistryMirror{"docker io": {Endpoints: []string{"https://mirror.example.com"}}},
+		}}, errRegistryNameInvalid},
+		{"no mirror endpoints", &v1beta1.ContainerRuntimeConfig{Registries: &v1beta1.RegistriesConfig{
+			Mirrors: map[string]v1beta1.RegistryMirror{"docker.io": {}},
+		}}, errRegistryNoEndpoints},
+		{"invalid mirror endpoint", &v1beta1.ContainerRuntimeConfig{Registries: &v1beta1.RegistriesConfig{
+			Mirrors: map[string]v1beta1.RegistryMirror{"docker.io": {Endpoints: []string{"mirror.example.com"}}},
+		}}, errRegistryEndpointInvalid},
+		{"invalid mirror rewrite", &v1beta1.ContainerRuntimeConfig{Registries: &v1beta1.RegistriesConfig{
+			Mirrors: map[string]v1beta1.RegistryMirror{"docker.io": {
+				Endpoints: []string{"https://mirror.example.com"},
+				Rewrite:   map[string]string{"^rancher/(.*": "mirrored/$1"},
+			}},
+		}}, errRegistryRewriteInvalid},
+		{"relative ca file", &v1beta1.ContainerRuntimeConfig{Registries: &v1beta1.RegistriesConfig{
+			Configs: map[string]v1beta1.RegistryConfig{"mirror.example.com": {CAFile: "certs/mirror.pem"}},
+		}}, errRegistryCAFileInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewNodeConfigValidator()
+			nodecfg := &v1beta1.NodeConfig{
+				ObjectMeta: v1.ObjectMeta{Name: "harvester-node-0", Namespace: "harvester-system"},
+				Spec:       v1beta1.NodeConfigSpec{ContainerRuntime: tt.input},
+			}
+
+			got := v.Create(new(admission.Request), nodecfg)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("create: want err=%v, got err=%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNodeConfigCPUPowerValidation(t *testing.T) {
+	maxCState := int32(1)
+	negative := int32(-1)
+	tests := []struct {
+		name  string
+		input *v1beta1.CPUPowerConfig
+		want  error
+	}{
+		{"no cpu power", nil, nil},
+		{"valid cpu power", &v1beta1.CPUPowerConfig{
+			CPUs:                        "0-3,8",
+			Governor:                    "performance",
+			EnergyPerformancePreference: "balance_performance",
+			MaxCState:                   &maxCState,
+		}, nil},
+		{"raw energy performance preference", &v1beta1.CPUPowerConfig{EnergyPerformancePreference: "128"}, nil},
+		{"invalid cpu list", &v1beta1.CPUPowerConfig{CPUs: "3-0"}, errCPUListInvalid},
+		{"invalid governor", &v1beta1.CPUPowerConfig{Governor: "performance; reboot"}, errCPUGovernorInvalid},
+		{"invalid energy performance preference", &v1beta1.CPUPowerConfig{EnergyPerformancePreference: "Balance Power"}, errCPUEnergyPerfPrefInvalid},
+		{"negative max c-state", &v1beta1.CPUPowerConfig{MaxCState: &negative}, errCPUMaxCStateInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewNodeConfigValidator()
+			nodecfg := &v1beta1.NodeConfig{
+				ObjectMeta: v1.ObjectMeta{Name: "harvester-node-0", Namespace: "harvester-system"},
+				Spec:       v1beta1.NodeConfigSpec{CPUPower: tt.input},
+			}
+
+			got := v.Create(new(admission.Request), nodecfg)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("create: want err=%v, got err=%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNodeConfigCPUIsolationValidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      *v1beta1.CPUIsolationConfig
+		kernelArgs []string
+		want       error
+	}{
+		{"no cpu isolation", nil, []string{"isolcpus=2-7"}, nil},
+		{"valid cpu isolation", &v1beta1.CPUIsolationConfig{ReservedCPUs: "0-1", IsolatedCPUs: "2-7"}, []string{"intel_iommu=on"}, nil},
+		{"reserved only", &v1beta1.CPUIsolationConfig{ReservedCPUs: "0,4"}, nil, nil},
+		{"no reserved cpus", &v1beta1.CPUIsolationConfig{IsolatedCPUs: "2-7"}, nil, errCPUIsolationNoReserved},
+		{"invalid cpu list", &v1beta1.CPUIsolationConfig{ReservedCPUs: "0-1", IsolatedCPUs: "2-x"}, nil, errCPUListInvalid},
+		{"overlapping cpus", &v1beta1.CPUIsolationConfig{ReservedCPUs: "0-2", IsolatedCPUs: "2-7"}, nil, errCPUIsolationOverlap},
+		{"conflicting kernel arg", &v1beta1.CPUIsolationConfig{ReservedCPUs: "0-1", IsolatedCPUs: "2-7"}, []string{"nohz_full=2-3"}, errCPUIsolationKernelArgSet},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewNodeConfigValidator()
+			nodecfg := &v1beta1.NodeConfig{
+				ObjectMeta: v1.ObjectMeta{Name: "harvester-node-0", Namespace: "harvester-system"},
+				Spec:       v1beta1.NodeConfigSpec{CPUIsolation: tt.input, KernelArgs: tt.kernelArgs},
+			}
+
+			got := v.Create(new(admission.Request), nodecfg)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("create: want err=%v, got err=%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNodeConfigSwapValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		input *v1beta1.SwapConfig
+		want  error
+	}{
+		{"no swap", nil, nil},
+		{"valid swap", &v1beta1.SwapConfig{
+			Zram: &v1beta1.ZramConfig{Size: resource.MustParse("4Gi"), Algorithm: "zstd"},
+			File: &v1beta1.SwapFileConfig{Path: "/var/lib/harvester/swapfile", Size: resource.MustParse("8Gi")},
+		}, nil},
+		{"empty zram", &v1beta1.SwapConfig{Zram: &v1beta1.ZramConfig{}}, errSwapSizeInvalid},
+		{"invalid zram algorithm", &v1beta1.SwapConfig{Zram: &v1beta1.ZramConfig{Size: resource.MustParse("4Gi"), Algorithm: "zstd; reboot"}}, errZramAlgorithmInvalid},
+		{"empty swapfile", &v1beta1.SwapConfig{File: &v1beta1.SwapFileConfig{Path: "/var/lib/swapfile"}}, errSwapSizeInvalid},
+		{"relative swapfile", &v1beta1.SwapConfig{File: &v1beta1.SwapFileConfig{Path: "swapfile", Size: resource.MustParse("1Gi")}}, errSwapFilePathInvalid},
+		{"unclean swapfile", &v1beta1.SwapConfig{File: &v1beta1.SwapFileConfig{Path: "/var/lib/../swapfile", Size: resource.MustParse("1Gi")}}, errSwapFilePathInvalid},
+		{"quoted swapfile", &v1beta1.SwapConfig{File: &v1beta1.SwapFileConfig{Path: "/var/lib/swap'file", Size: resource.MustParse("1Gi")}}, errSwapFilePathInvalid},
+		{"swapfile on tmpfs", &v1beta1.SwapConfig{File: &v1beta1.SwapFileConfig{Path: "/run/swapfile", Size: resource.MustParse("1Gi")}}, errSwapFilePathInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewNodeConfigValidator()
+			nodecfg := &v1beta1.NodeConfig{
+				ObjectMeta: v1.ObjectMeta{Name: "harvester-node-0", Namespace: "harvester-system"},
+				Spec:       v1beta1.NodeConfigSpec{Swap: tt.input},
+			}
+
+			got := v.Create(new(admission.Request), nodecfg)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("create: want err=%v, got err=%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNodeConfigJournaldValidation(t *testing.T) {
+	maxUse := resource.MustParse("1Gi")
+	zero := resource.MustParse("0")
+	tests := []struct {
+		name  string
+		input *v1beta1.JournaldConfig
+		want  error
+	}{
+		{"no journald", nil, nil},
+		{"empty journald", &v1beta1.JournaldConfig{}, nil},
+		{"valid journald", &v1beta1.JournaldConfig{
+			SystemMaxUse:    &maxUse,
+			MaxRetentionSec: &v1.Duration{Duration: 7 * 24 * time.Hour},
+		}, nil},
+		{"zero systemMaxUse", &v1beta1.JournaldConfig{SystemMaxUse: &zero}, errJournaldSystemMaxUseInvalid},
+		{"sub-second retention", &v1beta1.JournaldConfig{MaxRetentionSec: &v1.Duration{Duration: time.Millisecond}}, errJournaldRetentionInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewNodeConfigValidator()
+			nodecfg := &v1beta1.NodeConfig{
+				ObjectMeta: v1.ObjectMeta{Name: "harvester-node-0", Namespace: "harvester-system"},
+				Spec:       v1beta1.NodeConfigSpec{Journald: tt.input},
+			}
+
+			got := v.Create(new(admission.Request), nodecfg)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("create: want err=%v, got err=%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNodeConfigSystemdUnitsValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []v1beta1.SystemdUnitConfig
+		want  error
+	}{
+		{"no systemd units", nil, nil},
+		{"valid systemd units", []v1beta1.SystemdUnitConfig{
+			{Name: "iscsid.service", State: v1beta1.SystemdUnitEnabled, Settings: []v1beta1.SystemdUnitSetting{
+				{Section: "Service", Key: "ExecStart"},
+				{Section: "Service", Key: "ExecStart", Value: "/usr/sbin/iscsid -f"},
+			}},
+			{Name: "multipathd.service", State: v1beta1.SystemdUnitMasked},
+			{Name: "dev-disk-by\\x2dlabel-data.mount", Settings: []v1beta1.SystemdUnitSetting{{Section: "Mount", Key: "Options", Value: "noatime"}}},
+		}, nil},
+		{"invalid unit name", []v1beta1.SystemdUnitConfig{{Name: "../iscsid.service"}}, errSystemdUnitNameInvalid},
+		{"unit name without type", []v1beta1.SystemdUnitConfig{{Name: "iscsid"}}, errSystemdUnitNameInvalid},
+		{"duplicated unit", []v1beta1.SystemdUnitConfig{{Name: "iscsid.service"}, {Name: "iscsid.service"}}, errSystemdUnitDuplicated},
+		{"state managed by ntp", []v1beta1.SystemdUnitConfig{{Name: "chronyd.service", State: v1beta1.SystemdUnitDisabled}}, errSystemdUnitStateManaged},
+		{"invalid section", []v1beta1.SystemdUnitConfig{{Name: "iscsid.service", Settings: []v1beta1.SystemdUnitSetting{{Section: "Service]", Key: "Nice", Value: "1"}}}}, errSystemdUnitSettingInvalid},
+		{"invalid key", []v1beta1.SystemdUnitConfig{{Name: "iscsid.service", Settings: []v1beta1.SystemdUnitSetting{{Section: "Service", Key: "Nice=1\n", Value: "1"}}}}, errSystemdUnitSettingInvalid},
+		{"multiline value", []v1beta1.SystemdUnitConfig{{Name: "iscsid.service", Settings: []v1beta1.SystemdUnitSetting{{Section: "Service", Key: "Nice", Value: "1\n[Unit]"}}}}, errSystemdUnitSettingInvalid},
+		{"continued value", []v1beta1.SystemdUnitConfig{{Name: "iscsid.service", Settings: []v1beta1.SystemdUnitSetting{{Section: "Service", Key: "Nice", Value: "1\\"}}}}, errSystemdUnitSettingInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewNodeConfigValidator()
+			nodecfg := &v1beta1.NodeConfig{
+				ObjectMeta: v1.ObjectMeta{Name: "harvester-node-0", Namespace: "harvester-system"},
+				Spec:       v1beta1.NodeConfigSpec{SystemdUnits: tt.input},
+			}
+
+			got := v.Create(new(admission.Request), nodecfg)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("create: want err=%v, got err=%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNodeConfigDriftPoliciesValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		input map[string]v1beta1.DriftPolicy
+		want  error
+	}{
+		{"no drift policies", nil, nil},
+		{"valid drift policies", map[string]v1beta1.DriftPolicy{
+			"NTP":           v1beta1.DriftPolicyReport,
+			"host aliases":  v1beta1.DriftPolicyIgnore,
+			"systemd units": v1beta1.DriftPolicyEnforce,
+		}, nil},
+		{"section without files", map[string]v1beta1.DriftPolicy{"sysctl": v1beta1.DriftPolicyReport}, errDriftPolicySectionInvalid},
+		{"section in wrong case", map[string]v1beta1.DriftPolicy{"ntp": v1beta1.DriftPolicyReport}, errDriftPolicySectionInvalid},
+		{"invalid policy", map[string]v1beta1.DriftPolicy{"DNS": "revert"}, errDriftPolicyInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewNodeConfigValidator()
+			nodecfg := &v1beta1.NodeConfig{
+				ObjectMeta: v1.ObjectMeta{Name: "harvester-node-0", Namespace: "harvester-system"},
+				Spec:       v1beta1.NodeConfigSpec{DriftPolicies: tt.input},
+			}
+
+			got := v.Create(new(admission.Request), nodecfg)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("create: want err=%v, got err=%v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package admitter
+
+import (
+	"errors"
+
+	"github.com/harvester/webhook/pkg/server/admission"
+	admissionregv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+var (
+	errMatchSelectorInvalid = errors.New("matchSelector is not a valid label selector")
+	errRolloutPauseInvalid  = errors.New("rollout pause is negative")
+)
+
+type NodeConfigTemplate struct {
+	admission.DefaultValidator
+}
+
+func NewNodeConfigTemplateValidator() *NodeConfigTemplate {
+	return &NodeConfigTemplate{}
+}
+
+func (v *NodeConfigTemplate) Create(_ *admission.Request, newObj runtime.Object) error {
+	newTemplate := newObj.(*v1beta1.NodeConfigTemplate)
+	return v.validate(newTemplate)
+}
+
+func (v *NodeConfigTemplate) Update(_ *admission.Request, _ runtime.Object, newObj runtime.Object) error {
+	newTemplate := newObj.(*v1beta1.NodeConfigTemplate)
+	return v.validate(newTemplate)
+}
+
+// validate checks the template on its own, the NodeConfigs it is merged into
+// are validated again when they are written.
+func (v *NodeConfigTemplate) validate(template *v1beta1.NodeConfigTemplate) error {
+	for key, value := range template.Spec.MatchSelector {
+		if len(validation.IsQualifiedName(key)) > 0 || len(validation.IsValidLabelValue(value)) > 0 {
+			return errMatchSelectorInvalid
+		}
+	}
+	if rollout := template.Spec.Rollout; rollout != nil && rollout.Pause != nil && rollout.Pause.Duration < 0 {
+		return errRolloutPauseInvalid
+	}
+	return validateNodeConfigSpec(&template.Spec.Template)
+}
+
+func (v *NodeConfigTemplate) Resource() admission.Resource {
+	return admission.Resource{
+		Names:      []string{v1beta1.NodeConfigTemplateResourceName},
+		Scope:      admissionregv1.ClusterScope,
+		APIGroup:   v1beta1.SchemeGroupVersion.Group,
+		APIVersion: v1beta1.SchemeGroupVersion.Version,
+		ObjectType: &v1beta1.NodeConfigTemplate{},
+		OperationTypes: []admissionregv1.OperationType{
+			admissionregv1.Create,
+			admissionregv1.Update,
+		},
+	}
+}
@@ -0,0 +1,64 @@
+package admitter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/harvester/webhook/pkg/server/admission"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+func TestNodeConfigTemplateValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		input v1beta1.NodeConfigTemplateSpec
+		want  error
+	}{
+		{"empty template", v1beta1.NodeConfigTemplateSpec{}, nil},
+		{"valid template", v1beta1.NodeConfigTemplateSpec{
+			MatchSelector: map[string]string{"topology.kubernetes.io/zone": "zone-a"},
+			Template: v1beta1.NodeConfigSpec{
+				NTPConfig: &v1beta1.NTPConfig{Servers: []v1beta1.NTPServer{{Address: "time.example.com"}}},
+				Timezone:  "Asia/Taipei",
+			},
+		}, nil},
+		{"invalid selector key", v1beta1.NodeConfigTemplateSpec{
+			MatchSelector: map[string]string{"zone a": "a"},
+		}, errMatchSelectorInvalid},
+		{"invalid selector value", v1beta1.NodeConfigTemplateSpec{
+			MatchSelector: map[string]string{"zone": "a b"},
+		}, errMatchSelectorInvalid},
+		{"rollout", v1beta1.NodeConfigTemplateSpec{
+			Rollout: &v1beta1.RolloutStrategy{BatchSize: 2, Pause: &v1.Duration{Duration: time.Minute}},
+		}, nil},
+		{"negative rollout pause", v1beta1.NodeConfigTemplateSpec{
+			Rollout: &v1beta1.RolloutStrategy{Pause: &v1.Duration{Duration: -time.Minute}},
+		}, errRolloutPauseInvalid},
+		{"invalid template", v1beta1.NodeConfigTemplateSpec{
+			Template: v1beta1.NodeConfigSpec{Timezone: "Mars/Olympus_Mons"},
+		}, errTimezoneInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewNodeConfigTemplateValidator()
+			template := &v1beta1.NodeConfigTemplate{
+				ObjectMeta: v1.ObjectMeta{Name: "zone-a"},
+				Spec:       tt.input,
+			}
+
+			got := v.Create(new(admission.Request), template)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("create: want err=%v, got err=%v", tt.want, got)
+			}
+
+			got = v.Update(new(admission.Request), template.DeepCopy(), template)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("update: want err=%v, got err=%v", tt.want, got)
+			}
+		})
+	}
+}
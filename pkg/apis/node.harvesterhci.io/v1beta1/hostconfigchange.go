@@ -0,0 +1,71 @@
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:resource:shortName=hcc,scope=Cluster
+// +kubebuilder:printcolumn:name="Node",type=string,JSONPath=`.spec.node`
+// +kubebuilder:printcolumn:name="Kind",type=string,JSONPath=`.spec.object.kind`
+// +kubebuilder:printcolumn:name="Object",type=string,JSONPath=`.spec.object.name`
+// +kubebuilder:printcolumn:name="Section",type=string,JSONPath=`.spec.section`
+// +kubebuilder:printcolumn:name="User",type=string,JSONPath=`.spec.user`
+// +kubebuilder:printcolumn:name="Time",type=date,JSONPath=`.spec.time`
+
+// HostConfigChange is a change applied to the host of a node, it is copied
+// from the audit log of the node and could not be changed once created. The
+// changes of a node are labeled with node.harvesterhci.io/node.
+type HostConfigChange struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              HostConfigChangeSpec `json:"spec"`
+}
+
+type HostConfigChangeSpec struct {
+	// Node is the node the change was applied to.
+	Node string `json:"node"`
+
+	// Time is when the change was applied.
+	Time metav1.Time `json:"time"`
+
+	// Object is the object whose spec was applied.
+	Object ChangeObjectReference `json:"object"`
+
+	// Section is the part of the spec which was changed, e.g. `ntpConfigs`.
+	Section string `json:"section"`
+
+	// Old is the JSON of the section before the change, it is empty when the
+	// section was not applied before.
+	// +optional
+	Old string `json:"old,omitempty"`
+
+	// New is the JSON of the section after the change, it is empty when the
+	// section was removed.
+	// +optional
+	New string `json:"new,omitempty"`
+
+	// User is the user which last changed the spec of the object, as recorded
+	// by the webhook, or its field manager when it was changed before.
+	// +optional
+	User string `json:"user,omitempty"`
+
+	// Hash chains the change to the previous one in the audit log of the
+	// node.
+	Hash string `json:"hash"`
+}
+
+type ChangeObjectReference struct {
+	Kind string `json:"kind"`
+
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	Name string `json:"name"`
+
+	// ResourceVersion is the version of the object which was applied.
+	// +optional
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
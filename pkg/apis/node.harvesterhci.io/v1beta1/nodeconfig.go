@@ -1,12 +1,20 @@
 package v1beta1
 
 import (
-	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type AppliedConfigAnnotation struct {
-	NTPServers string `json:"ntpServers,omitempty"`
+	NTPServers    string      `json:"ntpServers,omitempty"`
+	NTPBackend    NTPBackend  `json:"ntpBackend,omitempty"`
+	NTPServerList []NTPServer `json:"ntpServerList,omitempty"`
+	// NTPGeneration is the NodeConfig generation of the applied NTP config
+	NTPGeneration    int64                   `json:"ntpGeneration,omitempty"`
+	ContainerRuntime *ContainerRuntimeConfig `json:"containerRuntime,omitempty"`
+	// Sections are the hashes of the spec sections each handler applied, a
+	// section is only applied again once it is changed
+	Sections map[string]string `json:"sections,omitempty"`
 }
 
 // +genclient
@@ -24,10 +32,329 @@ type NodeConfig struct {
 type NodeConfigSpec struct {
 	NTPConfig      *NTPConfig      `json:"ntpConfigs,omitempty"`
 	LonghornConfig *LonghornConfig `json:"longhornConfig,omitempty"`
+
+	// Sysctl is a map of kernel parameters, e.g. `vm.swappiness: "10"`, which
+	// are applied at runtime and persisted across reboots.
+	// +optional
+	Sysctl map[string]string `json:"sysctl,omitempty"`
+
+	// +optional
+	KernelModules *KernelModulesConfig `json:"kernelModules,omitempty"`
+
+	// KernelArgs are appended to the kernel command line, e.g.
+	// `intel_iommu=on`. They only take effect after the node is rebooted.
+	// +optional
+	KernelArgs []string `json:"kernelArgs,omitempty"`
+
+	// Timezone is the IANA time zone of the host, e.g. `Asia/Taipei`.
+	// +optional
+	Timezone string `json:"timezone,omitempty"`
+
+	// +optional
+	DNS *DNSConfig `json:"dns,omitempty"`
+
+	// HostAliases are added to /etc/hosts of the host.
+	// +optional
+	HostAliases []HostAlias `json:"hostAliases,omitempty"`
+
+	// +optional
+	ContainerRuntime *ContainerRuntimeConfig `json:"containerRuntime,omitempty"`
+
+	// +optional
+	CPUPower *CPUPowerConfig `json:"cpuPower,omitempty"`
+
+	// +optional
+	CPUIsolation *CPUIsolationConfig `json:"cpuIsolation,omitempty"`
+
+	// +optional
+	Swap *SwapConfig `json:"swap,omitempty"`
+
+	// +optional
+	Journald *JournaldConfig `json:"journald,omitempty"`
+
+	// SystemdUnits manage the drop-ins and the states of the systemd units,
+	// e.g. `iscsid.service` or `multipathd.service`.
+	// +optional
+	SystemdUnits []SystemdUnitConfig `json:"systemdUnits,omitempty"`
+
+	// DriftPolicies decide what is done when the files written by a section
+	// are changed on the host, keyed by the section name, e.g. `NTP` or
+	// `journald`. The sections which are not listed are enforced.
+	// +optional
+	DriftPolicies map[string]DriftPolicy `json:"driftPolicies,omitempty"`
+}
+
+// DriftPolicy is what is done when the files of a section are changed outside
+// of the node manager
+// +kubebuilder:validation:Enum=enforce;report;ignore
+type DriftPolicy string
+
+const (
+	// DriftPolicyEnforce reports the drift and applies the section again
+	DriftPolicyEnforce DriftPolicy = "enforce"
+
+	// DriftPolicyReport reports the drift and keeps the change until the spec
+	// is changed
+	DriftPolicyReport DriftPolicy = "report"
+
+	// DriftPolicyIgnore keeps the change without reporting it
+	DriftPolicyIgnore DriftPolicy = "ignore"
+)
+
+type SystemdUnitState string
+
+const (
+	SystemdUnitEnabled  SystemdUnitState = "enabled"
+	SystemdUnitDisabled SystemdUnitState = "disabled"
+	SystemdUnitMasked   SystemdUnitState = "masked"
+)
+
+// SystemdUnitConfig is rendered into a drop-in of the unit, the unit is
+// restarted when the drop-in is changed and the unit is running.
+type SystemdUnitConfig struct {
+	// Name is the full unit name, e.g. `iscsid.service`.
+	Name string `json:"name"`
+
+	// State is applied like `systemctl enable|disable|mask --now`, the state
+	// of the host is kept when it is empty, and restored once it is removed.
+	// +kubebuilder:validation:Enum=enabled;disabled;masked
+	// +optional
+	State SystemdUnitState `json:"state,omitempty"`
+
+	// +optional
+	Settings []SystemdUnitSetting `json:"settings,omitempty"`
+}
+
+// SystemdUnitSetting is a `Key=Value` line in the `[Section]` of the drop-in
+type SystemdUnitSetting struct {
+	// Section is the unit file section, e.g. `Service`.
+	Section string `json:"section"`
+
+	Key string `json:"key"`
+
+	// +optional
+	Value string `json:"value,omitempty"`
+}
+
+// JournaldConfig is rendered into a drop-in of journald.conf, the settings
+// which are left empty keep the defaults of the host.
+type JournaldConfig struct {
+	// SystemMaxUse is the disk space the persistent journal may use at most,
+	// e.g. `1Gi`.
+	// +optional
+	SystemMaxUse *resource.Quantity `json:"systemMaxUse,omitempty"`
+
+	// MaxRetentionSec is the maximum time to keep the journal entries, e.g.
+	// `168h`.
+	// +optional
+	MaxRetentionSec *metav1.Duration `json:"maxRetentionSec,omitempty"`
+
+	// +optional
+	ForwardToSyslog *bool `json:"forwardToSyslog,omitempty"`
+
+	// +optional
+	ForwardToKMsg *bool `json:"forwardToKMsg,omitempty"`
+
+	// +optional
+	ForwardToConsole *bool `json:"forwardToConsole,omitempty"`
+}
+
+// SwapConfig enables a zram device and a swapfile, zram is used before the
+// swapfile.
+type SwapConfig struct {
+	// +optional
+	Zram *ZramConfig `json:"zram,omitempty"`
+
+	// +optional
+	File *SwapFileConfig `json:"file,omitempty"`
+}
+
+// ZramConfig is a compressed swap device in memory
+type ZramConfig struct {
+	// Size is the uncompressed size of the device, e.g. `4Gi`.
+	Size resource.Quantity `json:"size"`
+
+	// Algorithm is the compression algorithm, e.g. `zstd` or `lz4`, the
+	// kernel default is used when empty.
+	// +optional
+	Algorithm string `json:"algorithm,omitempty"`
+}
+
+type SwapFileConfig struct {
+	// Path is the swapfile on a persistent disk of the host, e.g.
+	// `/var/lib/harvester/swapfile`. It is created when missing, and removed
+	// once it is no longer wanted.
+	Path string `json:"path"`
+
+	// Size is the size of the swapfile, e.g. `8Gi`.
+	Size resource.Quantity `json:"size"`
+}
+
+// CPUIsolationConfig separates the housekeeping CPUs from the CPUs dedicated
+// to VMs. The IRQs are moved to the reserved CPUs at runtime, the isolation
+// itself is done by kernel args which only take effect after a reboot.
+type CPUIsolationConfig struct {
+	// ReservedCPUs are the housekeeping CPUs in the cpulist format, e.g.
+	// `0-1`, which should match the reservedSystemCPUs of the kubelet.
+	ReservedCPUs string `json:"reservedCPUs"`
+
+	// IsolatedCPUs are removed from the scheduler, the timer tick and the
+	// RCU callbacks of the kernel, and banned from irqbalance.
+	// +optional
+	IsolatedCPUs string `json:"isolatedCPUs,omitempty"`
+}
+
+// CPUPowerConfig is applied through the cpufreq and cpuidle sysfs of each CPU,
+// the settings which are left empty are not changed.
+type CPUPowerConfig struct {
+	// CPUs is the list of the CPUs to apply to, e.g. `0-3,8`, it is all the
+	// online CPUs when empty.
+	// +optional
+	CPUs string `json:"cpus,omitempty"`
+
+	// Governor is the cpufreq scaling governor, e.g. `performance`.
+	// +optional
+	Governor string `json:"governor,omitempty"`
+
+	// EnergyPerformancePreference is the hint of the intel_pstate and
+	// amd-pstate drivers, e.g. `performance` or `balance_power`.
+	// +optional
+	EnergyPerformancePreference string `json:"energyPerformancePreference,omitempty"`
+
+	// MaxCState is the deepest idle state allowed, the deeper states are
+	// disabled. 0 only allows the polling state.
+	// +optional
+	MaxCState *int32 `json:"maxCState,omitempty"`
+}
+
+// ContainerRuntimeConfig is the proxy and registry config of rke2 and
+// containerd, rke2 is restarted to apply it.
+type ContainerRuntimeConfig struct {
+	// +optional
+	Proxy *ProxyConfig `json:"proxy,omitempty"`
+
+	// +optional
+	Registries *RegistriesConfig `json:"registries,omitempty"`
+}
+
+// ProxyConfig is written to the environment file of the rke2 service, rke2
+// adds the cluster CIDRs and domain to NoProxy.
+type ProxyConfig struct {
+	// +optional
+	HTTPProxy string `json:"httpProxy,omitempty"`
+
+	// +optional
+	HTTPSProxy string `json:"httpsProxy,omitempty"`
+
+	// NoProxy is a comma separated list of hosts, domains and CIDRs which are
+	// not proxied.
+	// +optional
+	NoProxy string `json:"noProxy,omitempty"`
+}
+
+// RegistriesConfig is rendered to /etc/rancher/rke2/registries.yaml
+type RegistriesConfig struct {
+	// Mirrors are keyed by the registry name, e.g. `docker.io`, or `*` for
+	// all the registries.
+	// +optional
+	Mirrors map[string]RegistryMirror `json:"mirrors,omitempty"`
+
+	// Configs are keyed by the registry or mirror host.
+	// +optional
+	Configs map[string]RegistryConfig `json:"configs,omitempty"`
+}
+
+type RegistryMirror struct {
+	Endpoints []string `json:"endpoints"`
+
+	// Rewrite maps the regular expressions of the image names to their
+	// replacements on the mirror.
+	// +optional
+	Rewrite map[string]string `json:"rewrite,omitempty"`
+}
+
+type RegistryConfig struct {
+	// CAFile is the path of the CA bundle on the host.
+	// +optional
+	CAFile string `json:"caFile,omitempty"`
+
+	// +optional
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+}
+
+// HostAlias is an entry of /etc/hosts
+type HostAlias struct {
+	IP        string   `json:"ip"`
+	Hostnames []string `json:"hostnames"`
+}
+
+// DNSConfig is the static resolver config of the host, it is applied through
+// netconfig and takes precedence over the one from DHCP.
+type DNSConfig struct {
+	// +optional
+	Nameservers []string `json:"nameservers,omitempty"`
+
+	// Search is the list of search domains.
+	// +optional
+	Search []string `json:"search,omitempty"`
+
+	// Options are the resolv.conf options, e.g. `ndots:2` or `rotate`.
+	// +optional
+	Options []string `json:"options,omitempty"`
+}
+
+type KernelModulesConfig struct {
+	// Load is the list of modules which are loaded at runtime and on boot.
+	// +optional
+	Load []string `json:"load,omitempty"`
+
+	// Blacklist prevents the modules from being loaded automatically, they
+	// are also unloaded at runtime.
+	// +optional
+	Blacklist []string `json:"blacklist,omitempty"`
+
+	// Parameters are the space separated module options, e.g.
+	// `kvm_intel: "nested=1"`.
+	// +optional
+	Parameters map[string]string `json:"parameters,omitempty"`
 }
 
 type NTPConfig struct {
-	NTPServers string `json:"ntpServers"`
+	// NTPServers is the legacy space separated list of NTP servers, it is
+	// still honoured when Servers is empty.
+	// +optional
+	NTPServers string `json:"ntpServers,omitempty"`
+
+	// +optional
+	Servers []NTPServer `json:"servers,omitempty"`
+
+	// Backend is the time sync daemon which is configured on the host.
+	// +optional
+	// +kubebuilder:validation:Enum=timesyncd;chrony
+	// +kubebuilder:default=timesyncd
+	Backend NTPBackend `json:"backend,omitempty"`
+}
+
+type NTPBackend string
+
+const (
+	NTPBackendTimesyncd NTPBackend = "timesyncd"
+	NTPBackendChrony    NTPBackend = "chrony"
+)
+
+type NTPServer struct {
+	// Address is the hostname or IP address of the NTP server.
+	Address string `json:"address"`
+
+	// Options are passed through to time sync backends which support
+	// per-server options, e.g. `iburst` or `prefer`.
+	// +optional
+	Options []string `json:"options,omitempty"`
+
+	// NTS enables Network Time Security (NTS-KE) for the server, it is
+	// only supported by the chrony backend.
+	// +optional
+	NTS bool `json:"nts,omitempty"`
 }
 
 type LonghornConfig struct {
@@ -36,29 +363,319 @@ type LonghornConfig struct {
 }
 
 type NodeConfigStatus struct {
-	NTPConditions []ConfigStatus `json:"ntpConditions,omitempty"`
+	// ObservedGeneration is the generation of the spec which was last
+	// reconciled on the node.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// +optional
+	NTPStatus *NTPStatus `json:"ntpStatus,omitempty"`
+
+	// +optional
+	Sysctl []SysctlStatus `json:"sysctl,omitempty"`
+
+	// +optional
+	KernelModules []KernelModuleStatus `json:"kernelModules,omitempty"`
+
+	// +optional
+	KernelArgs *KernelArgsStatus `json:"kernelArgs,omitempty"`
+
+	// Timezone is the current time zone of the host.
+	// +optional
+	Timezone string `json:"timezone,omitempty"`
+
+	// CPUPower is the current power settings of the CPUs managed by the
+	// cpuPower config.
+	// +optional
+	CPUPower []CPUPowerStatus `json:"cpuPower,omitempty"`
+
+	// +optional
+	CPUIsolation *CPUIsolationStatus `json:"cpuIsolation,omitempty"`
+
+	// Swap is the active swap devices of the host.
+	// +optional
+	Swap []SwapDeviceStatus `json:"swap,omitempty"`
+
+	// +optional
+	SystemdUnits []SystemdUnitStatus `json:"systemdUnits,omitempty"`
+
+	// Rollbacks are the sections which were rolled back to the state before
+	// they were applied, because they failed to apply or to become healthy. A
+	// section is retried with a backoff, and not applied again until the spec
+	// is changed once it is rolled back 5 times in a row. Its rollback is
+	// cleared once it is applied.
+	// +optional
+	// +listType=map
+	// +listMapKey=section
+	Rollbacks []SectionRollback `json:"rollbacks,omitempty"`
+
+	// ManagedFiles are the files written by the sections, with the content
+	// they were last applied with.
+	// +optional
+	// +listType=map
+	// +listMapKey=path
+	ManagedFiles []ManagedFileStatus `json:"managedFiles,omitempty"`
+}
+
+// ManagedFileStatus tracks a file written by a section for drift
+type ManagedFileStatus struct {
+	// Path is the host path of the file, the stage of the OEM settings or
+	// the GRUB variable written by the section is `<path>#<name>`.
+	Path string `json:"path"`
+
+	// Section is the name of the section which wrote the file, e.g. `NTP`.
+	Section string `json:"section"`
+
+	// AppliedHash is the sha256 of the applied content, it is empty when the
+	// section applied the file by removing it.
+	// +optional
+	AppliedHash string `json:"appliedHash,omitempty"`
+
+	// AppliedGeneration is the generation of the spec the file was applied
+	// with.
+	AppliedGeneration int64 `json:"appliedGeneration"`
+
+	// Drifted is true when the content on the host differs from the applied
+	// one.
+	Drifted bool `json:"drifted"`
+
+	// DriftedTime is when the drift was detected.
+	// +optional
+	DriftedTime *metav1.Time `json:"driftedTime,omitempty"`
+}
+
+// SectionRollback records the last rollback of a section
+type SectionRollback struct {
+	// Section is the name of the section, e.g. `NTP`.
+	Section string `json:"section"`
+
+	// Generation is the generation of the spec which failed to apply.
+	Generation int64 `json:"generation"`
+
+	// Message is the failure which caused the rollback.
+	Message string `json:"message"`
+
+	// Count is the number of times in a row the generation was rolled back.
+	// +optional
+	Count int32 `json:"count,omitempty"`
+
+	// RestoreError is set when the snapshot could not be fully restored, the
+	// section may be left half applied.
+	// +optional
+	RestoreError string `json:"restoreError,omitempty"`
+
+	Time metav1.Time `json:"time"`
+}
+
+// SystemdUnitStatus is the state of the unit reported by systemd
+type SystemdUnitStatus struct {
+	Name string `json:"name"`
+
+	// LoadState is e.g. `loaded`, `not-found` or `masked`.
+	// +optional
+	LoadState string `json:"loadState,omitempty"`
+
+	// ActiveState is e.g. `active`, `inactive` or `failed`.
+	// +optional
+	ActiveState string `json:"activeState,omitempty"`
+
+	// SubState is the unit type specific state, e.g. `running`.
+	// +optional
+	SubState string `json:"subState,omitempty"`
+
+	// UnitFileState is e.g. `enabled`, `disabled`, `masked` or `static`.
+	// +optional
+	UnitFileState string `json:"unitFileState,omitempty"`
+}
+
+type SwapDeviceStatus struct {
+	Name string `json:"name"`
+
+	// Type is `partition` or `file`, zram is a partition.
+	Type string `json:"type"`
+
+	Size resource.Quantity `json:"size"`
+	Used resource.Quantity `json:"used"`
+
+	Priority int32 `json:"priority"`
 }
 
-type ConfigStatus struct {
-	Type   ConfigConditionType    `json:"type"`
-	Status corev1.ConditionStatus `json:"status"`
-	// +nullable
-	LastProbeTime metav1.Time `json:"lastProbeTime,omitempty"`
-	// +nullable
-	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
-	Reason             string      `json:"reason,omitempty"`
-	Message            string      `json:"message,omitempty"`
+// CPUIsolationStatus is the CPU topology of the running kernel, the CPU sets
+// are in the cpulist format.
+type CPUIsolationStatus struct {
+	// +optional
+	OnlineCPUs string `json:"onlineCPUs,omitempty"`
+
+	// ReservedCPUs are the housekeeping CPUs the IRQs are moved to.
+	// +optional
+	ReservedCPUs string `json:"reservedCPUs,omitempty"`
+
+	// IsolatedCPUs are the CPUs isolated by the running kernel.
+	// +optional
+	IsolatedCPUs string `json:"isolatedCPUs,omitempty"`
+
+	// NohzFullCPUs are the CPUs running without the timer tick.
+	// +optional
+	NohzFullCPUs string `json:"nohzFullCPUs,omitempty"`
+
+	// UnmovableIRQs are the IRQs which are still handled by the CPUs other
+	// than the reserved ones, e.g. the managed IRQs of multi-queue devices.
+	// +optional
+	UnmovableIRQs []int32 `json:"unmovableIRQs,omitempty"`
+}
+
+type CPUPowerStatus struct {
+	CPU int32 `json:"cpu"`
+
+	// +optional
+	Governor string `json:"governor,omitempty"`
+
+	// +optional
+	EnergyPerformancePreference string `json:"energyPerformancePreference,omitempty"`
+
+	// MaxCState is the deepest enabled idle state.
+	// +optional
+	MaxCState *int32 `json:"maxCState,omitempty"`
+
+	// Drifted is true when any of the wanted settings differs from the
+	// current one.
+	Drifted bool `json:"drifted"`
+}
+
+type SysctlStatus struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+
+	// Current is the value read from the host.
+	// +optional
+	Current string `json:"current,omitempty"`
+
+	// Drifted is true when the current value differs from the wanted one.
+	Drifted bool `json:"drifted"`
+}
+
+type NTPStatus struct {
+	// CurrentServer is the server the host is currently synchronized with.
+	// +optional
+	CurrentServer string `json:"currentServer,omitempty"`
+
+	// Authenticated is true when the current server is authenticated by NTS.
+	Authenticated bool `json:"authenticated"`
+
+	// Offset is the estimated offset of the current server's clock relative
+	// to the local clock, a positive offset means the local clock is behind.
+	// +optional
+	Offset *metav1.Duration `json:"offset,omitempty"`
+
+	// +optional
+	Stratum uint32 `json:"stratum,omitempty"`
+
+	// +optional
+	Jitter *metav1.Duration `json:"jitter,omitempty"`
+
+	// RootDistance is the estimated maximum error to the reference clock.
+	// +optional
+	RootDistance *metav1.Duration `json:"rootDistance,omitempty"`
+
+	// +optional
+	LastMeasurementTime *metav1.Time `json:"lastMeasurementTime,omitempty"`
 }
 
-type ConfigConditionType string
+type KernelModuleStatus struct {
+	Name        string `json:"name"`
+	Loaded      bool   `json:"loaded"`
+	Blacklisted bool   `json:"blacklisted,omitempty"`
+
+	// Error is the failure of the last load or unload, including the
+	// modprobe output.
+	// +optional
+	Error string `json:"error,omitempty"`
+}
+
+// KernelArgsStatus lists the differences between the boot config and the
+// running kernel command line, which are resolved by a reboot.
+type KernelArgsStatus struct {
+	// Missing are the wanted args which are not in the running kernel
+	// command line.
+	// +optional
+	Missing []string `json:"missing,omitempty"`
+
+	// Stale are the args removed from the spec which are still in the
+	// running kernel command line.
+	// +optional
+	Stale []string `json:"stale,omitempty"`
+}
+
+type ConditionTypeNodeConfig string
 
 const (
-	// first time when we create the config, is "WaitApplied"
-	ConfigWaitApplied ConfigConditionType = "WaitApplied"
+	// NTPApplied is true when the NTP config of the spec is applied to the host
+	NTPApplied ConditionTypeNodeConfig = "NTPApplied"
+
+	// NTPSynchronized is true when the host clock is synchronized by NTP
+	NTPSynchronized ConditionTypeNodeConfig = "NTPSynchronized"
+
+	// LonghornV2Ready is true when the prerequisites of the Longhorn V2 Data
+	// Engine are met on the host
+	LonghornV2Ready ConditionTypeNodeConfig = "LonghornV2Ready"
+
+	// HugepagesAllocated is true when the requested hugepages are allocated
+	HugepagesAllocated ConditionTypeNodeConfig = "HugepagesAllocated"
+
+	// KubeletRestartPending is true when the kubelet has not picked up the
+	// hugepages currently allocated on the host
+	KubeletRestartPending ConditionTypeNodeConfig = "KubeletRestartPending"
+
+	// SysctlApplied is true when all the sysctls of the spec are applied
+	SysctlApplied ConditionTypeNodeConfig = "SysctlApplied"
+
+	// KernelModulesLoaded is true when the wanted modules are loaded and the
+	// blacklisted ones are not
+	KernelModulesLoaded ConditionTypeNodeConfig = "KernelModulesLoaded"
+
+	// RebootRequired is true when the node has to be rebooted to boot with
+	// the wanted kernel args
+	RebootRequired ConditionTypeNodeConfig = "RebootRequired"
+
+	// TimezoneApplied is true when the host is set to the wanted timezone
+	TimezoneApplied ConditionTypeNodeConfig = "TimezoneApplied"
+
+	// DNSApplied is true when the resolver config of the host matches the
+	// wanted one
+	DNSApplied ConditionTypeNodeConfig = "DNSApplied"
+
+	// HostAliasesApplied is true when the host aliases are in /etc/hosts
+	HostAliasesApplied ConditionTypeNodeConfig = "HostAliasesApplied"
+
+	// ContainerRuntimeApplied is true when the container runtime config is
+	// applied and rke2 is restarted
+	ContainerRuntimeApplied ConditionTypeNodeConfig = "ContainerRuntimeApplied"
+
+	// CPUPowerApplied is true when the CPUs are set to the wanted power
+	// settings
+	CPUPowerApplied ConditionTypeNodeConfig = "CPUPowerApplied"
+
+	// CPUIsolationApplied is true when the IRQs are moved to the reserved
+	// CPUs and the running kernel isolates the wanted CPUs
+	CPUIsolationApplied ConditionTypeNodeConfig = "CPUIsolationApplied"
+
+	// SwapApplied is true when the wanted swap devices are active
+	SwapApplied ConditionTypeNodeConfig = "SwapApplied"
+
+	// JournaldApplied is true when the journald drop-in is written and
+	// systemd-journald is restarted
+	JournaldApplied ConditionTypeNodeConfig = "JournaldApplied"
 
-	// when the config is applied, is "Applied"
-	ConfigApplied ConfigConditionType = "Applied"
+	// SystemdUnitsApplied is true when the drop-ins and the states of the
+	// systemd units are applied
+	SystemdUnitsApplied ConditionTypeNodeConfig = "SystemdUnitsApplied"
 
-	// when the applied config is modified, is "Modified"
-	ConfigModified ConfigConditionType = "Modified"
+	// ConfigDrifted is true when the files of a section with the report
+	// policy are changed outside of the node manager
+	ConfigDrifted ConditionTypeNodeConfig = "ConfigDrifted"
 )
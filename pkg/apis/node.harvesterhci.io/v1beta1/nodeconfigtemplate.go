@@ -0,0 +1,90 @@
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:resource:shortName=nctmpl,scope=Cluster
+// +kubebuilder:subresource:status
+
+// NodeConfigTemplate is a NodeConfig spec shared by the nodes matching the
+// selector, it is merged into the NodeConfig of each node.
+type NodeConfigTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              NodeConfigTemplateSpec   `json:"spec"`
+	Status            NodeConfigTemplateStatus `json:"status,omitempty"`
+}
+
+type NodeConfigTemplateSpec struct {
+	// MatchSelector is the labels of the nodes the template applies to, an
+	// empty selector matches all nodes.
+	// +optional
+	MatchSelector map[string]string `json:"matchSelector,omitempty"`
+	// Template is merged into the NodeConfig of the matching nodes section by
+	// section. When several templates match a node, the ones later in name
+	// order win, and the fields changed in the NodeConfig itself override all
+	// templates.
+	Template NodeConfigSpec `json:"template"`
+	// Rollout updates the matching nodes in batches when the template is
+	// changed, all nodes are updated at once when it is not set.
+	// +optional
+	Rollout *RolloutStrategy `json:"rollout,omitempty"`
+}
+
+// RolloutStrategy updates the nodes in batches in the order of their names. A
+// batch starts once the nodes of the previous batches report the conditions of
+// the template sections as true and the pause is over. The nodes which are not
+// ready or cordoned are skipped, the batches do not wait for them and they
+// are updated once they are back. The rollout halts while an updated node
+// reports a failed condition, and resumes once it recovers or the template is
+// changed again.
+type RolloutStrategy struct {
+	// BatchSize is the number of nodes updated in a batch, it defaults to 1.
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	BatchSize int32 `json:"batchSize,omitempty"`
+	// MaxUnavailable is the number of nodes which could be updating, failed,
+	// not ready or cordoned at the same time, it defaults to the batch size.
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	MaxUnavailable int32 `json:"maxUnavailable,omitempty"`
+	// Pause is the least time between the start of a batch and the start of
+	// the next one, e.g. `10m`.
+	// +optional
+	Pause *metav1.Duration `json:"pause,omitempty"`
+}
+
+type NodeConfigTemplateStatus struct {
+	// Nodes is the rollout state of the matching nodes keyed by the node
+	// name, it is only reported for the templates with a rollout strategy.
+	// +optional
+	Nodes map[string]TemplateRolloutStatus `json:"nodes,omitempty"`
+}
+
+type TemplateRolloutStatus struct {
+	State TemplateRolloutState `json:"state"`
+	// Message is why the node is waiting or failed.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+type TemplateRolloutState string
+
+const (
+	// TemplateRolloutPending is a node waiting for its batch
+	TemplateRolloutPending TemplateRolloutState = "Pending"
+	// TemplateRolloutUpdating is a node whose NodeConfig is updated but not
+	// yet applied
+	TemplateRolloutUpdating TemplateRolloutState = "Updating"
+	TemplateRolloutUpdated  TemplateRolloutState = "Updated"
+	// TemplateRolloutSkipped is a node which is not ready or cordoned, the
+	// rollout does not wait for it
+	TemplateRolloutSkipped TemplateRolloutState = "Skipped"
+	// TemplateRolloutFailed is a node reporting a failed condition, it halts
+	// the rollout
+	TemplateRolloutFailed TemplateRolloutState = "Failed"
+)
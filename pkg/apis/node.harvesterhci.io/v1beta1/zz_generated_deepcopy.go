@@ -29,6 +29,25 @@ import (
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AppliedConfigAnnotation) DeepCopyInto(out *AppliedConfigAnnotation) {
 	*out = *in
+	if in.NTPServerList != nil {
+		in, out := &in.NTPServerList, &out.NTPServerList
+		*out = make([]NTPServer, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ContainerRuntime != nil {
+		in, out := &in.ContainerRuntime, &out.ContainerRuntime
+		*out = new(ContainerRuntimeConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Sections != nil {
+		in, out := &in.Sections, &out.Sections
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 	return
 }
 
@@ -42,6 +61,101 @@ func (in *AppliedConfigAnnotation) DeepCopy() *AppliedConfigAnnotation {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CPUIsolationConfig) DeepCopyInto(out *CPUIsolationConfig) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CPUIsolationConfig.
+func (in *CPUIsolationConfig) DeepCopy() *CPUIsolationConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(CPUIsolationConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CPUIsolationStatus) DeepCopyInto(out *CPUIsolationStatus) {
+	*out = *in
+	if in.UnmovableIRQs != nil {
+		in, out := &in.UnmovableIRQs, &out.UnmovableIRQs
+		*out = make([]int32, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CPUIsolationStatus.
+func (in *CPUIsolationStatus) DeepCopy() *CPUIsolationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CPUIsolationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CPUPowerConfig) DeepCopyInto(out *CPUPowerConfig) {
+	*out = *in
+	if in.MaxCState != nil {
+		in, out := &in.MaxCState, &out.MaxCState
+		*out = new(int32)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CPUPowerConfig.
+func (in *CPUPowerConfig) DeepCopy() *CPUPowerConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(CPUPowerConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CPUPowerStatus) DeepCopyInto(out *CPUPowerStatus) {
+	*out = *in
+	if in.MaxCState != nil {
+		in, out := &in.MaxCState, &out.MaxCState
+		*out = new(int32)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CPUPowerStatus.
+func (in *CPUPowerStatus) DeepCopy() *CPUPowerStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CPUPowerStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ChangeObjectReference) DeepCopyInto(out *ChangeObjectReference) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ChangeObjectReference.
+func (in *ChangeObjectReference) DeepCopy() *ChangeObjectReference {
+	if in == nil {
+		return nil
+	}
+	out := new(ChangeObjectReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CloudInit) DeepCopyInto(out *CloudInit) {
 	*out = *in
@@ -150,19 +264,157 @@ func (in *CloudInitStatus) DeepCopy() *CloudInitStatus {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *ConfigStatus) DeepCopyInto(out *ConfigStatus) {
+func (in *ContainerRuntimeConfig) DeepCopyInto(out *ContainerRuntimeConfig) {
+	*out = *in
+	if in.Proxy != nil {
+		in, out := &in.Proxy, &out.Proxy
+		*out = new(ProxyConfig)
+		**out = **in
+	}
+	if in.Registries != nil {
+		in, out := &in.Registries, &out.Registries
+		*out = new(RegistriesConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ContainerRuntimeConfig.
+func (in *ContainerRuntimeConfig) DeepCopy() *ContainerRuntimeConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(ContainerRuntimeConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DNSConfig) DeepCopyInto(out *DNSConfig) {
+	*out = *in
+	if in.Nameservers != nil {
+		in, out := &in.Nameservers, &out.Nameservers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Search != nil {
+		in, out := &in.Search, &out.Search
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Options != nil {
+		in, out := &in.Options, &out.Options
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DNSConfig.
+func (in *DNSConfig) DeepCopy() *DNSConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(DNSConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HostAlias) DeepCopyInto(out *HostAlias) {
+	*out = *in
+	if in.Hostnames != nil {
+		in, out := &in.Hostnames, &out.Hostnames
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HostAlias.
+func (in *HostAlias) DeepCopy() *HostAlias {
+	if in == nil {
+		return nil
+	}
+	out := new(HostAlias)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HostConfigChange) DeepCopyInto(out *HostConfigChange) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HostConfigChange.
+func (in *HostConfigChange) DeepCopy() *HostConfigChange {
+	if in == nil {
+		return nil
+	}
+	out := new(HostConfigChange)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *HostConfigChange) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HostConfigChangeList) DeepCopyInto(out *HostConfigChangeList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]HostConfigChange, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HostConfigChangeList.
+func (in *HostConfigChangeList) DeepCopy() *HostConfigChangeList {
+	if in == nil {
+		return nil
+	}
+	out := new(HostConfigChangeList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *HostConfigChangeList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HostConfigChangeSpec) DeepCopyInto(out *HostConfigChangeSpec) {
 	*out = *in
-	in.LastProbeTime.DeepCopyInto(&out.LastProbeTime)
-	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	in.Time.DeepCopyInto(&out.Time)
+	out.Object = in.Object
 	return
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigStatus.
-func (in *ConfigStatus) DeepCopy() *ConfigStatus {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HostConfigChangeSpec.
+func (in *HostConfigChangeSpec) DeepCopy() *HostConfigChangeSpec {
 	if in == nil {
 		return nil
 	}
-	out := new(ConfigStatus)
+	out := new(HostConfigChangeSpec)
 	in.DeepCopyInto(out)
 	return out
 }
@@ -263,6 +515,122 @@ func (in *HugepageStatus) DeepCopy() *HugepageStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *JournaldConfig) DeepCopyInto(out *JournaldConfig) {
+	*out = *in
+	if in.SystemMaxUse != nil {
+		in, out := &in.SystemMaxUse, &out.SystemMaxUse
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.MaxRetentionSec != nil {
+		in, out := &in.MaxRetentionSec, &out.MaxRetentionSec
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.ForwardToSyslog != nil {
+		in, out := &in.ForwardToSyslog, &out.ForwardToSyslog
+		*out = new(bool)
+		**out = **in
+	}
+	if in.ForwardToKMsg != nil {
+		in, out := &in.ForwardToKMsg, &out.ForwardToKMsg
+		*out = new(bool)
+		**out = **in
+	}
+	if in.ForwardToConsole != nil {
+		in, out := &in.ForwardToConsole, &out.ForwardToConsole
+		*out = new(bool)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new JournaldConfig.
+func (in *JournaldConfig) DeepCopy() *JournaldConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(JournaldConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KernelArgsStatus) DeepCopyInto(out *KernelArgsStatus) {
+	*out = *in
+	if in.Missing != nil {
+		in, out := &in.Missing, &out.Missing
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Stale != nil {
+		in, out := &in.Stale, &out.Stale
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KernelArgsStatus.
+func (in *KernelArgsStatus) DeepCopy() *KernelArgsStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(KernelArgsStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KernelModuleStatus) DeepCopyInto(out *KernelModuleStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KernelModuleStatus.
+func (in *KernelModuleStatus) DeepCopy() *KernelModuleStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(KernelModuleStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KernelModulesConfig) DeepCopyInto(out *KernelModulesConfig) {
+	*out = *in
+	if in.Load != nil {
+		in, out := &in.Load, &out.Load
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Blacklist != nil {
+		in, out := &in.Blacklist, &out.Blacklist
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Parameters != nil {
+		in, out := &in.Parameters, &out.Parameters
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KernelModulesConfig.
+func (in *KernelModulesConfig) DeepCopy() *KernelModulesConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(KernelModulesConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Ksmtuned) DeepCopyInto(out *Ksmtuned) {
 	*out = *in
@@ -389,6 +757,26 @@ func (in *LonghornConfig) DeepCopy() *LonghornConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ManagedFileStatus) DeepCopyInto(out *ManagedFileStatus) {
+	*out = *in
+	if in.DriftedTime != nil {
+		in, out := &in.DriftedTime, &out.DriftedTime
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ManagedFileStatus.
+func (in *ManagedFileStatus) DeepCopy() *ManagedFileStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ManagedFileStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Meminfo) DeepCopyInto(out *Meminfo) {
 	*out = *in
@@ -408,6 +796,13 @@ func (in *Meminfo) DeepCopy() *Meminfo {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NTPConfig) DeepCopyInto(out *NTPConfig) {
 	*out = *in
+	if in.Servers != nil {
+		in, out := &in.Servers, &out.Servers
+		*out = make([]NTPServer, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -422,12 +817,68 @@ func (in *NTPConfig) DeepCopy() *NTPConfig {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *NodeConfig) DeepCopyInto(out *NodeConfig) {
+func (in *NTPServer) DeepCopyInto(out *NTPServer) {
 	*out = *in
-	out.TypeMeta = in.TypeMeta
-	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	in.Spec.DeepCopyInto(&out.Spec)
-	in.Status.DeepCopyInto(&out.Status)
+	if in.Options != nil {
+		in, out := &in.Options, &out.Options
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NTPServer.
+func (in *NTPServer) DeepCopy() *NTPServer {
+	if in == nil {
+		return nil
+	}
+	out := new(NTPServer)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NTPStatus) DeepCopyInto(out *NTPStatus) {
+	*out = *in
+	if in.Offset != nil {
+		in, out := &in.Offset, &out.Offset
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.Jitter != nil {
+		in, out := &in.Jitter, &out.Jitter
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.RootDistance != nil {
+		in, out := &in.RootDistance, &out.RootDistance
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.LastMeasurementTime != nil {
+		in, out := &in.LastMeasurementTime, &out.LastMeasurementTime
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NTPStatus.
+func (in *NTPStatus) DeepCopy() *NTPStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(NTPStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeConfig) DeepCopyInto(out *NodeConfig) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -488,13 +939,81 @@ func (in *NodeConfigSpec) DeepCopyInto(out *NodeConfigSpec) {
 	if in.NTPConfig != nil {
 		in, out := &in.NTPConfig, &out.NTPConfig
 		*out = new(NTPConfig)
-		**out = **in
+		(*in).DeepCopyInto(*out)
 	}
 	if in.LonghornConfig != nil {
 		in, out := &in.LonghornConfig, &out.LonghornConfig
 		*out = new(LonghornConfig)
 		**out = **in
 	}
+	if in.Sysctl != nil {
+		in, out := &in.Sysctl, &out.Sysctl
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.KernelModules != nil {
+		in, out := &in.KernelModules, &out.KernelModules
+		*out = new(KernelModulesConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.KernelArgs != nil {
+		in, out := &in.KernelArgs, &out.KernelArgs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.DNS != nil {
+		in, out := &in.DNS, &out.DNS
+		*out = new(DNSConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.HostAliases != nil {
+		in, out := &in.HostAliases, &out.HostAliases
+		*out = make([]HostAlias, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ContainerRuntime != nil {
+		in, out := &in.ContainerRuntime, &out.ContainerRuntime
+		*out = new(ContainerRuntimeConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.CPUPower != nil {
+		in, out := &in.CPUPower, &out.CPUPower
+		*out = new(CPUPowerConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.CPUIsolation != nil {
+		in, out := &in.CPUIsolation, &out.CPUIsolation
+		*out = new(CPUIsolationConfig)
+		**out = **in
+	}
+	if in.Swap != nil {
+		in, out := &in.Swap, &out.Swap
+		*out = new(SwapConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Journald != nil {
+		in, out := &in.Journald, &out.Journald
+		*out = new(JournaldConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SystemdUnits != nil {
+		in, out := &in.SystemdUnits, &out.SystemdUnits
+		*out = make([]SystemdUnitConfig, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.DriftPolicies != nil {
+		in, out := &in.DriftPolicies, &out.DriftPolicies
+		*out = make(map[string]DriftPolicy, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 	return
 }
 
@@ -511,9 +1030,67 @@ func (in *NodeConfigSpec) DeepCopy() *NodeConfigSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NodeConfigStatus) DeepCopyInto(out *NodeConfigStatus) {
 	*out = *in
-	if in.NTPConditions != nil {
-		in, out := &in.NTPConditions, &out.NTPConditions
-		*out = make([]ConfigStatus, len(*in))
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.NTPStatus != nil {
+		in, out := &in.NTPStatus, &out.NTPStatus
+		*out = new(NTPStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Sysctl != nil {
+		in, out := &in.Sysctl, &out.Sysctl
+		*out = make([]SysctlStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.KernelModules != nil {
+		in, out := &in.KernelModules, &out.KernelModules
+		*out = make([]KernelModuleStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.KernelArgs != nil {
+		in, out := &in.KernelArgs, &out.KernelArgs
+		*out = new(KernelArgsStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.CPUPower != nil {
+		in, out := &in.CPUPower, &out.CPUPower
+		*out = make([]CPUPowerStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.CPUIsolation != nil {
+		in, out := &in.CPUIsolation, &out.CPUIsolation
+		*out = new(CPUIsolationStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Swap != nil {
+		in, out := &in.Swap, &out.Swap
+		*out = make([]SwapDeviceStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.SystemdUnits != nil {
+		in, out := &in.SystemdUnits, &out.SystemdUnits
+		*out = make([]SystemdUnitStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.Rollbacks != nil {
+		in, out := &in.Rollbacks, &out.Rollbacks
+		*out = make([]SectionRollback, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ManagedFiles != nil {
+		in, out := &in.ManagedFiles, &out.ManagedFiles
+		*out = make([]ManagedFileStatus, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
@@ -531,6 +1108,209 @@ func (in *NodeConfigStatus) DeepCopy() *NodeConfigStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeConfigTemplate) DeepCopyInto(out *NodeConfigTemplate) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeConfigTemplate.
+func (in *NodeConfigTemplate) DeepCopy() *NodeConfigTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeConfigTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *NodeConfigTemplate) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeConfigTemplateList) DeepCopyInto(out *NodeConfigTemplateList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]NodeConfigTemplate, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeConfigTemplateList.
+func (in *NodeConfigTemplateList) DeepCopy() *NodeConfigTemplateList {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeConfigTemplateList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *NodeConfigTemplateList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeConfigTemplateSpec) DeepCopyInto(out *NodeConfigTemplateSpec) {
+	*out = *in
+	if in.MatchSelector != nil {
+		in, out := &in.MatchSelector, &out.MatchSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	in.Template.DeepCopyInto(&out.Template)
+	if in.Rollout != nil {
+		in, out := &in.Rollout, &out.Rollout
+		*out = new(RolloutStrategy)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeConfigTemplateSpec.
+func (in *NodeConfigTemplateSpec) DeepCopy() *NodeConfigTemplateSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeConfigTemplateSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeConfigTemplateStatus) DeepCopyInto(out *NodeConfigTemplateStatus) {
+	*out = *in
+	if in.Nodes != nil {
+		in, out := &in.Nodes, &out.Nodes
+		*out = make(map[string]TemplateRolloutStatus, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeConfigTemplateStatus.
+func (in *NodeConfigTemplateStatus) DeepCopy() *NodeConfigTemplateStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeConfigTemplateStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProxyConfig) DeepCopyInto(out *ProxyConfig) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProxyConfig.
+func (in *ProxyConfig) DeepCopy() *ProxyConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(ProxyConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistriesConfig) DeepCopyInto(out *RegistriesConfig) {
+	*out = *in
+	if in.Mirrors != nil {
+		in, out := &in.Mirrors, &out.Mirrors
+		*out = make(map[string]RegistryMirror, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.Configs != nil {
+		in, out := &in.Configs, &out.Configs
+		*out = make(map[string]RegistryConfig, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistriesConfig.
+func (in *RegistriesConfig) DeepCopy() *RegistriesConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistriesConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryConfig) DeepCopyInto(out *RegistryConfig) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryConfig.
+func (in *RegistryConfig) DeepCopy() *RegistryConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryMirror) DeepCopyInto(out *RegistryMirror) {
+	*out = *in
+	if in.Endpoints != nil {
+		in, out := &in.Endpoints, &out.Endpoints
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Rewrite != nil {
+		in, out := &in.Rewrite, &out.Rewrite
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryMirror.
+func (in *RegistryMirror) DeepCopy() *RegistryMirror {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryMirror)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Rollout) DeepCopyInto(out *Rollout) {
 	*out = *in
@@ -554,6 +1334,174 @@ func (in *Rollout) DeepCopy() *Rollout {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RolloutStrategy) DeepCopyInto(out *RolloutStrategy) {
+	*out = *in
+	if in.Pause != nil {
+		in, out := &in.Pause, &out.Pause
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RolloutStrategy.
+func (in *RolloutStrategy) DeepCopy() *RolloutStrategy {
+	if in == nil {
+		return nil
+	}
+	out := new(RolloutStrategy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SectionRollback) DeepCopyInto(out *SectionRollback) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SectionRollback.
+func (in *SectionRollback) DeepCopy() *SectionRollback {
+	if in == nil {
+		return nil
+	}
+	out := new(SectionRollback)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SwapConfig) DeepCopyInto(out *SwapConfig) {
+	*out = *in
+	if in.Zram != nil {
+		in, out := &in.Zram, &out.Zram
+		*out = new(ZramConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.File != nil {
+		in, out := &in.File, &out.File
+		*out = new(SwapFileConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SwapConfig.
+func (in *SwapConfig) DeepCopy() *SwapConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(SwapConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SwapDeviceStatus) DeepCopyInto(out *SwapDeviceStatus) {
+	*out = *in
+	out.Size = in.Size.DeepCopy()
+	out.Used = in.Used.DeepCopy()
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SwapDeviceStatus.
+func (in *SwapDeviceStatus) DeepCopy() *SwapDeviceStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SwapDeviceStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SwapFileConfig) DeepCopyInto(out *SwapFileConfig) {
+	*out = *in
+	out.Size = in.Size.DeepCopy()
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SwapFileConfig.
+func (in *SwapFileConfig) DeepCopy() *SwapFileConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(SwapFileConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SysctlStatus) DeepCopyInto(out *SysctlStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SysctlStatus.
+func (in *SysctlStatus) DeepCopy() *SysctlStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SysctlStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SystemdUnitConfig) DeepCopyInto(out *SystemdUnitConfig) {
+	*out = *in
+	if in.Settings != nil {
+		in, out := &in.Settings, &out.Settings
+		*out = make([]SystemdUnitSetting, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SystemdUnitConfig.
+func (in *SystemdUnitConfig) DeepCopy() *SystemdUnitConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(SystemdUnitConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SystemdUnitSetting) DeepCopyInto(out *SystemdUnitSetting) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SystemdUnitSetting.
+func (in *SystemdUnitSetting) DeepCopy() *SystemdUnitSetting {
+	if in == nil {
+		return nil
+	}
+	out := new(SystemdUnitSetting)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SystemdUnitStatus) DeepCopyInto(out *SystemdUnitStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SystemdUnitStatus.
+func (in *SystemdUnitStatus) DeepCopy() *SystemdUnitStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SystemdUnitStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *THPConfig) DeepCopyInto(out *THPConfig) {
 	*out = *in
@@ -569,3 +1517,36 @@ func (in *THPConfig) DeepCopy() *THPConfig {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TemplateRolloutStatus) DeepCopyInto(out *TemplateRolloutStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TemplateRolloutStatus.
+func (in *TemplateRolloutStatus) DeepCopy() *TemplateRolloutStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(TemplateRolloutStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ZramConfig) DeepCopyInto(out *ZramConfig) {
+	*out = *in
+	out.Size = in.Size.DeepCopy()
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ZramConfig.
+func (in *ZramConfig) DeepCopy() *ZramConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(ZramConfig)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -91,3 +91,37 @@ func NewCloudInit(namespace, name string, obj CloudInit) *CloudInit {
 	obj.Namespace = namespace
 	return &obj
 }
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// NodeConfigTemplateList is a list of NodeConfigTemplate resources
+type NodeConfigTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []NodeConfigTemplate `json:"items"`
+}
+
+func NewNodeConfigTemplate(namespace, name string, obj NodeConfigTemplate) *NodeConfigTemplate {
+	obj.APIVersion, obj.Kind = SchemeGroupVersion.WithKind("NodeConfigTemplate").ToAPIVersionAndKind()
+	obj.Name = name
+	obj.Namespace = namespace
+	return &obj
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// HostConfigChangeList is a list of HostConfigChange resources
+type HostConfigChangeList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []HostConfigChange `json:"items"`
+}
+
+func NewHostConfigChange(namespace, name string, obj HostConfigChange) *HostConfigChange {
+	obj.APIVersion, obj.Kind = SchemeGroupVersion.WithKind("HostConfigChange").ToAPIVersionAndKind()
+	obj.Name = name
+	obj.Namespace = namespace
+	return &obj
+}
@@ -28,10 +28,12 @@ import (
 )
 
 var (
-	CloudInitResourceName  = "cloudinits"
-	HugepageResourceName   = "hugepages"
-	KsmtunedResourceName   = "ksmtuneds"
-	NodeConfigResourceName = "nodeconfigs"
+	CloudInitResourceName          = "cloudinits"
+	HostConfigChangeResourceName   = "hostconfigchanges"
+	HugepageResourceName           = "hugepages"
+	KsmtunedResourceName           = "ksmtuneds"
+	NodeConfigResourceName         = "nodeconfigs"
+	NodeConfigTemplateResourceName = "nodeconfigtemplates"
 )
 
 // SchemeGroupVersion is group version used to register these objects
@@ -57,12 +59,16 @@ func addKnownTypes(scheme *runtime.Scheme) error {
 	scheme.AddKnownTypes(SchemeGroupVersion,
 		&CloudInit{},
 		&CloudInitList{},
+		&HostConfigChange{},
+		&HostConfigChangeList{},
 		&Hugepage{},
 		&HugepageList{},
 		&Ksmtuned{},
 		&KsmtunedList{},
 		&NodeConfig{},
 		&NodeConfigList{},
+		&NodeConfigTemplate{},
+		&NodeConfigTemplateList{},
 	)
 	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
 	return nil
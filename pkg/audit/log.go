@@ -0,0 +1,89 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Change is a change applied to the host, it is a line of the audit log
+type Change struct {
+	Time time.Time `json:"time"`
+	Node string    `json:"node"`
+
+	// Kind, Namespace, Name and ResourceVersion identify the object whose
+	// spec was applied
+	Kind            string `json:"kind"`
+	Namespace       string `json:"namespace,omitempty"`
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+
+	// Section is the part of the spec which was changed, Old is empty when
+	// it was not applied before and New is empty when it was removed
+	Section string          `json:"section"`
+	Old     json.RawMessage `json:"old,omitempty"`
+	New     json.RawMessage `json:"new,omitempty"`
+
+	// User is the requester which last changed the spec
+	User string `json:"user,omitempty"`
+
+	// Hash is the sha256 of the previous hash and the change, it chains the
+	// changes so that a change removed or altered in the log is detected
+	Hash string `json:"hash"`
+}
+
+func objectKey(kind, namespace, name string) string {
+	return fmt.Sprintf("%s/%s/%s", kind, namespace, name)
+}
+
+func (c *Change) key() string {
+	return objectKey(c.Kind, c.Namespace, c.Name)
+}
+
+// chain returns the hash of the change following the previous hash
+func (c Change) chain(prevHash string) (string, error) {
+	c.Hash = ""
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(prevHash))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ReadLog reads the changes of the audit log and verifies their hash chain,
+// the changes are returned along with the error when the chain is broken.
+func ReadLog(r io.Reader) ([]Change, error) {
+	var (
+		changes  []Change
+		prevHash string
+		chainErr error
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var change Change
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			return changes, fmt.Errorf("line %d: %v", line, err)
+		}
+		hash, err := change.chain(prevHash)
+		if err != nil {
+			return changes, fmt.Errorf("line %d: %v", line, err)
+		}
+		if hash != change.Hash && chainErr == nil {
+			chainErr = fmt.Errorf("line %d: hash chain is broken, the log was changed", line)
+		}
+		changes = append(changes, change)
+		prevHash = change.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return changes, err
+	}
+	return changes, chainErr
+}
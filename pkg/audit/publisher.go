@@ -0,0 +1,120 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	ctlv1 "github.com/harvester/node-manager/pkg/generated/controllers/node.harvesterhci.io/v1beta1"
+)
+
+const (
+	// LabelNode is the node of the HostConfigChange
+	LabelNode = "node.harvesterhci.io/node"
+
+	publishRetryInterval = 30 * time.Second
+)
+
+// NewHostConfigChange returns the HostConfigChange of the change, it is named
+// by the node and the hash so that a change is only created once.
+func NewHostConfigChange(change *Change) *nodeconfigv1.HostConfigChange {
+	return &nodeconfigv1.HostConfigChange{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   fmt.Sprintf("%s-%s", change.Node, change.Hash[:16]),
+			Labels: map[string]string{LabelNode: change.Node},
+		},
+		Spec: nodeconfigv1.HostConfigChangeSpec{
+			Node: change.Node,
+			Time: metav1.NewTime(change.Time),
+			Object: nodeconfigv1.ChangeObjectReference{
+				Kind:            change.Kind,
+				Namespace:       change.Namespace,
+				Name:            change.Name,
+				ResourceVersion: change.ResourceVersion,
+			},
+			Section: change.Section,
+			Old:     string(change.Old),
+			New:     string(change.New),
+			User:    change.User,
+			Hash:    change.Hash,
+		},
+	}
+}
+
+// Publish copies the changes of the audit log to HostConfigChanges, the log
+// stays the source of truth: the changes which could not be created are
+// retried until they are, and the ones missing on start are created again.
+func (r *Recorder) Publish(ctx context.Context, changes ctlv1.HostConfigChangeClient) {
+	if r == nil {
+		return
+	}
+	queue := make(chan Change, 1024)
+	r.mu.Lock()
+	r.publish = func(change Change) {
+		select {
+		case queue <- change:
+		default:
+			logrus.Warnf("Audit publish queue is full, change %s is published on next start", change.Hash)
+		}
+	}
+	r.mu.Unlock()
+
+	go func() {
+		pending := r.unpublished(changes)
+		ticker := time.NewTicker(publishRetryInterval)
+		defer ticker.Stop()
+		for {
+			pending = publishChanges(pending, changes)
+			select {
+			case change := <-queue:
+				pending = append(pending, change)
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// unpublished returns the changes of the log which are not yet published
+func (r *Recorder) unpublished(changes ctlv1.HostConfigChangeClient) []Change {
+	logged, err := readLogFile(r.path)
+	if err != nil {
+		logrus.Warnf("Read audit log to publish fail, err: %v", err)
+	}
+	existing, err := changes.List(metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", LabelNode, r.nodeName)})
+	if err != nil {
+		logrus.Warnf("List HostConfigChanges fail, all changes are published again: %v", err)
+		return logged
+	}
+	published := make(map[string]bool, len(existing.Items))
+	for _, item := range existing.Items {
+		published[item.Name] = true
+	}
+
+	var pending []Change
+	for i := range logged {
+		if !published[NewHostConfigChange(&logged[i]).Name] {
+			pending = append(pending, logged[i])
+		}
+	}
+	return pending
+}
+
+// publishChanges creates the changes in order, and returns the ones left once
+// a creation fails.
+func publishChanges(pending []Change, changes ctlv1.HostConfigChangeClient) []Change {
+	for i := range pending {
+		_, err := changes.Create(NewHostConfigChange(&pending[i]))
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			logrus.Warnf("Create HostConfigChange of %s fail, retry in %s: %v", pending[i].Hash, publishRetryInterval, err)
+			return pending[i:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// LogPath is the audit log on the host, /var/log is persistent
+	LogPath = "/host/var/log/harvester-node-manager/audit.log"
+
+	// AnnotationRequester is the user which last changed the spec of the
+	// object, it is set by the webhook from the user of the admission request
+	AnnotationRequester = "node.harvesterhci.io/requester"
+
+	// fsAppendFL is FS_APPEND_FL of chattr +a, the file could only be
+	// appended, even by root, until the flag is cleared
+	fsAppendFL = 0x20
+)
+
+// Recorder appends the changes applied to the host to the audit log. The
+// last applied value of each section is rebuilt from the log, so only the
+// sections which changed since are recorded. A nil Recorder records nothing.
+type Recorder struct {
+	mu       sync.Mutex
+	nodeName string
+	path     string
+	file     *os.File
+	lastHash string
+	// applied are the last recorded sections of each object
+	applied map[string]map[string]json.RawMessage
+	// publish is called with each recorded change once it is in the log
+	publish func(Change)
+}
+
+// NewRecorder opens the audit log, a log which is not intact is still appended
+// to, the break is kept in the log and reported on every open.
+func NewRecorder(nodeName, path string) (*Recorder, error) {
+	r := &Recorder{
+		nodeName: nodeName,
+		path:     path,
+		applied:  make(map[string]map[string]json.RawMessage),
+	}
+
+	changes, err := readLogFile(path)
+	if err != nil {
+		logrus.Errorf("Audit log %s is not intact, the changes are appended to what could be read: %v", path, err)
+	}
+	for i := range changes {
+		r.apply(&changes[i])
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("create %s failed: %v", filepath.Dir(path), err)
+	}
+	r.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open %s failed: %v", path, err)
+	}
+	if err := setAppendOnly(r.file); err != nil {
+		logrus.Warnf("Set %s append only fail, it is only protected by the hash chain: %v", path, err)
+	}
+	return r, nil
+}
+
+func readLogFile(path string) ([]Change, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open %s failed: %v", path, err)
+	}
+	defer f.Close()
+	changes, err := ReadLog(f)
+	if err != nil {
+		return changes, fmt.Errorf("read %s failed: %v", path, err)
+	}
+	return changes, nil
+}
+
+func setAppendOnly(f *os.File) error {
+	flags, err := unix.IoctlGetInt(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return err
+	}
+	if flags&fsAppendFL != 0 {
+		return nil
+	}
+	return unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, flags|fsAppendFL)
+}
+
+// apply updates the last applied sections with the change
+func (r *Recorder) apply(change *Change) {
+	key := change.key()
+	if change.New == nil {
+		delete(r.applied[key], change.Section)
+		if len(r.applied[key]) == 0 {
+			delete(r.applied, key)
+		}
+	} else {
+		if r.applied[key] == nil {
+			r.applied[key] = make(map[string]json.RawMessage)
+		}
+		r.applied[key][change.Section] = change.New
+	}
+	r.lastHash = change.Hash
+}
+
+// SpecSections splits the spec into its top-level fields, which are recorded
+// as the sections
+func SpecSections(spec any) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	sections := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return nil, err
+	}
+	return sections, nil
+}
+
+// Record records the sections of the object which differ from the last
+// recorded ones, a nil section is recorded as removed.
+func (r *Recorder) Record(kind string, obj metav1.Object, sections map[string]json.RawMessage) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.record(kind, obj, sections)
+}
+
+// RecordSpec records the sections of the spec, the sections recorded before
+// which are no longer in the spec are recorded as removed.
+func (r *Recorder) RecordSpec(kind string, obj metav1.Object, spec any) error {
+	if r == nil {
+		return nil
+	}
+	sections, err := SpecSections(spec)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for section := range r.applied[objectKey(kind, obj.GetNamespace(), obj.GetName())] {
+		if _, ok := sections[section]; !ok {
+			sections[section] = nil
+		}
+	}
+	return r.record(kind, obj, sections)
+}
+
+func (r *Recorder) record(kind string, obj metav1.Object, sections map[string]json.RawMessage) error {
+	now := time.Now().UTC()
+	user := Requester(obj)
+	applied := r.applied[objectKey(kind, obj.GetNamespace(), obj.GetName())]
+	var errs []error
+	for _, section := range slices.Sorted(maps.Keys(sections)) {
+		change := Change{
+			Time:            now,
+			Node:            r.nodeName,
+			Kind:            kind,
+			Namespace:       obj.GetNamespace(),
+			Name:            obj.GetName(),
+			ResourceVersion: obj.GetResourceVersion(),
+			Section:         section,
+			Old:             applied[section],
+			New:             compact(sections[section]),
+			User:            user,
+		}
+		if bytes.Equal(change.Old, change.New) {
+			continue
+		}
+		if err := r.append(&change); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RecordRemoval records all sections of the object as removed
+func (r *Recorder) RecordRemoval(kind string, obj metav1.Object) error {
+	return r.RecordSpec(kind, obj, struct{}{})
+}
+
+// Applied returns the last recorded sections of the object, it is false when
+// nothing is recorded by a nil Recorder.
+func (r *Recorder) Applied(kind string, obj metav1.Object) (map[string]json.RawMessage, bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return maps.Clone(r.applied[objectKey(kind, obj.GetNamespace(), obj.GetName())]), true
+}
+
+// compact drops the whitespaces so that the same values are equal, null is
+// regarded as removed
+func compact(value json.RawMessage) json.RawMessage {
+	if value == nil || string(value) == "null" {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, value); err != nil {
+		return value
+	}
+	return buf.Bytes()
+}
+
+// append writes the change to the log, it is synced before the change is
+// regarded as applied
+func (r *Recorder) append(change *Change) error {
+	hash, err := change.chain(r.lastHash)
+	if err != nil {
+		return err
+	}
+	change.Hash = hash
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if _, err := r.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("write audit log failed: %v", err)
+	}
+	if err := r.file.Sync(); err != nil {
+		return fmt.Errorf("sync audit log failed: %v", err)
+	}
+
+	logrus.Infof("Audit: %s %s/%s section %s is changed by %q", change.Kind, change.Namespace, change.Name, change.Section, change.User)
+	r.apply(change)
+	if r.publish != nil {
+		r.publish(*change)
+	}
+	return nil
+}
+
+// Requester returns the user which last changed the spec of the object, as
+// recorded by the webhook at admission. The objects which were not changed
+// since the webhook recorded it fall back to their field manager.
+func Requester(obj metav1.Object) string {
+	if user := obj.GetAnnotations()[AnnotationRequester]; user != "" {
+		return user
+	}
+	return FieldManager(obj)
+}
+
+// FieldManager returns the manager which last changed the object other than
+// through a subresource, e.g. `kubectl-edit`. The managers do not identify the
+// users, but they are all the object records about who made the change.
+func FieldManager(obj metav1.Object) string {
+	var (
+		manager string
+		latest  time.Time
+	)
+	for _, entry := range obj.GetManagedFields() {
+		if entry.Subresource != "" {
+			continue
+		}
+		var t time.Time
+		if entry.Time != nil {
+			t = entry.Time.Time
+		}
+		if manager == "" || t.After(latest) {
+			manager = entry.Manager
+			latest = t
+		}
+	}
+	return manager
+}
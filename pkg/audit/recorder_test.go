@@ -0,0 +1,166 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestObject(resourceVersion string) *metav1.ObjectMeta {
+	now := time.Now()
+	return &metav1.ObjectMeta{
+		Namespace:       "harvester-system",
+		Name:            "node1",
+		ResourceVersion: resourceVersion,
+		ManagedFields: []metav1.ManagedFieldsEntry{
+			{Manager: "harvester", Time: &metav1.Time{Time: now.Add(-time.Hour)}},
+			{Manager: "kubectl-edit", Time: &metav1.Time{Time: now}},
+			{Manager: "harvester-node-manager", Subresource: "status", Time: &metav1.Time{Time: now.Add(time.Hour)}},
+		},
+	}
+}
+
+// newTestRecorder opens the log under a temp dir, which is append only when
+// the test runs as root, the flag is cleared so that the dir could be removed
+func newTestRecorder(t *testing.T) (*Recorder, string) {
+	path := t.TempDir() + "/audit.log"
+	r, err := NewRecorder("node1", path)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		flags, err := unix.IoctlGetInt(int(r.file.Fd()), unix.FS_IOC_GETFLAGS)
+		if err == nil && flags&fsAppendFL != 0 {
+			_ = unix.IoctlSetPointerInt(int(r.file.Fd()), unix.FS_IOC_SETFLAGS, flags&^fsAppendFL)
+		}
+		r.file.Close()
+	})
+	return r, path
+}
+
+func readTestLog(t *testing.T, path string) []Change {
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	changes, err := ReadLog(bytes.NewReader(data))
+	require.Nil(t, err)
+	return changes
+}
+
+func TestRecord(t *testing.T) {
+	r, path := newTestRecorder(t)
+
+	var published []Change
+	r.publish = func(change Change) { published = append(published, change) }
+
+	sections := map[string]json.RawMessage{
+		"timezone": json.RawMessage(`"Asia/Taipei"`),
+		"dns":      json.RawMessage(`{"nameservers": ["1.1.1.1"]}`),
+		"swap":     nil,
+	}
+	require.Nil(t, r.Record("NodeConfig", newTestObject("1"), sections))
+	changes := readTestLog(t, path)
+	require.Len(t, changes, 2)
+	assert.Equal(t, "dns", changes[0].Section)
+	assert.Equal(t, `{"nameservers":["1.1.1.1"]}`, string(changes[0].New))
+	assert.Nil(t, changes[0].Old)
+	assert.Equal(t, "kubectl-edit", changes[0].User)
+	assert.Equal(t, "1", changes[0].ResourceVersion)
+	assert.Equal(t, "timezone", changes[1].Section)
+	assert.Equal(t, changes, published)
+
+	// the unchanged sections are not recorded again
+	require.Nil(t, r.Record("NodeConfig", newTestObject("2"), sections))
+	assert.Len(t, readTestLog(t, path), 2)
+
+	// the old value is recorded along with the new one
+	require.Nil(t, r.Record("NodeConfig", newTestObject("3"), map[string]json.RawMessage{"timezone": json.RawMessage(`"UTC"`)}))
+	changes = readTestLog(t, path)
+	require.Len(t, changes, 3)
+	assert.Equal(t, `"Asia/Taipei"`, string(changes[2].Old))
+	assert.Equal(t, `"UTC"`, string(changes[2].New))
+
+	// the last recorded sections are returned
+	applied, ok := r.Applied("NodeConfig", newTestObject("3"))
+	assert.True(t, ok)
+	assert.Equal(t, map[string]json.RawMessage{
+		"dns":      json.RawMessage(`{"nameservers":["1.1.1.1"]}`),
+		"timezone": json.RawMessage(`"UTC"`),
+	}, applied)
+	var nilRecorder *Recorder
+	_, ok = nilRecorder.Applied("NodeConfig", newTestObject("3"))
+	assert.False(t, ok)
+}
+
+func TestRecordSpec(t *testing.T) {
+	r, path := newTestRecorder(t)
+
+	type spec struct {
+		Mode      string `json:"mode,omitempty"`
+		ThresCoef uint   `json:"thresCoef"`
+	}
+	require.Nil(t, r.RecordSpec("Ksmtuned", newTestObject("1"), spec{Mode: "high", ThresCoef: 20}))
+	assert.Len(t, readTestLog(t, path), 2)
+
+	// the sections no longer in the spec are recorded as removed
+	require.Nil(t, r.RecordSpec("Ksmtuned", newTestObject("2"), spec{ThresCoef: 20}))
+	changes := readTestLog(t, path)
+	require.Len(t, changes, 3)
+	assert.Equal(t, "mode", changes[2].Section)
+	assert.Equal(t, `"high"`, string(changes[2].Old))
+	assert.Nil(t, changes[2].New)
+
+	// the recorded sections are rebuilt from the log
+	r, err := NewRecorder("node1", path)
+	require.Nil(t, err)
+	defer r.file.Close()
+	require.Nil(t, r.RecordSpec("Ksmtuned", newTestObject("3"), spec{ThresCoef: 20}))
+	assert.Len(t, readTestLog(t, path), 3)
+
+	require.Nil(t, r.RecordRemoval("Ksmtuned", newTestObject("4")))
+	changes = readTestLog(t, path)
+	require.Len(t, changes, 4)
+	assert.Equal(t, "thresCoef", changes[3].Section)
+	assert.Nil(t, changes[3].New)
+
+	// a nil recorder records nothing
+	var nilRecorder *Recorder
+	assert.Nil(t, nilRecorder.RecordSpec("Ksmtuned", newTestObject("5"), spec{}))
+}
+
+func TestReadLogTampered(t *testing.T) {
+	r, path := newTestRecorder(t)
+	for _, timezone := range []string{`"UTC"`, `"Asia/Taipei"`, `"Europe/Berlin"`} {
+		require.Nil(t, r.Record("NodeConfig", newTestObject("1"), map[string]json.RawMessage{"timezone": json.RawMessage(timezone)}))
+	}
+
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	lines := strings.SplitAfter(string(data), "\n")
+
+	// a changed value is detected
+	tampered := strings.Replace(string(data), `"new":"Asia/Taipei"`, `"new":"UTC"`, 1)
+	require.NotEqual(t, string(data), tampered)
+	_, err = ReadLog(strings.NewReader(tampered))
+	assert.ErrorContains(t, err, "line 2: hash chain is broken")
+
+	// a removed change is detected
+	_, err = ReadLog(strings.NewReader(lines[0] + lines[2]))
+	assert.ErrorContains(t, err, "line 2: hash chain is broken")
+}
+
+func TestRequester(t *testing.T) {
+	obj := newTestObject("1")
+	assert.Equal(t, "kubectl-edit", FieldManager(obj))
+	assert.Equal(t, "", FieldManager(&metav1.ObjectMeta{}))
+
+	// the user recorded by the webhook wins over the field manager
+	assert.Equal(t, "kubectl-edit", Requester(obj))
+	obj.Annotations = map[string]string{AnnotationRequester: "admin"}
+	assert.Equal(t, "admin", Requester(obj))
+}
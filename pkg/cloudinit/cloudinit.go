@@ -2,63 +2,51 @@ package cloudinit
 
 import (
 	"crypto/sha256"
-	"fmt"
 	"io"
-	"os"
 	"path/filepath"
-	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
 
 	cloudinitv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/oem"
 )
 
 const AnnotationHash = "node.harvesterhci.io/cloudinit-hash"
 
 var Directory = "/host/oem"
 
+// backupHistory is the number of backups of a cloud-init file kept
+const backupHistory = 3
+
+// store returns the store of the Elemental cloud-init file of the given
+// `cloudinit` object, the file is owned by the `cloudinit` object so two of
+// them cannot write the same file.
+func store(cloudinit *cloudinitv1.CloudInit) (*oem.Store, string) {
+	absPath := filepath.Join(Directory, cloudinit.Spec.Filename)
+	return oem.NewStore(absPath, absPath+".bak", backupHistory), "cloudinit/" + cloudinit.Name
+}
+
 // RequireLocal ensures that the Elemental cloud-init file described by
 // the given `cloudinit` object is an exact copy of the `cloudinit` object's
 // contents.
-func RequireLocal(cloudinit *cloudinitv1.CloudInit) (bool, error) {
-	absPath := filepath.Join(Directory, cloudinit.Spec.Filename)
-
-	f, err := os.Open(absPath)
-	var r io.Reader = f
-	if err != nil {
-		r = strings.NewReader("")
-	} else {
-		defer f.Close() //nolint:errcheck
-	}
-
-	diskChecksum, err := Measure(r)
-	if err != nil {
-		return false, err
-	}
-
-	if fmt.Sprintf("%x", diskChecksum) == cloudinit.Annotations[AnnotationHash] {
-		return false, nil
-	}
-
-	tempFile, err := os.CreateTemp(Directory, "node-manager")
-	if err != nil {
-		return false, err
-	}
-	defer os.RemoveAll(tempFile.Name()) //nolint:errcheck
-	defer tempFile.Close()              //nolint:errcheck
-
-	_, err = io.Copy(tempFile, strings.NewReader(cloudinit.Spec.Contents))
-	if err != nil {
-		return false, err
-	}
+func RequireLocal(cloudinit *cloudinitv1.CloudInit) (*oem.Result, error) {
+	s, owner := store(cloudinit)
+	return s.Write(owner, []byte(cloudinit.Spec.Contents))
+}
 
-	err = os.Rename(tempFile.Name(), absPath)
-	if err != nil {
-		return false, err
-	}
+// PlanLocal returns the change RequireLocal would make to the Elemental
+// cloud-init file without writing it.
+func PlanLocal(cloudinit *cloudinitv1.CloudInit) (*oem.Result, error) {
+	s, owner := store(cloudinit)
+	return s.PlanWrite(owner, []byte(cloudinit.Spec.Contents))
+}
 
-	return true, nil
+// RemoveLocal removes the Elemental cloud-init file described by the given
+// `cloudinit` object.
+func RemoveLocal(cloudinit *cloudinitv1.CloudInit) (*oem.Result, error) {
+	s, owner := store(cloudinit)
+	return s.Remove(owner)
 }
 
 func Measure(r io.Reader) ([]byte, error) {
@@ -21,6 +21,8 @@ func main() {
 					nodev1beta1.Ksmtuned{},
 					nodev1beta1.NodeConfig{},
 					nodev1beta1.CloudInit{},
+					nodev1beta1.NodeConfigTemplate{},
+					nodev1beta1.HostConfigChange{},
 				},
 				GenerateTypes:   true,
 				GenerateClients: true,
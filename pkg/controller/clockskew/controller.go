@@ -0,0 +1,328 @@
+package clockskew
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	ctlnode "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	ctlv1 "github.com/harvester/node-manager/pkg/generated/controllers/node.harvesterhci.io/v1beta1"
+)
+
+const (
+	HandlerName = "harvester-clock-skew-controller"
+
+	// NodeConditionClockSkew is set on every node by the leader, it is True
+	// on the nodes whose clock deviates from the others.
+	NodeConditionClockSkew corev1.NodeConditionType = "ClockSkew"
+
+	ReasonClockSkewDetected  = "ClockSkewDetected"
+	ReasonClockSkewTolerable = "ClockSkewTolerable"
+	ReasonNotEnoughData      = "NotEnoughMeasurements"
+	ReasonNoMeasurement      = "NoRecentMeasurement"
+
+	// Node objects are Cluster-scoped, see the cloudinit controller.
+	eventNamespace = "default"
+	eventAction    = "DetectClockSkew"
+)
+
+// MeasurementExpiry is how long an NTP measurement of a node is considered,
+// the NTP monitor reports a new measurement at least every few minutes.
+var MeasurementExpiry = 45 * time.Minute
+
+// Controller compares the NTP offsets the nodes report to their NodeConfig
+// status. It runs on the leader only, so the cluster wide view is computed
+// once and every node gets the same result.
+type Controller struct {
+	// NodeName is the node the leader runs on, it reports the events
+	NodeName  string
+	Threshold time.Duration
+
+	NodeConfigs      ctlv1.NodeConfigController
+	NodeConfigsCache ctlv1.NodeConfigCache
+	Nodes            ctlnode.NodeClient
+	NodesCache       ctlnode.NodeCache
+	Events           ctlnode.EventClient
+}
+
+func Register(ctx context.Context, nodeName string, threshold time.Duration, nodecfg ctlv1.NodeConfigController, nodes ctlnode.NodeController, events ctlnode.EventClient) *Controller {
+	ctl := &Controller{
+		NodeName:         nodeName,
+		Threshold:        threshold,
+		NodeConfigs:      nodecfg,
+		NodeConfigsCache: nodecfg.Cache(),
+		Nodes:            nodes,
+		NodesCache:       nodes.Cache(),
+		Events:           events,
+	}
+
+	nodecfg.OnChange(ctx, HandlerName, ctl.OnNodeConfigChange)
+	return ctl
+}
+
+// OnNodeConfigChange re-evaluates the cluster wide clock skew whenever any
+// node reports a new NTP measurement to its NodeConfig status, and once the
+// next measurement expires.
+func (c *Controller) OnNodeConfigChange(key string, nodecfg *nodeconfigv1.NodeConfig) (*nodeconfigv1.NodeConfig, error) {
+	namespace, _, _ := strings.Cut(key, "/")
+	nodecfgs, err := c.NodeConfigsCache.List(namespace, labels.Everything())
+	if err != nil {
+		return nodecfg, err
+	}
+	nodes, err := c.NodesCache.List(labels.Everything())
+	if err != nil {
+		return nodecfg, err
+	}
+
+	now := time.Now()
+	offsets := collectOffsets(nodecfgs, now)
+	maxSkew, outliers := detectClockSkew(offsets, c.Threshold)
+	var errs []error
+	for _, node := range nodes {
+		cond := c.newClockSkewCondition(node.Name, offsets, maxSkew, outliers)
+		detected, err := c.patchNodeCondition(node, cond)
+		if err != nil {
+			logrus.Errorf("Update node %s clock skew condition fail. err: %v", node.Name, err)
+			errs = append(errs, err)
+			continue
+		}
+		if detected {
+			if err := c.emitClockSkewEvent(node, cond.Message); err != nil {
+				logrus.Warnf("Emit clock skew event of node %s fail. err: %v", node.Name, err)
+			}
+		}
+	}
+
+	// the outliers and the nodes without measurements change once a
+	// measurement expires, even if no node reports anymore
+	if name, wait, ok := nextExpiry(nodecfgs, now); ok {
+		c.NodeConfigs.EnqueueAfter(namespace, name, wait)
+	}
+	return nodecfg, errors.Join(errs...)
+}
+
+// collectOffsets returns the latest NTP offsets of the nodes, the expired
+// measurements are skipped because they do not reflect the current clock.
+func collectOffsets(nodecfgs []*nodeconfigv1.NodeConfig, now time.Time) map[string]time.Duration {
+	offsets := make(map[string]time.Duration, len(nodecfgs))
+	for _, nodecfg := range nodecfgs {
+		ntpStatus := nodecfg.Status.NTPStatus
+		if ntpStatus == nil || ntpStatus.Offset == nil || ntpStatus.LastMeasurementTime == nil {
+			continue
+		}
+		if now.Sub(ntpStatus.LastMeasurementTime.Time) > MeasurementExpiry {
+			continue
+		}
+		offsets[nodecfg.Name] = ntpStatus.Offset.Duration
+	}
+	return offsets
+}
+
+// nextExpiry returns the NodeConfig whose measurement expires first, and how
+// long until it does.
+func nextExpiry(nodecfgs []*nodeconfigv1.NodeConfig, now time.Time) (string, time.Duration, bool) {
+	var (
+		name  string
+		first time.Time
+	)
+	for _, nodecfg := range nodecfgs {
+		ntpStatus := nodecfg.Status.NTPStatus
+		if ntpStatus == nil || ntpStatus.Offset == nil || ntpStatus.LastMeasurementTime == nil {
+			continue
+		}
+		expiry := ntpStatus.LastMeasurementTime.Add(MeasurementExpiry)
+		if !expiry.After(now) {
+			continue
+		}
+		if name == "" || expiry.Before(first) {
+			name, first = nodecfg.Name, expiry
+		}
+	}
+	if name == "" {
+		return "", 0, false
+	}
+	// evaluate just after the expiry, as a measurement expires only once it
+	// is older than MeasurementExpiry
+	return name, first.Sub(now) + time.Second, true
+}
+
+// detectClockSkew returns the maximum pairwise skew between the nodes. When
+// the skew exceeds the threshold, the nodes deviating from the median by more
+// than half of the threshold are returned as outliers, at least the node with
+// the smallest or the largest offset is always one of them.
+func detectClockSkew(offsets map[string]time.Duration, threshold time.Duration) (time.Duration, []string) {
+	if len(offsets) < 2 {
+		return 0, nil
+	}
+
+	values := make([]time.Duration, 0, len(offsets))
+	for _, offset := range offsets {
+		values = append(values, offset)
+	}
+	slices.Sort(values)
+
+	maxSkew := values[len(values)-1] - values[0]
+	if maxSkew <= threshold {
+		return maxSkew, nil
+	}
+
+	median := values[len(values)/2]
+	if len(values)%2 == 0 {
+		median = (values[len(values)/2-1] + values[len(values)/2]) / 2
+	}
+
+	var outliers []string
+	for name, offset := range offsets {
+		deviation := offset - median
+		if deviation < 0 {
+			deviation = -deviation
+		}
+		if deviation > threshold/2 {
+			outliers = append(outliers, name)
+		}
+	}
+	slices.Sort(outliers)
+	return maxSkew, outliers
+}
+
+// newClockSkewCondition returns the condition of the node, it is only True on
+// the outliers, the other nodes report whether the cluster is skewed in the
+// message.
+func (c *Controller) newClockSkewCondition(nodeName string, offsets map[string]time.Duration, maxSkew time.Duration, outliers []string) corev1.NodeCondition {
+	cond := corev1.NodeCondition{
+		Type:   NodeConditionClockSkew,
+		Status: corev1.ConditionFalse,
+	}
+
+	_, measured := offsets[nodeName]
+	switch {
+	case len(offsets) < 2:
+		cond.Status = corev1.ConditionUnknown
+		cond.Reason = ReasonNotEnoughData
+		cond.Message = fmt.Sprintf("Only %d node(s) reported a recent NTP measurement", len(offsets))
+	case !measured:
+		cond.Status = corev1.ConditionUnknown
+		cond.Reason = ReasonNoMeasurement
+		cond.Message = fmt.Sprintf("Node reported no NTP measurement in the last %s", MeasurementExpiry)
+	case slices.Contains(outliers, nodeName):
+		cond.Status = corev1.ConditionTrue
+		cond.Reason = ReasonClockSkewDetected
+		cond.Message = fmt.Sprintf("Clock deviates from the other nodes, maximum clock skew %s exceeds threshold %s, outlier nodes: %s",
+			maxSkew, c.Threshold, strings.Join(outliers, ", "))
+	case len(outliers) > 0:
+		cond.Reason = ReasonClockSkewTolerable
+		cond.Message = fmt.Sprintf("Clock is within threshold %s, outlier nodes: %s", c.Threshold, strings.Join(outliers, ", "))
+	default:
+		cond.Reason = ReasonClockSkewTolerable
+		cond.Message = fmt.Sprintf("Maximum clock skew %s is within threshold %s", maxSkew, c.Threshold)
+	}
+	return cond
+}
+
+// clockSkewConditionChanged compares the conditions, the skew changes on
+// every measurement, so only the message of a detected skew matters.
+func clockSkewConditionChanged(prev, cond corev1.NodeCondition) bool {
+	return prev.Status != cond.Status || prev.Reason != cond.Reason ||
+		(cond.Status == corev1.ConditionTrue && prev.Message != cond.Message)
+}
+
+// patchNodeCondition patches the condition into the node status, so it does
+// not conflict with the heartbeats of kubelet, and returns true when the
+// clock skew is newly detected on the node.
+func (c *Controller) patchNodeCondition(node *corev1.Node, cond corev1.NodeCondition) (bool, error) {
+	now := metav1.Now()
+	cond.LastHeartbeatTime = now
+	cond.LastTransitionTime = now
+
+	pos := slices.IndexFunc(node.Status.Conditions, func(nc corev1.NodeCondition) bool {
+		return nc.Type == NodeConditionClockSkew
+	})
+	if pos >= 0 {
+		prev := node.Status.Conditions[pos]
+		if !clockSkewConditionChanged(prev, cond) {
+			return false, nil
+		}
+		if prev.Status == cond.Status {
+			cond.LastTransitionTime = prev.LastTransitionTime
+		}
+	}
+
+	// conditions are merged by their type
+	patch, err := json.Marshal(map[string]any{
+		"status": map[string]any{"conditions": []corev1.NodeCondition{cond}},
+	})
+	if err != nil {
+		return false, err
+	}
+	logrus.Infof("Update node %s clock skew condition: %s", node.Name, cond.Message)
+	if _, err := c.Nodes.Patch(node.Name, types.StrategicMergePatchType, patch, "status"); err != nil {
+		return false, err
+	}
+	return cond.Status == corev1.ConditionTrue, nil
+}
+
+func (c *Controller) emitClockSkewEvent(node *corev1.Node, message string) error {
+	now := time.Now()
+
+	eventName := fmt.Sprintf("clock-skew.%s", node.Name)
+
+	event, err := c.Events.Get(eventNamespace, eventName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		event = &corev1.Event{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      eventName,
+				Namespace: eventNamespace,
+			},
+			InvolvedObject: corev1.ObjectReference{
+				Kind: "Node",
+				Name: node.Name,
+				UID:  node.UID,
+			},
+			Action:  eventAction,
+			Reason:  ReasonClockSkewDetected,
+			Message: message,
+			Source: corev1.EventSource{
+				Component: "harvester-node-manager",
+				Host:      node.Name,
+			},
+			Type:                corev1.EventTypeWarning,
+			ReportingController: fmt.Sprintf("harvesterhci.io/%s", HandlerName),
+			ReportingInstance:   c.NodeName,
+			EventTime:           metav1.NewMicroTime(now),
+			FirstTimestamp:      metav1.NewTime(now),
+			LastTimestamp:       metav1.NewTime(now),
+			Count:               1,
+		}
+
+		if _, err := c.Events.Create(event); err != nil {
+			return err
+		}
+
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	event.Message = message
+	event.LastTimestamp = metav1.NewTime(now)
+	event.Count++
+
+	if _, err := c.Events.Update(event); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package clockskew
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+func TestDetectClockSkew(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name         string
+		offsets      map[string]time.Duration
+		wantSkew     time.Duration
+		wantOutliers []string
+	}{
+		{"no node", nil, 0, nil},
+		{"single node", map[string]time.Duration{"node-0": 800 * ms}, 0, nil},
+		{"within threshold", map[string]time.Duration{"node-0": -100 * ms, "node-1": 200 * ms, "node-2": 0}, 300 * ms, nil},
+		{"single outlier", map[string]time.Duration{"node-0": 10 * ms, "node-1": -5 * ms, "node-2": 900 * ms}, 905 * ms, []string{"node-2"}},
+		{"two nodes", map[string]time.Duration{"node-0": -300 * ms, "node-1": 300 * ms}, 600 * ms, []string{"node-0", "node-1"}},
+		{"outliers on both sides", map[string]time.Duration{
+			"node-0": -700 * ms, "node-1": 0, "node-2": 20 * ms, "node-3": -20 * ms, "node-4": 600 * ms,
+		}, 1300 * ms, []string{"node-0", "node-4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			skew, outliers := detectClockSkew(tt.offsets, 500*ms)
+			assert.Equal(t, tt.wantSkew, skew)
+			assert.Equal(t, tt.wantOutliers, outliers)
+		})
+	}
+}
+
+func TestCollectOffsets(t *testing.T) {
+	now := time.Now()
+	newNodeConfig := func(name string, status *nodeconfigv1.NTPStatus) *nodeconfigv1.NodeConfig {
+		return &nodeconfigv1.NodeConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "harvester-system"},
+			Status:     nodeconfigv1.NodeConfigStatus{NTPStatus: status},
+		}
+	}
+
+	nodecfgs := []*nodeconfigv1.NodeConfig{
+		newNodeConfig("no-status", nil),
+		newNodeConfig("no-measurement", &nodeconfigv1.NTPStatus{CurrentServer: "10.0.0.1"}),
+		newNodeConfig("expired", &nodeconfigv1.NTPStatus{
+			Offset:              &metav1.Duration{Duration: time.Second},
+			LastMeasurementTime: &metav1.Time{Time: now.Add(-time.Hour)},
+		}),
+		newNodeConfig("recent", &nodeconfigv1.NTPStatus{
+			Offset:              &metav1.Duration{Duration: -time.Millisecond},
+			LastMeasurementTime: &metav1.Time{Time: now.Add(-time.Minute)},
+		}),
+	}
+
+	assert.Equal(t, map[string]time.Duration{"recent": -time.Millisecond}, collectOffsets(nodecfgs, now))
+}
+
+func TestNextExpiry(t *testing.T) {
+	now := time.Now()
+	newNodeConfig := func(name string, measured time.Duration) *nodeconfigv1.NodeConfig {
+		return &nodeconfigv1.NodeConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "harvester-system"},
+			Status: nodeconfigv1.NodeConfigStatus{NTPStatus: &nodeconfigv1.NTPStatus{
+				Offset:              &metav1.Duration{},
+				LastMeasurementTime: &metav1.Time{Time: now.Add(-measured)},
+			}},
+		}
+	}
+
+	_, _, ok := nextExpiry([]*nodeconfigv1.NodeConfig{newNodeConfig("expired", time.Hour)}, now)
+	assert.False(t, ok)
+
+	name, wait, ok := nextExpiry([]*nodeconfigv1.NodeConfig{
+		newNodeConfig("expired", time.Hour),
+		newNodeConfig("recent", time.Minute),
+		newNodeConfig("old", 40*time.Minute),
+	}, now)
+	assert.True(t, ok)
+	assert.Equal(t, "old", name)
+	assert.Equal(t, 5*time.Minute+time.Second, wait)
+}
+
+func TestNewClockSkewCondition(t *testing.T) {
+	ms := time.Millisecond
+	c := &Controller{Threshold: 500 * ms}
+	offsets := map[string]time.Duration{"node-0": 10 * ms, "node-1": -5 * ms, "node-2": 900 * ms}
+	maxSkew, outliers := detectClockSkew(offsets, c.Threshold)
+
+	tests := []struct {
+		name       string
+		node       string
+		offsets    map[string]time.Duration
+		wantStatus corev1.ConditionStatus
+		wantReason string
+	}{
+		{"outlier", "node-2", offsets, corev1.ConditionTrue, ReasonClockSkewDetected},
+		{"in sync with an outlier", "node-0", offsets, corev1.ConditionFalse, ReasonClockSkewTolerable},
+		{"no recent measurement", "node-3", offsets, corev1.ConditionUnknown, ReasonNoMeasurement},
+		{"not enough measurements", "node-0", map[string]time.Duration{"node-0": 0}, corev1.ConditionUnknown, ReasonNotEnoughData},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cond := c.newClockSkewCondition(tt.node, tt.offsets, maxSkew, outliers)
+			assert.Equal(t, NodeConditionClockSkew, cond.Type)
+			assert.Equal(t, tt.wantStatus, cond.Status)
+			assert.Equal(t, tt.wantReason, cond.Reason)
+		})
+	}
+
+	// the skew of the nodes within the threshold is not updated on every
+	// measurement, the outliers of a detected skew are
+	tolerable := c.newClockSkewCondition("node-0", offsets, maxSkew, outliers)
+	assert.False(t, clockSkewConditionChanged(tolerable, c.newClockSkewCondition("node-0", offsets, maxSkew+ms, outliers)))
+	detected := c.newClockSkewCondition("node-2", offsets, maxSkew, outliers)
+	assert.True(t, clockSkewConditionChanged(detected, c.newClockSkewCondition("node-2", offsets, maxSkew, []string{"node-1", "node-2"})))
+	assert.True(t, clockSkewConditionChanged(tolerable, detected))
+}
@@ -2,6 +2,8 @@ package cloudinit
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -18,8 +20,10 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	cloudinitv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/audit"
 	"github.com/harvester/node-manager/pkg/cloudinit"
 	ctrlv1 "github.com/harvester/node-manager/pkg/generated/controllers/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/oem"
 )
 
 const (
@@ -37,6 +41,10 @@ const (
 	eventActionRemove    = "RemoveFile"
 	eventReasonRemove    = "CloudInitNotApplicable"
 
+	kindCloudInit = "CloudInit"
+	// auditSection is the section of the audit log the file is recorded in
+	auditSection = "file"
+
 	// This is mainly used for detecting a "zero value" for timestamps
 	// in a call to stat, where 0 means it has been 0 seconds since the
 	// unix epoch.
@@ -48,14 +56,16 @@ type controller struct {
 	cloudinits ctrlv1.CloudInitClient
 	events     ctlnodev1.EventClient
 	nodeCache  ctlnodev1.NodeCache
+	audit      *audit.Recorder
 }
 
-func Register(ctx context.Context, nodeName string, cloudinits ctrlv1.CloudInitController, nodeCache ctlnodev1.NodeCache, events ctlnodev1.EventClient) {
+func Register(ctx context.Context, nodeName string, cloudinits ctrlv1.CloudInitController, nodeCache ctlnodev1.NodeCache, events ctlnodev1.EventClient, recorder *audit.Recorder) {
 	ctl := &controller{
 		nodeName:   nodeName,
 		cloudinits: cloudinits,
 		events:     events,
 		nodeCache:  nodeCache,
+		audit:      recorder,
 	}
 
 	cloudinits.OnChange(ctx, handlerName, ctl.OnCloudInitChange)
@@ -96,17 +106,19 @@ func (c *controller) OnCloudInitChange(_ string, cloudInitObj *cloudinitv1.Cloud
 	}
 
 	if cloudinit.MatchesNode(node, cloudInitCopy) {
-		changed, err := cloudinit.RequireLocal(cloudInitCopy)
+		result, err := cloudinit.RequireLocal(cloudInitCopy)
 		_, _ = c.updateStatus(node, cloudInitCopy)
 		if err != nil {
 			return cloudInitCopy, err
 		}
 
-		if !changed {
+		if len(result.Changes) == 0 {
 			return cloudInitCopy, nil
 		}
 
-		err = c.emitOverwriteEvent(cloudInitCopy)
+		c.recordFile(cloudInitCopy, checksumString)
+
+		err = c.emitOverwriteEvent(cloudInitCopy, result.ForeignEdit)
 		if err != nil {
 			logrus.WithError(err).
 				WithField("cloudinit_name", cloudInitCopy.Name).
@@ -116,10 +128,15 @@ func (c *controller) OnCloudInitChange(_ string, cloudInitObj *cloudinitv1.Cloud
 		return cloudInitCopy, err
 	}
 
-	err = os.Remove(filepath.Join(cloudinit.Directory, cloudInitCopy.Spec.Filename))
-	if os.IsNotExist(err) {
+	// The file written for another CloudInit with the same filename is kept
+	result, err := cloudinit.RemoveLocal(cloudInitCopy)
+	if err != nil && !errors.Is(err, oem.ErrFileOwned) {
+		return cloudInitCopy, err
+	}
+	if err != nil || len(result.Changes) == 0 {
 		return c.updateStatus(node, cloudInitCopy)
 	}
+	c.recordFile(cloudInitCopy, "")
 
 	err = c.emitRemoveEvent(cloudInitCopy)
 	if err != nil {
@@ -132,8 +149,8 @@ func (c *controller) OnCloudInitChange(_ string, cloudInitObj *cloudinitv1.Cloud
 }
 
 func (c *controller) OnCloudInitRemove(_ string, cloudInitObj *cloudinitv1.CloudInit) (*cloudinitv1.CloudInit, error) {
-	err := os.Remove(filepath.Join(cloudinit.Directory, cloudInitObj.Spec.Filename))
-	if os.IsNotExist(err) {
+	result, err := cloudinit.RemoveLocal(cloudInitObj)
+	if errors.Is(err, oem.ErrFileOwned) {
 		return cloudInitObj, nil
 	}
 
@@ -141,9 +158,44 @@ func (c *controller) OnCloudInitRemove(_ string, cloudInitObj *cloudinitv1.Cloud
 		return cloudInitObj, err
 	}
 
+	if len(result.Changes) == 0 {
+		return cloudInitObj, nil
+	}
+
+	if err := c.audit.RecordRemoval(kindCloudInit, cloudInitObj); err != nil {
+		logrus.WithError(err).
+			WithField("cloudinit_name", cloudInitObj.Name).
+			Warn("Failed to record removal of CloudInit in the audit log")
+	}
+
 	return cloudInitObj, nil
 }
 
+// recordFile records the file written to /oem in the audit log, or its removal
+// when the checksum is empty. Only the checksum of the contents is recorded,
+// as they may contain secrets.
+func (c *controller) recordFile(cloudInitObj *cloudinitv1.CloudInit, checksum string) {
+	var file json.RawMessage
+	if checksum != "" {
+		data, err := json.Marshal(map[string]string{
+			"filename": cloudInitObj.Spec.Filename,
+			"sha256":   checksum,
+		})
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to marshal CloudInit file for the audit log")
+			return
+		}
+		file = data
+	}
+
+	sections := map[string]json.RawMessage{auditSection: file}
+	if err := c.audit.Record(kindCloudInit, cloudInitObj, sections); err != nil {
+		logrus.WithError(err).
+			WithField("cloudinit_name", cloudInitObj.Name).
+			Warn("Failed to record CloudInit in the audit log")
+	}
+}
+
 type byCondType []metav1.Condition
 
 func (n byCondType) Len() int           { return len(n) }
@@ -158,6 +210,7 @@ const (
 	CloudInitReasonNotApplicable    = "CloudInitNotApplicable"
 	CloudInitReasonChecksumMismatch = "CloudInitChecksumMismatch"
 	CloudInitReasonChecksumMatch    = "CloudInitChecksumMatch"
+	CloudInitReasonForeignEdit      = "CloudInitForeignEdit"
 )
 
 func (c *controller) updateStatus(node *corev1.Node, cloudInitObj *cloudinitv1.CloudInit) (*cloudinitv1.CloudInit, error) {
@@ -260,10 +313,14 @@ func newPresentCondition(cloudInit *cloudinitv1.CloudInit) metav1.Condition {
 	}
 }
 
-func (c *controller) emitOverwriteEvent(cloudInitObj *cloudinitv1.CloudInit) error {
+func (c *controller) emitOverwriteEvent(cloudInitObj *cloudinitv1.CloudInit, foreignEdit bool) error {
 	now := time.Now()
 
 	eventName := fmt.Sprintf("cloudinit-overwrite-%s.%s", cloudInitObj.Name, c.nodeName)
+	message := fmt.Sprintf("%s has been overwritten on %s", cloudInitObj.Spec.Filename, c.nodeName)
+	if foreignEdit {
+		message = fmt.Sprintf("%s was changed outside of the node manager and has been overwritten on %s", cloudInitObj.Spec.Filename, c.nodeName)
+	}
 
 	event, err := c.events.Get(eventNamespace, eventName, metav1.GetOptions{})
 	if apierrors.IsNotFound(err) {
@@ -279,7 +336,7 @@ func (c *controller) emitOverwriteEvent(cloudInitObj *cloudinitv1.CloudInit) err
 			},
 			Action:  eventActionReconcile,
 			Reason:  eventReasonReconcile,
-			Message: fmt.Sprintf("%s has been overwritten on %s", cloudInitObj.Spec.Filename, c.nodeName),
+			Message: message,
 			Source: corev1.EventSource{
 				Component: "harvester-node-manager",
 				Host:      c.nodeName,
@@ -303,6 +360,7 @@ func (c *controller) emitOverwriteEvent(cloudInitObj *cloudinitv1.CloudInit) err
 		return err
 	}
 
+	event.Message = message
 	event.LastTimestamp = metav1.NewTime(now)
 	event.Count++
 
@@ -394,8 +452,7 @@ func newOutOfSyncCondition(cloudInit *cloudinitv1.CloudInit) metav1.Condition {
 		message = "Local file checksum is different than the CloudInit checksum"
 	)
 
-	f, err := os.Open(filepath.Join(cloudinit.Directory, cloudInit.Spec.Filename))
-	if err != nil {
+	if _, err := os.Stat(filepath.Join(cloudinit.Directory, cloudInit.Spec.Filename)); err != nil {
 		return metav1.Condition{
 			Type:    string(cloudinitv1.CloudInitOutOfSync),
 			Status:  metav1.ConditionUnknown,
@@ -403,14 +460,17 @@ func newOutOfSyncCondition(cloudInit *cloudinitv1.CloudInit) metav1.Condition {
 			Message: fmt.Sprintf("Open file: %v", err),
 		}
 	}
-	defer f.Close() //nolint:errcheck
 
-	checksum, err := cloudinit.Measure(f)
-	if err != nil {
+	result, err := cloudinit.PlanLocal(cloudInit)
+	switch {
+	case err != nil:
 		status = metav1.ConditionUnknown
 		reason = CloudInitReasonError
-		message = fmt.Sprintf("Calculate checksum: %v", err)
-	} else if fmt.Sprintf("%x", checksum) == cloudInit.Annotations[cloudinit.AnnotationHash] {
+		message = fmt.Sprintf("Plan file: %v", err)
+	case result.ForeignEdit:
+		reason = CloudInitReasonForeignEdit
+		message = "Local file is changed outside of the node manager"
+	case len(result.Changes) == 0:
 		status = metav1.ConditionFalse
 		reason = CloudInitReasonChecksumMatch
 		message = "Local file checksum is the same as the CloudInit checksum"
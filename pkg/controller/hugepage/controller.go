@@ -12,6 +12,7 @@ import (
 	"github.com/harvester/node-manager/pkg/hugepage"
 
 	nodev1beta1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/audit"
 	ctlhugepage "github.com/harvester/node-manager/pkg/generated/controllers/node.harvesterhci.io/v1beta1"
 )
 
@@ -33,9 +34,10 @@ type Controller struct {
 	Nodes     ctlnode.NodeController
 
 	HugepageManager *hugepage.Manager
+	Audit           *audit.Recorder
 }
 
-func Register(ctx context.Context, name string, hugepagectl ctlhugepage.HugepageController, nodes ctlnode.NodeController) (*Controller, error) {
+func Register(ctx context.Context, name string, hugepagectl ctlhugepage.HugepageController, nodes ctlnode.NodeController, recorder *audit.Recorder) (*Controller, error) {
 	mgr, err := hugepage.NewHugepageManager(ctx, hugepage.THPPath)
 	if err != nil {
 		return nil, err
@@ -48,6 +50,7 @@ func Register(ctx context.Context, name string, hugepagectl ctlhugepage.Hugepage
 		NodeCache:       nodes.Cache(),
 		Nodes:           nodes,
 		HugepageManager: mgr,
+		Audit:           recorder,
 	}
 
 	c.HugepageClient.OnChange(ctx, HugepageHandlerName, c.OnChange)
@@ -75,6 +78,9 @@ func (c *Controller) OnChange(key string, hugetlb *nodev1beta1.Hugepage) (*nodev
 		// to be regenerated and applied to object
 		logrus.WithField("name", key).Debugf("attempting to apply hugepages configuration")
 		if err := c.HugepageManager.ApplyConfig(&hugetlb.Spec.Transparent); err == nil {
+			if err := c.Audit.RecordSpec("Hugepage", hugetlb, hugetlb.Spec); err != nil {
+				logrus.WithField("name", key).Warnf("failed to record hugepages configuration in the audit log: %v", err)
+			}
 			c.HugepageClient.Enqueue(key)
 		}
 		return hugetlb, err
@@ -8,6 +8,7 @@ import (
 	"github.com/sirupsen/logrus"
 
 	ksmtunedv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/audit"
 	ctlksmtuned "github.com/harvester/node-manager/pkg/generated/controllers/node.harvesterhci.io/v1beta1"
 	"github.com/harvester/node-manager/pkg/ksmtuned"
 	"github.com/harvester/node-manager/pkg/metrics"
@@ -16,6 +17,8 @@ import (
 const (
 	HandlerName     = "harvester-ksmtuned-handler"
 	NodeHandlerName = "harvester-ksmtuned-node-handler"
+
+	kindKsmtuned = "Ksmtuned"
 )
 
 var (
@@ -48,9 +51,10 @@ type Controller struct {
 	Nodes     ctlnode.NodeController
 
 	Ksmtuned *ksmtuned.Ksmtuned
+	Audit    *audit.Recorder
 }
 
-func Register(ctx context.Context, nodeName string, kts ctlksmtuned.KsmtunedController, nodes ctlnode.NodeController) (*Controller, error) {
+func Register(ctx context.Context, nodeName string, kts ctlksmtuned.KsmtunedController, nodes ctlnode.NodeController, recorder *audit.Recorder) (*Controller, error) {
 	k, err := ksmtuned.NewKsmtuned(ctx, nodeName)
 	if err != nil {
 		return nil, err
@@ -65,6 +69,7 @@ func Register(ctx context.Context, nodeName string, kts ctlksmtuned.KsmtunedCont
 		NodeCache:     nodes.Cache(),
 		Nodes:         nodes,
 		Ksmtuned:      k,
+		Audit:         recorder,
 	}
 
 	c.Ksmtuneds.OnChange(ctx, HandlerName, c.OnChange)
@@ -94,17 +99,27 @@ func (c *Controller) OnChange(key string, kt *ksmtunedv1.Ksmtuned) (*ksmtunedv1.
 
 	switch kt.Spec.Run {
 	case ksmtunedv1.Stop:
-		return kt, c.Ksmtuned.Stop()
+		if err := c.Ksmtuned.Stop(); err != nil {
+			return kt, err
+		}
+		c.recordAudit(kt)
+		return kt, nil
 	case ksmtunedv1.Prune:
-		return kt, c.Ksmtuned.Prune()
+		if err := c.Ksmtuned.Prune(); err != nil {
+			return kt, err
+		}
+		c.recordAudit(kt)
+		return kt, nil
 	default:
 		if parameters, ok = modes[kt.Spec.Mode]; !ok {
 			c.Ksmtuned.Apply(kt.Spec.ThresCoef, kt.Spec.KsmtunedParameters)
+			c.recordAudit(kt)
 			return kt, nil
 		}
 	}
 
 	c.Ksmtuned.Apply(kt.Spec.ThresCoef, parameters)
+	c.recordAudit(kt)
 
 	if !reflect.DeepEqual(kt.Spec.KsmtunedParameters, parameters) {
 		newObj := kt.DeepCopy()
@@ -119,7 +134,21 @@ func (c *Controller) OnRemove(_ string, kt *ksmtunedv1.Ksmtuned) (*ksmtunedv1.Ks
 	if kt.Name != c.NodeName {
 		return kt, nil
 	}
-	return kt, c.Ksmtuned.Stop()
+	if err := c.Ksmtuned.Stop(); err != nil {
+		return kt, err
+	}
+	if err := c.Audit.RecordRemoval(kindKsmtuned, kt); err != nil {
+		logrus.Warnf("failed to record the removal of Ksmtuned %s in the audit log: %s", kt.Name, err)
+	}
+	return kt, nil
+}
+
+// recordAudit records the applied spec in the audit log, the parameters of a
+// mode are recorded once they are updated to the spec
+func (c *Controller) recordAudit(kt *ksmtunedv1.Ksmtuned) {
+	if err := c.Audit.RecordSpec(kindKsmtuned, kt, kt.Spec); err != nil {
+		logrus.Warnf("failed to record Ksmtuned %s in the audit log: %s", kt.Name, err)
+	}
 }
 
 func (c *Controller) watchStatus(ctx context.Context, name string) {
@@ -2,19 +2,24 @@ package config
 
 import (
 	"fmt"
-	"os"
 	"slices"
+	"sync"
 
-	"github.com/harvester/go-common/files"
-	"github.com/harvester/node-manager/pkg/utils"
 	"github.com/mudler/yip/pkg/schema"
-	"github.com/sirupsen/logrus"
+
+	"github.com/harvester/node-manager/pkg/oem"
 )
 
 const (
 	// we use `99_settings.yaml` because it needs to be run after `90_custom.yaml`
 	// with elemental works, the later change would override the previous one
 	yipStageInitramfs = "initramfs"
+	// settingsOEMOwner is the prefix of the owners of the NodeConfig stages in
+	// the OEM settings, each section owns its stages. The stages written when
+	// it was the owner of all of them are adopted by the sections.
+	settingsOEMOwner = "nodeconfig"
+	// settingsOEMHistory is the number of backups of the OEM settings kept
+	settingsOEMHistory = 5
 )
 
 // The following would ordinarily be const, but we need to override them in unit tests
@@ -25,6 +30,13 @@ var (
 	settingsOEMPathBackupPath = "/host/oem/99_settings.yaml.bak"
 )
 
+// foreignEdits are the OEM settings files changed outside of the node manager
+// which are not reported yet
+var foreignEdits struct {
+	sync.Mutex
+	paths []string
+}
+
 type NTPConfigTemplate struct {
 	NTPConfigKeyValuePairs map[string]string
 }
@@ -38,88 +50,57 @@ func generateNTPConfigData() string {
 `
 }
 
-func UpdatePersistentOEMSettings(stage schema.Stage) error {
-	_, err := os.Stat(settingsOEMPath)
-	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("stat %s failed: %v", settingsOEMPath, err)
-	}
-
-	settings := utils.GenerateOEMTemplate()
-	doBackup := true
-	if os.IsNotExist(err) {
-		// New file, we can just set the stages to whatever was passed in.
-		settings.Stages = make(map[string][]schema.Stage)
-		settings.Stages[yipStageInitramfs] = []schema.Stage{stage}
-		doBackup = false
-	} else {
-		// Existing file, we need to load it...
-		err = utils.LoadYipConfigToTarget(settingsOEMPath, settings)
-		if err != nil {
-			return fmt.Errorf("load %s to YIP format failed: %v", settingsOEMPath, err)
-		}
-		logrus.Debugf("Loaded settings from file %s, content: %+v", settingsOEMPath, settings)
-		// ...then merge the new stage into whatever stages are already present,
-		// either overwriting or appending as necessary.
-		existingStage := slices.IndexFunc(settings.Stages[yipStageInitramfs], func(s schema.Stage) bool {
-			return s.Name == stage.Name
-		})
-		if existingStage == -1 {
-			settings.Stages[yipStageInitramfs] = append(settings.Stages[yipStageInitramfs], stage)
-		} else {
-			settings.Stages[yipStageInitramfs][existingStage] = stage
-		}
-	}
-
-	return writePersistentOEMSettings(settings, doBackup)
+// settingsOEMStore returns the store of the OEM settings file
+func settingsOEMStore() *oem.Store {
+	return oem.NewStore(settingsOEMPath, settingsOEMPathBackupPath, settingsOEMHistory).Adopt(settingsOEMOwner)
 }
 
-func RemovePersistentOEMSettings(stageName string) error {
-	yipConfig, err := utils.LoadYipConfig(settingsOEMPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return fmt.Errorf("load %s failed: %v", settingsOEMPath, err)
+// recordForeignEdit records the OEM settings file of the result when it was
+// changed outside of the node manager, the store only reports it once
+func recordForeignEdit(path string, result *oem.Result) {
+	if result == nil || !result.ForeignEdit {
+		return
 	}
-	logrus.Debugf("Loaded yipConfig: %+v, %p", yipConfig, yipConfig)
-
-	if _, found := yipConfig.Stages[yipStageInitramfs]; !found {
-		// this moment, we only have `initramfs` stage, so we could remove all OEM settings files.
-		logrus.Infof("No `initramfs` stage found, remove all OEM settings files.")
-		return files.RemoveFiles(settingsOEMPath)
+	foreignEdits.Lock()
+	defer foreignEdits.Unlock()
+	if !slices.Contains(foreignEdits.paths, path) {
+		foreignEdits.paths = append(foreignEdits.paths, path)
 	}
+}
 
-	pos := slices.IndexFunc(yipConfig.Stages[yipStageInitramfs], func(s schema.Stage) bool {
-		return s.Name == stageName
-	})
+// TakeOEMForeignEdits returns the OEM settings files changed outside of the
+// node manager since they were last taken
+func TakeOEMForeignEdits() []string {
+	foreignEdits.Lock()
+	defer foreignEdits.Unlock()
+	paths := foreignEdits.paths
+	foreignEdits.paths = nil
+	return paths
+}
 
-	if pos >= 0 {
-		stages := yipConfig.Stages[yipStageInitramfs]
-		stages = append(stages[:pos], stages[pos+1:]...)
-		if len(stages) == 0 {
-			logrus.Infof("No other stages found, remove all OEM settings files.")
-			return files.RemoveFiles(settingsOEMPath)
-		}
-		yipConfig.Stages[yipStageInitramfs] = stages
+// UpdatePersistentOEMSettings adds or replaces the stage of the owner in the
+// initramfs stages of the OEM settings file
+func UpdatePersistentOEMSettings(owner string, stage schema.Stage) error {
+	result, err := settingsOEMStore().Update(owner, func(tx *oem.Tx) error {
+		return tx.Put(yipStageInitramfs, stage)
+	})
+	if err != nil {
+		return fmt.Errorf("update stage %s of %s failed: %w", stage.Name, settingsOEMPath, err)
 	}
-
-	// we still have other stages, so we need to backup/update OEM settings files
-	return writePersistentOEMSettings(yipConfig, true)
+	recordForeignEdit(settingsOEMPath, result)
+	return nil
 }
 
-func writePersistentOEMSettings(yipConfig *schema.YipConfig, doBackup bool) error {
-	if doBackup {
-		if _, err := files.BackupFile(settingsOEMPath); err != nil {
-			return fmt.Errorf("backup %s failed: %v", settingsOEMPath, err)
-		}
-	}
-	logrus.Infof("Prepare to update new settings to persistent files: %+v", yipConfig)
-	tmpFileName, err := files.GenerateYAMLTempFileWithDir(yipConfig, "settings", oemPath)
+// RemovePersistentOEMSettings removes the stage of the owner from the
+// initramfs stages of the OEM settings file, the file is removed along with
+// its last stage
+func RemovePersistentOEMSettings(owner, stageName string) error {
+	result, err := settingsOEMStore().Update(owner, func(tx *oem.Tx) error {
+		return tx.Delete(yipStageInitramfs, stageName)
+	})
 	if err != nil {
-		return fmt.Errorf("generate temp YAML file failed: %v", err)
-	}
-	if err = os.Rename(tmpFileName, settingsOEMPath); err != nil {
-		return fmt.Errorf("rename temp file to %s failed: %v", settingsOEMPath, err)
+		return fmt.Errorf("remove stage %s of %s failed: %w", stageName, settingsOEMPath, err)
 	}
+	recordForeignEdit(settingsOEMPath, result)
 	return nil
 }
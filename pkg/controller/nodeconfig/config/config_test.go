@@ -1,32 +1,48 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
 	"os"
 	"strconv"
 	"testing"
 
 	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/oem"
 	"github.com/harvester/node-manager/pkg/utils"
 	"github.com/mudler/yip/pkg/schema"
+	ctlnode "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestNTPConfigPersistence(t *testing.T) {
+// setupOEMTest points the OEM settings at a temp dir, the returned dir is the
+// root of the fake host paths
+func setupOEMTest(t *testing.T) string {
+	t.Helper()
 	tmpDir := t.TempDir()
 	oemPath = tmpDir + "/host/oem/"
 	settingsOEMPath = tmpDir + "/host/oem/99_settings.yaml"
 	settingsOEMPathBackupPath = tmpDir + "/host/oem/99_settings.yaml.bak"
-	if os.MkdirAll(oemPath, 0777) != nil {
-		t.Errorf("Unable to create %s", oemPath)
-	}
+	require.Nil(t, os.MkdirAll(oemPath, 0777))
+	return tmpDir
+}
+
+func TestNTPConfigPersistence(t *testing.T) {
+	setupOEMTest(t)
 
 	ntpConfig := v1beta1.NTPConfig{
 		NTPServers: "0.suse.pool.ntp.org 1.suse.pool.ntp.org",
 	}
 
 	// Create config for the first time
-	ntpConfigHandler := NewNTPConfigHandler(nil, nil, "harvester-node-0", &ntpConfig, "")
+	ntpConfigHandler := NewNTPConfigHandler(nil, "harvester-node-0", &ntpConfig, "")
 	err := ntpConfigHandler.UpdateNTPConfigPersistence()
 	assert.Nil(t, err)
 
@@ -89,20 +105,14 @@ func TestNTPConfigPersistence(t *testing.T) {
 }
 
 func TestExtraConfigPersistence(t *testing.T) {
-	tmpDir := t.TempDir()
-	oemPath = tmpDir + "/host/oem/"
-	settingsOEMPath = tmpDir + "/host/oem/99_settings.yaml"
-	settingsOEMPathBackupPath = tmpDir + "/host/oem/99_settings.yaml.bak"
-	if os.MkdirAll(oemPath, 0777) != nil {
-		t.Errorf("Unable to create %s", oemPath)
-	}
+	setupOEMTest(t)
 
 	ntpConfig := v1beta1.NTPConfig{
 		NTPServers: "0.suse.pool.ntp.org 1.suse.pool.ntp.org",
 	}
 
 	// Create config for the first time, with NTP as in TestNTPConfigPersistence()
-	ntpConfigHandler := NewNTPConfigHandler(nil, nil, "harvester-node-0", &ntpConfig, "")
+	ntpConfigHandler := NewNTPConfigHandler(nil, "harvester-node-0", &ntpConfig, "")
 	err := ntpConfigHandler.UpdateNTPConfigPersistence()
 	assert.Nil(t, err)
 
@@ -118,7 +128,7 @@ func TestExtraConfigPersistence(t *testing.T) {
 	extraStage := schema.Stage{
 		Name: "extra",
 	}
-	err = UpdatePersistentOEMSettings(extraStage)
+	err = UpdatePersistentOEMSettings("extra", extraStage)
 	assert.Nil(t, err)
 
 	// Backup file should exist
@@ -145,7 +155,7 @@ func TestExtraConfigPersistence(t *testing.T) {
 		Name:     "extra",
 		Commands: []string{"/bin/true"},
 	}
-	err = UpdatePersistentOEMSettings(newExtraStage)
+	err = UpdatePersistentOEMSettings("extra", newExtraStage)
 	assert.Nil(t, err)
 
 	// Should be able to load config and see the updated commands in the extra stage,
@@ -173,7 +183,7 @@ func TestExtraConfigPersistence(t *testing.T) {
 	assert.Equal(t, "extra", yipConfig.Stages[yipStageInitramfs][0].Name)
 
 	// Remove the extra stage
-	err = RemovePersistentOEMSettings("extra")
+	err = RemovePersistentOEMSettings("extra", "extra")
 	assert.Nil(t, err)
 
 	// Settings file should be gone
@@ -186,13 +196,7 @@ func TestExtraConfigPersistence(t *testing.T) {
 }
 
 func TestLonghornConfigPersistence(t *testing.T) {
-	tmpDir := t.TempDir()
-	oemPath = tmpDir + "/host/oem"
-	settingsOEMPath = tmpDir + "/host/oem/99_settings.yaml"
-	settingsOEMPathBackupPath = tmpDir + "/host/oem/99_settings.yaml.bak"
-	if os.MkdirAll(oemPath, 0777) != nil {
-		t.Errorf("Unable to create %s", oemPath)
-	}
+	setupOEMTest(t)
 
 	testLonghornConfigPersistence := func(hugepagesToAllocate uint64) {
 		err := updateLonghornConfigPersistence(hugepagesToAllocate)
@@ -229,3 +233,275 @@ func TestLonghornConfigPersistence(t *testing.T) {
 	testLonghornConfigPersistence(512)
 	testLonghornConfigPersistence(0)
 }
+
+func TestOEMSettingsOwners(t *testing.T) {
+	setupOEMTest(t)
+
+	// the stages written by the single NodeConfig owner are adopted
+	_, err := settingsOEMStore().Update(settingsOEMOwner, func(tx *oem.Tx) error {
+		return tx.Put(yipStageInitramfs, schema.Stage{Name: sysctlStageName})
+	})
+	require.Nil(t, err)
+	assert.Nil(t, UpdatePersistentOEMSettings(sysctlOEMOwner, schema.Stage{Name: sysctlStageName, Commands: []string{"sysctl --system"}}))
+
+	// the stage could not be changed by the other sections
+	err = RemovePersistentOEMSettings(dnsOEMOwner, sysctlStageName)
+	assert.True(t, errors.Is(err, oem.ErrStageOwned))
+
+	// the foreign edit is reported once
+	assert.Empty(t, TakeOEMForeignEdits())
+	raw, err := os.ReadFile(settingsOEMPath)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(settingsOEMPath, append(raw, []byte("    boot:\n        - name: Custom\n")...), 0644))
+	assert.Nil(t, UpdatePersistentOEMSettings(dnsOEMOwner, schema.Stage{Name: dnsStageName}))
+	assert.Equal(t, []string{settingsOEMPath}, TakeOEMForeignEdits())
+	assert.Empty(t, TakeOEMForeignEdits())
+}
+
+func TestReGenerateNTPConfig(t *testing.T) {
+	// legacy string is de-duplicated and folded into the server list
+	ntpConfig := reGenerateNTPConfig(&v1beta1.NTPConfig{
+		NTPServers: "0.suse.pool.ntp.org  1.suse.pool.ntp.org 0.suse.pool.ntp.org",
+	})
+	assert.Equal(t, "0.suse.pool.ntp.org 1.suse.pool.ntp.org", ntpConfig.NTPServers)
+	assert.Equal(t, []v1beta1.NTPServer{{Address: "0.suse.pool.ntp.org"}, {Address: "1.suse.pool.ntp.org"}}, ntpConfig.Servers)
+
+	// structured list takes precedence and keeps the per-server options
+	ntpConfig = reGenerateNTPConfig(&v1beta1.NTPConfig{
+		Servers: []v1beta1.NTPServer{
+			{Address: "time.example.com", Options: []string{"iburst"}},
+			{Address: "10.0.0.1"},
+		},
+	})
+	assert.Equal(t, "time.example.com 10.0.0.1", ntpConfig.NTPServers)
+	assert.Equal(t, []string{"iburst"}, ntpConfig.Servers[0].Options)
+
+	// missing config is treated as empty
+	ntpConfig = reGenerateNTPConfig(nil)
+	assert.Equal(t, "", ntpConfig.NTPServers)
+}
+
+func TestChronyNTPConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	chronyConfigPath = tmpDir + "/harvester-ntp.conf"
+
+	ntpConfig := v1beta1.NTPConfig{
+		Backend: v1beta1.NTPBackendChrony,
+		Servers: []v1beta1.NTPServer{
+			{Address: "time.cloudflare.com", Options: []string{"iburst"}, NTS: true},
+			{Address: "10.0.0.1", Options: []string{"iburst", "prefer"}},
+		},
+	}
+	ntpConfigHandler := NewNTPConfigHandler(nil, "harvester-node-0", &ntpConfig, "")
+
+	expected := `# Generated by harvester-node-manager, do not edit.
+server time.cloudflare.com iburst nts
+server 10.0.0.1 iburst prefer
+`
+	err := ntpConfigHandler.updateChronyConfig()
+	assert.Nil(t, err)
+	content, err := os.ReadFile(chronyConfigPath)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, string(content))
+
+	// persistence writes the same drop-in and switches the services
+	stage, err := ntpConfigHandler.generateNTPStages()
+	assert.Nil(t, err)
+	assert.Equal(t, NTPName, stage.Name)
+	assert.Equal(t, 1, len(stage.Files))
+	assert.Equal(t, "/etc/chrony.d/harvester-ntp.conf", stage.Files[0].Path)
+	assert.Equal(t, expected, stage.Files[0].Content)
+	assert.Equal(t, []string{"chronyd"}, stage.Systemctl.Enable)
+	assert.Equal(t, []string{"systemd-timesyncd"}, stage.Systemctl.Disable)
+	assert.Empty(t, stage.TimeSyncd)
+
+	// switching back to timesyncd removes the drop-in, and chronyd is no
+	// longer started on boot
+	ntpConfigHandler = NewNTPConfigHandler(nil, "harvester-node-0", &v1beta1.NTPConfig{NTPServers: "0.suse.pool.ntp.org"}, "")
+	stage, err = ntpConfigHandler.generateNTPStages()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"NTP": "0.suse.pool.ntp.org"}, stage.TimeSyncd)
+	assert.Equal(t, []string{"chronyd"}, stage.Systemctl.Disable)
+	removed, err := removeChronyConfig()
+	assert.Nil(t, err)
+	assert.True(t, removed)
+	_, err = os.Stat(chronyConfigPath)
+	assert.True(t, os.IsNotExist(err))
+	removed, err = removeChronyConfig()
+	assert.Nil(t, err)
+	assert.False(t, removed)
+}
+
+func TestNTPConfigChanged(t *testing.T) {
+	timesyncd := reGenerateNTPConfig(&v1beta1.NTPConfig{NTPServers: "0.suse.pool.ntp.org"})
+	chrony := reGenerateNTPConfig(&v1beta1.NTPConfig{
+		Backend: v1beta1.NTPBackendChrony,
+		Servers: []v1beta1.NTPServer{{Address: "0.suse.pool.ntp.org", NTS: true}},
+	})
+
+	// annotations written before the backend was introduced are timesyncd
+	assert.False(t, ntpConfigChanged(&v1beta1.AppliedConfigAnnotation{NTPServers: "0.suse.pool.ntp.org"}, timesyncd))
+	assert.True(t, ntpConfigChanged(&v1beta1.AppliedConfigAnnotation{NTPServers: "1.suse.pool.ntp.org"}, timesyncd))
+	assert.True(t, ntpConfigChanged(&v1beta1.AppliedConfigAnnotation{NTPServers: "0.suse.pool.ntp.org"}, chrony))
+
+	// per-server settings only matter for chrony
+	assert.False(t, ntpConfigChanged(&v1beta1.AppliedConfigAnnotation{
+		NTPServers:    "0.suse.pool.ntp.org",
+		NTPBackend:    v1beta1.NTPBackendChrony,
+		NTPServerList: []v1beta1.NTPServer{{Address: "0.suse.pool.ntp.org", NTS: true}},
+	}, chrony))
+	assert.True(t, ntpConfigChanged(&v1beta1.AppliedConfigAnnotation{
+		NTPServers:    "0.suse.pool.ntp.org",
+		NTPBackend:    v1beta1.NTPBackendChrony,
+		NTPServerList: []v1beta1.NTPServer{{Address: "0.suse.pool.ntp.org"}},
+	}, chrony))
+}
+
+func TestLonghornConditions(t *testing.T) {
+	hugepagesPath = t.TempDir() + "/nr_hugepages"
+	newNode := func(capacity string) *corev1.Node {
+		return &corev1.Node{
+			Status: corev1.NodeStatus{
+				Capacity: corev1.ResourceList{
+					corev1.ResourceHugePagesPrefix + "2Mi": resource.MustParse(capacity),
+				},
+			},
+		}
+	}
+	conditionStatus := func(conds []metav1.Condition) map[v1beta1.ConditionTypeNodeConfig]metav1.ConditionStatus {
+		status := make(map[v1beta1.ConditionTypeNodeConfig]metav1.ConditionStatus, len(conds))
+		for _, cond := range conds {
+			assert.Equal(t, int64(3), cond.ObservedGeneration)
+			status[v1beta1.ConditionTypeNodeConfig(cond.Type)] = cond.Status
+		}
+		return status
+	}
+	enabled := &v1beta1.LonghornConfig{EnableV2DataEngine: true, HugepagesToAllocate: 1024}
+
+	// nr_hugepages can not be read
+	conds := NewLonghornConditions(3, enabled, newNode("0"), nil)
+	assert.Equal(t, map[v1beta1.ConditionTypeNodeConfig]metav1.ConditionStatus{
+		v1beta1.LonghornV2Ready:       metav1.ConditionFalse,
+		v1beta1.HugepagesAllocated:    metav1.ConditionUnknown,
+		v1beta1.KubeletRestartPending: metav1.ConditionUnknown,
+	}, conditionStatus(conds))
+
+	assert.Nil(t, setNrHugepages(1024))
+
+	// hugepages are allocated, but the kubelet is not restarted yet
+	conds = NewLonghornConditions(3, enabled, newNode("0"), nil)
+	assert.Equal(t, map[v1beta1.ConditionTypeNodeConfig]metav1.ConditionStatus{
+		v1beta1.LonghornV2Ready:       metav1.ConditionFalse,
+		v1beta1.HugepagesAllocated:    metav1.ConditionTrue,
+		v1beta1.KubeletRestartPending: metav1.ConditionTrue,
+	}, conditionStatus(conds))
+	assert.Equal(t, "KubeletRestartPending", conds[0].Reason)
+
+	conds = NewLonghornConditions(3, enabled, newNode("2Gi"), nil)
+	assert.Equal(t, map[v1beta1.ConditionTypeNodeConfig]metav1.ConditionStatus{
+		v1beta1.LonghornV2Ready:       metav1.ConditionTrue,
+		v1beta1.HugepagesAllocated:    metav1.ConditionTrue,
+		v1beta1.KubeletRestartPending: metav1.ConditionFalse,
+	}, conditionStatus(conds))
+
+	// the failure is reported in LonghornV2Ready
+	conds = NewLonghornConditions(3, enabled, newNode("2Gi"), errors.New("modprobe failed"))
+	assert.Equal(t, metav1.ConditionFalse, conds[0].Status)
+	assert.Equal(t, "modprobe failed", conds[0].Message)
+
+	// not enough hugepages
+	conds = NewLonghornConditions(3, &v1beta1.LonghornConfig{EnableV2DataEngine: true, HugepagesToAllocate: 2048}, newNode("2Gi"), nil)
+	assert.Equal(t, map[v1beta1.ConditionTypeNodeConfig]metav1.ConditionStatus{
+		v1beta1.LonghornV2Ready:       metav1.ConditionFalse,
+		v1beta1.HugepagesAllocated:    metav1.ConditionFalse,
+		v1beta1.KubeletRestartPending: metav1.ConditionFalse,
+	}, conditionStatus(conds))
+	assert.Equal(t, "InsufficientHugepages", conds[0].Reason)
+
+	// disabled
+	assert.Nil(t, setNrHugepages(0))
+	conds = NewLonghornConditions(3, nil, newNode("0"), nil)
+	assert.Equal(t, map[v1beta1.ConditionTypeNodeConfig]metav1.ConditionStatus{
+		v1beta1.LonghornV2Ready:       metav1.ConditionFalse,
+		v1beta1.HugepagesAllocated:    metav1.ConditionFalse,
+		v1beta1.KubeletRestartPending: metav1.ConditionFalse,
+	}, conditionStatus(conds))
+	assert.Equal(t, "V2DataEngineDisabled", conds[0].Reason)
+}
+
+// fakeNodes applies the JSON merge patches of the annotations to the node, the
+// other methods are not used
+type fakeNodes struct {
+	ctlnode.NodeController
+	node *corev1.Node
+	// beforePatch runs once before the next patch, like a concurrent writer
+	beforePatch func(node *corev1.Node)
+}
+
+func (f *fakeNodes) Get(string, metav1.GetOptions) (*corev1.Node, error) {
+	return f.node.DeepCopy(), nil
+}
+
+func (f *fakeNodes) Patch(name string, pt types.PatchType, data []byte, _ ...string) (*corev1.Node, error) {
+	if beforePatch := f.beforePatch; beforePatch != nil {
+		f.beforePatch = nil
+		beforePatch(f.node)
+		f.bumpResourceVersion()
+	}
+	if pt != types.MergePatchType {
+		return nil, errors.New("unexpected patch type")
+	}
+	patch := struct {
+		Metadata struct {
+			ResourceVersion string             `json:"resourceVersion"`
+			Annotations     map[string]*string `json:"annotations"`
+		} `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, err
+	}
+	if rv := patch.Metadata.ResourceVersion; rv != "" && rv != f.node.ResourceVersion {
+		return nil, apierrors.NewConflict(corev1.Resource("nodes"), name, errors.New("the object has been modified"))
+	}
+	for key, value := range patch.Metadata.Annotations {
+		if value == nil {
+			delete(f.node.Annotations, key)
+		} else {
+			f.node.Annotations[key] = *value
+		}
+	}
+	f.bumpResourceVersion()
+	return f.node.DeepCopy(), nil
+}
+
+func (f *fakeNodes) bumpResourceVersion() {
+	rv, _ := strconv.Atoi(f.node.ResourceVersion)
+	f.node.ResourceVersion = strconv.Itoa(rv + 1)
+}
+
+func TestUpdateNodeNTPAnnotation(t *testing.T) {
+	nodes := &fakeNodes{node: &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:            "harvester-node-0",
+		ResourceVersion: "1",
+		Annotations:     map[string]string{},
+	}}}
+	ntpConfig := &v1beta1.NTPConfig{NTPServers: "0.suse.pool.ntp.org"}
+	handler := NewNTPConfigHandler(nodes, "harvester-node-0", ntpConfig, "")
+
+	// the annotation is created by the monitor
+	assert.Nil(t, handler.UpdateNodeNTPAnnotation())
+	assert.NotContains(t, nodes.node.Annotations, utils.AnnotationNTP)
+
+	nodes.node.Annotations[utils.AnnotationNTP] = `{"ntpSyncStatus":"unsynced","currentNtpServers":"","authenticated":false}`
+	// the monitor updates the sync status concurrently, it is not lost
+	nodes.beforePatch = func(node *corev1.Node) {
+		node.Annotations[utils.AnnotationNTP] = `{"ntpSyncStatus":"synced","currentNtpServers":"","currentNtpSource":"0.suse.pool.ntp.org","authenticated":false}`
+	}
+	assert.Nil(t, handler.UpdateNodeNTPAnnotation())
+	assert.Equal(t, `{"ntpSyncStatus":"synced","currentNtpServers":"0.suse.pool.ntp.org","currentNtpSource":"0.suse.pool.ntp.org","authenticated":false}`, nodes.node.Annotations[utils.AnnotationNTP])
+
+	// unchanged, nothing is patched
+	rv := nodes.node.ResourceVersion
+	assert.Nil(t, handler.UpdateNodeNTPAnnotation())
+	assert.Equal(t, rv, nodes.node.ResourceVersion)
+}
@@ -0,0 +1,369 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/harvester/go-common/files"
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+const (
+	registriesStageName        = "Runtime RKE2 Registries"
+	containerRuntimeOEMOwner   = settingsOEMOwner + "/container-runtime"
+	proxyStageNamePrefix       = "Runtime RKE2 Proxy"
+	hostRegistriesPath         = "/etc/rancher/rke2/registries.yaml"
+	containerRuntimeOriginName = "container-runtime.origin"
+)
+
+var proxyEnvKeys = []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"}
+
+// The following would ordinarily be const, but we need to override them in unit tests
+var (
+	registriesPath = "/host" + hostRegistriesPath
+	// rke2EnvPaths are the environment files of the rke2-server and
+	// rke2-agent services, the host paths are without the /host prefix
+	rke2EnvPaths = map[string]string{
+		"/etc/default/rke2-server": "/host/etc/default/rke2-server",
+		"/etc/default/rke2-agent":  "/host/etc/default/rke2-agent",
+	}
+	// containerRuntimeOriginPath keeps the config before we changed it, so it
+	// could be restored when it is removed from the NodeConfig.
+	containerRuntimeOriginPath = "/host/oem/" + containerRuntimeOriginName
+	restartContainerRuntime    = restartKubelet
+)
+
+type containerRuntimeOrigin struct {
+	// Registries is the original registries.yaml, it is nil when the file
+	// did not exist
+	Registries        *string `json:"registries,omitempty"`
+	RegistriesManaged bool    `json:"registriesManaged,omitempty"`
+	// Proxy is the original proxy variables of each environment file
+	Proxy map[string]map[string]string `json:"proxy,omitempty"`
+}
+
+// registries is the format of the rke2 registries.yaml
+type registries struct {
+	Mirrors map[string]registryMirror `yaml:"mirrors,omitempty"`
+	Configs map[string]registryConfig `yaml:"configs,omitempty"`
+}
+
+type registryMirror struct {
+	Endpoint []string          `yaml:"endpoint,omitempty"`
+	Rewrite  map[string]string `yaml:"rewrite,omitempty"`
+}
+
+type registryConfig struct {
+	TLS *registryTLS `yaml:"tls,omitempty"`
+}
+
+type registryTLS struct {
+	CAFile             string `yaml:"ca_file,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+}
+
+func loadContainerRuntimeOrigin() (*containerRuntimeOrigin, error) {
+	origin := &containerRuntimeOrigin{}
+	data, err := os.ReadFile(containerRuntimeOriginPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return origin, nil
+		}
+		return nil, fmt.Errorf("read %s failed: %v", containerRuntimeOriginPath, err)
+	}
+	if err := json.Unmarshal(data, origin); err != nil {
+		return nil, fmt.Errorf("unmarshal %s failed: %v", containerRuntimeOriginPath, err)
+	}
+	return origin, nil
+}
+
+func saveContainerRuntimeOrigin(origin *containerRuntimeOrigin) error {
+	if !origin.RegistriesManaged && len(origin.Proxy) == 0 {
+		if err := os.Remove(containerRuntimeOriginPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s failed: %v", containerRuntimeOriginPath, err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(origin)
+	if err != nil {
+		return fmt.Errorf("marshal container runtime origin failed: %v", err)
+	}
+	tmpFileName, err := files.GenerateTempFileWithDir(data, containerRuntimeOriginName, filepath.Dir(containerRuntimeOriginPath))
+	if err != nil {
+		return fmt.Errorf("generate temp container runtime origin failed: %v", err)
+	}
+	return os.Rename(tmpFileName, containerRuntimeOriginPath)
+}
+
+func generateRegistries(cfg *nodeconfigv1.RegistriesConfig) *registries {
+	r := &registries{}
+	for name, mirror := range cfg.Mirrors {
+		if r.Mirrors == nil {
+			r.Mirrors = make(map[string]registryMirror)
+		}
+		r.Mirrors[name] = registryMirror{Endpoint: mirror.Endpoints, Rewrite: mirror.Rewrite}
+	}
+	for host, config := range cfg.Configs {
+		if r.Configs == nil {
+			r.Configs = make(map[string]registryConfig)
+		}
+		r.Configs[host] = registryConfig{TLS: &registryTLS{CAFile: config.CAFile, InsecureSkipVerify: config.InsecureSkipVerify}}
+	}
+	return r
+}
+
+func readRegistries() (*string, error) {
+	data, err := os.ReadFile(registriesPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read %s failed: %v", registriesPath, err)
+	}
+	content := string(data)
+	return &content, nil
+}
+
+// writeRegistries writes registries.yaml, it is removed when content is nil.
+// It returns the written content and whether the file is changed.
+func writeRegistries(obj *registries, content *string) (string, bool, error) {
+	current, err := readRegistries()
+	if err != nil {
+		return "", false, err
+	}
+
+	if obj == nil && content == nil {
+		if current == nil {
+			return "", false, nil
+		}
+		if err := os.Remove(registriesPath); err != nil {
+			return "", false, fmt.Errorf("remove %s failed: %v", registriesPath, err)
+		}
+		return "", true, nil
+	}
+
+	var tmpFileName string
+	if obj != nil {
+		tmpFileName, err = files.GenerateYAMLTempFileFullOptions(obj, "registries", filepath.Dir(registriesPath), 0600)
+	} else {
+		tmpFileName, err = files.GenerateTempFileWithDir([]byte(*content), "registries", filepath.Dir(registriesPath))
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("generate temp registries.yaml failed: %v", err)
+	}
+	data, err := os.ReadFile(tmpFileName)
+	if err != nil {
+		_ = os.Remove(tmpFileName)
+		return "", false, fmt.Errorf("read temp registries.yaml failed: %v", err)
+	}
+	if current != nil && *current == string(data) {
+		_ = os.Remove(tmpFileName)
+		return string(data), false, nil
+	}
+	if err := os.Rename(tmpFileName, registriesPath); err != nil {
+		return "", false, fmt.Errorf("rename temp registries.yaml failed: %v", err)
+	}
+	return string(data), true, nil
+}
+
+func generateProxyEnv(proxy *nodeconfigv1.ProxyConfig) map[string]string {
+	env := make(map[string]string)
+	for key, value := range map[string]string{
+		"HTTP_PROXY":  proxy.HTTPProxy,
+		"HTTPS_PROXY": proxy.HTTPSProxy,
+		"NO_PROXY":    proxy.NoProxy,
+	} {
+		if value != "" {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+// applyRegistries manages registries.yaml, the original file is restored once
+// the registries are removed from the NodeConfig.
+func applyRegistries(cfg *nodeconfigv1.RegistriesConfig, origin *containerRuntimeOrigin) (bool, error) {
+	if cfg == nil {
+		if !origin.RegistriesManaged {
+			return false, RemovePersistentOEMSettings(containerRuntimeOEMOwner, registriesStageName)
+		}
+		logrus.Infof("Restore %s", hostRegistriesPath)
+		_, changed, err := writeRegistries(nil, origin.Registries)
+		if err != nil {
+			return changed, err
+		}
+		origin.Registries = nil
+		origin.RegistriesManaged = false
+		return changed, RemovePersistentOEMSettings(containerRuntimeOEMOwner, registriesStageName)
+	}
+
+	if !origin.RegistriesManaged {
+		current, err := readRegistries()
+		if err != nil {
+			return false, err
+		}
+		origin.Registries = current
+		origin.RegistriesManaged = true
+		if err := saveContainerRuntimeOrigin(origin); err != nil {
+			return false, err
+		}
+	}
+
+	content, changed, err := writeRegistries(generateRegistries(cfg), nil)
+	if err != nil {
+		return false, err
+	}
+	if changed {
+		logrus.Infof("Updated %s", hostRegistriesPath)
+	}
+	return changed, UpdatePersistentOEMSettings(containerRuntimeOEMOwner, schema.Stage{
+		Name: registriesStageName,
+		Files: []schema.File{
+			{
+				Path:        hostRegistriesPath,
+				Permissions: 0600,
+				Content:     content,
+			},
+		},
+	})
+}
+
+// applyProxy manages the proxy variables of the rke2 environment files, the
+// original variables are restored once the proxy is removed from the
+// NodeConfig.
+func applyProxy(cfg *nodeconfigv1.ProxyConfig, origin *containerRuntimeOrigin) (bool, error) {
+	changed := false
+	for _, hostPath := range slices.Sorted(maps.Keys(rke2EnvPaths)) {
+		path := rke2EnvPaths[hostPath]
+		stageName := fmt.Sprintf("%s %s", proxyStageNamePrefix, filepath.Base(hostPath))
+		current, err := utils.ReadEnvFile(path, proxyEnvKeys)
+		if err != nil {
+			return changed, err
+		}
+
+		if cfg == nil {
+			originEnv, found := origin.Proxy[hostPath]
+			if !found {
+				if err := RemovePersistentOEMSettings(containerRuntimeOEMOwner, stageName); err != nil {
+					return changed, err
+				}
+				continue
+			}
+			if !maps.Equal(current, originEnv) {
+				logrus.Infof("Restore proxy of %s", hostPath)
+				if err := utils.UpdateEnvFile(path, originEnv, proxyEnvKeys); err != nil {
+					return changed, err
+				}
+				changed = true
+			}
+			delete(origin.Proxy, hostPath)
+			if err := RemovePersistentOEMSettings(containerRuntimeOEMOwner, stageName); err != nil {
+				return changed, err
+			}
+			continue
+		}
+
+		if _, found := origin.Proxy[hostPath]; !found {
+			if origin.Proxy == nil {
+				origin.Proxy = make(map[string]map[string]string)
+			}
+			origin.Proxy[hostPath] = current
+			if err := saveContainerRuntimeOrigin(origin); err != nil {
+				return changed, err
+			}
+		}
+		wanted := generateProxyEnv(cfg)
+		if !maps.Equal(current, wanted) {
+			logrus.Infof("Update proxy of %s", hostPath)
+			if err := utils.UpdateEnvFile(path, wanted, proxyEnvKeys); err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+		if err := UpdatePersistentOEMSettings(containerRuntimeOEMOwner, schema.Stage{
+			Name:            stageName,
+			EnvironmentFile: hostPath,
+			Environment:     wanted,
+		}); err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+// ApplyContainerRuntime writes registries.yaml and the proxy variables of the
+// rke2 services, then persists them. It returns whether any file is changed,
+// rke2 is not restarted here.
+func ApplyContainerRuntime(cfg *nodeconfigv1.ContainerRuntimeConfig) (bool, error) {
+	if cfg == nil {
+		cfg = &nodeconfigv1.ContainerRuntimeConfig{}
+	}
+	origin, err := loadContainerRuntimeOrigin()
+	if err != nil {
+		return false, err
+	}
+
+	registriesChanged, err := applyRegistries(cfg.Registries, origin)
+	if err != nil {
+		return registriesChanged, fmt.Errorf("apply registries failed: %v", err)
+	}
+	proxyChanged, err := applyProxy(cfg.Proxy, origin)
+	if err != nil {
+		return registriesChanged || proxyChanged, fmt.Errorf("apply proxy failed: %v", err)
+	}
+	return registriesChanged || proxyChanged, saveContainerRuntimeOrigin(origin)
+}
+
+// RestartContainerRuntime restarts rke2, and containerd with it, to pick up
+// the container runtime config.
+func RestartContainerRuntime() error {
+	logrus.Infof("Restart rke2 to apply the container runtime config")
+	return restartContainerRuntime()
+}
+
+// RemoveContainerRuntime restores the container runtime config changed by the
+// NodeConfig, rke2 is restarted when any file is restored.
+func RemoveContainerRuntime() error {
+	changed, err := ApplyContainerRuntime(nil)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+	return RestartContainerRuntime()
+}
+
+// ContainerRuntimePaths are the host files written by the container runtime
+// config
+func ContainerRuntimePaths() []string {
+	return append([]string{registriesPath, containerRuntimeOriginPath}, slices.Sorted(maps.Values(rke2EnvPaths))...)
+}
+
+// NewContainerRuntimeAppliedCondition returns the ContainerRuntimeApplied
+// condition, err is the failure of the last attempt to apply the config.
+func NewContainerRuntimeAppliedCondition(generation int64, err error) metav1.Condition {
+	cond := metav1.Condition{
+		Type:               string(nodeconfigv1.ContainerRuntimeApplied),
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             "ContainerRuntimeApplied",
+		Message:            "container runtime config is applied",
+	}
+
+	if err != nil {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "ContainerRuntimeFailed"
+		cond.Message = err.Error()
+	}
+	return cond
+}
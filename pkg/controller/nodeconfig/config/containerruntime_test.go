@@ -0,0 +1,92 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+func TestApplyContainerRuntime(t *testing.T) {
+	tmpDir := setupOEMTest(t)
+	containerRuntimeOriginPath = tmpDir + "/host/oem/" + containerRuntimeOriginName
+	registriesPath = tmpDir + "/registries.yaml"
+	rke2EnvPaths = map[string]string{
+		"/etc/default/rke2-server": tmpDir + "/rke2-server",
+		"/etc/default/rke2-agent":  tmpDir + "/rke2-agent",
+	}
+	assert.Nil(t, os.WriteFile(tmpDir+"/rke2-server", []byte("RKE2_CGROUP_ROOT=\"/\"\nHTTP_PROXY=\"http://old.example.com:3128\"\n"), 0644))
+
+	restarts := 0
+	restartContainerRuntime = func() error {
+		restarts++
+		return nil
+	}
+
+	// not managed
+	changed, err := ApplyContainerRuntime(nil)
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	assert.Nil(t, RemoveContainerRuntime())
+	assert.Equal(t, 0, restarts)
+
+	cfg := &v1beta1.ContainerRuntimeConfig{
+		Proxy: &v1beta1.ProxyConfig{
+			HTTPProxy: "http://proxy.example.com:3128",
+			NoProxy:   "localhost,127.0.0.1",
+		},
+		Registries: &v1beta1.RegistriesConfig{
+			Mirrors: map[string]v1beta1.RegistryMirror{
+				"docker.io": {Endpoints: []string{"https://mirror.example.com:5000"}},
+			},
+			Configs: map[string]v1beta1.RegistryConfig{
+				"mirror.example.com:5000": {InsecureSkipVerify: true},
+			},
+		},
+	}
+	changed, err = ApplyContainerRuntime(cfg)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	raw, err := os.ReadFile(registriesPath)
+	assert.Nil(t, err)
+	assert.Contains(t, string(raw), "https://mirror.example.com:5000")
+	assert.Contains(t, string(raw), "insecure_skip_verify: true")
+	server, err := utils.ReadEnvFile(tmpDir+"/rke2-server", proxyEnvKeys)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"HTTP_PROXY": "http://proxy.example.com:3128", "NO_PROXY": "localhost,127.0.0.1"}, server)
+	agent, err := utils.ReadEnvFile(tmpDir+"/rke2-agent", proxyEnvKeys)
+	assert.Nil(t, err)
+	assert.Equal(t, server, agent)
+	raw, err = os.ReadFile(tmpDir + "/rke2-server")
+	assert.Nil(t, err)
+	assert.Contains(t, string(raw), "RKE2_CGROUP_ROOT=\"/\"\n")
+
+	yipConfig, err := utils.LoadYipConfig(settingsOEMPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(yipConfig.Stages[yipStageInitramfs]))
+	assert.Equal(t, registriesStageName, yipConfig.Stages[yipStageInitramfs][0].Name)
+	assert.Equal(t, hostRegistriesPath, yipConfig.Stages[yipStageInitramfs][0].Files[0].Path)
+
+	// applying the same config again changes nothing
+	changed, err = ApplyContainerRuntime(cfg)
+	assert.Nil(t, err)
+	assert.False(t, changed)
+
+	assert.Nil(t, RemoveContainerRuntime())
+	assert.Equal(t, 1, restarts)
+	_, err = os.Stat(registriesPath)
+	assert.True(t, os.IsNotExist(err))
+	raw, err = os.ReadFile(tmpDir + "/rke2-server")
+	assert.Nil(t, err)
+	assert.Equal(t, "RKE2_CGROUP_ROOT=\"/\"\nHTTP_PROXY=\"http://old.example.com:3128\"\n", string(raw))
+	agent, err = utils.ReadEnvFile(tmpDir+"/rke2-agent", proxyEnvKeys)
+	assert.Nil(t, err)
+	assert.Empty(t, agent)
+	_, err = os.Stat(containerRuntimeOriginPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(settingsOEMPath)
+	assert.True(t, os.IsNotExist(err))
+}
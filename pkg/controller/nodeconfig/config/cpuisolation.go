@@ -0,0 +1,422 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/harvester/go-common/files"
+	"github.com/harvester/go-common/sys"
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+const (
+	cpuIsolationStageName  = "Runtime CPU Isolation"
+	cpuIsolationOEMOwner   = settingsOEMOwner + "/cpu-isolation"
+	cpuIsolationOriginName = "cpu-isolation.origin"
+	hostIRQBalancePath     = "/etc/sysconfig/irqbalance"
+	irqBalanceBannedCPUs   = "IRQBALANCE_BANNED_CPULIST"
+	irqDefaultAffinity     = "default_smp_affinity"
+)
+
+// The following would ordinarily be const, but we need to override them in unit tests
+var (
+	procIRQPath    = "/proc/irq"
+	irqBalancePath = "/host" + hostIRQBalancePath
+	// cpuIsolationOriginPath keeps the IRQ affinities and the irqbalance
+	// config before we changed them, so they could be restored when the
+	// cpuIsolation config is removed from the NodeConfig.
+	cpuIsolationOriginPath = "/host/oem/" + cpuIsolationOriginName
+	restartIRQBalance      = func() error {
+		return sys.TryRestartService("irqbalance.service")
+	}
+)
+
+type cpuIsolationOrigin struct {
+	// IRQAffinity is the original affinity of each IRQ, and the default
+	// affinity keyed by default_smp_affinity
+	IRQAffinity map[string]string `json:"irqAffinity,omitempty"`
+	// IRQBalance is the original irqbalance config, it is only valid when
+	// IRQBalanceManaged is true
+	IRQBalance        map[string]string `json:"irqBalance,omitempty"`
+	IRQBalanceManaged bool              `json:"irqBalanceManaged,omitempty"`
+}
+
+type cpuIsolationCPUs struct {
+	online   []int
+	reserved []int
+	isolated []int
+}
+
+func getCPUIsolationCPUs(cfg *nodeconfigv1.CPUIsolationConfig) (*cpuIsolationCPUs, error) {
+	online, err := readCPUFile("online")
+	if err != nil {
+		return nil, err
+	}
+	cpus := &cpuIsolationCPUs{}
+	if cpus.online, err = utils.ParseCPUList(online); err != nil {
+		return nil, err
+	}
+	if cpus.reserved, err = utils.ParseCPUList(cfg.ReservedCPUs); err != nil {
+		return nil, err
+	}
+	if cpus.isolated, err = utils.ParseCPUList(cfg.IsolatedCPUs); err != nil {
+		return nil, err
+	}
+	for _, cpu := range slices.Concat(cpus.reserved, cpus.isolated) {
+		if !slices.Contains(cpus.online, cpu) {
+			return nil, fmt.Errorf("cpu %d is not online", cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// CPUIsolationKernelArgs returns the kernel args which isolate the CPUs, they
+// are managed together with the kernel args of the spec.
+func CPUIsolationKernelArgs(cfg *nodeconfigv1.CPUIsolationConfig) []string {
+	if cfg == nil {
+		return nil
+	}
+	reserved, err := utils.ParseCPUList(cfg.ReservedCPUs)
+	if err != nil || len(reserved) == 0 {
+		return nil
+	}
+	args := []string{"irqaffinity=" + utils.FormatCPUList(reserved)}
+
+	isolated, err := utils.ParseCPUList(cfg.IsolatedCPUs)
+	if err != nil || len(isolated) == 0 {
+		return args
+	}
+	isolatedList := utils.FormatCPUList(isolated)
+	return append(args,
+		"isolcpus=managed_irq,domain,"+isolatedList,
+		"nohz_full="+isolatedList,
+		"rcu_nocbs="+isolatedList,
+	)
+}
+
+func loadCPUIsolationOrigin() (*cpuIsolationOrigin, error) {
+	origin := &cpuIsolationOrigin{}
+	data, err := os.ReadFile(cpuIsolationOriginPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return origin, nil
+		}
+		return nil, fmt.Errorf("read %s failed: %v", cpuIsolationOriginPath, err)
+	}
+	if err := json.Unmarshal(data, origin); err != nil {
+		return nil, fmt.Errorf("unmarshal %s failed: %v", cpuIsolationOriginPath, err)
+	}
+	return origin, nil
+}
+
+func saveCPUIsolationOrigin(origin *cpuIsolationOrigin) error {
+	if len(origin.IRQAffinity) == 0 && !origin.IRQBalanceManaged {
+		if err := os.Remove(cpuIsolationOriginPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s failed: %v", cpuIsolationOriginPath, err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(origin)
+	if err != nil {
+		return fmt.Errorf("marshal cpu isolation origin failed: %v", err)
+	}
+	tmpFileName, err := files.GenerateTempFileWithDir(data, cpuIsolationOriginName, filepath.Dir(cpuIsolationOriginPath))
+	if err != nil {
+		return fmt.Errorf("generate temp cpu isolation origin failed: %v", err)
+	}
+	return os.Rename(tmpFileName, cpuIsolationOriginPath)
+}
+
+// listIRQs returns the IRQs which have an affinity
+func listIRQs() ([]string, error) {
+	entries, err := os.ReadDir(procIRQPath)
+	if err != nil {
+		return nil, fmt.Errorf("read %s failed: %v", procIRQPath, err)
+	}
+	var irqs []string
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+			irqs = append(irqs, entry.Name())
+		}
+	}
+	return irqs, nil
+}
+
+// irqAffinityFile returns the affinity file of the IRQ, the default affinity
+// is only available as a cpumask.
+func irqAffinityFile(irq string) string {
+	if irq == irqDefaultAffinity {
+		return filepath.Join(procIRQPath, irqDefaultAffinity)
+	}
+	return filepath.Join(procIRQPath, irq, "smp_affinity_list")
+}
+
+func readIRQAffinity(irq string) ([]int, string, error) {
+	data, err := os.ReadFile(irqAffinityFile(irq))
+	if err != nil {
+		return nil, "", err
+	}
+	raw := strings.TrimSpace(string(data))
+	var cpus []int
+	if irq == irqDefaultAffinity {
+		cpus, err = utils.ParseCPUMask(raw)
+	} else {
+		cpus, err = utils.ParseCPUList(raw)
+	}
+	return cpus, raw, err
+}
+
+func writeIRQAffinity(irq, value string) error {
+	return os.WriteFile(irqAffinityFile(irq), []byte(value), 0644)
+}
+
+// isUnmovableIRQ is true for the errors of the IRQs whose affinity is managed
+// by the kernel, or which could not be moved by the irq chip.
+func isUnmovableIRQ(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EINVAL)
+}
+
+// applyIRQAffinity moves the IRQs to the reserved CPUs, the original
+// affinities are recorded the first time they are changed.
+func applyIRQAffinity(reserved []int, origin *cpuIsolationOrigin) []string {
+	irqs, err := listIRQs()
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if origin.IRQAffinity == nil {
+		origin.IRQAffinity = make(map[string]string)
+	}
+
+	var errs []string
+	for _, irq := range append([]string{irqDefaultAffinity}, irqs...) {
+		current, raw, err := readIRQAffinity(irq)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				errs = append(errs, fmt.Sprintf("read affinity of irq %s failed: %v", irq, err))
+			}
+			continue
+		}
+		if slices.Equal(current, reserved) {
+			continue
+		}
+		wanted := utils.FormatCPUList(reserved)
+		if irq == irqDefaultAffinity {
+			wanted = utils.FormatCPUMask(reserved)
+		}
+		if _, found := origin.IRQAffinity[irq]; !found {
+			origin.IRQAffinity[irq] = raw
+		}
+		if err := writeIRQAffinity(irq, wanted); err != nil {
+			if isUnmovableIRQ(err) {
+				logrus.Debugf("Skip unmovable irq %s: %v", irq, err)
+				continue
+			}
+			errs = append(errs, fmt.Sprintf("write affinity of irq %s failed: %v", irq, err))
+		}
+	}
+	return errs
+}
+
+// restoreIRQAffinity restores the recorded IRQ affinities, the IRQs which are
+// gone are dropped.
+func restoreIRQAffinity(origin *cpuIsolationOrigin) []string {
+	var errs []string
+	for _, irq := range slices.Sorted(maps.Keys(origin.IRQAffinity)) {
+		if err := writeIRQAffinity(irq, origin.IRQAffinity[irq]); err != nil && !os.IsNotExist(err) && !isUnmovableIRQ(err) {
+			errs = append(errs, fmt.Sprintf("restore affinity of irq %s failed: %v", irq, err))
+			continue
+		}
+		delete(origin.IRQAffinity, irq)
+	}
+	return errs
+}
+
+// applyIRQBalance bans the isolated CPUs from irqbalance, and restarts it
+// when the config is changed. The original config is restored when wanted is
+// nil.
+func applyIRQBalance(wanted map[string]string, origin *cpuIsolationOrigin) error {
+	keys := []string{irqBalanceBannedCPUs}
+	current, err := utils.ReadEnvFile(irqBalancePath, keys)
+	if err != nil {
+		return err
+	}
+	if wanted == nil {
+		if !origin.IRQBalanceManaged {
+			return nil
+		}
+		wanted = origin.IRQBalance
+	} else if !origin.IRQBalanceManaged {
+		origin.IRQBalance = current
+		origin.IRQBalanceManaged = true
+		if err := saveCPUIsolationOrigin(origin); err != nil {
+			return err
+		}
+	}
+
+	if !maps.Equal(current, wanted) {
+		logrus.Infof("Update irqbalance config from %v to %v", current, wanted)
+		if err := utils.UpdateEnvFile(irqBalancePath, wanted, keys); err != nil {
+			return err
+		}
+		if err := restartIRQBalance(); err != nil {
+			return fmt.Errorf("restart irqbalance failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// ApplyCPUIsolation moves the IRQs to the reserved CPUs, bans the isolated
+// CPUs from irqbalance and persists them. The IRQ affinities and irqbalance
+// config are restored once the cpuIsolation config is removed from the
+// NodeConfig. The kernel args are applied by ApplyKernelArgs.
+func ApplyCPUIsolation(cfg *nodeconfigv1.CPUIsolationConfig) error {
+	origin, err := loadCPUIsolationOrigin()
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	if cfg == nil {
+		errs = append(errs, restoreIRQAffinity(origin)...)
+		if err := applyIRQBalance(nil, origin); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			origin.IRQBalance = nil
+			origin.IRQBalanceManaged = false
+		}
+		if err := RemovePersistentOEMSettings(cpuIsolationOEMOwner, cpuIsolationStageName); err != nil {
+			errs = append(errs, err.Error())
+		}
+	} else {
+		cpus, err := getCPUIsolationCPUs(cfg)
+		if err != nil {
+			return fmt.Errorf("apply cpu isolation failed: %v", err)
+		}
+		errs = append(errs, applyIRQAffinity(cpus.reserved, origin)...)
+		irqBalance := map[string]string{}
+		if len(cpus.isolated) > 0 {
+			irqBalance[irqBalanceBannedCPUs] = utils.FormatCPUList(cpus.isolated)
+		}
+		if err := applyIRQBalance(irqBalance, origin); err != nil {
+			errs = append(errs, err.Error())
+		}
+		if err := updateCPUIsolationPersistence(cpus.reserved, irqBalance); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if err := saveCPUIsolationOrigin(origin); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("apply cpu isolation failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// RestoreCPUIsolation restores the IRQ affinities and the irqbalance config
+// changed by the NodeConfig
+func RestoreCPUIsolation() error {
+	return ApplyCPUIsolation(nil)
+}
+
+// updateCPUIsolationPersistence writes the irqbalance config before it is
+// started on boot, the IRQs of the devices probed early are moved as well,
+// the later ones follow the irqaffinity kernel arg.
+func updateCPUIsolationPersistence(reserved []int, irqBalance map[string]string) error {
+	return UpdatePersistentOEMSettings(cpuIsolationOEMOwner, schema.Stage{
+		Name: cpuIsolationStageName,
+		Commands: []string{
+			fmt.Sprintf("for irq in /proc/irq/*/smp_affinity_list; do echo %s > $irq 2>/dev/null || true; done", utils.FormatCPUList(reserved)),
+		},
+		EnvironmentFile: hostIRQBalancePath,
+		Environment:     irqBalance,
+	})
+}
+
+// GetCPUIsolationStatus returns the CPU topology of the running kernel, and the
+// IRQs which are not handled by the reserved CPUs only.
+func GetCPUIsolationStatus(cfg *nodeconfigv1.CPUIsolationConfig) *nodeconfigv1.CPUIsolationStatus {
+	if cfg == nil {
+		return nil
+	}
+	status := &nodeconfigv1.CPUIsolationStatus{}
+	// the files are empty when nothing is isolated
+	status.OnlineCPUs, _ = readCPUFile("online")
+	status.IsolatedCPUs, _ = readCPUFile("isolated")
+	status.NohzFullCPUs, _ = readCPUFile("nohz_full")
+	if status.NohzFullCPUs == "(null)" {
+		status.NohzFullCPUs = ""
+	}
+
+	reserved, err := utils.ParseCPUList(cfg.ReservedCPUs)
+	if err != nil {
+		logrus.Warnf("Get cpu isolation status failed. err: %v", err)
+		return status
+	}
+	status.ReservedCPUs = utils.FormatCPUList(reserved)
+
+	irqs, err := listIRQs()
+	if err != nil {
+		logrus.Warnf("Get cpu isolation status failed. err: %v", err)
+		return status
+	}
+	for _, irq := range irqs {
+		current, _, err := readIRQAffinity(irq)
+		if err != nil {
+			continue
+		}
+		if slices.ContainsFunc(current, func(cpu int) bool { return !slices.Contains(reserved, cpu) }) {
+			n, _ := strconv.Atoi(irq)
+			status.UnmovableIRQs = append(status.UnmovableIRQs, int32(n))
+		}
+	}
+	slices.Sort(status.UnmovableIRQs)
+	return status
+}
+
+// NewCPUIsolationAppliedCondition returns the CPUIsolationApplied condition,
+// err is the failure of the last attempt to apply the cpuIsolation config.
+func NewCPUIsolationAppliedCondition(generation int64, cfg *nodeconfigv1.CPUIsolationConfig, status *nodeconfigv1.CPUIsolationStatus, err error) metav1.Condition {
+	cond := metav1.Condition{
+		Type:               string(nodeconfigv1.CPUIsolationApplied),
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             "CPUIsolationApplied",
+		Message:            "cpu isolation is applied",
+	}
+
+	switch {
+	case err != nil:
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "CPUIsolationFailed"
+		cond.Message = err.Error()
+	case cfg == nil:
+		cond.Reason = "CPUIsolationNotManaged"
+		cond.Message = "cpu isolation is not managed"
+	case status != nil && !sameCPUList(status.IsolatedCPUs, cfg.IsolatedCPUs):
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "CPUIsolationRebootRequired"
+		cond.Message = fmt.Sprintf("isolated cpus are %q instead of %q until the node is rebooted", status.IsolatedCPUs, cfg.IsolatedCPUs)
+	}
+	return cond
+}
+
+func sameCPUList(a, b string) bool {
+	aCPUs, aErr := utils.ParseCPUList(a)
+	bCPUs, bErr := utils.ParseCPUList(b)
+	return aErr == nil && bErr == nil && slices.Equal(aCPUs, bCPUs)
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+func TestApplyCPUIsolation(t *testing.T) {
+	tmpDir := setupOEMTest(t)
+	cpuIsolationOriginPath = tmpDir + "/host/oem/" + cpuIsolationOriginName
+	cpuPath = tmpDir + "/cpu"
+	procIRQPath = tmpDir + "/irq"
+	irqBalancePath = tmpDir + "/irqbalance"
+	assert.Nil(t, os.MkdirAll(cpuPath, 0777))
+	assert.Nil(t, os.WriteFile(cpuPath+"/online", []byte("0-7\n"), 0644))
+	assert.Nil(t, os.WriteFile(cpuPath+"/isolated", []byte("\n"), 0644))
+	assert.Nil(t, os.WriteFile(cpuPath+"/nohz_full", []byte("(null)\n"), 0644))
+	assert.Nil(t, os.MkdirAll(procIRQPath, 0777))
+	assert.Nil(t, os.WriteFile(procIRQPath+"/"+irqDefaultAffinity, []byte("ff\n"), 0644))
+	for _, irq := range []string{"0", "24", "25"} {
+		assert.Nil(t, os.MkdirAll(procIRQPath+"/"+irq, 0777))
+		assert.Nil(t, os.WriteFile(procIRQPath+"/"+irq+"/smp_affinity_list", []byte("0-7\n"), 0644))
+	}
+	assert.Nil(t, os.WriteFile(irqBalancePath, []byte("IRQBALANCE_ONESHOT=\"\"\n"), 0644))
+	readFile := func(path string) string {
+		data, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		return strings.TrimSpace(string(data))
+	}
+
+	restarts := 0
+	restartIRQBalance = func() error {
+		restarts++
+		return nil
+	}
+
+	// not managed
+	assert.Nil(t, ApplyCPUIsolation(nil))
+	assert.Nil(t, GetCPUIsolationStatus(nil))
+	assert.Nil(t, CPUIsolationKernelArgs(nil))
+
+	cfg := &v1beta1.CPUIsolationConfig{ReservedCPUs: "1,0", IsolatedCPUs: "2-7"}
+	assert.Equal(t, []string{"irqaffinity=0-1", "isolcpus=managed_irq,domain,2-7", "nohz_full=2-7", "rcu_nocbs=2-7"}, CPUIsolationKernelArgs(cfg))
+	assert.Nil(t, ApplyCPUIsolation(cfg))
+	assert.Equal(t, "3", readFile(procIRQPath+"/"+irqDefaultAffinity))
+	assert.Equal(t, "0-1", readFile(procIRQPath+"/24/smp_affinity_list"))
+	assert.Equal(t, "IRQBALANCE_ONESHOT=\"\"\nIRQBALANCE_BANNED_CPULIST=\"2-7\"", readFile(irqBalancePath))
+	assert.Equal(t, 1, restarts)
+
+	yipConfig, err := utils.LoadYipConfig(settingsOEMPath)
+	assert.Nil(t, err)
+	assert.Equal(t, cpuIsolationStageName, yipConfig.Stages[yipStageInitramfs][0].Name)
+	assert.Equal(t, hostIRQBalancePath, yipConfig.Stages[yipStageInitramfs][0].EnvironmentFile)
+	assert.Equal(t, "2-7", yipConfig.Stages[yipStageInitramfs][0].Environment[irqBalanceBannedCPUs])
+
+	// the kernel is not booted with the isolation yet, and irq 25 could not
+	// be moved
+	assert.Nil(t, os.WriteFile(procIRQPath+"/25/smp_affinity_list", []byte("4\n"), 0644))
+	status := GetCPUIsolationStatus(cfg)
+	assert.Equal(t, &v1beta1.CPUIsolationStatus{
+		OnlineCPUs:    "0-7",
+		ReservedCPUs:  "0-1",
+		UnmovableIRQs: []int32{25},
+	}, status)
+	cond := NewCPUIsolationAppliedCondition(1, cfg, status, nil)
+	assert.Equal(t, "CPUIsolationRebootRequired", cond.Reason)
+
+	assert.Nil(t, os.WriteFile(cpuPath+"/isolated", []byte("2-7\n"), 0644))
+	cond = NewCPUIsolationAppliedCondition(1, cfg, GetCPUIsolationStatus(cfg), nil)
+	assert.Equal(t, metav1.ConditionTrue, cond.Status)
+
+	// applying the same config again does not restart irqbalance
+	assert.Nil(t, ApplyCPUIsolation(cfg))
+	assert.Equal(t, 1, restarts)
+
+	// cpus which are not online are rejected
+	assert.NotNil(t, ApplyCPUIsolation(&v1beta1.CPUIsolationConfig{ReservedCPUs: "0-1", IsolatedCPUs: "2-9"}))
+
+	assert.Nil(t, RestoreCPUIsolation())
+	assert.Equal(t, "ff", readFile(procIRQPath+"/"+irqDefaultAffinity))
+	assert.Equal(t, "0-7", readFile(procIRQPath+"/24/smp_affinity_list"))
+	assert.Equal(t, "IRQBALANCE_ONESHOT=\"\"", readFile(irqBalancePath))
+	assert.Equal(t, 2, restarts)
+	_, err = os.Stat(cpuIsolationOriginPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(settingsOEMPath)
+	assert.True(t, os.IsNotExist(err))
+}
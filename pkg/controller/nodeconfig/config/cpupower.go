@@ -0,0 +1,371 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/harvester/go-common/files"
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+const (
+	cpuPowerStageName  = "Runtime CPU Power"
+	cpuPowerOEMOwner   = settingsOEMOwner + "/cpu-power"
+	cpuPowerOriginName = "cpu-power.origin"
+	hostCPUPath        = "/sys/devices/system/cpu"
+	cpuGovernorFile    = "cpufreq/scaling_governor"
+	cpuEPPFile         = "cpufreq/energy_performance_preference"
+)
+
+// The following would ordinarily be const, but we need to override them in unit tests
+var (
+	cpuPath = hostCPUPath
+	// cpuPowerOriginPath keeps the values before we changed them, so they
+	// could be restored when the cpuPower config is removed from the
+	// NodeConfig.
+	cpuPowerOriginPath = "/host/oem/" + cpuPowerOriginName
+)
+
+// cpuPowerSetting is a sysfs file relative to cpuPath and the value to write
+type cpuPowerSetting struct {
+	file  string
+	value string
+}
+
+// cpuPowerFileOrder sorts the files, the governor is always written before
+// the energy performance preference, which could not be changed with the
+// performance governor of intel_pstate.
+func cpuPowerFileOrder(a, b string) int {
+	aGovernor, bGovernor := strings.HasSuffix(a, cpuGovernorFile), strings.HasSuffix(b, cpuGovernorFile)
+	switch {
+	case aGovernor && !bGovernor:
+		return -1
+	case !aGovernor && bGovernor:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func readCPUFile(file string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(cpuPath, file))
+	if err != nil {
+		return "", fmt.Errorf("read %s failed: %v", file, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func writeCPUFile(file, value string) error {
+	if err := os.WriteFile(filepath.Join(cpuPath, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("write %q to %s failed: %v", value, file, err)
+	}
+	return nil
+}
+
+// cpuIdleStates returns the indexes of the idle states of the CPU
+func cpuIdleStates(cpu int) ([]int, error) {
+	dirs, err := filepath.Glob(filepath.Join(cpuPath, fmt.Sprintf("cpu%d/cpuidle/state*", cpu)))
+	if err != nil {
+		return nil, err
+	}
+	states := make([]int, 0, len(dirs))
+	for _, dir := range dirs {
+		state, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "state"))
+		if err != nil {
+			continue
+		}
+		states = append(states, state)
+	}
+	slices.Sort(states)
+	return states, nil
+}
+
+// getCPUPowerCPUs returns the CPUs of the cpuPower config, which are limited
+// to the online CPUs.
+func getCPUPowerCPUs(cpuPower *nodeconfigv1.CPUPowerConfig) ([]int, error) {
+	online, err := readCPUFile("online")
+	if err != nil {
+		return nil, err
+	}
+	cpus, err := utils.ParseCPUList(online)
+	if err != nil {
+		return nil, err
+	}
+	if cpuPower.CPUs == "" {
+		return cpus, nil
+	}
+
+	wanted, err := utils.ParseCPUList(cpuPower.CPUs)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(wanted, func(cpu int) bool {
+		if !slices.Contains(cpus, cpu) {
+			logrus.Warnf("CPU %d is not online, skip the cpuPower config", cpu)
+			return true
+		}
+		return false
+	}), nil
+}
+
+// generateCPUPowerSettings returns the sysfs files to write for the CPUs
+func generateCPUPowerSettings(cpuPower *nodeconfigv1.CPUPowerConfig, cpus []int) ([]cpuPowerSetting, error) {
+	var settings []cpuPowerSetting
+	for _, cpu := range cpus {
+		if cpuPower.Governor != "" {
+			settings = append(settings, cpuPowerSetting{fmt.Sprintf("cpu%d/%s", cpu, cpuGovernorFile), cpuPower.Governor})
+		}
+		if cpuPower.EnergyPerformancePreference != "" {
+			settings = append(settings, cpuPowerSetting{fmt.Sprintf("cpu%d/%s", cpu, cpuEPPFile), cpuPower.EnergyPerformancePreference})
+		}
+		if cpuPower.MaxCState == nil {
+			continue
+		}
+		states, err := cpuIdleStates(cpu)
+		if err != nil {
+			return nil, fmt.Errorf("list idle states of cpu%d failed: %v", cpu, err)
+		}
+		if len(states) == 0 {
+			return nil, fmt.Errorf("cpuidle is not supported by cpu%d", cpu)
+		}
+		for _, state := range states {
+			disable := "0"
+			if state > int(*cpuPower.MaxCState) {
+				disable = "1"
+			}
+			settings = append(settings, cpuPowerSetting{fmt.Sprintf("cpu%d/cpuidle/state%d/disable", cpu, state), disable})
+		}
+	}
+	return settings, nil
+}
+
+func loadCPUPowerOrigin() (map[string]string, error) {
+	origin := make(map[string]string)
+	data, err := os.ReadFile(cpuPowerOriginPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return origin, nil
+		}
+		return nil, fmt.Errorf("read %s failed: %v", cpuPowerOriginPath, err)
+	}
+	if err := json.Unmarshal(data, &origin); err != nil {
+		return nil, fmt.Errorf("unmarshal %s failed: %v", cpuPowerOriginPath, err)
+	}
+	return origin, nil
+}
+
+func saveCPUPowerOrigin(origin map[string]string) error {
+	if len(origin) == 0 {
+		if err := os.Remove(cpuPowerOriginPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s failed: %v", cpuPowerOriginPath, err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(origin)
+	if err != nil {
+		return fmt.Errorf("marshal cpu power origin failed: %v", err)
+	}
+	tmpFileName, err := files.GenerateTempFileWithDir(data, cpuPowerOriginName, filepath.Dir(cpuPowerOriginPath))
+	if err != nil {
+		return fmt.Errorf("generate temp cpu power origin failed: %v", err)
+	}
+	return os.Rename(tmpFileName, cpuPowerOriginPath)
+}
+
+// ApplyCPUPower sets the governor, energy performance preference and idle
+// states of the CPUs and persists them. The original values are recorded the
+// first time they are changed, and restored once they are no longer wanted.
+func ApplyCPUPower(cpuPower *nodeconfigv1.CPUPowerConfig) error {
+	origin, err := loadCPUPowerOrigin()
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	var cpus []int
+	var settings []cpuPowerSetting
+	if cpuPower != nil {
+		if cpus, err = getCPUPowerCPUs(cpuPower); err != nil {
+			return fmt.Errorf("apply cpu power failed: %v", err)
+		}
+		if settings, err = generateCPUPowerSettings(cpuPower, cpus); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	wanted := make(map[string]bool, len(settings))
+	for _, setting := range settings {
+		wanted[setting.file] = true
+		current, err := readCPUFile(setting.file)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if _, found := origin[setting.file]; !found {
+			origin[setting.file] = current
+		}
+		if current == setting.value {
+			continue
+		}
+		logrus.Infof("Set %s from %q to %q", setting.file, current, setting.value)
+		if err := writeCPUFile(setting.file, setting.value); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	restore := make([]string, 0, len(origin))
+	for file := range origin {
+		if !wanted[file] {
+			restore = append(restore, file)
+		}
+	}
+	slices.SortFunc(restore, cpuPowerFileOrder)
+	for _, file := range restore {
+		logrus.Infof("Restore %s to %q", file, origin[file])
+		if err := writeCPUFile(file, origin[file]); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		delete(origin, file)
+	}
+
+	if err := saveCPUPowerOrigin(origin); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := updateCPUPowerPersistence(cpuPower, cpus); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("apply cpu power failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// RestoreCPUPower restores all the CPU power settings changed by the NodeConfig
+func RestoreCPUPower() error {
+	return ApplyCPUPower(nil)
+}
+
+// updateCPUPowerPersistence writes the sysfs files on boot, the CPUs are
+// looped in the shell to keep the stage short on hosts with many CPUs.
+func updateCPUPowerPersistence(cpuPower *nodeconfigv1.CPUPowerConfig, cpus []int) error {
+	if cpuPower == nil || len(cpus) == 0 {
+		return RemovePersistentOEMSettings(cpuPowerOEMOwner, cpuPowerStageName)
+	}
+
+	cpuList := make([]string, 0, len(cpus))
+	for _, cpu := range cpus {
+		cpuList = append(cpuList, strconv.Itoa(cpu))
+	}
+	loop := fmt.Sprintf("for cpu in %s; do", strings.Join(cpuList, " "))
+
+	var commands []string
+	if cpuPower.Governor != "" {
+		commands = append(commands, fmt.Sprintf("%s echo '%s' > %s/cpu$cpu/%s; done", loop, cpuPower.Governor, hostCPUPath, cpuGovernorFile))
+	}
+	if cpuPower.EnergyPerformancePreference != "" {
+		commands = append(commands, fmt.Sprintf("%s echo '%s' > %s/cpu$cpu/%s; done", loop, cpuPower.EnergyPerformancePreference, hostCPUPath, cpuEPPFile))
+	}
+	if cpuPower.MaxCState != nil {
+		commands = append(commands, fmt.Sprintf(`%s for state in %s/cpu$cpu/cpuidle/state*; do if [ "${state##*state}" -gt %d ]; then echo 1 > $state/disable; else echo 0 > $state/disable; fi; done; done`,
+			loop, hostCPUPath, *cpuPower.MaxCState))
+	}
+	if len(commands) == 0 {
+		return RemovePersistentOEMSettings(cpuPowerOEMOwner, cpuPowerStageName)
+	}
+
+	return UpdatePersistentOEMSettings(cpuPowerOEMOwner, schema.Stage{
+		Name:     cpuPowerStageName,
+		Commands: commands,
+	})
+}
+
+// getCPUMaxCState returns the deepest idle state of the CPU before the first
+// disabled one, it is nil when cpuidle is not supported.
+func getCPUMaxCState(cpu int) *int32 {
+	states, err := cpuIdleStates(cpu)
+	if err != nil || len(states) == 0 {
+		return nil
+	}
+	maxCState := int32(-1)
+	for _, state := range states {
+		disable, err := readCPUFile(fmt.Sprintf("cpu%d/cpuidle/state%d/disable", cpu, state))
+		if err != nil || disable != "0" {
+			break
+		}
+		maxCState = int32(state)
+	}
+	return &maxCState
+}
+
+// GetCPUPowerStatus reads the current power settings of the CPUs of the
+// cpuPower config and compares them with the wanted ones.
+func GetCPUPowerStatus(cpuPower *nodeconfigv1.CPUPowerConfig) []nodeconfigv1.CPUPowerStatus {
+	if cpuPower == nil {
+		return nil
+	}
+	cpus, err := getCPUPowerCPUs(cpuPower)
+	if err != nil {
+		logrus.Warnf("Get cpu power status failed. err: %v", err)
+		return nil
+	}
+
+	status := make([]nodeconfigv1.CPUPowerStatus, 0, len(cpus))
+	for _, cpu := range cpus {
+		// the files are missing when the drivers do not support them
+		governor, _ := readCPUFile(fmt.Sprintf("cpu%d/%s", cpu, cpuGovernorFile))
+		epp, _ := readCPUFile(fmt.Sprintf("cpu%d/%s", cpu, cpuEPPFile))
+		s := nodeconfigv1.CPUPowerStatus{
+			CPU:                         int32(cpu),
+			Governor:                    governor,
+			EnergyPerformancePreference: epp,
+			MaxCState:                   getCPUMaxCState(cpu),
+		}
+		s.Drifted = (cpuPower.Governor != "" && cpuPower.Governor != s.Governor) ||
+			(cpuPower.EnergyPerformancePreference != "" && cpuPower.EnergyPerformancePreference != s.EnergyPerformancePreference) ||
+			(cpuPower.MaxCState != nil && (s.MaxCState == nil || *s.MaxCState != *cpuPower.MaxCState))
+		status = append(status, s)
+	}
+	return status
+}
+
+// NewCPUPowerAppliedCondition returns the CPUPowerApplied condition, err is the
+// failure of the last attempt to apply the cpuPower config.
+func NewCPUPowerAppliedCondition(generation int64, status []nodeconfigv1.CPUPowerStatus, err error) metav1.Condition {
+	cond := metav1.Condition{
+		Type:               string(nodeconfigv1.CPUPowerApplied),
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             "CPUPowerApplied",
+		Message:            "cpu power settings are applied",
+	}
+
+	var drifted []int
+	for _, s := range status {
+		if s.Drifted {
+			drifted = append(drifted, int(s.CPU))
+		}
+	}
+
+	switch {
+	case err != nil:
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "CPUPowerFailed"
+		cond.Message = err.Error()
+	case len(drifted) > 0:
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "CPUPowerDrifted"
+		cond.Message = fmt.Sprintf("cpus are drifted: %s", utils.FormatCPUList(drifted))
+	}
+	return cond
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+func TestApplyCPUPower(t *testing.T) {
+	tmpDir := setupOEMTest(t)
+	cpuPowerOriginPath = tmpDir + "/host/oem/" + cpuPowerOriginName
+	cpuPath = tmpDir + "/cpu"
+	assert.Nil(t, os.MkdirAll(cpuPath, 0777))
+	assert.Nil(t, os.WriteFile(cpuPath+"/online", []byte("0-1\n"), 0644))
+	for _, cpu := range []string{"cpu0", "cpu1"} {
+		assert.Nil(t, os.MkdirAll(cpuPath+"/"+cpu+"/cpufreq", 0777))
+		assert.Nil(t, os.WriteFile(cpuPath+"/"+cpu+"/"+cpuGovernorFile, []byte("powersave\n"), 0644))
+		assert.Nil(t, os.WriteFile(cpuPath+"/"+cpu+"/"+cpuEPPFile, []byte("balance_power\n"), 0644))
+		for _, state := range []string{"state0", "state1", "state2", "state3"} {
+			assert.Nil(t, os.MkdirAll(cpuPath+"/"+cpu+"/cpuidle/"+state, 0777))
+			assert.Nil(t, os.WriteFile(cpuPath+"/"+cpu+"/cpuidle/"+state+"/disable", []byte("0\n"), 0644))
+		}
+	}
+	readFile := func(file string) string {
+		data, err := os.ReadFile(cpuPath + "/" + file)
+		assert.Nil(t, err)
+		return strings.TrimSpace(string(data))
+	}
+
+	// not managed
+	assert.Nil(t, ApplyCPUPower(nil))
+	assert.Nil(t, GetCPUPowerStatus(nil))
+
+	maxCState := int32(1)
+	cpuPower := &v1beta1.CPUPowerConfig{
+		CPUs:                        "1",
+		Governor:                    "performance",
+		EnergyPerformancePreference: "performance",
+		MaxCState:                   &maxCState,
+	}
+	assert.Nil(t, ApplyCPUPower(cpuPower))
+	assert.Equal(t, "performance", readFile("cpu1/"+cpuGovernorFile))
+	assert.Equal(t, "performance", readFile("cpu1/"+cpuEPPFile))
+	assert.Equal(t, "0", readFile("cpu1/cpuidle/state1/disable"))
+	assert.Equal(t, "1", readFile("cpu1/cpuidle/state2/disable"))
+	assert.Equal(t, "1", readFile("cpu1/cpuidle/state3/disable"))
+	assert.Equal(t, "powersave", readFile("cpu0/"+cpuGovernorFile))
+	assert.Equal(t, "0", readFile("cpu0/cpuidle/state3/disable"))
+
+	status := GetCPUPowerStatus(cpuPower)
+	assert.Equal(t, []v1beta1.CPUPowerStatus{{
+		CPU:                         1,
+		Governor:                    "performance",
+		EnergyPerformancePreference: "performance",
+		MaxCState:                   &maxCState,
+	}}, status)
+	assert.Equal(t, metav1.ConditionTrue, NewCPUPowerAppliedCondition(1, status, nil).Status)
+
+	yipConfig, err := utils.LoadYipConfig(settingsOEMPath)
+	assert.Nil(t, err)
+	assert.Equal(t, cpuPowerStageName, yipConfig.Stages[yipStageInitramfs][0].Name)
+	assert.Equal(t, 3, len(yipConfig.Stages[yipStageInitramfs][0].Commands))
+	assert.Equal(t, "for cpu in 1; do echo 'performance' > /sys/devices/system/cpu/cpu$cpu/cpufreq/scaling_governor; done", yipConfig.Stages[yipStageInitramfs][0].Commands[0])
+
+	// drift is reported
+	assert.Nil(t, os.WriteFile(cpuPath+"/cpu1/"+cpuGovernorFile, []byte("schedutil\n"), 0644))
+	cond := NewCPUPowerAppliedCondition(1, GetCPUPowerStatus(cpuPower), nil)
+	assert.Equal(t, "CPUPowerDrifted", cond.Reason)
+	assert.Equal(t, "cpus are drifted: 1", cond.Message)
+
+	// the settings removed from the config are restored
+	assert.Nil(t, ApplyCPUPower(&v1beta1.CPUPowerConfig{CPUs: "1", Governor: "performance"}))
+	assert.Equal(t, "performance", readFile("cpu1/"+cpuGovernorFile))
+	assert.Equal(t, "balance_power", readFile("cpu1/"+cpuEPPFile))
+	assert.Equal(t, "0", readFile("cpu1/cpuidle/state3/disable"))
+
+	assert.Nil(t, RestoreCPUPower())
+	assert.Equal(t, "powersave", readFile("cpu1/"+cpuGovernorFile))
+	_, err = os.Stat(cpuPowerOriginPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(settingsOEMPath)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+
+	"github.com/harvester/go-common/files"
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+const (
+	dnsStageName     = "Runtime DNS Settings"
+	dnsOEMOwner      = settingsOEMOwner + "/dns"
+	dnsOriginName    = "dns.origin"
+	netconfigService = "harvester-node-manager-netconfig.service"
+	netconfigBinary  = "/sbin/netconfig"
+)
+
+// The following would ordinarily be const, but we need to override them in unit tests
+var (
+	// dnsOriginPath keeps the netconfig DNS variables before we changed them,
+	// so they could be restored when the DNS config is removed from the
+	// NodeConfig.
+	dnsOriginPath = "/host/oem/" + dnsOriginName
+	// netconfigUpdate regenerates /etc/resolv.conf on the host
+	netconfigUpdate = func() error {
+		return utils.RunHostCommand(netconfigService, []string{netconfigBinary, "update", "-m", "dns"})
+	}
+)
+
+func loadDNSOrigin() (map[string]string, error) {
+	data, err := os.ReadFile(dnsOriginPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read %s failed: %v", dnsOriginPath, err)
+	}
+	var origin map[string]string
+	if err := json.Unmarshal(data, &origin); err != nil {
+		return nil, fmt.Errorf("unmarshal %s failed: %v", dnsOriginPath, err)
+	}
+	return origin, nil
+}
+
+func saveDNSOrigin(origin map[string]string) error {
+	if origin == nil {
+		if err := os.Remove(dnsOriginPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s failed: %v", dnsOriginPath, err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(origin)
+	if err != nil {
+		return fmt.Errorf("marshal DNS origin failed: %v", err)
+	}
+	tmpFileName, err := files.GenerateTempFileWithDir(data, dnsOriginName, filepath.Dir(dnsOriginPath))
+	if err != nil {
+		return fmt.Errorf("generate temp DNS origin failed: %v", err)
+	}
+	return os.Rename(tmpFileName, dnsOriginPath)
+}
+
+// ApplyDNS writes the DNS config to the host netconfig config and regenerates
+// /etc/resolv.conf, then persists it. The original config is restored once the
+// DNS config is removed from the NodeConfig.
+func ApplyDNS(dns *nodeconfigv1.DNSConfig) error {
+	origin, err := loadDNSOrigin()
+	if err != nil {
+		return err
+	}
+	// nothing to restore, the resolver config is not managed
+	if dns == nil && origin == nil {
+		return RemovePersistentOEMSettings(dnsOEMOwner, dnsStageName)
+	}
+
+	current, err := utils.ReadNetconfigDNS()
+	if err != nil {
+		return err
+	}
+
+	wanted := utils.DNSConfigToNetconfig(dns)
+	if dns == nil {
+		wanted = origin
+	} else if origin == nil {
+		if err := saveDNSOrigin(current); err != nil {
+			return err
+		}
+	}
+
+	if !maps.Equal(current, wanted) {
+		logrus.Infof("Update netconfig DNS config from %v to %v", current, wanted)
+		if err := utils.WriteNetconfig(wanted); err != nil {
+			return err
+		}
+	}
+	// netconfig only rewrites resolv.conf when the result is changed, it is
+	// also run when the config is unchanged in case the last run failed
+	if err := netconfigUpdate(); err != nil {
+		return fmt.Errorf("update resolv.conf failed: %v", err)
+	}
+
+	if dns == nil {
+		if err := saveDNSOrigin(nil); err != nil {
+			return err
+		}
+		return RemovePersistentOEMSettings(dnsOEMOwner, dnsStageName)
+	}
+	return updateDNSPersistence(wanted)
+}
+
+// RestoreDNS restores the DNS config changed by the NodeConfig
+func RestoreDNS() error {
+	return ApplyDNS(nil)
+}
+
+// DNSPaths are the host files written by the DNS config
+func DNSPaths() []string {
+	return []string{utils.NetconfigPath, dnsOriginPath}
+}
+
+// ReloadDNS regenerates /etc/resolv.conf once the netconfig is restored
+func ReloadDNS() error {
+	return netconfigUpdate()
+}
+
+// updateDNSPersistence writes the netconfig variables on boot, before the
+// network is started.
+func updateDNSPersistence(values map[string]string) error {
+	return UpdatePersistentOEMSettings(dnsOEMOwner, schema.Stage{
+		Name:            dnsStageName,
+		EnvironmentFile: utils.HostNetconfigPath,
+		Environment:     values,
+	})
+}
+
+// NewDNSAppliedCondition returns the DNSApplied condition, err is the failure
+// of the last attempt to apply the DNS config.
+func NewDNSAppliedCondition(generation int64, dns *nodeconfigv1.DNSConfig, err error) metav1.Condition {
+	cond := metav1.Condition{
+		Type:               string(nodeconfigv1.DNSApplied),
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             "DNSApplied",
+		Message:            "DNS config is applied",
+	}
+
+	switch {
+	case err != nil:
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "DNSFailed"
+		cond.Message = err.Error()
+	case dns == nil:
+		cond.Reason = "DNSNotManaged"
+		cond.Message = "DNS config is not managed"
+	}
+	return cond
+}
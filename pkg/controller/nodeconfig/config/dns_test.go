@@ -0,0 +1,69 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+func TestApplyDNS(t *testing.T) {
+	tmpDir := setupOEMTest(t)
+	dnsOriginPath = tmpDir + "/host/oem/" + dnsOriginName
+	utils.NetconfigPath = tmpDir + "/config"
+	netconfig := "## Type: string\nNETCONFIG_DNS_POLICY=\"auto\"\nNETCONFIG_DNS_STATIC_SERVERS=\"\"\nNETCONFIG_DNS_STATIC_SEARCHLIST=\"\"\n"
+	assert.Nil(t, os.WriteFile(utils.NetconfigPath, []byte(netconfig), 0644))
+
+	updates := 0
+	netconfigUpdate = func() error {
+		updates++
+		return nil
+	}
+
+	// not managed
+	assert.Nil(t, ApplyDNS(nil))
+	assert.Equal(t, 0, updates)
+
+	dns := &v1beta1.DNSConfig{
+		Nameservers: []string{"10.0.0.53", "10.0.1.53"},
+		Search:      []string{"example.com"},
+		Options:     []string{"ndots:2"},
+	}
+	assert.Nil(t, ApplyDNS(dns))
+	assert.Equal(t, 1, updates)
+	raw, err := os.ReadFile(utils.NetconfigPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "## Type: string\nNETCONFIG_DNS_POLICY=\"auto\"\nNETCONFIG_DNS_STATIC_SERVERS=\"10.0.0.53 10.0.1.53\"\nNETCONFIG_DNS_STATIC_SEARCHLIST=\"example.com\"\nNETCONFIG_DNS_RESOLVER_OPTIONS=\"ndots:2\"\n", string(raw))
+	current, err := utils.ReadNetconfigDNS()
+	assert.Nil(t, err)
+	assert.Equal(t, utils.DNSConfigToNetconfig(dns), current)
+
+	yipConfig, err := utils.LoadYipConfig(settingsOEMPath)
+	assert.Nil(t, err)
+	assert.Equal(t, dnsStageName, yipConfig.Stages[yipStageInitramfs][0].Name)
+	assert.Equal(t, utils.HostNetconfigPath, yipConfig.Stages[yipStageInitramfs][0].EnvironmentFile)
+	assert.Equal(t, "10.0.0.53 10.0.1.53", yipConfig.Stages[yipStageInitramfs][0].Environment[utils.NetconfigDNSServers])
+
+	// failure of netconfig is reported
+	netconfigUpdate = func() error { return errors.New("exit status 1") }
+	err = ApplyDNS(dns)
+	assert.NotNil(t, err)
+	assert.Equal(t, "DNSFailed", NewDNSAppliedCondition(1, dns, err).Reason)
+
+	netconfigUpdate = func() error {
+		updates++
+		return nil
+	}
+	assert.Nil(t, RestoreDNS())
+	raw, err = os.ReadFile(utils.NetconfigPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "## Type: string\nNETCONFIG_DNS_POLICY=\"auto\"\nNETCONFIG_DNS_STATIC_SERVERS=\"\"\nNETCONFIG_DNS_STATIC_SEARCHLIST=\"\"\nNETCONFIG_DNS_RESOLVER_OPTIONS=\"\"\n", string(raw))
+	_, err = os.Stat(dnsOriginPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(settingsOEMPath)
+	assert.True(t, os.IsNotExist(err))
+}
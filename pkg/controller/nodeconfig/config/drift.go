@@ -0,0 +1,252 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/mudler/yip/pkg/schema"
+	"go.yaml.in/yaml/v4"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+// The managed paths are the host files written by the sections while they are
+// set, the drift of the files is tracked from the content they were applied
+// with. This includes the files under /host/oem recording what the sections
+// changed, as the sections are restored from them. The OEM settings file and
+// the GRUB environment block are shared with others, only the stage or the
+// variable of the section is tracked, as `<path>#<name>`. The backups of the
+// original files outside /host/oem are not tracked, they are only written by
+// us.
+
+const managedPathSeparator = "#"
+
+func settingsStageManagedPath(stageName string) string {
+	return settingsOEMPath + managedPathSeparator + stageName
+}
+
+func grubEnvManagedPath(name string) string {
+	return grubEnvPath + managedPathSeparator + name
+}
+
+// ManagedFile returns the host file of the managed path, the path of a stage
+// or a variable is the one of the file it is kept in.
+func ManagedFile(path string) string {
+	file, _, _ := strings.Cut(path, managedPathSeparator)
+	return file
+}
+
+// HashManagedPath returns the hex encoded sha256 of the content of the
+// managed path, it is empty when the file, the stage or the variable does
+// not exist.
+func HashManagedPath(path string) (string, error) {
+	if name, found := strings.CutPrefix(path, settingsOEMPath+managedPathSeparator); found {
+		return hashSettingsStage(name)
+	}
+	if name, found := strings.CutPrefix(path, grubEnvPath+managedPathSeparator); found {
+		return hashGrubEnvVar(name)
+	}
+	if path == hostsPath {
+		// the single file bind mount keeps the file replaced on the host, the
+		// drift is observed on the current one
+		path = currentHostsPath()
+	}
+	return utils.HashFile(path)
+}
+
+func hashSettingsStage(name string) (string, error) {
+	stages, err := settingsOEMStore().Stages()
+	if err != nil {
+		return "", err
+	}
+	idx := slices.IndexFunc(stages[yipStageInitramfs], func(stage schema.Stage) bool {
+		return stage.Name == name
+	})
+	if idx < 0 {
+		return "", nil
+	}
+	data, err := yaml.Marshal(stages[yipStageInitramfs][idx])
+	if err != nil {
+		return "", fmt.Errorf("marshal stage %s of %s failed: %v", name, settingsOEMPath, err)
+	}
+	return utils.HashData(data), nil
+}
+
+func hashGrubEnvVar(name string) (string, error) {
+	vars, _, err := readGrubEnv()
+	if err != nil {
+		return "", err
+	}
+	idx := slices.IndexFunc(vars, func(v grubEnvVar) bool { return v.name == name })
+	if idx < 0 {
+		return "", nil
+	}
+	return utils.HashData([]byte(vars[idx].value)), nil
+}
+
+func NTPManagedPaths(ntpConfig *nodeconfigv1.NTPConfig) []string {
+	if ntpConfig == nil {
+		return nil
+	}
+	paths := []string{timesyncdConfigPath, settingsStageManagedPath(NTPName)}
+	if ntpConfig.Backend == nodeconfigv1.NTPBackendChrony {
+		paths[0] = chronyConfigPath
+	}
+	return paths
+}
+
+func DNSManagedPaths(dns *nodeconfigv1.DNSConfig) []string {
+	if dns == nil {
+		return nil
+	}
+	return []string{utils.NetconfigPath, dnsOriginPath, settingsStageManagedPath(dnsStageName)}
+}
+
+func HostAliasesManagedPaths(hostAliases []nodeconfigv1.HostAlias) []string {
+	if len(hostAliases) == 0 {
+		return nil
+	}
+	return []string{hostsPath, settingsStageManagedPath(hostAliasesStageName)}
+}
+
+func JournaldManagedPaths(journald *nodeconfigv1.JournaldConfig) []string {
+	if journald == nil {
+		return nil
+	}
+	return []string{utils.JournaldDropInPath, settingsStageManagedPath(journaldStageName)}
+}
+
+func ContainerRuntimeManagedPaths(containerRuntime *nodeconfigv1.ContainerRuntimeConfig) []string {
+	if containerRuntime == nil {
+		return nil
+	}
+	paths := []string{containerRuntimeOriginPath}
+	if containerRuntime.Registries != nil {
+		paths = append(paths, registriesPath, settingsStageManagedPath(registriesStageName))
+	}
+	if containerRuntime.Proxy != nil {
+		paths = append(paths, slices.Sorted(maps.Values(rke2EnvPaths))...)
+	}
+	return paths
+}
+
+func KernelModulesManagedPaths(kernelModules *nodeconfigv1.KernelModulesConfig) []string {
+	if kernelModules == nil {
+		return nil
+	}
+	return []string{modprobeConfigPath, kernelModulesAppliedPath, settingsStageManagedPath(kernelModulesStageName)}
+}
+
+func CPUIsolationManagedPaths(cpuIsolation *nodeconfigv1.CPUIsolationConfig) []string {
+	if cpuIsolation == nil {
+		return nil
+	}
+	return []string{irqBalancePath, cpuIsolationOriginPath, settingsStageManagedPath(cpuIsolationStageName)}
+}
+
+// SystemdUnitsManagedPaths are the drop-ins of the units with settings, the
+// unit states are not files
+func SystemdUnitsManagedPaths(units []nodeconfigv1.SystemdUnitConfig) []string {
+	if len(units) == 0 {
+		return nil
+	}
+	paths := []string{systemdUnitsOriginPath, settingsStageManagedPath(systemdUnitsStageName)}
+	for _, unit := range units {
+		if len(unit.Settings) > 0 {
+			paths = append(paths, systemdUnitDropInPath(systemdUnitPath, unit.Name))
+		}
+	}
+	return paths
+}
+
+// SysctlManagedPaths are the files of the sysctls, the values in /proc/sys
+// are compared by GetSysctlStatus
+func SysctlManagedPaths(sysctl map[string]string) []string {
+	if len(sysctl) == 0 {
+		return nil
+	}
+	return []string{sysctlOriginPath, settingsStageManagedPath(sysctlStageName)}
+}
+
+// CPUPowerManagedPaths are the files of the CPU power settings, the values in
+// sysfs are compared by GetCPUPowerStatus
+func CPUPowerManagedPaths(cpuPower *nodeconfigv1.CPUPowerConfig) []string {
+	if cpuPower == nil {
+		return nil
+	}
+	return []string{cpuPowerOriginPath, settingsStageManagedPath(cpuPowerStageName)}
+}
+
+func SwapManagedPaths(swap *nodeconfigv1.SwapConfig) []string {
+	if swap == nil {
+		return nil
+	}
+	return []string{swapAppliedPath, settingsStageManagedPath(swapStageName)}
+}
+
+// KernelArgsManagedPaths are the GRUB variable and the record of the args,
+// including the ones of the CPU isolation
+func KernelArgsManagedPaths(kernelArgs []string) []string {
+	if len(kernelArgs) == 0 {
+		return nil
+	}
+	return []string{kernelArgsAppliedPath, grubEnvManagedPath(kernelArgsGrubVar)}
+}
+
+func TimezoneManagedPaths(timezone string) []string {
+	if timezone == "" {
+		return nil
+	}
+	return []string{timezoneOriginPath, settingsStageManagedPath(timezoneStageName)}
+}
+
+// LonghornManagedPaths are the SPDK stage and the hugepages allocated for the
+// V2 Data Engine
+func LonghornManagedPaths(longhornConfig *nodeconfigv1.LonghornConfig) []string {
+	if longhornConfig == nil || !longhornConfig.EnableV2DataEngine {
+		return nil
+	}
+	paths := []string{settingsStageManagedPath(spdkStageName)}
+	if longhornConfig.HugepagesToAllocate > 0 {
+		paths = append(paths, hugepagesPath)
+	}
+	return paths
+}
+
+// GetDriftPolicy returns the drift policy of the section, the sections which
+// are not listed are enforced
+func GetDriftPolicy(policies map[string]nodeconfigv1.DriftPolicy, section string) nodeconfigv1.DriftPolicy {
+	if policy, ok := policies[section]; ok {
+		return policy
+	}
+	return nodeconfigv1.DriftPolicyEnforce
+}
+
+// NewConfigDriftedCondition returns the ConfigDrifted condition, the drift of
+// the sections with the ignore policy is not reported.
+func NewConfigDriftedCondition(generation int64, policies map[string]nodeconfigv1.DriftPolicy, files []nodeconfigv1.ManagedFileStatus) metav1.Condition {
+	cond := metav1.Condition{
+		Type:               string(nodeconfigv1.ConfigDrifted),
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: generation,
+		Reason:             "ConfigInSync",
+		Message:            "the managed files are in sync with the applied config",
+	}
+
+	var drifted []string
+	for _, file := range files {
+		if file.Drifted && GetDriftPolicy(policies, file.Section) != nodeconfigv1.DriftPolicyIgnore {
+			drifted = append(drifted, fmt.Sprintf("%s (%s)", file.Path, file.Section))
+		}
+	}
+	if len(drifted) > 0 {
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "ConfigDrifted"
+		cond.Message = fmt.Sprintf("changed outside of the node manager: %s", strings.Join(drifted, ", "))
+	}
+	return cond
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashManagedPath(t *testing.T) {
+	tmpDir := setupOEMTest(t)
+	grubEnvPath = tmpDir + "/host/oem/grubenv"
+	sysctlOriginPath = tmpDir + "/host/oem/sysctl.origin"
+
+	sysctlPath := settingsStageManagedPath(sysctlStageName)
+	assert.Equal(t, settingsOEMPath, ManagedFile(sysctlPath))
+	assert.Equal(t, sysctlOriginPath, ManagedFile(sysctlOriginPath))
+	hash, err := HashManagedPath(sysctlPath)
+	require.Nil(t, err)
+	assert.Empty(t, hash, "the stage is not written yet")
+
+	require.Nil(t, UpdatePersistentOEMSettings(sysctlOEMOwner, schema.Stage{Name: sysctlStageName, Sysctl: map[string]string{"vm.swappiness": "10"}}))
+	applied, err := HashManagedPath(sysctlPath)
+	require.Nil(t, err)
+	assert.NotEmpty(t, applied)
+
+	// the stages of the other sections do not drift the stage
+	require.Nil(t, UpdatePersistentOEMSettings(timezoneOEMOwner, schema.Stage{Name: timezoneStageName, Commands: []string{"timedatectl set-timezone UTC"}}))
+	hash, err = HashManagedPath(sysctlPath)
+	require.Nil(t, err)
+	assert.Equal(t, applied, hash)
+
+	// the stage edited on the host drifts
+	data, err := os.ReadFile(settingsOEMPath)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(settingsOEMPath, []byte(strings.Replace(string(data), `"10"`, `"60"`, 1)), 0644))
+	hash, err = HashManagedPath(sysctlPath)
+	require.Nil(t, err)
+	assert.NotEqual(t, applied, hash)
+
+	// only the GRUB variable of the kernel args is hashed
+	grubEnv := func(vars string) {
+		data := "# GRUB Environment Block\n" + vars
+		require.Nil(t, os.WriteFile(grubEnvPath, []byte(data+strings.Repeat("#", 1024-len(data))), 0644))
+	}
+	kernelArgsPath := grubEnvManagedPath(kernelArgsGrubVar)
+	grubEnv("third_party_kernel_args=iommu=pt\n")
+	applied, err = HashManagedPath(kernelArgsPath)
+	require.Nil(t, err)
+	assert.NotEmpty(t, applied)
+	grubEnv("next_entry=recovery\nthird_party_kernel_args=iommu=pt\n")
+	hash, err = HashManagedPath(kernelArgsPath)
+	require.Nil(t, err)
+	assert.Equal(t, applied, hash)
+	grubEnv("next_entry=recovery\n")
+	hash, err = HashManagedPath(kernelArgsPath)
+	require.Nil(t, err)
+	assert.Empty(t, hash)
+
+	// the other paths are hashed as files
+	require.Nil(t, os.WriteFile(sysctlOriginPath, []byte(`{"vm.swappiness":"60"}`), 0644))
+	hash, err = HashManagedPath(sysctlOriginPath)
+	require.Nil(t, err)
+	assert.NotEmpty(t, hash)
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+const systemdUnitFailedState = "failed"
+
+// The following would ordinarily be const, but we need to override them in unit tests
+var (
+	healthCheckInterval = 2 * time.Second
+	getNTPSynchronized  = utils.GetTimeDate1PropertiesNTPSynchronized
+	getNTPSource        = currentNTPSource
+	lookupHost          = net.DefaultResolver.LookupHost
+)
+
+// checkUnitActive waits for the unit to become active until the context is
+// done, it fails at once when the unit failed.
+func checkUnitActive(ctx context.Context, unit string) error {
+	var status utils.UnitStatus
+	err := wait.PollUntilContextCancel(ctx, healthCheckInterval, true, func(context.Context) (bool, error) {
+		var err error
+		if status, err = getSystemdUnitStatus(unit); err != nil {
+			logrus.Warnf("Get status of %s failed, err: %v", unit, err)
+			return false, nil
+		}
+		if status.ActiveState == systemdUnitFailedState {
+			return false, fmt.Errorf("%s is failed (%s)", unit, status.SubState)
+		}
+		return status.ActiveState == systemdUnitActiveState, nil
+	})
+	if wait.Interrupted(err) {
+		return fmt.Errorf("%s is not active before the health check deadline, it is %s", unit, status.ActiveState)
+	}
+	return err
+}
+
+// checkNTPSynchronized waits for the clock to be synchronized by NTP with one
+// of the servers until the context is done, any source is accepted when no
+// server is configured.
+func checkNTPSynchronized(ctx context.Context, backend nodeconfigv1.NTPBackend, servers []nodeconfigv1.NTPServer) error {
+	var source string
+	err := wait.PollUntilContextCancel(ctx, healthCheckInterval, true, func(ctx context.Context) (bool, error) {
+		synchronized, err := getNTPSynchronized()
+		if err != nil {
+			logrus.Warnf("Get NTP synchronized status failed, err: %v", err)
+			return false, nil
+		}
+		if !synchronized || len(servers) == 0 {
+			return synchronized, nil
+		}
+		if source, err = getNTPSource(backend); err != nil {
+			logrus.Warnf("Get NTP source failed, err: %v", err)
+			return false, nil
+		}
+		return ntpSourceConfigured(ctx, source, servers), nil
+	})
+	if wait.Interrupted(err) {
+		if source != "" {
+			return fmt.Errorf("the clock is synchronized with %s instead of the NTP servers before the health check deadline", source)
+		}
+		return fmt.Errorf("the clock is not synchronized before the health check deadline")
+	}
+	return err
+}
+
+// currentNTPSource returns the server the backend is synchronized with, chrony
+// reports its address.
+func currentNTPSource(backend nodeconfigv1.NTPBackend) (string, error) {
+	if backend != nodeconfigv1.NTPBackendChrony {
+		return utils.GetTimesync1PropertiesServerName()
+	}
+	sources, err := utils.GetChronySources()
+	if err != nil {
+		return "", err
+	}
+	pos := slices.IndexFunc(sources, func(s utils.ChronySource) bool {
+		return s.Selected
+	})
+	if pos < 0 {
+		return "", nil
+	}
+	return sources[pos].Address, nil
+}
+
+// ntpSourceConfigured returns whether the source is one of the servers, or
+// one of their addresses.
+func ntpSourceConfigured(ctx context.Context, source string, servers []nodeconfigv1.NTPServer) bool {
+	if source == "" {
+		return false
+	}
+	for _, server := range servers {
+		if strings.EqualFold(server.Address, source) {
+			return true
+		}
+		addresses, err := lookupHost(ctx, server.Address)
+		if err != nil {
+			logrus.Warnf("Lookup NTP server %s failed, err: %v", server.Address, err)
+			continue
+		}
+		if slices.Contains(addresses, source) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+func newHealthCheckContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestCheckUnitActive(t *testing.T) {
+	healthCheckInterval = 10 * time.Millisecond
+	states := []string{"activating", "active"}
+	getSystemdUnitStatus = func(string) (utils.UnitStatus, error) {
+		status := utils.UnitStatus{ActiveState: states[0]}
+		if len(states) > 1 {
+			states = states[1:]
+		}
+		return status, nil
+	}
+	assert.Nil(t, checkUnitActive(newHealthCheckContext(t), systemdJournaldService))
+
+	states = []string{"failed"}
+	assert.EqualError(t, checkUnitActive(newHealthCheckContext(t), systemdJournaldService), "systemd-journald.service is failed ()")
+
+	states = []string{"activating"}
+	assert.EqualError(t, checkUnitActive(newHealthCheckContext(t), systemdJournaldService), "systemd-journald.service is not active before the health check deadline, it is activating")
+}
+
+func TestCheckNTPSynchronized(t *testing.T) {
+	healthCheckInterval = 10 * time.Millisecond
+	synchronized := false
+	getNTPSynchronized = func() (bool, error) {
+		return synchronized, nil
+	}
+	source := "ntp.example.com"
+	getNTPSource = func(nodeconfigv1.NTPBackend) (string, error) {
+		return source, nil
+	}
+	lookupHost = func(_ context.Context, host string) ([]string, error) {
+		return map[string][]string{"0.suse.pool.ntp.org": {"192.0.2.1"}}[host], nil
+	}
+	servers := []nodeconfigv1.NTPServer{{Address: "0.suse.pool.ntp.org"}}
+
+	assert.EqualError(t, checkNTPSynchronized(newHealthCheckContext(t), nodeconfigv1.NTPBackendTimesyncd, servers), "the clock is not synchronized before the health check deadline")
+
+	// synchronized with a source other than the servers
+	synchronized = true
+	assert.EqualError(t, checkNTPSynchronized(newHealthCheckContext(t), nodeconfigv1.NTPBackendTimesyncd, servers), "the clock is synchronized with ntp.example.com instead of the NTP servers before the health check deadline")
+	// any source is accepted without servers
+	assert.Nil(t, checkNTPSynchronized(newHealthCheckContext(t), nodeconfigv1.NTPBackendTimesyncd, nil))
+
+	// timesyncd reports the server name, chrony its address
+	source = "0.SUSE.pool.ntp.org"
+	assert.Nil(t, checkNTPSynchronized(newHealthCheckContext(t), nodeconfigv1.NTPBackendTimesyncd, servers))
+	source = "192.0.2.1"
+	assert.Nil(t, checkNTPSynchronized(newHealthCheckContext(t), nodeconfigv1.NTPBackendChrony, servers))
+
+	// the controller context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	synchronized = false
+	assert.NotNil(t, checkNTPSynchronized(ctx, nodeconfigv1.NTPBackendTimesyncd, servers))
+}
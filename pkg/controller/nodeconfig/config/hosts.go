@@ -0,0 +1,164 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+const (
+	hostAliasesStageName = "Runtime Host Aliases"
+	hostAliasesOEMOwner  = settingsOEMOwner + "/host-aliases"
+	hostsBlockBegin      = "# BEGIN harvester-node-manager host aliases"
+	hostsBlockEnd        = "# END harvester-node-manager host aliases"
+	hostHostsPath        = "/etc/hosts"
+)
+
+// The following would ordinarily be const, but we need to override them in unit tests
+var (
+	hostsPath = "/host/etc/hosts"
+	// hostRootHostsPath is /etc/hosts through the root of the host init,
+	// which is always the current file of the host
+	hostRootHostsPath = "/host/proc/1/root/etc/hosts"
+)
+
+// CheckHostsMount fails when /etc/hosts was replaced on the host since the
+// pod started, e.g. by `sed -i`. The single file bind mount keeps the
+// replaced file until the pod is restarted, the host aliases written to it
+// would not reach the host.
+func CheckHostsMount() error {
+	mounted, err := os.Stat(hostsPath)
+	if err != nil {
+		return fmt.Errorf("stat %s failed: %v", hostsPath, err)
+	}
+	current, err := os.Stat(hostRootHostsPath)
+	if err != nil {
+		return fmt.Errorf("stat %s failed: %v", hostRootHostsPath, err)
+	}
+	if !os.SameFile(mounted, current) {
+		return fmt.Errorf("%s is replaced on the host since the node manager started, restart the node manager pod to mount it again", hostHostsPath)
+	}
+	return nil
+}
+
+// currentHostsPath returns the path of the current /etc/hosts of the host,
+// the mounted one when the root of the host is not visible
+func currentHostsPath() string {
+	if _, err := os.Stat(hostRootHostsPath); err == nil {
+		return hostRootHostsPath
+	}
+	return hostsPath
+}
+
+// renderHostAliases returns the lines of the managed block of /etc/hosts
+func renderHostAliases(hostAliases []nodeconfigv1.HostAlias) []string {
+	if len(hostAliases) == 0 {
+		return nil
+	}
+	lines := []string{hostsBlockBegin}
+	for _, alias := range hostAliases {
+		lines = append(lines, fmt.Sprintf("%s %s", alias.IP, strings.Join(alias.Hostnames, " ")))
+	}
+	return append(lines, hostsBlockEnd)
+}
+
+// replaceHostsBlock replaces the managed block of the hosts file content, the
+// other lines are kept as they are.
+func replaceHostsBlock(content string, block []string) string {
+	var lines []string
+	inBlock := false
+	for _, line := range strings.Split(strings.TrimSuffix(content, "\n"), "\n") {
+		switch {
+		case line == "" && content == "":
+			// empty file, there is no line to keep
+		case line == hostsBlockBegin:
+			inBlock = true
+		case line == hostsBlockEnd:
+			inBlock = false
+		case !inBlock:
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, block...)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// ApplyHostAliases renders the host aliases into the managed block of
+// /etc/hosts and persists them, the block is removed when there is no alias.
+func ApplyHostAliases(hostAliases []nodeconfigv1.HostAlias) error {
+	if err := CheckHostsMount(); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(hostsPath)
+	if err != nil {
+		return fmt.Errorf("read %s failed: %v", hostsPath, err)
+	}
+
+	block := renderHostAliases(hostAliases)
+	content := replaceHostsBlock(string(data), block)
+	if content != string(data) {
+		logrus.Infof("Update host aliases in %s: %v", hostHostsPath, block)
+		// /etc/hosts is a single file bind mount, it could not be replaced by
+		// rename, and it is checked to still be the file of the host
+		if err := os.WriteFile(hostsPath, []byte(content), 0644); err != nil {
+			return fmt.Errorf("write %s failed: %v", hostsPath, err)
+		}
+	}
+
+	return updateHostAliasesPersistence(block)
+}
+
+// RemoveHostAliases removes the managed block from /etc/hosts
+func RemoveHostAliases() error {
+	return ApplyHostAliases(nil)
+}
+
+// HostAliasesPaths are the host files written by the host aliases
+func HostAliasesPaths() []string {
+	return []string{hostsPath}
+}
+
+// updateHostAliasesPersistence replaces the managed block on boot, because
+// /etc is not persistent.
+func updateHostAliasesPersistence(block []string) error {
+	if len(block) == 0 {
+		return RemovePersistentOEMSettings(hostAliasesOEMOwner, hostAliasesStageName)
+	}
+
+	quoted := make([]string, 0, len(block))
+	for _, line := range block {
+		quoted = append(quoted, fmt.Sprintf("'%s'", line))
+	}
+	return UpdatePersistentOEMSettings(hostAliasesOEMOwner, schema.Stage{
+		Name: hostAliasesStageName,
+		Commands: []string{
+			fmt.Sprintf("sed -i '/^%s$/,/^%s$/d' %s", hostsBlockBegin, hostsBlockEnd, hostHostsPath),
+			fmt.Sprintf("printf '%%s\\n' %s >> %s", strings.Join(quoted, " "), hostHostsPath),
+		},
+	})
+}
+
+// NewHostAliasesAppliedCondition returns the HostAliasesApplied condition, err
+// is the failure of the last attempt to apply the host aliases.
+func NewHostAliasesAppliedCondition(generation int64, err error) metav1.Condition {
+	cond := metav1.Condition{
+		Type:               string(nodeconfigv1.HostAliasesApplied),
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             "HostAliasesApplied",
+		Message:            "host aliases are applied",
+	}
+
+	if err != nil {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "HostAliasesFailed"
+		cond.Message = err.Error()
+	}
+	return cond
+}
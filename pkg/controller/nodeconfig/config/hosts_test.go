@@ -0,0 +1,75 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+func TestApplyHostAliases(t *testing.T) {
+	tmpDir := setupOEMTest(t)
+	hostsPath = tmpDir + "/hosts"
+	hostRootHostsPath = hostsPath
+	hosts := "127.0.0.1 localhost\n::1 localhost ipv6-localhost\n"
+	assert.Nil(t, os.WriteFile(hostsPath, []byte(hosts), 0644))
+
+	hostAliases := []v1beta1.HostAlias{
+		{IP: "10.0.0.10", Hostnames: []string{"registry.example.com", "registry"}},
+	}
+	assert.Nil(t, ApplyHostAliases(hostAliases))
+	raw, err := os.ReadFile(hostsPath)
+	assert.Nil(t, err)
+	assert.Equal(t, hosts+hostsBlockBegin+"\n10.0.0.10 registry.example.com registry\n"+hostsBlockEnd+"\n", string(raw))
+
+	yipConfig, err := utils.LoadYipConfig(settingsOEMPath)
+	assert.Nil(t, err)
+	assert.Equal(t, hostAliasesStageName, yipConfig.Stages[yipStageInitramfs][0].Name)
+	assert.Equal(t, []string{
+		"sed -i '/^" + hostsBlockBegin + "$/,/^" + hostsBlockEnd + "$/d' /etc/hosts",
+		"printf '%s\\n' '" + hostsBlockBegin + "' '10.0.0.10 registry.example.com registry' '" + hostsBlockEnd + "' >> /etc/hosts",
+	}, yipConfig.Stages[yipStageInitramfs][0].Commands)
+
+	// the lines added by others after the block are kept
+	assert.Nil(t, os.WriteFile(hostsPath, append(raw, []byte("10.0.0.20 other\n")...), 0644))
+	hostAliases[0].Hostnames = []string{"registry.example.com"}
+	assert.Nil(t, ApplyHostAliases(hostAliases))
+	raw, err = os.ReadFile(hostsPath)
+	assert.Nil(t, err)
+	assert.Equal(t, hosts+"10.0.0.20 other\n"+hostsBlockBegin+"\n10.0.0.10 registry.example.com\n"+hostsBlockEnd+"\n", string(raw))
+
+	assert.Nil(t, RemoveHostAliases())
+	raw, err = os.ReadFile(hostsPath)
+	assert.Nil(t, err)
+	assert.Equal(t, hosts+"10.0.0.20 other\n", string(raw))
+	_, err = os.Stat(settingsOEMPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCheckHostsMount(t *testing.T) {
+	tmpDir := setupOEMTest(t)
+	hostsPath = tmpDir + "/hosts"
+	hostRootHostsPath = tmpDir + "/root-hosts"
+	assert.Nil(t, os.WriteFile(hostsPath, []byte("127.0.0.1 localhost\n"), 0644))
+	assert.Nil(t, os.Link(hostsPath, hostRootHostsPath))
+	assert.Nil(t, CheckHostsMount())
+	applied, err := HashManagedPath(hostsPath)
+	assert.Nil(t, err)
+
+	// replaced on the host by a rename, the mounted file is left behind
+	assert.Nil(t, os.WriteFile(tmpDir+"/hosts.new", []byte("127.0.0.1 localhost\n10.0.0.20 other\n"), 0644))
+	assert.Nil(t, os.Rename(tmpDir+"/hosts.new", hostRootHostsPath))
+	assert.EqualError(t, CheckHostsMount(), "/etc/hosts is replaced on the host since the node manager started, restart the node manager pod to mount it again")
+	assert.NotNil(t, ApplyHostAliases([]v1beta1.HostAlias{{IP: "10.0.0.10", Hostnames: []string{"registry"}}}))
+	raw, err := os.ReadFile(hostsPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1 localhost\n", string(raw))
+
+	// the drift is observed on the file of the host
+	hash, err := HashManagedPath(hostsPath)
+	assert.Nil(t, err)
+	assert.NotEqual(t, applied, hash)
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/harvester/go-common/files"
+	"github.com/harvester/go-common/sys"
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+const (
+	journaldStageName       = "Runtime Journald Settings"
+	journaldOEMOwner        = settingsOEMOwner + "/journald"
+	systemdJournaldService  = "systemd-journald.service"
+	journaldDropInTempName  = "journald.conf"
+	journaldDropInFilePerms = 0644
+)
+
+// The following would ordinarily be const, but we need to override it in unit tests
+var restartJournald = func() error {
+	return sys.RestartService(systemdJournaldService)
+}
+
+// ApplyJournald writes the journald drop-in and restarts systemd-journald when
+// it is changed, then persists it. The drop-in is removed once the journald
+// config is removed from the NodeConfig.
+func ApplyJournald(journald *nodeconfigv1.JournaldConfig) error {
+	wanted := utils.GenerateJournaldConfig(journald)
+	current, err := os.ReadFile(utils.JournaldDropInPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read %s failed: %v", utils.JournaldDropInPath, err)
+	}
+	exists := err == nil
+
+	switch {
+	case journald == nil && !exists:
+		return RemovePersistentOEMSettings(journaldOEMOwner, journaldStageName)
+	case journald == nil:
+		logrus.Infof("Remove journald drop-in %s", utils.HostJournaldDropInPath)
+		if err := os.Remove(utils.JournaldDropInPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s failed: %v", utils.JournaldDropInPath, err)
+		}
+	case !exists || string(current) != wanted:
+		logrus.Infof("Update journald drop-in %s", utils.HostJournaldDropInPath)
+		dir := filepath.Dir(utils.JournaldDropInPath)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("create %s failed: %v", dir, err)
+		}
+		tmpFileName, err := files.GenerateTempFileWithDir([]byte(wanted), journaldDropInTempName, dir)
+		if err != nil {
+			return fmt.Errorf("generate temp journald drop-in failed: %v", err)
+		}
+		if err := os.Chmod(tmpFileName, journaldDropInFilePerms); err != nil {
+			return fmt.Errorf("chmod temp journald drop-in failed: %v", err)
+		}
+		if err := os.Rename(tmpFileName, utils.JournaldDropInPath); err != nil {
+			return fmt.Errorf("rename temp journald drop-in failed: %v", err)
+		}
+	default:
+		return updateJournaldPersistence(wanted)
+	}
+
+	logrus.Infof("Restart systemd-journald service ...")
+	if err := restartJournald(); err != nil {
+		return fmt.Errorf("restart systemd-journald failed: %v", err)
+	}
+	if journald == nil {
+		return RemovePersistentOEMSettings(journaldOEMOwner, journaldStageName)
+	}
+	return updateJournaldPersistence(wanted)
+}
+
+// RemoveJournald removes the journald drop-in written by the NodeConfig
+func RemoveJournald() error {
+	return ApplyJournald(nil)
+}
+
+// JournaldPaths are the host files written by the journald config
+func JournaldPaths() []string {
+	return []string{utils.JournaldDropInPath}
+}
+
+// ReloadJournald restarts systemd-journald once the drop-in is restored
+func ReloadJournald() error {
+	return restartJournald()
+}
+
+// CheckJournaldHealth waits for systemd-journald to become active
+func CheckJournaldHealth(ctx context.Context) error {
+	return checkUnitActive(ctx, systemdJournaldService)
+}
+
+// updateJournaldPersistence writes the drop-in on boot, before
+// systemd-journald is started in the root filesystem.
+func updateJournaldPersistence(raw string) error {
+	return UpdatePersistentOEMSettings(journaldOEMOwner, schema.Stage{
+		Name: journaldStageName,
+		Files: []schema.File{
+			{
+				Path:        utils.HostJournaldDropInPath,
+				Permissions: journaldDropInFilePerms,
+				Content:     raw,
+			},
+		},
+	})
+}
+
+// NewJournaldAppliedCondition returns the JournaldApplied condition, err is
+// the failure of the last attempt to apply the journald config.
+func NewJournaldAppliedCondition(generation int64, journald *nodeconfigv1.JournaldConfig, err error) metav1.Condition {
+	cond := metav1.Condition{
+		Type:               string(nodeconfigv1.JournaldApplied),
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             "JournaldApplied",
+		Message:            "journald config is applied",
+	}
+
+	switch {
+	case err != nil:
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "JournaldFailed"
+		cond.Message = err.Error()
+	case journald == nil:
+		cond.Reason = "JournaldNotManaged"
+		cond.Message = "journald config is not managed"
+	}
+	return cond
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+func TestApplyJournald(t *testing.T) {
+	tmpDir := setupOEMTest(t)
+	utils.JournaldDropInPath = tmpDir + "/journald.conf.d/" + utils.JournaldDropInName
+	restarts := 0
+	restartJournald = func() error {
+		restarts++
+		return nil
+	}
+
+	// not managed
+	assert.Nil(t, RemoveJournald())
+	assert.Equal(t, 0, restarts)
+
+	maxUse := resource.MustParse("2Gi")
+	forward := false
+	journald := &v1beta1.JournaldConfig{
+		SystemMaxUse:    &maxUse,
+		MaxRetentionSec: &metav1.Duration{Duration: 48 * time.Hour},
+		ForwardToSyslog: &forward,
+	}
+	expected := "# Generated by harvester-node-manager, do not edit\n" +
+		"[Journal]\n" +
+		"SystemMaxUse=2147483648\n" +
+		"MaxRetentionSec=172800s\n" +
+		"ForwardToSyslog=no\n"
+	assert.Nil(t, ApplyJournald(journald))
+	raw, err := os.ReadFile(utils.JournaldDropInPath)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, string(raw))
+	assert.Equal(t, 1, restarts)
+
+	yipConfig, err := utils.LoadYipConfig(settingsOEMPath)
+	assert.Nil(t, err)
+	assert.Equal(t, journaldStageName, yipConfig.Stages[yipStageInitramfs][0].Name)
+	assert.Equal(t, utils.HostJournaldDropInPath, yipConfig.Stages[yipStageInitramfs][0].Files[0].Path)
+	assert.Equal(t, expected, yipConfig.Stages[yipStageInitramfs][0].Files[0].Content)
+
+	// unchanged, journald is not restarted again
+	assert.Nil(t, ApplyJournald(journald))
+	assert.Equal(t, 1, restarts)
+
+	// local change is restored
+	assert.Nil(t, os.WriteFile(utils.JournaldDropInPath, []byte("[Journal]\n"), 0644))
+	assert.Nil(t, ApplyJournald(journald))
+	raw, err = os.ReadFile(utils.JournaldDropInPath)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, string(raw))
+	assert.Equal(t, 2, restarts)
+
+	assert.Nil(t, RemoveJournald())
+	_, err = os.Stat(utils.JournaldDropInPath)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 3, restarts)
+	_, err = os.Stat(settingsOEMPath)
+	assert.True(t, os.IsNotExist(err))
+}
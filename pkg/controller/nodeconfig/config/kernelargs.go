@@ -0,0 +1,280 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/harvester/go-common/files"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+const (
+	grubEnvHeader = "# GRUB Environment Block\n"
+	grubEnvSize   = 1024
+	// kernelArgsGrubVar is appended to the kernel command line by the
+	// Harvester GRUB config
+	kernelArgsGrubVar     = "third_party_kernel_args"
+	kernelArgsAppliedName = "kernel-args.applied"
+	kernelArgsGrubEnvName = "grubenv"
+)
+
+// The following would ordinarily be const, but we need to override them in unit tests
+var (
+	grubEnvPath     = "/host/oem/" + kernelArgsGrubEnvName
+	procCmdlinePath = "/proc/cmdline"
+	bootIDPath      = "/proc/sys/kernel/random/boot_id"
+	// kernelArgsAppliedPath keeps the args written by the NodeConfig, so the
+	// args added by others to the GRUB variable are kept, and the removed
+	// args are tracked until the node is rebooted.
+	kernelArgsAppliedPath = "/host/oem/" + kernelArgsAppliedName
+)
+
+type kernelArgsApplied struct {
+	Args []string `json:"args,omitempty"`
+	// Removed are the args removed from the boot config since BootID
+	Removed []string `json:"removed,omitempty"`
+	BootID  string   `json:"bootID,omitempty"`
+}
+
+type grubEnvVar struct {
+	name  string
+	value string
+}
+
+// readGrubEnv returns the variables of the GRUB environment block in order,
+// and the size of the block.
+func readGrubEnv() ([]grubEnvVar, int, error) {
+	data, err := os.ReadFile(grubEnvPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, grubEnvSize, nil
+		}
+		return nil, 0, fmt.Errorf("read %s failed: %v", grubEnvPath, err)
+	}
+	if !bytes.HasPrefix(data, []byte(grubEnvHeader)) {
+		return nil, 0, fmt.Errorf("%s is not a GRUB environment block", grubEnvPath)
+	}
+
+	var vars []grubEnvVar
+	var line strings.Builder
+	content := data[len(grubEnvHeader):]
+	for i := 0; i < len(content); i++ {
+		switch c := content[i]; {
+		case c == '\\' && i+1 < len(content):
+			i++
+			line.WriteByte(content[i])
+		case c == '\n':
+			if name, value, found := strings.Cut(line.String(), "="); found && !strings.HasPrefix(name, "#") {
+				vars = append(vars, grubEnvVar{name: name, value: value})
+			}
+			line.Reset()
+		default:
+			line.WriteByte(c)
+		}
+	}
+	return vars, max(len(data), grubEnvSize), nil
+}
+
+// writeGrubEnv writes the variables as grub2-editenv does, the block is
+// padded with `#` to keep its size.
+func writeGrubEnv(vars []grubEnvVar, size int) error {
+	escape := strings.NewReplacer(`\`, `\\`, "\n", "\\\n")
+	buf := bytes.NewBufferString(grubEnvHeader)
+	for _, v := range vars {
+		fmt.Fprintf(buf, "%s=%s\n", v.name, escape.Replace(v.value))
+	}
+	if buf.Len() > size {
+		return fmt.Errorf("GRUB environment block %s is too small", grubEnvPath)
+	}
+	buf.Write(bytes.Repeat([]byte("#"), size-buf.Len()))
+
+	tmpFileName, err := files.GenerateTempFileWithDir(buf.Bytes(), kernelArgsGrubEnvName, filepath.Dir(grubEnvPath))
+	if err != nil {
+		return fmt.Errorf("generate temp GRUB environment failed: %v", err)
+	}
+	if err := os.Rename(tmpFileName, grubEnvPath); err != nil {
+		return fmt.Errorf("rename temp GRUB environment failed: %v", err)
+	}
+	return nil
+}
+
+// updateGrubKernelArgs replaces the previously applied args in the GRUB
+// variable with the wanted ones, the args added by others are kept.
+func updateGrubKernelArgs(previous, wanted []string) error {
+	vars, size, err := readGrubEnv()
+	if err != nil {
+		return err
+	}
+
+	idx := slices.IndexFunc(vars, func(v grubEnvVar) bool { return v.name == kernelArgsGrubVar })
+	var args []string
+	if idx >= 0 {
+		for _, arg := range strings.Fields(vars[idx].value) {
+			if !slices.Contains(previous, arg) && !slices.Contains(wanted, arg) {
+				args = append(args, arg)
+			}
+		}
+	}
+	args = append(args, wanted...)
+	value := strings.Join(args, " ")
+
+	switch {
+	case idx >= 0 && vars[idx].value == value:
+		return nil
+	case idx >= 0 && value == "":
+		vars = slices.Delete(vars, idx, idx+1)
+	case idx >= 0:
+		vars[idx].value = value
+	case value == "":
+		return nil
+	default:
+		vars = append(vars, grubEnvVar{name: kernelArgsGrubVar, value: value})
+	}
+	logrus.Infof("Set GRUB variable %s to %q", kernelArgsGrubVar, value)
+	return writeGrubEnv(vars, size)
+}
+
+func loadKernelArgsApplied() (*kernelArgsApplied, error) {
+	applied := &kernelArgsApplied{}
+	data, err := os.ReadFile(kernelArgsAppliedPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return applied, nil
+		}
+		return nil, fmt.Errorf("read %s failed: %v", kernelArgsAppliedPath, err)
+	}
+	if err := json.Unmarshal(data, applied); err != nil {
+		return nil, fmt.Errorf("unmarshal %s failed: %v", kernelArgsAppliedPath, err)
+	}
+	return applied, nil
+}
+
+func saveKernelArgsApplied(applied *kernelArgsApplied) error {
+	if len(applied.Args) == 0 && len(applied.Removed) == 0 {
+		if err := os.Remove(kernelArgsAppliedPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s failed: %v", kernelArgsAppliedPath, err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(applied)
+	if err != nil {
+		return fmt.Errorf("marshal applied kernel args failed: %v", err)
+	}
+	tmpFileName, err := files.GenerateTempFileWithDir(data, kernelArgsAppliedName, filepath.Dir(kernelArgsAppliedPath))
+	if err != nil {
+		return fmt.Errorf("generate temp applied kernel args failed: %v", err)
+	}
+	return os.Rename(tmpFileName, kernelArgsAppliedPath)
+}
+
+func readFileString(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read %s failed: %v", path, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// ApplyKernelArgs writes the wanted kernel args to the GRUB environment, then
+// compares them with the running kernel command line. The returned status is
+// nil when no reboot is required.
+func ApplyKernelArgs(wanted []string) (*nodeconfigv1.KernelArgsStatus, error) {
+	applied, err := loadKernelArgsApplied()
+	if err != nil {
+		return nil, err
+	}
+	bootID, err := readFileString(bootIDPath)
+	if err != nil {
+		return nil, err
+	}
+	cmdline, err := readFileString(procCmdlinePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// the removed args are gone once the node is rebooted with the new
+	// boot config
+	if applied.BootID != bootID {
+		applied.Removed = nil
+	}
+	for _, arg := range applied.Args {
+		if !slices.Contains(wanted, arg) && !slices.Contains(applied.Removed, arg) {
+			applied.Removed = append(applied.Removed, arg)
+		}
+	}
+	applied.Removed = slices.DeleteFunc(applied.Removed, func(arg string) bool {
+		return slices.Contains(wanted, arg)
+	})
+
+	if err := updateGrubKernelArgs(applied.Args, wanted); err != nil {
+		return nil, fmt.Errorf("apply kernel args failed: %v", err)
+	}
+	applied.Args = slices.Clone(wanted)
+	applied.BootID = bootID
+	if err := saveKernelArgsApplied(applied); err != nil {
+		return nil, fmt.Errorf("apply kernel args failed: %v", err)
+	}
+
+	running := strings.Fields(cmdline)
+	status := &nodeconfigv1.KernelArgsStatus{}
+	for _, arg := range wanted {
+		if !slices.Contains(running, arg) {
+			status.Missing = append(status.Missing, arg)
+		}
+	}
+	for _, arg := range applied.Removed {
+		if slices.Contains(running, arg) {
+			status.Stale = append(status.Stale, arg)
+		}
+	}
+	if len(status.Missing) == 0 && len(status.Stale) == 0 {
+		return nil, nil
+	}
+	return status, nil
+}
+
+// RemoveKernelArgs removes the args written by the NodeConfig from the GRUB
+// environment, they are dropped from the kernel command line on next boot.
+func RemoveKernelArgs() error {
+	_, err := ApplyKernelArgs(nil)
+	return err
+}
+
+// NewRebootRequiredCondition returns the RebootRequired condition, err is the
+// failure of the last attempt to apply the kernel args.
+func NewRebootRequiredCondition(generation int64, status *nodeconfigv1.KernelArgsStatus, err error) metav1.Condition {
+	cond := metav1.Condition{
+		Type:               string(nodeconfigv1.RebootRequired),
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: generation,
+		Reason:             "KernelArgsApplied",
+		Message:            "the node is running with the wanted kernel args",
+	}
+
+	switch {
+	case err != nil:
+		cond.Status = metav1.ConditionUnknown
+		cond.Reason = "KernelArgsFailed"
+		cond.Message = err.Error()
+	case status != nil:
+		var changes []string
+		for _, arg := range status.Missing {
+			changes = append(changes, "+"+arg)
+		}
+		for _, arg := range status.Stale {
+			changes = append(changes, "-"+arg)
+		}
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "KernelArgsChanged"
+		cond.Message = fmt.Sprintf("reboot to apply the kernel args: %s", strings.Join(changes, " "))
+	}
+	return cond
+}
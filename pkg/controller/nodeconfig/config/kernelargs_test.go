@@ -0,0 +1,69 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+func TestApplyKernelArgs(t *testing.T) {
+	tmpDir := t.TempDir()
+	grubEnvPath = tmpDir + "/grubenv"
+	kernelArgsAppliedPath = tmpDir + "/kernel-args.applied"
+	procCmdlinePath = tmpDir + "/cmdline"
+	bootIDPath = tmpDir + "/boot_id"
+
+	grubEnv := func() string {
+		raw, err := os.ReadFile(grubEnvPath)
+		assert.Nil(t, err)
+		assert.Equal(t, 1024, len(raw))
+		return strings.TrimRight(string(raw), "#")
+	}
+	assert.Nil(t, os.WriteFile(bootIDPath, []byte("boot-1\n"), 0644))
+	assert.Nil(t, os.WriteFile(procCmdlinePath, []byte("BOOT_IMAGE=/cOS/active.img console=tty1 quiet\n"), 0644))
+	grubEnvData := "# GRUB Environment Block\nnext_entry=recovery\nthird_party_kernel_args=quiet\n"
+	assert.Nil(t, os.WriteFile(grubEnvPath, []byte(grubEnvData+strings.Repeat("#", 1024-len(grubEnvData))), 0644))
+
+	// the args added by others are kept
+	status, err := ApplyKernelArgs([]string{"intel_iommu=on", "iommu=pt"})
+	assert.Nil(t, err)
+	assert.Equal(t, &v1beta1.KernelArgsStatus{Missing: []string{"intel_iommu=on", "iommu=pt"}}, status)
+	assert.Equal(t, "# GRUB Environment Block\nnext_entry=recovery\nthird_party_kernel_args=quiet intel_iommu=on iommu=pt\n", grubEnv())
+	cond := NewRebootRequiredCondition(1, status, err)
+	assert.Equal(t, metav1.ConditionTrue, cond.Status)
+	assert.Equal(t, "reboot to apply the kernel args: +intel_iommu=on +iommu=pt", cond.Message)
+
+	// rebooted with the new args
+	assert.Nil(t, os.WriteFile(bootIDPath, []byte("boot-2\n"), 0644))
+	assert.Nil(t, os.WriteFile(procCmdlinePath, []byte("BOOT_IMAGE=/cOS/active.img quiet intel_iommu=on iommu=pt\n"), 0644))
+	status, err = ApplyKernelArgs([]string{"intel_iommu=on", "iommu=pt"})
+	assert.Nil(t, err)
+	assert.Nil(t, status)
+	assert.Equal(t, metav1.ConditionFalse, NewRebootRequiredCondition(1, status, err).Status)
+
+	// the removed args are stale until the next reboot
+	status, err = ApplyKernelArgs([]string{"intel_iommu=on"})
+	assert.Nil(t, err)
+	assert.Equal(t, &v1beta1.KernelArgsStatus{Stale: []string{"iommu=pt"}}, status)
+	status, err = ApplyKernelArgs([]string{"intel_iommu=on"})
+	assert.Nil(t, err)
+	assert.Equal(t, &v1beta1.KernelArgsStatus{Stale: []string{"iommu=pt"}}, status)
+	assert.Equal(t, "# GRUB Environment Block\nnext_entry=recovery\nthird_party_kernel_args=quiet intel_iommu=on\n", grubEnv())
+
+	assert.Nil(t, os.WriteFile(bootIDPath, []byte("boot-3\n"), 0644))
+	assert.Nil(t, os.WriteFile(procCmdlinePath, []byte("BOOT_IMAGE=/cOS/active.img quiet intel_iommu=on\n"), 0644))
+	status, err = ApplyKernelArgs([]string{"intel_iommu=on"})
+	assert.Nil(t, err)
+	assert.Nil(t, status)
+
+	assert.Nil(t, RemoveKernelArgs())
+	assert.Equal(t, "# GRUB Environment Block\nnext_entry=recovery\nthird_party_kernel_args=quiet\n", grubEnv())
+	applied, err := loadKernelArgsApplied()
+	assert.Nil(t, err)
+	assert.Equal(t, &kernelArgsApplied{Removed: []string{"intel_iommu=on"}, BootID: "boot-3"}, applied)
+}
@@ -0,0 +1,298 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/harvester/go-common/files"
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+const (
+	kernelModulesStageName   = "Runtime Kernel Modules"
+	kernelModulesOEMOwner    = settingsOEMOwner + "/kernel-modules"
+	modprobeConfigName       = "99-harvester-node-manager.conf"
+	hostModprobeConfigPath   = "/etc/modprobe.d/" + modprobeConfigName
+	modprobeBinary           = "/usr/sbin/modprobe"
+	kernelModulesAppliedName = "kernel-modules.applied"
+)
+
+// The following would ordinarily be const, but we need to override them in unit tests
+var (
+	sysModulePath      = "/sys/module"
+	modprobeConfigPath = "/host/etc/modprobe.d/" + modprobeConfigName
+	// kernelModulesAppliedPath keeps the modules loaded by the NodeConfig, so
+	// they could be unloaded once removed from the NodeConfig. The modules
+	// which were already loaded before are not recorded.
+	kernelModulesAppliedPath = "/host/oem/" + kernelModulesAppliedName
+	// modprobeCommand is replaced in unit tests
+	modprobeCommand = func(args ...string) ([]byte, error) {
+		return exec.Command(modprobeBinary, args...).CombinedOutput()
+	}
+)
+
+func modprobe(modules []string, load bool) error {
+	args := []string{"-a"}
+	if !load {
+		args = append(args, "-r")
+	}
+	args = append(args, modules...)
+	out, err := modprobeCommand(args...)
+	if err != nil {
+		// This ensures we capture some helpful information if modules can't
+		// be loaded.  For example, if /lib/modules isn't actually mounted in
+		// the container, we'll see something like this:
+		//   modprobe failed: exit status 1 (output: 'modprobe: WARNING: Module
+		//   vfio_pci not found in directory /lib/modules/5.14.21-150500.55.68-default[...]')
+		return fmt.Errorf("modprobe failed: %v (output: '%s')", err, out)
+	}
+	return nil
+}
+
+// loadKernelModule loads a single module with its parameters, modprobe in
+// the container does not read the host /etc/modprobe.d.
+func loadKernelModule(module, parameters string) error {
+	args := append([]string{module}, strings.Fields(parameters)...)
+	out, err := modprobeCommand(args...)
+	if err != nil {
+		return fmt.Errorf("modprobe failed: %v (output: '%s')", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// isKernelModuleLoaded also covers the built-in modules, which are not listed
+// in /proc/modules.
+func isKernelModuleLoaded(module string) bool {
+	_, err := os.Stat(filepath.Join(sysModulePath, strings.ReplaceAll(module, "-", "_")))
+	return err == nil
+}
+
+func loadAppliedKernelModules() ([]string, error) {
+	var applied []string
+	data, err := os.ReadFile(kernelModulesAppliedPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read %s failed: %v", kernelModulesAppliedPath, err)
+	}
+	if err := json.Unmarshal(data, &applied); err != nil {
+		return nil, fmt.Errorf("unmarshal %s failed: %v", kernelModulesAppliedPath, err)
+	}
+	return applied, nil
+}
+
+func saveAppliedKernelModules(applied []string) error {
+	if len(applied) == 0 {
+		if err := os.Remove(kernelModulesAppliedPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s failed: %v", kernelModulesAppliedPath, err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(applied)
+	if err != nil {
+		return fmt.Errorf("marshal applied kernel modules failed: %v", err)
+	}
+	tmpFileName, err := files.GenerateTempFileWithDir(data, kernelModulesAppliedName, filepath.Dir(kernelModulesAppliedPath))
+	if err != nil {
+		return fmt.Errorf("generate temp applied kernel modules failed: %v", err)
+	}
+	return os.Rename(tmpFileName, kernelModulesAppliedPath)
+}
+
+func generateModprobeConfigData() string {
+	return `# Generated by harvester-node-manager, do not edit.
+{{- range $module, $parameters := .Parameters }}
+options {{ $module }} {{ $parameters }}
+{{- end }}
+{{- range .Blacklist }}
+blacklist {{ . }}
+{{- end }}
+`
+}
+
+func generateModprobeConfigRawString(kernelModules *nodeconfigv1.KernelModulesConfig) (string, error) {
+	tmpl, err := template.New("modprobe").Parse(generateModprobeConfigData())
+	if err != nil {
+		return "", err
+	}
+	buf := bytes.NewBufferString("")
+	if err := tmpl.Execute(buf, kernelModules); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func updateModprobeConfig(raw string) error {
+	if raw == "" {
+		if err := os.Remove(modprobeConfigPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s failed: %v", modprobeConfigPath, err)
+		}
+		return nil
+	}
+
+	tmpFileName, err := files.GenerateTempFileWithDir([]byte(raw), modprobeConfigName, filepath.Dir(modprobeConfigPath))
+	if err != nil {
+		return fmt.Errorf("generate temp modprobe config failed: %v", err)
+	}
+	if err := os.Rename(tmpFileName, modprobeConfigPath); err != nil {
+		return fmt.Errorf("rename temp modprobe config failed: %v", err)
+	}
+	return nil
+}
+
+// ApplyKernelModules loads and unloads the kernel modules at runtime, then
+// persists the config to /etc/modprobe.d and the OEM settings. The modules
+// which are no longer wanted are unloaded, except the ones in keep, which are
+// still required by other sections. The status of each module is returned
+// even if the err is not nil.
+func ApplyKernelModules(kernelModules *nodeconfigv1.KernelModulesConfig, keep []string) ([]nodeconfigv1.KernelModuleStatus, error) {
+	if kernelModules == nil {
+		kernelModules = &nodeconfigv1.KernelModulesConfig{}
+	}
+
+	applied, err := loadAppliedKernelModules()
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	var newApplied []string
+	for _, module := range applied {
+		if slices.Contains(kernelModules.Load, module) {
+			newApplied = append(newApplied, module)
+			continue
+		}
+		if slices.Contains(keep, module) {
+			continue
+		}
+		logrus.Infof("Unload kernel module %s", module)
+		if err := modprobe([]string{module}, false); err != nil {
+			// the module might be in use, retry later but do not block the others
+			logrus.Warnf("Unload kernel module %s failed. err: %v", module, err)
+			newApplied = append(newApplied, module)
+		}
+	}
+
+	var status []nodeconfigv1.KernelModuleStatus
+	for _, module := range kernelModules.Load {
+		moduleStatus := nodeconfigv1.KernelModuleStatus{Name: module}
+		if !isKernelModuleLoaded(module) {
+			logrus.Infof("Load kernel module %s", module)
+			if err := loadKernelModule(module, kernelModules.Parameters[module]); err != nil {
+				moduleStatus.Error = err.Error()
+				errs = append(errs, err.Error())
+			} else if !slices.Contains(newApplied, module) {
+				newApplied = append(newApplied, module)
+			}
+		}
+		moduleStatus.Loaded = isKernelModuleLoaded(module)
+		status = append(status, moduleStatus)
+	}
+
+	for _, module := range kernelModules.Blacklist {
+		moduleStatus := nodeconfigv1.KernelModuleStatus{Name: module, Blacklisted: true}
+		if isKernelModuleLoaded(module) {
+			logrus.Infof("Unload blacklisted kernel module %s", module)
+			if err := modprobe([]string{module}, false); err != nil {
+				moduleStatus.Error = err.Error()
+				errs = append(errs, err.Error())
+			}
+		}
+		moduleStatus.Loaded = isKernelModuleLoaded(module)
+		status = append(status, moduleStatus)
+	}
+
+	if err := saveAppliedKernelModules(newApplied); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := updateKernelModulesPersistence(kernelModules); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return status, fmt.Errorf("apply kernel modules failed: %s", strings.Join(errs, "; "))
+	}
+	return status, nil
+}
+
+// RemoveKernelModules unloads the modules loaded by the NodeConfig and removes
+// the persistent config.
+func RemoveKernelModules(keep []string) error {
+	_, err := ApplyKernelModules(nil, keep)
+	return err
+}
+
+func updateKernelModulesPersistence(kernelModules *nodeconfigv1.KernelModulesConfig) error {
+	var raw string
+	if len(kernelModules.Parameters) > 0 || len(kernelModules.Blacklist) > 0 {
+		var err error
+		if raw, err = generateModprobeConfigRawString(kernelModules); err != nil {
+			return fmt.Errorf("generate modprobe config failed: %v", err)
+		}
+	}
+	if err := updateModprobeConfig(raw); err != nil {
+		return err
+	}
+
+	if raw == "" && len(kernelModules.Load) == 0 {
+		return RemovePersistentOEMSettings(kernelModulesOEMOwner, kernelModulesStageName)
+	}
+
+	stage := schema.Stage{
+		Name:    kernelModulesStageName,
+		Modules: kernelModules.Load,
+	}
+	if raw != "" {
+		stage.Files = []schema.File{
+			{
+				Path:        hostModprobeConfigPath,
+				Permissions: 0644,
+				Content:     raw,
+			},
+		}
+	}
+	return UpdatePersistentOEMSettings(kernelModulesOEMOwner, stage)
+}
+
+// NewKernelModulesLoadedCondition returns the KernelModulesLoaded condition,
+// err is the failure of the last attempt to apply the kernel modules.
+func NewKernelModulesLoadedCondition(generation int64, status []nodeconfigv1.KernelModuleStatus, err error) metav1.Condition {
+	cond := metav1.Condition{
+		Type:               string(nodeconfigv1.KernelModulesLoaded),
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             "KernelModulesLoaded",
+		Message:            "kernel modules are loaded",
+	}
+
+	var unexpected []string
+	for _, s := range status {
+		if s.Loaded == s.Blacklisted {
+			unexpected = append(unexpected, s.Name)
+		}
+	}
+
+	switch {
+	case err != nil:
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "KernelModulesFailed"
+		cond.Message = err.Error()
+	case len(unexpected) > 0:
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "KernelModulesUnexpected"
+		cond.Message = fmt.Sprintf("kernel modules are not in the wanted state: %s", strings.Join(unexpected, ", "))
+	}
+	return cond
+}
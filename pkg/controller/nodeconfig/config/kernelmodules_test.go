@@ -0,0 +1,87 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+func TestApplyKernelModules(t *testing.T) {
+	tmpDir := setupOEMTest(t)
+	kernelModulesAppliedPath = tmpDir + "/host/oem/kernel-modules.applied"
+	modprobeConfigPath = tmpDir + "/host/etc/modprobe.d/" + modprobeConfigName
+	sysModulePath = tmpDir + "/sys/module"
+	assert.Nil(t, os.MkdirAll(tmpDir+"/host/etc/modprobe.d", 0777))
+	assert.Nil(t, os.MkdirAll(sysModulePath+"/nouveau", 0777))
+	assert.Nil(t, os.MkdirAll(sysModulePath+"/vfio_pci", 0777))
+
+	// fake modprobe which only updates /sys/module
+	var calls [][]string
+	modprobeCommand = func(args ...string) ([]byte, error) {
+		calls = append(calls, args)
+		if args[0] == "-a" && args[1] == "-r" {
+			for _, module := range args[2:] {
+				assert.Nil(t, os.RemoveAll(sysModulePath+"/"+module))
+			}
+			return nil, nil
+		}
+		if args[0] == "missing" {
+			return []byte("modprobe: FATAL: Module missing not found"), errors.New("exit status 1")
+		}
+		return nil, os.MkdirAll(sysModulePath+"/"+strings.ReplaceAll(args[0], "-", "_"), 0777)
+	}
+
+	kernelModules := &v1beta1.KernelModulesConfig{
+		Load:       []string{"vfio_pci", "nvme-tcp", "kvm_intel"},
+		Blacklist:  []string{"nouveau"},
+		Parameters: map[string]string{"kvm_intel": "nested=1"},
+	}
+	status, err := ApplyKernelModules(kernelModules, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []v1beta1.KernelModuleStatus{
+		{Name: "vfio_pci", Loaded: true},
+		{Name: "nvme-tcp", Loaded: true},
+		{Name: "kvm_intel", Loaded: true},
+		{Name: "nouveau", Blacklisted: true},
+	}, status)
+	assert.Equal(t, [][]string{{"nvme-tcp"}, {"kvm_intel", "nested=1"}, {"-a", "-r", "nouveau"}}, calls)
+
+	// vfio_pci was loaded before, only the loaded modules are recorded
+	applied, err := loadAppliedKernelModules()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"nvme-tcp", "kvm_intel"}, applied)
+
+	// persisted to modprobe.d and OEM settings
+	raw, err := os.ReadFile(modprobeConfigPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "# Generated by harvester-node-manager, do not edit.\noptions kvm_intel nested=1\nblacklist nouveau\n", string(raw))
+	yipConfig, err := utils.LoadYipConfig(settingsOEMPath)
+	assert.Nil(t, err)
+	assert.Equal(t, kernelModulesStageName, yipConfig.Stages[yipStageInitramfs][0].Name)
+	assert.Equal(t, kernelModules.Load, yipConfig.Stages[yipStageInitramfs][0].Modules)
+	assert.Equal(t, hostModprobeConfigPath, yipConfig.Stages[yipStageInitramfs][0].Files[0].Path)
+
+	// failure keeps the modprobe output
+	calls = nil
+	status, err = ApplyKernelModules(&v1beta1.KernelModulesConfig{Load: []string{"nvme-tcp", "missing"}}, []string{"kvm_intel"})
+	assert.NotNil(t, err)
+	assert.False(t, status[1].Loaded)
+	assert.Contains(t, status[1].Error, "Module missing not found")
+	assert.Equal(t, "KernelModulesFailed", NewKernelModulesLoadedCondition(1, status, err).Reason)
+	// kvm_intel is still required by others, so it is not unloaded
+	assert.Equal(t, [][]string{{"missing"}}, calls)
+
+	calls = nil
+	assert.Nil(t, RemoveKernelModules(nil))
+	assert.Equal(t, [][]string{{"-a", "-r", "nvme-tcp"}}, calls)
+	_, err = os.Stat(modprobeConfigPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(kernelModulesAppliedPath)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -3,40 +3,38 @@ package config
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
 
 	"github.com/harvester/go-common/sys"
 	"github.com/mudler/yip/pkg/schema"
 	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
 )
 
 const (
-	spdkStageName = "Runtime SPDK Prerequisites"
-	hugepagesPath = "/sys/kernel/mm/hugepages/hugepages-2048kB/nr_hugepages"
+	spdkStageName    = "Runtime SPDK Prerequisites"
+	longhornOEMOwner = settingsOEMOwner + "/longhorn"
+	hugepageSize     = 2 * 1024 * 1024
 )
 
 var (
 	modulesToLoad = []string{"vfio_pci", "uio_pci_generic", "nvme_tcp"}
+
+	// The following would ordinarily be const, but we need to override it in unit tests
+	hugepagesPath = "/sys/kernel/mm/hugepages/hugepages-2048kB/nr_hugepages"
 )
 
-func modprobe(modules []string, load bool) error {
-	args := []string{"-a"}
-	if !load {
-		args = append(args, "-r")
-	}
-	args = append(args, modules...)
-	out, err := exec.Command("/usr/sbin/modprobe", args...).CombinedOutput()
-	if err != nil {
-		// This ensures we capture some helpful information if modules can't
-		// be loaded.  For example, if /lib/modules isn't actually mounted in
-		// the container, we'll see something like this:
-		//   modprobe failed: exit status 1 (output: 'modprobe: WARNING: Module
-		//   vfio_pci not found in directory /lib/modules/5.14.21-150500.55.68-default[...]')
-		return fmt.Errorf("modprobe failed: %v (output: '%s')", err, out)
+// LonghornKernelModules returns the kernel modules required by the Longhorn config
+func LonghornKernelModules(longhornConfig *nodeconfigv1.LonghornConfig) []string {
+	if longhornConfig == nil || !longhornConfig.EnableV2DataEngine {
+		return nil
 	}
-	return nil
+	return modulesToLoad
 }
 
 func setNrHugepages(n uint64) error {
@@ -85,7 +83,7 @@ func updateLonghornConfigPersistence(hugepagesToAllocate uint64) error {
 		stage.Sysctl = map[string]string{"vm.nr_hugepages": fmt.Sprintf("%d", hugepagesToAllocate)}
 	}
 
-	return UpdatePersistentOEMSettings(stage)
+	return UpdatePersistentOEMSettings(longhornOEMOwner, stage)
 }
 
 func EnableV2DataEngine(hugepagesToAllocate uint64) error {
@@ -136,15 +134,16 @@ func EnableV2DataEngine(hugepagesToAllocate uint64) error {
 		// Another possible corner case is where kubelet restart just fails for
 		// some reason, but in this case the best (or least worst) choice
 		// so far is to let the admin figure out what is causing the kubelet
-		// restart to fail, fix that thing, and restart it manually.
+		// restart to fail, fix that thing, and restart it manually. Both cases
+		// are reported by the KubeletRestartPending condition.
 		logrus.Infof("Restarting kubelet to set nr_hugepages=%d", hugepagesToAllocate)
 		return restartKubelet()
 	}
 
 	// We didn't get enough hugepages (not enough available unfragmented memory)
 	// but the system is now configured correctly so that if it's rebooted we should
-	// get the required allocation.
-	// TODO: record this somewhere (an event?) so that it can be picked up in the GUI
+	// get the required allocation. This is reported by the HugepagesAllocated
+	// condition so that it can be picked up in the GUI.
 	// Note that if there aren't enough hugepages, when harvester tries to enable the
 	// v2 data engine setting in Longhorn, the validator.longhorn.io admission webhook
 	// will pick up the failure and an error will be displayed on the harvester settings
@@ -161,7 +160,7 @@ func DisableV2DataEngine() error {
 	}
 
 	// Write the persistent config first, so we know it's saved...
-	if err := RemovePersistentOEMSettings(spdkStageName); err != nil {
+	if err := RemovePersistentOEMSettings(longhornOEMOwner, spdkStageName); err != nil {
 		return err
 	}
 
@@ -179,3 +178,89 @@ func DisableV2DataEngine() error {
 	// TODO: see comment in EnableV2DataEngine() about possible kubectl restart failure corner case
 	return restartKubelet()
 }
+
+// NewLonghornConditions returns the LonghornV2Ready, HugepagesAllocated and
+// KubeletRestartPending conditions, err is the failure of the last attempt to
+// enable or disable the V2 Data Engine. The kubelet only picks up hugepages
+// when restarted, so a restart is pending as long as the hugepages-2Mi
+// capacity of the node differs from the hugepages allocated on the host.
+func NewLonghornConditions(generation int64, longhornConfig *nodeconfigv1.LonghornConfig, node *corev1.Node, err error) []metav1.Condition {
+	enabled := longhornConfig != nil && longhornConfig.EnableV2DataEngine
+	var requested uint64
+	if enabled {
+		requested = uint64(longhornConfig.HugepagesToAllocate)
+	}
+
+	ready := metav1.Condition{
+		Type:   string(nodeconfigv1.LonghornV2Ready),
+		Status: metav1.ConditionFalse,
+	}
+	allocated := metav1.Condition{
+		Type:   string(nodeconfigv1.HugepagesAllocated),
+		Status: metav1.ConditionFalse,
+	}
+	restartPending := metav1.Condition{
+		Type:   string(nodeconfigv1.KubeletRestartPending),
+		Status: metav1.ConditionFalse,
+	}
+
+	nrHugepages, nrErr := getNrHugepages()
+	switch {
+	case nrErr != nil:
+		allocated.Status = metav1.ConditionUnknown
+		allocated.Reason = "HugepagesUnknown"
+		allocated.Message = nrErr.Error()
+		restartPending.Status = metav1.ConditionUnknown
+		restartPending.Reason = "HugepagesUnknown"
+		restartPending.Message = nrErr.Error()
+	default:
+		if !enabled {
+			allocated.Reason = "HugepagesNotRequested"
+			allocated.Message = "V2 Data Engine is disabled"
+		} else if nrHugepages >= requested {
+			allocated.Status = metav1.ConditionTrue
+			allocated.Reason = "HugepagesAllocated"
+			allocated.Message = fmt.Sprintf("%d hugepages are allocated", nrHugepages)
+		} else {
+			allocated.Reason = "InsufficientHugepages"
+			allocated.Message = fmt.Sprintf("Unable to allocate %d hugepages (only got %d)", requested, nrHugepages)
+		}
+
+		capacity := node.Status.Capacity[corev1.ResourceHugePagesPrefix+"2Mi"]
+		wanted := resource.NewQuantity(int64(nrHugepages)*hugepageSize, resource.BinarySI) //nolint:gosec
+		if capacity.Cmp(*wanted) != 0 {
+			restartPending.Status = metav1.ConditionTrue
+			restartPending.Reason = "HugepagesCapacityOutdated"
+			restartPending.Message = fmt.Sprintf("kubelet reports %s hugepages-2Mi while %s is allocated, kubelet needs to be restarted",
+				capacity.String(), wanted.String())
+		} else {
+			restartPending.Reason = "HugepagesCapacityUpToDate"
+			restartPending.Message = "kubelet reports the allocated hugepages"
+		}
+	}
+
+	switch {
+	case err != nil:
+		ready.Reason = "V2DataEngineFailed"
+		ready.Message = err.Error()
+	case !enabled:
+		ready.Reason = "V2DataEngineDisabled"
+		ready.Message = "V2 Data Engine is disabled"
+	case allocated.Status != metav1.ConditionTrue:
+		ready.Reason = allocated.Reason
+		ready.Message = allocated.Message
+	case restartPending.Status != metav1.ConditionFalse:
+		ready.Reason = "KubeletRestartPending"
+		ready.Message = restartPending.Message
+	default:
+		ready.Status = metav1.ConditionTrue
+		ready.Reason = "V2DataEngineReady"
+		ready.Message = "V2 Data Engine prerequisites are met"
+	}
+
+	conds := []metav1.Condition{ready, allocated, restartPending}
+	for i := range conds {
+		conds[i].ObservedGeneration = generation
+	}
+	return conds
+}
@@ -2,31 +2,29 @@ package config
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"html/template"
 	"io"
 	"os"
+	"path/filepath"
 	"reflect"
-	"slices"
-	"strings"
-	"sync"
+	"text/template"
 
 	"github.com/harvester/go-common/files"
 	"github.com/harvester/go-common/sys"
 	"github.com/mudler/yip/pkg/schema"
 	ctlnode "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
 	"github.com/sirupsen/logrus"
-	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
-	ctlv1 "github.com/harvester/node-manager/pkg/generated/controllers/node.harvesterhci.io/v1beta1"
 	"github.com/harvester/node-manager/pkg/utils"
 )
 
 const (
 	NTPName                   = "ntp"
+	ntpOEMOwner               = settingsOEMOwner + "/ntp"
 	systemdTimesyncdService   = "systemd-timesyncd.service"
 	timesyncdConfigPath       = "/host/etc/systemd/timesyncd.conf"
 	timesyncdConfigBackupPath = "/host/etc/systemd/timesyncd.conf.bak"
@@ -34,31 +32,37 @@ const (
 	timesyncdService          = "systemd-timesyncd"
 	timeWaitSyncService       = "systemd-time-wait-sync"
 	configNTPServer           = "ntpServer"
+	systemdChronydService     = "chronyd.service"
+	chronydService            = "chronyd"
+	hostChronyConfigPath      = "/etc/chrony.d/" + utils.ChronyConfigName
 )
 
-type NTPStatusAnnotation utils.NTPStatusAnnotation
+// The following would ordinarily be const, but we need to override it in unit tests
+var chronyConfigPath = utils.ChronyConfigPath + utils.ChronyConfigName
 
 type NTPHandler struct {
 	NTPConfig      *nodeconfigv1.NTPConfig
 	AppliedConfigs string // AppliedConfigs is a json format string, you should unmarshal it to AppliedConfigAnnotation
 	NodeClient     ctlnode.NodeClient
 	ConfName       string
-	mtx            *sync.Mutex
+
+	// chronyReplaced is set when switching from the chrony backend back to timesyncd
+	chronyReplaced bool
 }
 
-func NewNTPConfigHandler(mtx *sync.Mutex, nodes ctlnode.NodeController, confName string, ntpconfigs *nodeconfigv1.NTPConfig, appliedConfig string) *NTPHandler {
+func NewNTPConfigHandler(nodes ctlnode.NodeController, confName string, ntpconfigs *nodeconfigv1.NTPConfig, appliedConfig string) *NTPHandler {
 	newntpconfigs := reGenerateNTPConfig(ntpconfigs)
 	return &NTPHandler{
 		NTPConfig:      newntpconfigs,
 		AppliedConfigs: appliedConfig,
 		NodeClient:     nodes,
 		ConfName:       confName,
-		mtx:            mtx,
 	}
 }
 
-// DoNTPUpdate will backup and update NTP to system, return bool for restart service and generic error
-func (handler *NTPHandler) DoNTPUpdate(forceUpdate bool) (bool, error) {
+// Changed returns whether the NTP config needs to be updated, it is compared
+// with the applied config from the annotation unless forceUpdate is set.
+func (handler *NTPHandler) Changed(forceUpdate bool) bool {
 	var content nodeconfigv1.AppliedConfigAnnotation
 	if !forceUpdate && handler.AppliedConfigs != "" {
 		logrus.Infof("Found applied config from annotation: %s", handler.AppliedConfigs)
@@ -67,16 +71,22 @@ func (handler *NTPHandler) DoNTPUpdate(forceUpdate bool) (bool, error) {
 			logrus.Warnf("Unmarshal applied config from annotation failed, assume that is empty err: %v", err)
 		}
 
-		if content.NTPServers == handler.NTPConfig.NTPServers {
-			return false, nil
+		if !ntpConfigChanged(&content, handler.NTPConfig) {
+			return false
 		}
 	}
 
 	// if the incoming NTPServers is empty but we have annotation, we should remove the NTP config
-	if handler.NTPConfig.NTPServers == "" && handler.AppliedConfigs == "" {
+	return handler.NTPConfig.NTPServers != "" || handler.AppliedConfigs != ""
+}
+
+// DoNTPUpdate will backup and update NTP to system, return bool for restart service and generic error
+func (handler *NTPHandler) DoNTPUpdate(forceUpdate bool) (bool, error) {
+	if !handler.Changed(forceUpdate) {
 		return false, nil
 	}
 
+	// the original timesyncd config is kept for the rollback even if we switch to chrony
 	_, err := os.Stat(timesyncdConfigOriginPath)
 	if os.IsNotExist(err) {
 		logrus.Infof("Backup original ntp config ...")
@@ -85,6 +95,20 @@ func (handler *NTPHandler) DoNTPUpdate(forceUpdate bool) (bool, error) {
 		}
 	}
 
+	if handler.NTPConfig.Backend == nodeconfigv1.NTPBackendChrony {
+		logrus.Infof("Prepare to update chrony NTP server with: %s", handler.NTPConfig.NTPServers)
+		if err := handler.updateChronyConfig(); err != nil {
+			return false, fmt.Errorf("update chrony NTP config failed, skip this round. err: %v", err)
+		}
+		return true, nil
+	}
+
+	removed, err := removeChronyConfig()
+	if err != nil {
+		return false, fmt.Errorf("remove chrony NTP config failed, skip this round. err: %v", err)
+	}
+	handler.chronyReplaced = removed
+
 	logrus.Infof("Backup current ntp config ...")
 	if err := handler.backupNTPConfig(); err != nil {
 		return false, fmt.Errorf("backup NTP config failed, skip this round. err: %v", err)
@@ -98,6 +122,26 @@ func (handler *NTPHandler) DoNTPUpdate(forceUpdate bool) (bool, error) {
 	return true, nil
 }
 
+// ntpConfigChanged compares the applied config from the annotation with the wanted one
+func ntpConfigChanged(applied *nodeconfigv1.AppliedConfigAnnotation, wanted *nodeconfigv1.NTPConfig) bool {
+	appliedBackend := applied.NTPBackend
+	if appliedBackend == "" {
+		appliedBackend = nodeconfigv1.NTPBackendTimesyncd
+	}
+	if applied.NTPServers != wanted.NTPServers || appliedBackend != wanted.Backend {
+		return true
+	}
+
+	// per-server options and NTS are only rendered for chrony
+	if wanted.Backend != nodeconfigv1.NTPBackendChrony {
+		return false
+	}
+	if len(applied.NTPServerList) == 0 && len(wanted.Servers) == 0 {
+		return false
+	}
+	return !reflect.DeepEqual(applied.NTPServerList, wanted.Servers)
+}
+
 func generateNTPConfigTemplate(servers string) *NTPConfigTemplate {
 	return &NTPConfigTemplate{
 		NTPConfigKeyValuePairs: map[string]string{
@@ -140,46 +184,72 @@ func (handler *NTPHandler) updateNTPConfig() error {
 	return nil
 }
 
-func (handler *NTPHandler) UpdateNodeNTPAnnotation() error {
-	logrus.Debugf("Prepare to update currentNTPServer for node annotation: %s", handler.ConfName)
-	handler.mtx.Lock()
-	defer handler.mtx.Unlock()
-	node, err := handler.NodeClient.Get(handler.ConfName, metav1.GetOptions{})
-	if err != nil {
-		logrus.Errorf("Get node %s failed. err: %v", handler.ConfName, err)
-		return err
-	}
+func generateChronyConfigData() string {
+	return `# Generated by harvester-node-manager, do not edit.
+{{- range . }}
+server {{ .Address }}{{ range .Options }} {{ . }}{{ end }}{{ if .NTS }} nts{{ end }}
+{{- end }}
+`
+}
 
-	if _, found := node.Annotations[utils.AnnotationNTP]; !found {
-		logrus.Debugf("First update should be done by monitor, skip!")
-		return nil
+func (handler *NTPHandler) generateChronyConfigRawString() (string, error) {
+	tmpl, err := template.New("chrony").Parse(generateChronyConfigData())
+	if err != nil {
+		return "", err
 	}
-	annoNTPValue := node.Annotations[utils.AnnotationNTP]
-	var ntpValue NTPStatusAnnotation
-	if err := json.Unmarshal([]byte(annoNTPValue), &ntpValue); err != nil {
-		logrus.Errorf("Unmarshal annotation value failed. err: %v", err)
-		return err
+	buf := bytes.NewBufferString("")
+	if err := tmpl.Execute(buf, handler.NTPConfig.Servers); err != nil {
+		return "", err
 	}
-	logrus.Debugf("Current annotation value: %+v", ntpValue)
+	return buf.String(), nil
+}
 
-	ntpValue.CurrentNTPServers = handler.NTPConfig.NTPServers
+// updateChronyConfig write the chrony drop-in, chrony includes /etc/chrony.d/*.conf
+func (handler *NTPHandler) updateChronyConfig() error {
+	raw, err := handler.generateChronyConfigRawString()
+	if err != nil {
+		return fmt.Errorf("generate chrony Config Raw Buffer failed. err: %v", err)
+	}
 
-	bytes, err := json.Marshal(ntpValue)
+	tempChronyConfigName, err := files.GenerateTempFileWithDir([]byte(raw), utils.ChronyConfigName, filepath.Dir(chronyConfigPath))
 	if err != nil {
-		logrus.Errorf("Marshal annotation value fail, skip this round NTP check. err: %v", err)
-		return err
+		return fmt.Errorf("generate temp chrony config failed. err: %v", err)
 	}
 
-	nodeCpy := node.DeepCopy()
-	nodeCpy.Annotations[utils.AnnotationNTP] = string(bytes)
-	if !reflect.DeepEqual(node, nodeCpy) {
-		if _, err := handler.NodeClient.Update(nodeCpy); err != nil {
-			return err
-		}
+	if err := os.Rename(tempChronyConfigName, chronyConfigPath); err != nil {
+		return fmt.Errorf("rename temp chrony config failed. err: %v", err)
 	}
+
 	return nil
 }
 
+// removeChronyConfig removes the chrony drop-in, return true if it was present
+func removeChronyConfig() (bool, error) {
+	if _, err := os.Stat(chronyConfigPath); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	logrus.Infof("Remove chrony NTP config %s ...", chronyConfigPath)
+	return true, files.RemoveFiles(chronyConfigPath)
+}
+
+// UpdateNodeNTPAnnotation records the servers in the NTP annotation of the
+// node, the annotation is created by the NTP monitor which owns the other
+// fields.
+func (handler *NTPHandler) UpdateNodeNTPAnnotation() error {
+	logrus.Debugf("Prepare to update currentNTPServer for node annotation: %s", handler.ConfName)
+	return utils.UpdateNTPStatusAnnotation(handler.NodeClient, handler.ConfName, func(value *utils.NTPStatusAnnotation, found bool) bool {
+		if !found {
+			logrus.Debugf("First update should be done by monitor, skip!")
+			return false
+		}
+		value.CurrentNTPServers = handler.NTPConfig.NTPServers
+		return true
+	})
+}
+
 func (handler *NTPHandler) backupNTPConfig() error {
 	if _, err := files.BackupFile(timesyncdConfigPath); err != nil {
 		return fmt.Errorf("backup NTP config failed. err: %v", err)
@@ -212,167 +282,154 @@ func NTPConfigRollback() error {
 	return err
 }
 
-func (handler *NTPHandler) RestartService() error {
-	logrus.Infof("Restart systemd-timesyncd service ...")
-	return sys.RestartService(systemdTimesyncdService)
-}
-
-// make NTP configuration persistence, using 99_settings.yaml to make sure we are later than 99_oem.yaml
-func (handler *NTPHandler) UpdateNTPConfigPersistence() error {
-	logrus.Infof("Prepare to make NTP configuration persistence ...")
-	ntpServer := handler.NTPConfig.NTPServers
-	ntpStages := generateNTPStages(ntpServer)
-	return UpdatePersistentOEMSettings(ntpStages)
-}
-
-func generateNTPStages(ntpserver string) schema.Stage {
-	return schema.Stage{
-		Name: NTPName,
-		TimeSyncd: map[string]string{
-			"NTP": ntpserver,
-		},
-		Systemctl: schema.Systemctl{
-			Enable: []string{"systemd-timesyncd", "systemd-time-wait-sync"},
-		},
+// RemoveChronyNTPConfig removes the chrony drop-in and hands over to timesyncd again, it may called by OnRemove
+func RemoveChronyNTPConfig() error {
+	removed, err := removeChronyConfig()
+	if err != nil || !removed {
+		return err
 	}
-}
-
-func RemovePersistentNTPConfig() error {
-	return RemovePersistentOEMSettings(NTPName)
-}
-
-func CheckConfigApplied(configName string, status nodeconfigv1.NodeConfigStatus) bool {
-	switch configName {
-	case "ntp":
-		return ntpConfigWaitApplied(status)
-	default:
-		logrus.Warnf("Unknown config name: %s, we should not be blocked here", configName)
-		return false
+	logrus.Infof("Stop chronyd service ...")
+	if err := utils.StopService(systemdChronydService); err != nil {
+		return err
 	}
+	return sys.RestartService(systemdTimesyncdService)
 }
 
-func ntpConfigWaitApplied(status nodeconfigv1.NodeConfigStatus) bool {
-	// apply NTP config first time
-	var configModified, configApplied bool
-	if status.NTPConditions == nil {
-		return true
+func (handler *NTPHandler) RestartService() error {
+	if handler.NTPConfig.Backend == nodeconfigv1.NTPBackendChrony {
+		// both daemons would fight over the clock, so make sure only chronyd is running
+		logrus.Infof("Stop systemd-timesyncd service ...")
+		if err := utils.StopService(systemdTimesyncdService); err != nil {
+			return err
+		}
+		logrus.Infof("Restart chronyd service ...")
+		return sys.RestartService(systemdChronydService)
 	}
 
-	for _, cond := range status.NTPConditions {
-		if cond.Type == nodeconfigv1.ConfigModified {
-			configModified = cond.Status == corev1.ConditionTrue
-		}
-		if cond.Type == nodeconfigv1.ConfigApplied {
-			configApplied = cond.Status == corev1.ConditionTrue
+	if handler.chronyReplaced {
+		logrus.Infof("Stop chronyd service ...")
+		if err := utils.StopService(systemdChronydService); err != nil {
+			return err
 		}
 	}
-	return (configModified && !configApplied)
+	logrus.Infof("Restart systemd-timesyncd service ...")
+	return sys.RestartService(systemdTimesyncdService)
 }
 
-// conds: ConfigModified : False + ConfigApplied : True
-func UpdateNTPConfigApplied(nodecfgctl ctlv1.NodeConfigController, nodecfg *nodeconfigv1.NodeConfig) (*nodeconfigv1.NodeConfig, error) {
-	conds := []nodeconfigv1.ConfigStatus{
-		NewNTPConfigModifiedCondition(corev1.ConditionFalse),
-		NewNTPConfigAppliedCondition(corev1.ConditionTrue),
-	}
-	nodecfgCpy := nodecfg.DeepCopy()
-	if err := updateNodeConfigStatus(NTPName, &nodecfgCpy.Status, conds); err != nil {
-		logrus.Errorf("Update NTP config status to applied failed. err: %v", err)
-		return nil, err
+// CheckHealth waits for the NTP service of the backend to become active, and
+// the clock to be synchronized with one of the servers
+func (handler *NTPHandler) CheckHealth(ctx context.Context) error {
+	service := systemdTimesyncdService
+	if handler.NTPConfig.Backend == nodeconfigv1.NTPBackendChrony {
+		service = systemdChronydService
 	}
-	if !reflect.DeepEqual(nodecfg.Status, nodecfgCpy.Status) {
-		return nodecfgctl.UpdateStatus(nodecfgCpy)
+	if err := checkUnitActive(ctx, service); err != nil {
+		return err
 	}
-	return nodecfg, nil
+	return checkNTPSynchronized(ctx, handler.NTPConfig.Backend, handler.NTPConfig.Servers)
 }
 
-// conds: ConfigModified : True + ConfigApplied : False
-func UpdateNTPConfigChanged(nodecfgctl ctlv1.NodeConfigController, nodecfg *nodeconfigv1.NodeConfig) (*nodeconfigv1.NodeConfig, error) {
-	conds := []nodeconfigv1.ConfigStatus{
-		NewNTPConfigModifiedCondition(corev1.ConditionTrue),
-		NewNTPConfigAppliedCondition(corev1.ConditionFalse),
-	}
-	nodecfgCpy := nodecfg.DeepCopy()
-	if err := updateNodeConfigStatus(NTPName, &nodecfgCpy.Status, conds); err != nil {
-		logrus.Errorf("Update NTP config status to changed failed. err: %v", err)
-		return nil, err
-	}
-	if !reflect.DeepEqual(nodecfg.Status, nodecfgCpy.Status) {
-		logrus.Infof("DEBUG: update status: %+v", nodecfgCpy.Status)
-		return nodecfgctl.UpdateStatus(nodecfgCpy)
-	}
-	return nodecfg, nil
+// NTPPaths are the host files written by the NTP config
+func NTPPaths() []string {
+	return []string{timesyncdConfigPath, timesyncdConfigOriginPath, chronyConfigPath}
 }
 
-func NewNTPConfigModifiedCondition(status corev1.ConditionStatus) nodeconfigv1.ConfigStatus {
-	return nodeconfigv1.ConfigStatus{
-		Type:    nodeconfigv1.ConfigModified,
-		Status:  status,
-		Reason:  "NTPConfigModified",
-		Message: "NTP config is created or modified, need to wait it to be applied",
+// ReloadNTP restarts the NTP service of the backend the host files are for,
+// once they are restored.
+func ReloadNTP() error {
+	if _, err := os.Stat(chronyConfigPath); err == nil {
+		if err := utils.StopService(systemdTimesyncdService); err != nil {
+			return err
+		}
+		return sys.RestartService(systemdChronydService)
+	}
+	if err := utils.StopService(systemdChronydService); err != nil {
+		return err
 	}
+	return sys.RestartService(systemdTimesyncdService)
 }
 
-func NewNTPConfigAppliedCondition(status corev1.ConditionStatus) nodeconfigv1.ConfigStatus {
-	return nodeconfigv1.ConfigStatus{
-		Type:    nodeconfigv1.ConfigApplied,
-		Status:  status,
-		Reason:  "NTPConfigApplied",
-		Message: "NTP config is Applied",
+// make NTP configuration persistence, using 99_settings.yaml to make sure we are later than 99_oem.yaml
+func (handler *NTPHandler) UpdateNTPConfigPersistence() error {
+	logrus.Infof("Prepare to make NTP configuration persistence ...")
+	ntpStages, err := handler.generateNTPStages()
+	if err != nil {
+		return err
 	}
+	return UpdatePersistentOEMSettings(ntpOEMOwner, ntpStages)
 }
 
-func updateNodeConfigStatus(configName string, status *nodeconfigv1.NodeConfigStatus, conds []nodeconfigv1.ConfigStatus) error {
-	switch configName {
-	case "ntp":
-		for _, cond := range conds {
-			status.NTPConditions = updateCondition(status.NTPConditions, cond)
+func (handler *NTPHandler) generateNTPStages() (schema.Stage, error) {
+	if handler.NTPConfig.Backend == nodeconfigv1.NTPBackendChrony {
+		raw, err := handler.generateChronyConfigRawString()
+		if err != nil {
+			return schema.Stage{}, fmt.Errorf("generate chrony Config Raw Buffer failed. err: %v", err)
 		}
-	default:
-		return fmt.Errorf("not supported config name: %s", configName)
+		return schema.Stage{
+			Name: NTPName,
+			Files: []schema.File{
+				{
+					Path:        hostChronyConfigPath,
+					Permissions: 0644,
+					Content:     raw,
+				},
+			},
+			Systemctl: schema.Systemctl{
+				Enable:  []string{chronydService},
+				Disable: []string{timesyncdService},
+			},
+		}, nil
 	}
-	return nil
+
+	return schema.Stage{
+		Name: NTPName,
+		TimeSyncd: map[string]string{
+			"NTP": handler.NTPConfig.NTPServers,
+		},
+		Systemctl: schema.Systemctl{
+			Enable: []string{timesyncdService, timeWaitSyncService},
+			// chronyd is enabled by the stage of the chrony backend, both
+			// daemons would fight over the clock on the next boot
+			Disable: []string{chronydService},
+		},
+	}, nil
 }
 
-func updateCondition(conditions []nodeconfigv1.ConfigStatus, c nodeconfigv1.ConfigStatus) []nodeconfigv1.ConfigStatus {
-	found := false
-	var pos = 0
-	logrus.Debugf("Prepare to check the coming Type: %s, Status: %s", c.Type, c.Status)
-	for id, condition := range conditions {
-		logrus.Debugf("condition.Type: %s, condition.Status: %s", condition.Type, condition.Status)
-		if condition.Type == c.Type {
-			found = true
-			pos = id
-			break
-		}
-	}
+func RemovePersistentNTPConfig() error {
+	return RemovePersistentOEMSettings(ntpOEMOwner, NTPName)
+}
 
-	if found {
-		logrus.Debugf("found Current Type: %s, condition.Status: %s", conditions[pos].Type, conditions[pos].Status)
-		if conditions[pos].Status != c.Status {
-			conditions[pos] = c
+// NewNTPAppliedCondition returns the NTPApplied condition, err is the
+// failure of the last attempt to apply the NTP config.
+func NewNTPAppliedCondition(generation int64, err error) metav1.Condition {
+	if err != nil {
+		return metav1.Condition{
+			Type:               string(nodeconfigv1.NTPApplied),
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: generation,
+			Reason:             "NTPConfigFailed",
+			Message:            err.Error(),
 		}
-	} else {
-		conditions = append(conditions, c)
 	}
-	return conditions
+	return metav1.Condition{
+		Type:               string(nodeconfigv1.NTPApplied),
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             "NTPConfigApplied",
+		Message:            "NTP config is applied",
+	}
 }
 
 func reGenerateNTPConfig(ntpconfigs *nodeconfigv1.NTPConfig) *nodeconfigv1.NTPConfig {
-	if ntpconfigs.NTPServers == "" {
-		return ntpconfigs
-	}
-
-	// fileter the duplicated NTP servers
-	currentNTPServers := strings.Split(ntpconfigs.NTPServers, " ")
-	parsedNTPServers := make([]string, 0)
-	for _, ntpServer := range currentNTPServers {
-		if !slices.Contains(parsedNTPServers, ntpServer) {
-			parsedNTPServers = append(parsedNTPServers, ntpServer)
-		}
+	// filter the duplicated NTP servers and fold the legacy string into the list
+	servers := utils.GetNTPServers(ntpconfigs)
+	backend := nodeconfigv1.NTPBackendTimesyncd
+	if ntpconfigs != nil && ntpconfigs.Backend != "" {
+		backend = ntpconfigs.Backend
 	}
 	return &nodeconfigv1.NTPConfig{
-		NTPServers: strings.Join(parsedNTPServers, " "),
+		NTPServers: utils.NTPServersToString(servers),
+		Servers:    servers,
+		Backend:    backend,
 	}
-
 }
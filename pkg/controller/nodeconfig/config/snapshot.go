@@ -0,0 +1,157 @@
+package config
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"syscall"
+
+	"github.com/harvester/go-common/files"
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/sirupsen/logrus"
+
+	"github.com/harvester/node-manager/pkg/oem"
+)
+
+// Snapshot is the content of the host files written by a section, along with
+// the initramfs stages of the OEM settings, taken before the section is
+// applied so the section could be restored when it fails.
+type Snapshot struct {
+	// files maps the path to its content, nil when the file did not exist
+	files  map[string]*fileSnapshot
+	stages []schema.Stage
+	// owners maps the names of the stages to their owners
+	owners map[string]string
+}
+
+type fileSnapshot struct {
+	data []byte
+	perm os.FileMode
+}
+
+// TakeSnapshot reads the files and the initramfs stages of the OEM settings
+func TakeSnapshot(paths ...string) (*Snapshot, error) {
+	snapshot := &Snapshot{files: make(map[string]*fileSnapshot, len(paths))}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			snapshot.files[path] = nil
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("stat %s failed: %v", path, err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read %s failed: %v", path, err)
+		}
+		snapshot.files[path] = &fileSnapshot{data: data, perm: info.Mode().Perm()}
+	}
+
+	stages, err := settingsOEMStore().Stages()
+	if err != nil {
+		return nil, fmt.Errorf("read stages of %s failed: %v", settingsOEMPath, err)
+	}
+	snapshot.stages = stages[yipStageInitramfs]
+	if snapshot.owners, err = settingsOEMStore().Owners(yipStageInitramfs); err != nil {
+		return nil, fmt.Errorf("read owners of %s failed: %v", settingsOEMPath, err)
+	}
+	return snapshot, nil
+}
+
+// Restore writes back the files, the ones which did not exist are removed.
+// The initramfs stages which are changed since the snapshot was taken are
+// restored too. All files are restored even if some of them fail.
+func (s *Snapshot) Restore() error {
+	var errs []error
+	for path, file := range s.files {
+		if err := restoreFile(path, file); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := s.restoreStages(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func restoreFile(path string, file *fileSnapshot) error {
+	if file == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s failed: %v", path, err)
+		}
+		return nil
+	}
+	current, err := os.ReadFile(path)
+	if err == nil && slices.Equal(current, file.data) {
+		return nil
+	}
+	logrus.Infof("Restore %s from the snapshot", path)
+	tmpFileName, err := files.GenerateTempFileFullOptions(file.data, filepath.Base(path), filepath.Dir(path), file.perm)
+	if err != nil {
+		return fmt.Errorf("restore %s failed: %v", path, err)
+	}
+	err = os.Rename(tmpFileName, path)
+	if err == nil {
+		return nil
+	}
+	os.Remove(tmpFileName)
+	// a single file bind mount, e.g. /etc/hosts, could not be replaced by
+	// rename, it is written in place
+	if !errors.Is(err, syscall.EBUSY) {
+		return fmt.Errorf("restore %s failed: %v", path, err)
+	}
+	if err := os.WriteFile(path, file.data, file.perm); err != nil {
+		return fmt.Errorf("restore %s failed: %v", path, err)
+	}
+	return nil
+}
+
+// restoreStages only touches the stages which differ from the snapshot, so the
+// stages which are not owned by the NodeConfig are left alone. Each stage is
+// restored by its owner.
+func (s *Snapshot) restoreStages() error {
+	store := settingsOEMStore()
+	stages, err := store.Stages()
+	if err != nil {
+		return fmt.Errorf("read stages of %s failed: %v", settingsOEMPath, err)
+	}
+	owners, err := store.Owners(yipStageInitramfs)
+	if err != nil {
+		return fmt.Errorf("read owners of %s failed: %v", settingsOEMPath, err)
+	}
+	restore := func(name string, fn func(tx *oem.Tx) error) error {
+		owner := cmp.Or(owners[name], s.owners[name], settingsOEMOwner)
+		result, err := store.Update(owner, fn)
+		if err != nil {
+			return fmt.Errorf("restore stage %s of %s failed: %v", name, settingsOEMPath, err)
+		}
+		recordForeignEdit(settingsOEMPath, result)
+		return nil
+	}
+
+	var errs []error
+	current := stages[yipStageInitramfs]
+	for _, stage := range current {
+		if slices.ContainsFunc(s.stages, func(snapshotted schema.Stage) bool { return snapshotted.Name == stage.Name }) {
+			continue
+		}
+		errs = append(errs, restore(stage.Name, func(tx *oem.Tx) error {
+			return tx.Delete(yipStageInitramfs, stage.Name)
+		}))
+	}
+	for _, stage := range s.stages {
+		pos := slices.IndexFunc(current, func(existing schema.Stage) bool { return existing.Name == stage.Name })
+		if pos >= 0 && reflect.DeepEqual(current[pos], stage) {
+			continue
+		}
+		errs = append(errs, restore(stage.Name, func(tx *oem.Tx) error {
+			return tx.Put(yipStageInitramfs, stage)
+		}))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+func TestSnapshot(t *testing.T) {
+	tmpDir := setupOEMTest(t)
+	existingPath := tmpDir + "/timesyncd.conf"
+	createdPath := tmpDir + "/timesyncd.conf.origin"
+	assert.Nil(t, os.WriteFile(existingPath, []byte("[Time]\n"), 0600))
+	dnsStage := schema.Stage{Name: dnsStageName, Commands: []string{"netconfig update"}}
+	assert.Nil(t, UpdatePersistentOEMSettings(dnsOEMOwner, dnsStage))
+
+	snapshot, err := TakeSnapshot(existingPath, createdPath)
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.WriteFile(existingPath, []byte("[Time]\nNTP=0.suse.pool.ntp.org\n"), 0600))
+	assert.Nil(t, os.WriteFile(createdPath, []byte("[Time]\n"), 0644))
+	assert.Nil(t, UpdatePersistentOEMSettings(dnsOEMOwner, schema.Stage{Name: dnsStageName}))
+	assert.Nil(t, UpdatePersistentOEMSettings(ntpOEMOwner, schema.Stage{Name: "Runtime NTP Settings"}))
+
+	assert.Nil(t, snapshot.Restore())
+	raw, err := os.ReadFile(existingPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "[Time]\n", string(raw))
+	info, err := os.Stat(existingPath)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	_, err = os.Stat(createdPath)
+	assert.True(t, os.IsNotExist(err))
+	yipConfig, err := utils.LoadYipConfig(settingsOEMPath)
+	assert.Nil(t, err)
+	assert.Equal(t, []schema.Stage{dnsStage}, yipConfig.Stages[yipStageInitramfs])
+
+	// nothing is changed since the snapshot
+	assert.Nil(t, snapshot.Restore())
+}
+
+func TestSnapshotBindMount(t *testing.T) {
+	tmpDir := setupOEMTest(t)
+	hostPath := tmpDir + "/host-hosts"
+	path := tmpDir + "/hosts"
+	require.Nil(t, os.WriteFile(hostPath, []byte("127.0.0.1 localhost\n"), 0644))
+	require.Nil(t, os.WriteFile(path, nil, 0644))
+	if err := unix.Mount(hostPath, path, "", unix.MS_BIND, ""); err != nil {
+		t.Skipf("bind mount is not permitted: %v", err)
+	}
+	t.Cleanup(func() { _ = unix.Unmount(path, 0) })
+
+	snapshot, err := TakeSnapshot(path)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(path, []byte("127.0.0.1 localhost\n10.0.0.1 registry.example.com\n"), 0644))
+
+	// the mount point could not be replaced by rename, it is restored in place
+	assert.Nil(t, snapshot.Restore())
+	raw, err := os.ReadFile(hostPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1 localhost\n", string(raw))
+	entries, err := os.ReadDir(tmpDir)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		if entry.Name() != "hosts" {
+			assert.False(t, strings.HasPrefix(entry.Name(), "hosts"), "the temp file %s is removed", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/harvester/go-common/files"
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+const (
+	swapStageName   = "Runtime Swap"
+	swapOEMOwner    = settingsOEMOwner + "/swap"
+	swapAppliedName = "swap.applied"
+	swapService     = "harvester-node-manager-swap.service"
+	// the priorities tell our swap devices from the others, zram is used
+	// before the swapfile
+	zramSwapPriority = 100
+	fileSwapPriority = 10
+)
+
+// The following would ordinarily be const, but we need to override them in unit tests
+var (
+	procSwapsPath   = "/proc/swaps"
+	zramControlPath = "/sys/class/zram-control"
+	sysBlockPath    = "/sys/block"
+	// swapAppliedPath keeps the swapfile we created, so it could be removed
+	// when it is no longer wanted.
+	swapAppliedPath = "/host/oem/" + swapAppliedName
+	// runSwapCommand runs the script on the host, the swap devices and files
+	// are only visible there
+	runSwapCommand = func(script string) error {
+		return utils.RunHostCommand(swapService, []string{"/bin/sh", "-c", script})
+	}
+)
+
+type swapApplied struct {
+	File string `json:"file,omitempty"`
+	Size int64  `json:"size,omitempty"`
+}
+
+type swapEntry struct {
+	name     string
+	typ      string
+	size     int64
+	used     int64
+	priority int32
+}
+
+// readSwaps returns the active swap devices, the sizes are in bytes
+func readSwaps() ([]swapEntry, error) {
+	data, err := os.ReadFile(procSwapsPath)
+	if err != nil {
+		return nil, fmt.Errorf("read %s failed: %v", procSwapsPath, err)
+	}
+	var entries []swapEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 5 || fields[0] == "Filename" {
+			continue
+		}
+		size, sizeErr := strconv.ParseInt(fields[2], 10, 64)
+		used, usedErr := strconv.ParseInt(fields[3], 10, 64)
+		priority, priorityErr := strconv.ParseInt(fields[4], 10, 32)
+		if sizeErr != nil || usedErr != nil || priorityErr != nil {
+			logrus.Warnf("Skip invalid swap entry %q", scanner.Text())
+			continue
+		}
+		entries = append(entries, swapEntry{
+			name:     fields[0],
+			typ:      fields[1],
+			size:     size * 1024,
+			used:     used * 1024,
+			priority: int32(priority),
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// findZram returns the name of our zram device, e.g. `zram1`
+func findZram(entries []swapEntry) string {
+	for _, entry := range entries {
+		name := filepath.Base(entry.name)
+		if strings.HasPrefix(name, "zram") && entry.priority == zramSwapPriority {
+			return name
+		}
+	}
+	return ""
+}
+
+// findSwapFile is true when the swapfile is active, the path is shown
+// relative to the root of the reader, so only the suffix is compared.
+func findSwapFile(entries []swapEntry, path string) bool {
+	for _, entry := range entries {
+		if entry.typ == "file" && (strings.HasSuffix(path, entry.name) || strings.HasSuffix(entry.name, path)) {
+			return true
+		}
+	}
+	return false
+}
+
+func readZramFile(device, file string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(sysBlockPath, device, file))
+	if err != nil {
+		return "", fmt.Errorf("read %s of %s failed: %v", file, device, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func writeZramFile(path, value string) error {
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("write %q to %s failed: %v", value, path, err)
+	}
+	return nil
+}
+
+// zramMatches is true when the device has the wanted size and algorithm, the
+// current algorithm is the one in brackets, e.g. `lzo lz4 [zstd]`.
+func zramMatches(device string, zram *nodeconfigv1.ZramConfig) bool {
+	disksize, err := readZramFile(device, "disksize")
+	if err != nil {
+		logrus.Warnf("Check zram device failed. err: %v", err)
+		return false
+	}
+	pageSize := int64(os.Getpagesize())
+	wantedSize := (zram.Size.Value() + pageSize - 1) / pageSize * pageSize
+	if disksize != strconv.FormatInt(wantedSize, 10) {
+		return false
+	}
+	if zram.Algorithm == "" {
+		return true
+	}
+	algorithms, err := readZramFile(device, "comp_algorithm")
+	if err != nil {
+		logrus.Warnf("Check zram device failed. err: %v", err)
+		return false
+	}
+	return strings.Contains(" "+algorithms+" ", " ["+zram.Algorithm+"] ")
+}
+
+func removeZram(device string) error {
+	logrus.Infof("Remove zram swap device %s", device)
+	if err := runSwapCommand(fmt.Sprintf("swapoff /dev/%s", device)); err != nil {
+		return fmt.Errorf("swapoff %s failed: %v", device, err)
+	}
+	if err := writeZramFile(filepath.Join(sysBlockPath, device, "reset"), "1"); err != nil {
+		return err
+	}
+	// zram0 is created when the module is loaded, which may not be removable
+	if err := writeZramFile(filepath.Join(zramControlPath, "hot_remove"), strings.TrimPrefix(device, "zram")); err != nil {
+		logrus.Warnf("Remove zram device %s failed. err: %v", device, err)
+	}
+	return nil
+}
+
+func createZram(zram *nodeconfigv1.ZramConfig) error {
+	if err := modprobe([]string{"zram"}, true); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(zramControlPath, "hot_add"))
+	if err != nil {
+		return fmt.Errorf("add zram device failed: %v", err)
+	}
+	device := "zram" + strings.TrimSpace(string(data))
+	logrus.Infof("Create zram swap device %s with size %s", device, zram.Size.String())
+
+	// the algorithm could only be changed before the size is set
+	if zram.Algorithm != "" {
+		if err := writeZramFile(filepath.Join(sysBlockPath, device, "comp_algorithm"), zram.Algorithm); err != nil {
+			return err
+		}
+	}
+	if err := writeZramFile(filepath.Join(sysBlockPath, device, "disksize"), strconv.FormatInt(zram.Size.Value(), 10)); err != nil {
+		return err
+	}
+	if err := runSwapCommand(fmt.Sprintf("mkswap /dev/%s && swapon -p %d /dev/%s", device, zramSwapPriority, device)); err != nil {
+		return fmt.Errorf("enable zram swap %s failed: %v", device, err)
+	}
+	return nil
+}
+
+func applyZram(zram *nodeconfigv1.ZramConfig, entries []swapEntry) error {
+	device := findZram(entries)
+	if device != "" {
+		if zram != nil && zramMatches(device, zram) {
+			return nil
+		}
+		if err := removeZram(device); err != nil {
+			return err
+		}
+	}
+	if zram == nil {
+		return nil
+	}
+	return createZram(zram)
+}
+
+func loadSwapApplied() (*swapApplied, error) {
+	applied := &swapApplied{}
+	data, err := os.ReadFile(swapAppliedPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return applied, nil
+		}
+		return nil, fmt.Errorf("read %s failed: %v", swapAppliedPath, err)
+	}
+	if err := json.Unmarshal(data, applied); err != nil {
+		return nil, fmt.Errorf("unmarshal %s failed: %v", swapAppliedPath, err)
+	}
+	return applied, nil
+}
+
+func saveSwapApplied(applied *swapApplied) error {
+	if applied.File == "" {
+		if err := os.Remove(swapAppliedPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s failed: %v", swapAppliedPath, err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(applied)
+	if err != nil {
+		return fmt.Errorf("marshal applied swap failed: %v", err)
+	}
+	tmpFileName, err := files.GenerateTempFileWithDir(data, swapAppliedName, filepath.Dir(swapAppliedPath))
+	if err != nil {
+		return fmt.Errorf("generate temp applied swap failed: %v", err)
+	}
+	return os.Rename(tmpFileName, swapAppliedPath)
+}
+
+// swapFileScript creates the swapfile when it is missing and enables it
+func swapFileScript(file *nodeconfigv1.SwapFileConfig) string {
+	return fmt.Sprintf("[ -f '%[1]s' ] || { mkdir -p '%[2]s' && fallocate -l %[3]d '%[1]s' && chmod 600 '%[1]s' && mkswap '%[1]s'; } && swapon -p %[4]d '%[1]s'",
+		file.Path, filepath.Dir(file.Path), file.Size.Value(), fileSwapPriority)
+}
+
+func applySwapFile(file *nodeconfigv1.SwapFileConfig, entries []swapEntry) error {
+	applied, err := loadSwapApplied()
+	if err != nil {
+		return err
+	}
+
+	// the swapfile is recreated when it is moved or resized
+	if applied.File != "" && (file == nil || applied.File != file.Path || applied.Size != file.Size.Value()) {
+		logrus.Infof("Remove swapfile %s", applied.File)
+		if err := runSwapCommand(fmt.Sprintf("{ swapoff '%[1]s' 2>/dev/null || true; } && rm -f '%[1]s'", applied.File)); err != nil {
+			return fmt.Errorf("remove swapfile %s failed: %v", applied.File, err)
+		}
+		applied.File = ""
+		applied.Size = 0
+		if err := saveSwapApplied(applied); err != nil {
+			return err
+		}
+		entries = nil
+	}
+	if file == nil || findSwapFile(entries, file.Path) {
+		return nil
+	}
+
+	// the swapfile is recorded first, so it could be removed even if
+	// enabling it failed
+	applied.File = file.Path
+	applied.Size = file.Size.Value()
+	if err := saveSwapApplied(applied); err != nil {
+		return err
+	}
+	logrus.Infof("Enable swapfile %s with size %s", file.Path, file.Size.String())
+	if err := runSwapCommand(swapFileScript(file)); err != nil {
+		return fmt.Errorf("enable swapfile %s failed: %v", file.Path, err)
+	}
+	return nil
+}
+
+// ApplySwap enables the zram device and the swapfile of the swap config and
+// persists them, the ones which are no longer wanted are disabled and
+// removed.
+func ApplySwap(swap *nodeconfigv1.SwapConfig) error {
+	if swap == nil {
+		swap = &nodeconfigv1.SwapConfig{}
+	}
+	entries, err := readSwaps()
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	if err := applyZram(swap.Zram, entries); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := applySwapFile(swap.File, entries); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := updateSwapPersistence(swap); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("apply swap failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// RemoveSwap disables and removes the swap devices created by the NodeConfig
+func RemoveSwap() error {
+	return ApplySwap(nil)
+}
+
+// updateSwapPersistence creates the zram device and enables the swapfile on
+// boot.
+func updateSwapPersistence(swap *nodeconfigv1.SwapConfig) error {
+	var commands []string
+	if swap.Zram != nil {
+		zramctl := fmt.Sprintf("zramctl --find --size %d", swap.Zram.Size.Value())
+		if swap.Zram.Algorithm != "" {
+			zramctl += " --algorithm " + swap.Zram.Algorithm
+		}
+		commands = append(commands,
+			"modprobe zram",
+			fmt.Sprintf("dev=$(%s) && mkswap $dev && swapon -p %d $dev", zramctl, zramSwapPriority),
+		)
+	}
+	if swap.File != nil {
+		commands = append(commands, swapFileScript(swap.File))
+	}
+	if len(commands) == 0 {
+		return RemovePersistentOEMSettings(swapOEMOwner, swapStageName)
+	}
+
+	return UpdatePersistentOEMSettings(swapOEMOwner, schema.Stage{
+		Name:     swapStageName,
+		Commands: commands,
+	})
+}
+
+// GetSwapStatus returns the active swap devices of the host
+func GetSwapStatus(swap *nodeconfigv1.SwapConfig) []nodeconfigv1.SwapDeviceStatus {
+	if swap == nil {
+		return nil
+	}
+	entries, err := readSwaps()
+	if err != nil {
+		logrus.Warnf("Get swap status failed. err: %v", err)
+		return nil
+	}
+	status := make([]nodeconfigv1.SwapDeviceStatus, 0, len(entries))
+	for _, entry := range entries {
+		status = append(status, nodeconfigv1.SwapDeviceStatus{
+			Name:     entry.name,
+			Type:     entry.typ,
+			Size:     *resource.NewQuantity(entry.size, resource.BinarySI),
+			Used:     *resource.NewQuantity(entry.used, resource.BinarySI),
+			Priority: entry.priority,
+		})
+	}
+	return status
+}
+
+// NewSwapAppliedCondition returns the SwapApplied condition, err is the
+// failure of the last attempt to apply the swap config.
+func NewSwapAppliedCondition(generation int64, swap *nodeconfigv1.SwapConfig, status []nodeconfigv1.SwapDeviceStatus, err error) metav1.Condition {
+	cond := metav1.Condition{
+		Type:               string(nodeconfigv1.SwapApplied),
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             "SwapApplied",
+		Message:            "swap is applied",
+	}
+
+	if err != nil {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "SwapFailed"
+		cond.Message = err.Error()
+		return cond
+	}
+	if swap == nil {
+		cond.Reason = "SwapNotManaged"
+		cond.Message = "swap is not managed"
+		return cond
+	}
+
+	entries := make([]swapEntry, 0, len(status))
+	for _, s := range status {
+		entries = append(entries, swapEntry{name: s.Name, typ: s.Type, priority: s.Priority})
+	}
+	var inactive []string
+	if swap.Zram != nil && findZram(entries) == "" {
+		inactive = append(inactive, "zram")
+	}
+	if swap.File != nil && !findSwapFile(entries, swap.File.Path) {
+		inactive = append(inactive, swap.File.Path)
+	}
+	if len(inactive) > 0 {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "SwapDrifted"
+		cond.Message = fmt.Sprintf("swap is not active: %s", strings.Join(inactive, ", "))
+	}
+	return cond
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+func TestApplySwap(t *testing.T) {
+	tmpDir := setupOEMTest(t)
+	swapAppliedPath = tmpDir + "/host/oem/" + swapAppliedName
+	procSwapsPath = tmpDir + "/swaps"
+	zramControlPath = tmpDir + "/zram-control"
+	sysBlockPath = tmpDir + "/block"
+	assert.Nil(t, os.MkdirAll(zramControlPath, 0777))
+	assert.Nil(t, os.MkdirAll(sysBlockPath+"/zram1", 0777))
+	assert.Nil(t, os.WriteFile(zramControlPath+"/hot_add", []byte("1\n"), 0644))
+	swapsHeader := "Filename\t\t\t\tType\t\tSize\t\tUsed\t\tPriority\n"
+	assert.Nil(t, os.WriteFile(procSwapsPath, []byte(swapsHeader), 0644))
+	modprobeCommand = func(args ...string) ([]byte, error) {
+		return nil, nil
+	}
+	var scripts []string
+	runSwapCommand = func(script string) error {
+		scripts = append(scripts, script)
+		return nil
+	}
+
+	// not managed
+	assert.Nil(t, RemoveSwap())
+	assert.Nil(t, GetSwapStatus(nil))
+	assert.Empty(t, scripts)
+
+	swap := &v1beta1.SwapConfig{
+		Zram: &v1beta1.ZramConfig{Size: resource.MustParse("1Gi"), Algorithm: "zstd"},
+		File: &v1beta1.SwapFileConfig{Path: "/var/lib/harvester/swapfile", Size: resource.MustParse("2Gi")},
+	}
+	assert.Nil(t, ApplySwap(swap))
+	raw, err := os.ReadFile(sysBlockPath + "/zram1/disksize")
+	assert.Nil(t, err)
+	assert.Equal(t, "1073741824", string(raw))
+	raw, err = os.ReadFile(sysBlockPath + "/zram1/comp_algorithm")
+	assert.Nil(t, err)
+	assert.Equal(t, "zstd", string(raw))
+	assert.Equal(t, []string{
+		"mkswap /dev/zram1 && swapon -p 100 /dev/zram1",
+		"[ -f '/var/lib/harvester/swapfile' ] || { mkdir -p '/var/lib/harvester' && fallocate -l 2147483648 '/var/lib/harvester/swapfile' && chmod 600 '/var/lib/harvester/swapfile' && mkswap '/var/lib/harvester/swapfile'; } && swapon -p 10 '/var/lib/harvester/swapfile'",
+	}, scripts)
+
+	yipConfig, err := utils.LoadYipConfig(settingsOEMPath)
+	assert.Nil(t, err)
+	assert.Equal(t, swapStageName, yipConfig.Stages[yipStageInitramfs][0].Name)
+	assert.Equal(t, "dev=$(zramctl --find --size 1073741824 --algorithm zstd) && mkswap $dev && swapon -p 100 $dev", yipConfig.Stages[yipStageInitramfs][0].Commands[1])
+
+	// the swapfile is not enabled yet
+	cond := NewSwapAppliedCondition(1, swap, GetSwapStatus(swap), nil)
+	assert.Equal(t, "SwapDrifted", cond.Reason)
+	assert.Equal(t, "swap is not active: zram, /var/lib/harvester/swapfile", cond.Message)
+
+	swaps := swapsHeader +
+		"/dev/zram1                              partition\t1048572\t\t2048\t\t100\n" +
+		"/var/lib/harvester/swapfile             file\t\t2097148\t\t0\t\t10\n"
+	assert.Nil(t, os.WriteFile(procSwapsPath, []byte(swaps), 0644))
+	assert.Nil(t, os.WriteFile(sysBlockPath+"/zram1/disksize", []byte("1073741824\n"), 0644))
+	assert.Nil(t, os.WriteFile(sysBlockPath+"/zram1/comp_algorithm", []byte("lzo lz4 [zstd]\n"), 0644))
+	status := GetSwapStatus(swap)
+	assert.Equal(t, 2, len(status))
+	assert.Equal(t, "/dev/zram1", status[0].Name)
+	assert.Equal(t, int64(2048*1024), status[0].Used.Value())
+	assert.Equal(t, int32(10), status[1].Priority)
+	assert.Equal(t, metav1.ConditionTrue, NewSwapAppliedCondition(1, swap, status, nil).Status)
+
+	// nothing is changed when the swap is active
+	scripts = nil
+	assert.Nil(t, ApplySwap(swap))
+	assert.Empty(t, scripts)
+
+	assert.Nil(t, RemoveSwap())
+	assert.Equal(t, []string{
+		"swapoff /dev/zram1",
+		"{ swapoff '/var/lib/harvester/swapfile' 2>/dev/null || true; } && rm -f '/var/lib/harvester/swapfile'",
+	}, scripts)
+	raw, err = os.ReadFile(sysBlockPath + "/zram1/reset")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(raw))
+	_, err = os.Stat(swapAppliedPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(settingsOEMPath)
+	assert.True(t, os.IsNotExist(err))
+}
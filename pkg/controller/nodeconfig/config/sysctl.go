@@ -0,0 +1,254 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/harvester/go-common/files"
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+const (
+	sysctlStageName = "Runtime Sysctl Settings"
+	sysctlOEMOwner  = settingsOEMOwner + "/sysctl"
+)
+
+// The following would ordinarily be const, but we need to override them in unit tests
+var (
+	sysctlPath = "/proc/sys"
+	// sysctlOriginPath keeps the values before we changed them, so they
+	// could be restored when the keys are removed from the NodeConfig.
+	sysctlOriginPath = "/host/oem/sysctl.origin"
+)
+
+// sysctlKeyToPath converts `net.ipv4.ip_forward` to `net/ipv4/ip_forward`,
+// keys which already use slashes are kept as they are.
+func sysctlKeyToPath(key string) string {
+	if !strings.Contains(key, "/") {
+		key = strings.ReplaceAll(key, ".", "/")
+	}
+	return filepath.Join(sysctlPath, key)
+}
+
+// network sysctls are per namespace, they are handled in the host namespace
+func isNetSysctl(key string) bool {
+	return strings.HasPrefix(key, "net.") || strings.HasPrefix(key, "net/")
+}
+
+// normalizeSysctlValue folds the whitespace, the kernel separates multiple
+// values with tabs, e.g. `net.ipv4.tcp_rmem`.
+func normalizeSysctlValue(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+func readSysctl(key string) (string, error) {
+	var value string
+	read := func() error {
+		data, err := os.ReadFile(sysctlKeyToPath(key))
+		if err != nil {
+			return err
+		}
+		value = normalizeSysctlValue(string(data))
+		return nil
+	}
+
+	if isNetSysctl(key) {
+		if err := utils.RunInHostNetNS(read); err != nil {
+			return "", fmt.Errorf("read sysctl %s failed: %v", key, err)
+		}
+		return value, nil
+	}
+	if err := read(); err != nil {
+		return "", fmt.Errorf("read sysctl %s failed: %v", key, err)
+	}
+	return value, nil
+}
+
+func writeSysctl(key, value string) error {
+	write := func() error {
+		return os.WriteFile(sysctlKeyToPath(key), []byte(value), 0644)
+	}
+
+	var err error
+	if isNetSysctl(key) {
+		err = utils.RunInHostNetNS(write)
+	} else {
+		err = write()
+	}
+	if err != nil {
+		return fmt.Errorf("write %q to sysctl %s failed: %v", value, key, err)
+	}
+	return nil
+}
+
+func loadSysctlOrigin() (map[string]string, error) {
+	origin := make(map[string]string)
+	data, err := os.ReadFile(sysctlOriginPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return origin, nil
+		}
+		return nil, fmt.Errorf("read %s failed: %v", sysctlOriginPath, err)
+	}
+	if err := json.Unmarshal(data, &origin); err != nil {
+		return nil, fmt.Errorf("unmarshal %s failed: %v", sysctlOriginPath, err)
+	}
+	return origin, nil
+}
+
+func saveSysctlOrigin(origin map[string]string) error {
+	if len(origin) == 0 {
+		if err := os.Remove(sysctlOriginPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s failed: %v", sysctlOriginPath, err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(origin)
+	if err != nil {
+		return fmt.Errorf("marshal sysctl origin failed: %v", err)
+	}
+	tmpFileName, err := files.GenerateTempFileWithDir(data, "sysctl.origin", filepath.Dir(sysctlOriginPath))
+	if err != nil {
+		return fmt.Errorf("generate temp sysctl origin failed: %v", err)
+	}
+	return os.Rename(tmpFileName, sysctlOriginPath)
+}
+
+// ApplySysctl sets the wanted sysctls at runtime and persists them. The
+// original value is recorded the first time a key is changed, and restored
+// once the key is no longer wanted.
+func ApplySysctl(wanted map[string]string) error {
+	origin, err := loadSysctlOrigin()
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	keys := make([]string, 0, len(wanted))
+	for key := range wanted {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		current, err := readSysctl(key)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if _, found := origin[key]; !found {
+			origin[key] = current
+		}
+		if current == normalizeSysctlValue(wanted[key]) {
+			continue
+		}
+		logrus.Infof("Set sysctl %s from %q to %q", key, current, wanted[key])
+		if err := writeSysctl(key, wanted[key]); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	for key, value := range origin {
+		if _, found := wanted[key]; found {
+			continue
+		}
+		logrus.Infof("Restore sysctl %s to %q", key, value)
+		if err := writeSysctl(key, value); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		delete(origin, key)
+	}
+
+	if err := saveSysctlOrigin(origin); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := updateSysctlPersistence(wanted); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("apply sysctl failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// RestoreSysctl restores all the sysctls changed by the NodeConfig
+func RestoreSysctl() error {
+	return ApplySysctl(nil)
+}
+
+func updateSysctlPersistence(wanted map[string]string) error {
+	if len(wanted) == 0 {
+		return RemovePersistentOEMSettings(sysctlOEMOwner, sysctlStageName)
+	}
+
+	return UpdatePersistentOEMSettings(sysctlOEMOwner, schema.Stage{
+		Name:   sysctlStageName,
+		Sysctl: wanted,
+	})
+}
+
+// GetSysctlStatus compares the wanted sysctls with the current values
+func GetSysctlStatus(wanted map[string]string) []nodeconfigv1.SysctlStatus {
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	status := make([]nodeconfigv1.SysctlStatus, 0, len(wanted))
+	for key, value := range wanted {
+		current, err := readSysctl(key)
+		if err != nil {
+			logrus.Warnf("Get sysctl status failed. err: %v", err)
+		}
+		status = append(status, nodeconfigv1.SysctlStatus{
+			Key:     key,
+			Value:   value,
+			Current: current,
+			Drifted: current != normalizeSysctlValue(value),
+		})
+	}
+	slices.SortFunc(status, func(a, b nodeconfigv1.SysctlStatus) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return status
+}
+
+// NewSysctlAppliedCondition returns the SysctlApplied condition, err is the
+// failure of the last attempt to apply the sysctls.
+func NewSysctlAppliedCondition(generation int64, status []nodeconfigv1.SysctlStatus, err error) metav1.Condition {
+	cond := metav1.Condition{
+		Type:               string(nodeconfigv1.SysctlApplied),
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             "SysctlApplied",
+		Message:            "sysctls are applied",
+	}
+
+	var drifted []string
+	for _, s := range status {
+		if s.Drifted {
+			drifted = append(drifted, s.Key)
+		}
+	}
+
+	switch {
+	case err != nil:
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "SysctlFailed"
+		cond.Message = err.Error()
+	case len(drifted) > 0:
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "SysctlDrifted"
+		cond.Message = fmt.Sprintf("sysctls are drifted: %s", strings.Join(drifted, ", "))
+	}
+	return cond
+}
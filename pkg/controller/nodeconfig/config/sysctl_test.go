@@ -0,0 +1,59 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+func TestApplySysctl(t *testing.T) {
+	tmpDir := setupOEMTest(t)
+	sysctlOriginPath = tmpDir + "/host/oem/sysctl.origin"
+	sysctlPath = tmpDir + "/proc/sys"
+	assert.Nil(t, os.MkdirAll(sysctlPath+"/vm", 0777))
+	assert.Nil(t, os.WriteFile(sysctlPath+"/vm/swappiness", []byte("60\n"), 0644))
+	assert.Nil(t, os.WriteFile(sysctlPath+"/vm/max_map_count", []byte("65530\n"), 0644))
+
+	readSysctlFile := func(name string) string {
+		data, err := os.ReadFile(sysctlPath + "/vm/" + name)
+		assert.Nil(t, err)
+		return string(data)
+	}
+
+	wanted := map[string]string{"vm.swappiness": "10", "vm/max_map_count": "262144"}
+	assert.Nil(t, ApplySysctl(wanted))
+	assert.Equal(t, "10", readSysctlFile("swappiness"))
+	assert.Equal(t, "262144", readSysctlFile("max_map_count"))
+
+	// persisted with a yip Sysctl stage
+	yipConfig, err := utils.LoadYipConfig(settingsOEMPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(yipConfig.Stages[yipStageInitramfs]))
+	assert.Equal(t, sysctlStageName, yipConfig.Stages[yipStageInitramfs][0].Name)
+	assert.Equal(t, wanted, yipConfig.Stages[yipStageInitramfs][0].Sysctl)
+
+	// drift is reported per key
+	assert.Nil(t, os.WriteFile(sysctlPath+"/vm/swappiness", []byte("30\n"), 0644))
+	status := GetSysctlStatus(wanted)
+	assert.Equal(t, []v1beta1.SysctlStatus{
+		{Key: "vm.swappiness", Value: "10", Current: "30", Drifted: true},
+		{Key: "vm/max_map_count", Value: "262144", Current: "262144", Drifted: false},
+	}, status)
+	assert.Equal(t, "SysctlDrifted", NewSysctlAppliedCondition(1, status, nil).Reason)
+
+	// removed key is restored to the original value
+	assert.Nil(t, ApplySysctl(map[string]string{"vm.swappiness": "10"}))
+	assert.Equal(t, "10", readSysctlFile("swappiness"))
+	assert.Equal(t, "65530", readSysctlFile("max_map_count"))
+
+	assert.Nil(t, RestoreSysctl())
+	assert.Equal(t, "60", readSysctlFile("swappiness"))
+	_, err = os.Stat(sysctlOriginPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(settingsOEMPath)
+	assert.True(t, os.IsNotExist(err))
+}
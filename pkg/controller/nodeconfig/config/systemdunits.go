@@ -0,0 +1,375 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/harvester/go-common/files"
+	"github.com/harvester/go-common/sys"
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+const (
+	systemdUnitsStageName    = "Runtime Systemd Units"
+	systemdUnitsOEMOwner     = settingsOEMOwner + "/systemd-units"
+	systemdUnitsOriginName   = "systemd-units.origin"
+	systemdUnitDropInName    = "99-harvester-node-manager.conf"
+	systemdUnitDropInPerms   = 0644
+	hostSystemdUnitPath      = "/etc/systemd/system"
+	systemdUnitActiveState   = "active"
+	systemdUnitDropInTmpName = "systemd-unit.conf"
+)
+
+// The following would ordinarily be const, but we need to override them in unit tests
+var (
+	systemdUnitPath = utils.SystemdConfigPath + "system"
+	// systemdUnitsOriginPath keeps the unit file states before we changed
+	// them, so they could be restored when the units are removed from the
+	// NodeConfig.
+	systemdUnitsOriginPath = "/host/oem/" + systemdUnitsOriginName
+	reloadSystemd          = utils.ReloadSystemd
+	restartSystemdUnit     = sys.TryRestartService
+	getSystemdUnitStatus   = utils.GetUnitStatus
+	setSystemdUnitState    = func(unit string, state nodeconfigv1.SystemdUnitState) error {
+		return utils.SetUnitState(unit, string(state))
+	}
+)
+
+func systemdUnitDropInPath(root, unit string) string {
+	return filepath.Join(root, unit+".d", systemdUnitDropInName)
+}
+
+// systemdUnitFileState folds the unit file state reported by systemd into the
+// states we manage, e.g. `enabled-runtime` is enabled and `static` units are
+// regarded as enabled as they could not be disabled.
+func systemdUnitFileState(state string) nodeconfigv1.SystemdUnitState {
+	switch {
+	case strings.HasPrefix(state, "masked"):
+		return nodeconfigv1.SystemdUnitMasked
+	case state == "disabled":
+		return nodeconfigv1.SystemdUnitDisabled
+	}
+	return nodeconfigv1.SystemdUnitEnabled
+}
+
+// generateSystemdUnitDropIn renders the settings, the settings of a section
+// are grouped in the order they are listed, so a list setting could be reset
+// with an empty value first, e.g. `ExecStart=`.
+func generateSystemdUnitDropIn(settings []nodeconfigv1.SystemdUnitSetting) string {
+	var sections []string
+	lines := make(map[string][]string)
+	for _, setting := range settings {
+		if _, found := lines[setting.Section]; !found {
+			sections = append(sections, setting.Section)
+		}
+		lines[setting.Section] = append(lines[setting.Section], fmt.Sprintf("%s=%s", setting.Key, setting.Value))
+	}
+
+	var sb strings.Builder
+	sb.WriteString("# Generated by harvester-node-manager, do not edit\n")
+	for i, section := range sections {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "[%s]\n", section)
+		for _, line := range lines[section] {
+			sb.WriteString(line + "\n")
+		}
+	}
+	return sb.String()
+}
+
+// applySystemdUnitDropIns writes the wanted drop-ins and removes the ones
+// which are no longer wanted, it returns the units whose drop-in is changed.
+func applySystemdUnitDropIns(units []nodeconfigv1.SystemdUnitConfig) (map[string]bool, []string) {
+	var errs []string
+	changed := make(map[string]bool)
+	wanted := make(map[string]string)
+	for _, unit := range units {
+		if len(unit.Settings) > 0 {
+			wanted[unit.Name] = generateSystemdUnitDropIn(unit.Settings)
+		}
+	}
+
+	existing, err := filepath.Glob(systemdUnitDropInPath(systemdUnitPath, "*"))
+	if err != nil {
+		return changed, []string{fmt.Sprintf("list systemd unit drop-ins failed: %v", err)}
+	}
+	for _, path := range existing {
+		unit := strings.TrimSuffix(filepath.Base(filepath.Dir(path)), ".d")
+		if _, found := wanted[unit]; found {
+			continue
+		}
+		logrus.Infof("Remove drop-in of systemd unit %s", unit)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Sprintf("remove %s failed: %v", path, err))
+			continue
+		}
+		// the directory is kept when there are other drop-ins
+		_ = os.Remove(filepath.Dir(path))
+		changed[unit] = true
+	}
+
+	for _, unit := range slices.Sorted(maps.Keys(wanted)) {
+		path := systemdUnitDropInPath(systemdUnitPath, unit)
+		current, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Sprintf("read %s failed: %v", path, err))
+			continue
+		}
+		if err == nil && string(current) == wanted[unit] {
+			continue
+		}
+		logrus.Infof("Update drop-in of systemd unit %s", unit)
+		if err := writeSystemdUnitDropIn(path, wanted[unit]); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		changed[unit] = true
+	}
+	return changed, errs
+}
+
+func writeSystemdUnitDropIn(path, raw string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create %s failed: %v", dir, err)
+	}
+	tmpFileName, err := files.GenerateTempFileWithDir([]byte(raw), systemdUnitDropInTmpName, dir)
+	if err != nil {
+		return fmt.Errorf("generate temp drop-in for %s failed: %v", path, err)
+	}
+	if err := os.Chmod(tmpFileName, systemdUnitDropInPerms); err != nil {
+		return fmt.Errorf("chmod temp drop-in for %s failed: %v", path, err)
+	}
+	if err := os.Rename(tmpFileName, path); err != nil {
+		return fmt.Errorf("rename temp drop-in for %s failed: %v", path, err)
+	}
+	return nil
+}
+
+func loadSystemdUnitsOrigin() (map[string]nodeconfigv1.SystemdUnitState, error) {
+	origin := make(map[string]nodeconfigv1.SystemdUnitState)
+	data, err := os.ReadFile(systemdUnitsOriginPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return origin, nil
+		}
+		return nil, fmt.Errorf("read %s failed: %v", systemdUnitsOriginPath, err)
+	}
+	if err := json.Unmarshal(data, &origin); err != nil {
+		return nil, fmt.Errorf("unmarshal %s failed: %v", systemdUnitsOriginPath, err)
+	}
+	return origin, nil
+}
+
+func saveSystemdUnitsOrigin(origin map[string]nodeconfigv1.SystemdUnitState) error {
+	if len(origin) == 0 {
+		if err := os.Remove(systemdUnitsOriginPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s failed: %v", systemdUnitsOriginPath, err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(origin)
+	if err != nil {
+		return fmt.Errorf("marshal systemd units origin failed: %v", err)
+	}
+	tmpFileName, err := files.GenerateTempFileWithDir(data, systemdUnitsOriginName, filepath.Dir(systemdUnitsOriginPath))
+	if err != nil {
+		return fmt.Errorf("generate temp systemd units origin failed: %v", err)
+	}
+	return os.Rename(tmpFileName, systemdUnitsOriginPath)
+}
+
+// ApplySystemdUnits writes the drop-ins and sets the states of the systemd
+// units, then persists them. The running units are restarted when their
+// drop-in is changed. The original unit file states are recorded the first
+// time they are managed, and restored once they are no longer wanted.
+func ApplySystemdUnits(units []nodeconfigv1.SystemdUnitConfig) error {
+	origin, err := loadSystemdUnitsOrigin()
+	if err != nil {
+		return err
+	}
+
+	changed, errs := applySystemdUnitDropIns(units)
+	if len(changed) > 0 {
+		logrus.Infof("Reload systemd ...")
+		if err := reloadSystemd(); err != nil {
+			errs = append(errs, fmt.Sprintf("reload systemd failed: %v", err))
+		}
+	}
+
+	wanted := make(map[string]nodeconfigv1.SystemdUnitState)
+	for _, unit := range units {
+		if unit.State != "" {
+			wanted[unit.Name] = unit.State
+		}
+	}
+
+	for _, unit := range slices.Sorted(maps.Keys(wanted)) {
+		status, err := getSystemdUnitStatus(unit)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		current := systemdUnitFileState(status.UnitFileState)
+		if _, found := origin[unit]; !found {
+			origin[unit] = current
+		}
+		if current == wanted[unit] {
+			continue
+		}
+		logrus.Infof("Set systemd unit %s from %s to %s", unit, current, wanted[unit])
+		if err := setSystemdUnitState(unit, wanted[unit]); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	for _, unit := range slices.Sorted(maps.Keys(origin)) {
+		if _, found := wanted[unit]; found {
+			continue
+		}
+		status, err := getSystemdUnitStatus(unit)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if current := systemdUnitFileState(status.UnitFileState); current != origin[unit] {
+			logrus.Infof("Restore systemd unit %s from %s to %s", unit, current, origin[unit])
+			if err := setSystemdUnitState(unit, origin[unit]); err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+		}
+		delete(origin, unit)
+	}
+
+	for _, unit := range slices.Sorted(maps.Keys(changed)) {
+		if state := wanted[unit]; state == nodeconfigv1.SystemdUnitDisabled || state == nodeconfigv1.SystemdUnitMasked {
+			continue
+		}
+		logrus.Infof("Restart systemd unit %s if it is running ...", unit)
+		if err := restartSystemdUnit(unit); err != nil {
+			errs = append(errs, fmt.Sprintf("restart %s failed: %v", unit, err))
+		}
+	}
+
+	if err := saveSystemdUnitsOrigin(origin); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := updateSystemdUnitsPersistence(units); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("apply systemd units failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// RemoveSystemdUnits removes the drop-ins and restores the unit file states
+// changed by the NodeConfig
+func RemoveSystemdUnits() error {
+	return ApplySystemdUnits(nil)
+}
+
+// updateSystemdUnitsPersistence writes the drop-ins and sets the unit file
+// states on boot, before systemd is started in the root filesystem.
+func updateSystemdUnitsPersistence(units []nodeconfigv1.SystemdUnitConfig) error {
+	stage := schema.Stage{Name: systemdUnitsStageName}
+	for _, unit := range units {
+		if len(unit.Settings) > 0 {
+			stage.Files = append(stage.Files, schema.File{
+				Path:        systemdUnitDropInPath(hostSystemdUnitPath, unit.Name),
+				Permissions: systemdUnitDropInPerms,
+				Content:     generateSystemdUnitDropIn(unit.Settings),
+			})
+		}
+		switch unit.State {
+		case nodeconfigv1.SystemdUnitEnabled:
+			stage.Systemctl.Enable = append(stage.Systemctl.Enable, unit.Name)
+		case nodeconfigv1.SystemdUnitDisabled:
+			stage.Systemctl.Disable = append(stage.Systemctl.Disable, unit.Name)
+		case nodeconfigv1.SystemdUnitMasked:
+			stage.Systemctl.Mask = append(stage.Systemctl.Mask, unit.Name)
+		}
+	}
+	if len(stage.Files) == 0 && len(stage.Systemctl.Enable) == 0 && len(stage.Systemctl.Disable) == 0 && len(stage.Systemctl.Mask) == 0 {
+		return RemovePersistentOEMSettings(systemdUnitsOEMOwner, systemdUnitsStageName)
+	}
+	return UpdatePersistentOEMSettings(systemdUnitsOEMOwner, stage)
+}
+
+// GetSystemdUnitsStatus returns the states of the units reported by systemd
+func GetSystemdUnitsStatus(units []nodeconfigv1.SystemdUnitConfig) []nodeconfigv1.SystemdUnitStatus {
+	if len(units) == 0 {
+		return nil
+	}
+	status := make([]nodeconfigv1.SystemdUnitStatus, 0, len(units))
+	for _, unit := range units {
+		s := nodeconfigv1.SystemdUnitStatus{Name: unit.Name}
+		unitStatus, err := getSystemdUnitStatus(unit.Name)
+		if err != nil {
+			logrus.Warnf("Get systemd unit status failed. err: %v", err)
+		} else {
+			s.LoadState = unitStatus.LoadState
+			s.ActiveState = unitStatus.ActiveState
+			s.SubState = unitStatus.SubState
+			s.UnitFileState = unitStatus.UnitFileState
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// NewSystemdUnitsAppliedCondition returns the SystemdUnitsApplied condition,
+// the units are drifted when their unit file state is changed on the host, or
+// they are wanted to be enabled but are not active.
+func NewSystemdUnitsAppliedCondition(generation int64, units []nodeconfigv1.SystemdUnitConfig, status []nodeconfigv1.SystemdUnitStatus, err error) metav1.Condition {
+	cond := metav1.Condition{
+		Type:               string(nodeconfigv1.SystemdUnitsApplied),
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             "SystemdUnitsApplied",
+		Message:            "systemd units are applied",
+	}
+
+	if err != nil {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "SystemdUnitsFailed"
+		cond.Message = err.Error()
+		return cond
+	}
+	if len(units) == 0 {
+		cond.Reason = "SystemdUnitsNotManaged"
+		cond.Message = "systemd units are not managed"
+		return cond
+	}
+
+	var drifted []string
+	for i, unit := range units {
+		if unit.State == "" || i >= len(status) {
+			continue
+		}
+		if systemdUnitFileState(status[i].UnitFileState) != unit.State ||
+			(unit.State == nodeconfigv1.SystemdUnitEnabled && status[i].ActiveState != systemdUnitActiveState) {
+			drifted = append(drifted, unit.Name)
+		}
+	}
+	if len(drifted) > 0 {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "SystemdUnitsDrifted"
+		cond.Message = fmt.Sprintf("systemd units are drifted: %s", strings.Join(drifted, ", "))
+	}
+	return cond
+}
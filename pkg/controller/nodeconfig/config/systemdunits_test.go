@@ -0,0 +1,114 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+func TestApplySystemdUnits(t *testing.T) {
+	tmpDir := setupOEMTest(t)
+	systemdUnitsOriginPath = tmpDir + "/host/oem/" + systemdUnitsOriginName
+	systemdUnitPath = tmpDir + "/system"
+	// a drop-in which is not written by us is kept
+	assert.Nil(t, os.MkdirAll(systemdUnitPath+"/iscsid.service.d", 0755))
+	assert.Nil(t, os.WriteFile(systemdUnitPath+"/iscsid.service.d/10-local.conf", []byte("[Service]\n"), 0644))
+
+	states := map[string]string{"iscsid.service": "disabled", "multipathd.service": "enabled"}
+	reloads := 0
+	var restarts []string
+	reloadSystemd = func() error {
+		reloads++
+		return nil
+	}
+	restartSystemdUnit = func(unit string) error {
+		restarts = append(restarts, unit)
+		return nil
+	}
+	getSystemdUnitStatus = func(unit string) (utils.UnitStatus, error) {
+		activeState := "inactive"
+		if states[unit] == "enabled" {
+			activeState = "active"
+		}
+		return utils.UnitStatus{LoadState: "loaded", ActiveState: activeState, UnitFileState: states[unit]}, nil
+	}
+	setSystemdUnitState = func(unit string, state v1beta1.SystemdUnitState) error {
+		states[unit] = string(state)
+		return nil
+	}
+
+	// not managed
+	assert.Nil(t, RemoveSystemdUnits())
+	assert.Equal(t, 0, reloads)
+	assert.Nil(t, GetSystemdUnitsStatus(nil))
+
+	units := []v1beta1.SystemdUnitConfig{
+		{Name: "iscsid.service", State: v1beta1.SystemdUnitEnabled, Settings: []v1beta1.SystemdUnitSetting{
+			{Section: "Service", Key: "ExecStart"},
+			{Section: "Unit", Key: "After", Value: "network-online.target"},
+			{Section: "Service", Key: "ExecStart", Value: "/usr/sbin/iscsid -f -d 1"},
+		}},
+		{Name: "multipathd.service", State: v1beta1.SystemdUnitMasked},
+	}
+	expected := "# Generated by harvester-node-manager, do not edit\n" +
+		"[Service]\n" +
+		"ExecStart=\n" +
+		"ExecStart=/usr/sbin/iscsid -f -d 1\n" +
+		"\n" +
+		"[Unit]\n" +
+		"After=network-online.target\n"
+	assert.Nil(t, ApplySystemdUnits(units))
+	raw, err := os.ReadFile(systemdUnitPath + "/iscsid.service.d/" + systemdUnitDropInName)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, string(raw))
+	assert.Equal(t, 1, reloads)
+	assert.Equal(t, []string{"iscsid.service"}, restarts)
+	assert.Equal(t, map[string]string{"iscsid.service": "enabled", "multipathd.service": "masked"}, states)
+
+	yipConfig, err := utils.LoadYipConfig(settingsOEMPath)
+	assert.Nil(t, err)
+	stage := yipConfig.Stages[yipStageInitramfs][0]
+	assert.Equal(t, systemdUnitsStageName, stage.Name)
+	assert.Equal(t, "/etc/systemd/system/iscsid.service.d/"+systemdUnitDropInName, stage.Files[0].Path)
+	assert.Equal(t, expected, stage.Files[0].Content)
+	assert.Equal(t, []string{"iscsid.service"}, stage.Systemctl.Enable)
+	assert.Equal(t, []string{"multipathd.service"}, stage.Systemctl.Mask)
+
+	status := GetSystemdUnitsStatus(units)
+	assert.Equal(t, []v1beta1.SystemdUnitStatus{
+		{Name: "iscsid.service", LoadState: "loaded", ActiveState: "active", UnitFileState: "enabled"},
+		{Name: "multipathd.service", LoadState: "loaded", ActiveState: "inactive", UnitFileState: "masked"},
+	}, status)
+	assert.Equal(t, "SystemdUnitsApplied", NewSystemdUnitsAppliedCondition(1, units, status, nil).Reason)
+
+	// unchanged, nothing is reloaded or restarted again
+	assert.Nil(t, ApplySystemdUnits(units))
+	assert.Equal(t, 1, reloads)
+	assert.Equal(t, []string{"iscsid.service"}, restarts)
+
+	// the unit is unmasked on the host
+	states["multipathd.service"] = "enabled"
+	cond := NewSystemdUnitsAppliedCondition(1, units, GetSystemdUnitsStatus(units), nil)
+	assert.Equal(t, "SystemdUnitsDrifted", cond.Reason)
+	assert.Equal(t, "systemd units are drifted: multipathd.service", cond.Message)
+	assert.Nil(t, ApplySystemdUnits(units))
+	assert.Equal(t, "masked", states["multipathd.service"])
+
+	// the drop-in is removed, and the states are restored
+	assert.Nil(t, RemoveSystemdUnits())
+	_, err = os.Stat(systemdUnitPath + "/iscsid.service.d/" + systemdUnitDropInName)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(systemdUnitPath + "/iscsid.service.d/10-local.conf")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, reloads)
+	assert.Equal(t, []string{"iscsid.service", "iscsid.service"}, restarts)
+	assert.Equal(t, map[string]string{"iscsid.service": "disabled", "multipathd.service": "enabled"}, states)
+	_, err = os.Stat(systemdUnitsOriginPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(settingsOEMPath)
+	assert.True(t, os.IsNotExist(err))
+}
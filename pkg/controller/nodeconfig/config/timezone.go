@@ -0,0 +1,175 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/harvester/go-common/files"
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+const (
+	timezoneStageName  = "Runtime Timezone"
+	timezoneOEMOwner   = settingsOEMOwner + "/timezone"
+	timezoneOriginName = "timezone.origin"
+)
+
+// The following would ordinarily be const, but we need to override them in unit tests
+var (
+	// zoneinfoPath is the host zoneinfo database
+	zoneinfoPath = "/host/usr/share/zoneinfo"
+	// timezoneOriginPath keeps the timezone before we changed it, so it
+	// could be restored when the timezone is removed from the NodeConfig.
+	timezoneOriginPath = "/host/oem/" + timezoneOriginName
+	getTimezone        = utils.GetTimeDate1PropertiesTimezone
+	setTimezone        = utils.SetTimeDate1Timezone
+)
+
+// ValidateTimezone checks the timezone against the host zoneinfo database
+func ValidateTimezone(timezone string) error {
+	info, err := os.Stat(filepath.Join(zoneinfoPath, filepath.Clean("/"+timezone)))
+	if err != nil || info.IsDir() {
+		return fmt.Errorf("timezone %s is not found in the host zoneinfo database", timezone)
+	}
+	return nil
+}
+
+func loadTimezoneOrigin() (string, error) {
+	data, err := os.ReadFile(timezoneOriginPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("read %s failed: %v", timezoneOriginPath, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func saveTimezoneOrigin(origin string) error {
+	if origin == "" {
+		if err := os.Remove(timezoneOriginPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s failed: %v", timezoneOriginPath, err)
+		}
+		return nil
+	}
+	tmpFileName, err := files.GenerateTempFileWithDir([]byte(origin), timezoneOriginName, filepath.Dir(timezoneOriginPath))
+	if err != nil {
+		return fmt.Errorf("generate temp timezone origin failed: %v", err)
+	}
+	return os.Rename(tmpFileName, timezoneOriginPath)
+}
+
+// ApplyTimezone sets the host timezone through timedate1 and persists it, the
+// original timezone is restored once the timezone is removed from the
+// NodeConfig. It returns the current timezone of the host, which is empty when
+// the timezone is not managed.
+func ApplyTimezone(wanted string) (string, error) {
+	origin, err := loadTimezoneOrigin()
+	if err != nil {
+		return "", err
+	}
+	// nothing to restore, the host timezone is not managed
+	if wanted == "" && origin == "" {
+		return "", RemovePersistentOEMSettings(timezoneOEMOwner, timezoneStageName)
+	}
+
+	current, err := getTimezone()
+	if err != nil {
+		return "", fmt.Errorf("get timezone failed: %v", err)
+	}
+
+	if wanted == "" {
+		if origin != current {
+			logrus.Infof("Restore timezone to %s", origin)
+			if err := setTimezone(origin); err != nil {
+				return "", fmt.Errorf("restore timezone %s failed: %v", origin, err)
+			}
+		}
+		if err := saveTimezoneOrigin(""); err != nil {
+			return "", err
+		}
+		return "", RemovePersistentOEMSettings(timezoneOEMOwner, timezoneStageName)
+	}
+
+	if err := ValidateTimezone(wanted); err != nil {
+		return current, err
+	}
+	if origin == "" {
+		if err := saveTimezoneOrigin(current); err != nil {
+			return current, err
+		}
+	}
+	if current != wanted {
+		logrus.Infof("Set timezone from %s to %s", current, wanted)
+		if err := setTimezone(wanted); err != nil {
+			return current, fmt.Errorf("set timezone %s failed: %v", wanted, err)
+		}
+		current = wanted
+	}
+	return current, updateTimezonePersistence(wanted)
+}
+
+// TimezoneDrifted returns whether the host timezone differs from the wanted
+// one, the host timezone is not managed when nothing is wanted
+func TimezoneDrifted(wanted string) bool {
+	if wanted == "" {
+		return false
+	}
+	current, err := getTimezone()
+	if err != nil {
+		logrus.Warnf("Get timezone failed. err: %v", err)
+		return true
+	}
+	return current != wanted
+}
+
+// RestoreTimezone restores the timezone changed by the NodeConfig
+func RestoreTimezone() error {
+	_, err := ApplyTimezone("")
+	return err
+}
+
+// updateTimezonePersistence links /etc/localtime on boot, as
+// `timedatectl set-timezone` does, because /etc is not persistent.
+func updateTimezonePersistence(timezone string) error {
+	return UpdatePersistentOEMSettings(timezoneOEMOwner, schema.Stage{
+		Name: timezoneStageName,
+		Commands: []string{
+			fmt.Sprintf("ln -sf '../usr/share/zoneinfo/%s' /etc/localtime", timezone),
+		},
+	})
+}
+
+// NewTimezoneAppliedCondition returns the TimezoneApplied condition, err is the
+// failure of the last attempt to apply the timezone.
+func NewTimezoneAppliedCondition(generation int64, wanted, current string, err error) metav1.Condition {
+	cond := metav1.Condition{
+		Type:               string(nodeconfigv1.TimezoneApplied),
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		Reason:             "TimezoneApplied",
+		Message:            fmt.Sprintf("timezone is %s", current),
+	}
+
+	switch {
+	case err != nil:
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "TimezoneFailed"
+		cond.Message = err.Error()
+	case wanted == "":
+		cond.Reason = "TimezoneNotManaged"
+		cond.Message = "timezone is not managed"
+	case wanted != current:
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = "TimezoneDrifted"
+		cond.Message = fmt.Sprintf("timezone is %s instead of %s", current, wanted)
+	}
+	return cond
+}
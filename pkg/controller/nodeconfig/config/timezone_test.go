@@ -0,0 +1,60 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+func TestApplyTimezone(t *testing.T) {
+	tmpDir := setupOEMTest(t)
+	timezoneOriginPath = tmpDir + "/host/oem/" + timezoneOriginName
+	zoneinfoPath = tmpDir + "/zoneinfo"
+	assert.Nil(t, os.MkdirAll(zoneinfoPath+"/Asia", 0777))
+	assert.Nil(t, os.WriteFile(zoneinfoPath+"/Asia/Taipei", nil, 0644))
+	assert.Nil(t, os.WriteFile(zoneinfoPath+"/UTC", nil, 0644))
+
+	// fake timedate1
+	hostTimezone := "UTC"
+	getTimezone = func() (string, error) { return hostTimezone, nil }
+	setTimezone = func(timezone string) error {
+		hostTimezone = timezone
+		return nil
+	}
+
+	// not managed
+	current, err := ApplyTimezone("")
+	assert.Nil(t, err)
+	assert.Equal(t, "", current)
+	assert.Equal(t, "TimezoneNotManaged", NewTimezoneAppliedCondition(1, "", current, err).Reason)
+
+	current, err = ApplyTimezone("Asia/Taipei")
+	assert.Nil(t, err)
+	assert.Equal(t, "Asia/Taipei", current)
+	assert.Equal(t, "Asia/Taipei", hostTimezone)
+	assert.Equal(t, metav1.ConditionTrue, NewTimezoneAppliedCondition(1, "Asia/Taipei", current, err).Status)
+	origin, err := loadTimezoneOrigin()
+	assert.Nil(t, err)
+	assert.Equal(t, "UTC", origin)
+	yipConfig, err := utils.LoadYipConfig(settingsOEMPath)
+	assert.Nil(t, err)
+	assert.Equal(t, timezoneStageName, yipConfig.Stages[yipStageInitramfs][0].Name)
+	assert.Equal(t, []string{"ln -sf '../usr/share/zoneinfo/Asia/Taipei' /etc/localtime"}, yipConfig.Stages[yipStageInitramfs][0].Commands)
+
+	// not in the host zoneinfo database
+	current, err = ApplyTimezone("Europe/Berlin")
+	assert.NotNil(t, err)
+	assert.Equal(t, "Asia/Taipei", current)
+	assert.Equal(t, "TimezoneFailed", NewTimezoneAppliedCondition(1, "Europe/Berlin", current, err).Reason)
+
+	assert.Nil(t, RestoreTimezone())
+	assert.Equal(t, "UTC", hostTimezone)
+	_, err = os.Stat(timezoneOriginPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(settingsOEMPath)
+	assert.True(t, os.IsNotExist(err))
+}
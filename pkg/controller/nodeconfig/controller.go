@@ -3,25 +3,40 @@ package nodeconfig
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"slices"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/harvester/go-common/common"
 	ctlnode "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
 	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/audit"
 	"github.com/harvester/node-manager/pkg/controller/nodeconfig/config"
 	ctlv1 "github.com/harvester/node-manager/pkg/generated/controllers/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
 )
 
 const (
 	HandlerName             = "harvester-node-config-controller"
 	ConfigApplied           = "Applied"
-	ConfigAppliedAnnotation = "AppliedConfig"
+	ConfigAppliedAnnotation = utils.AnnotationAppliedConfig
+
+	eventActionRollback = "Rollback"
+	eventReasonRollback = "NodeConfigRolledBack"
+	eventActionDrift    = "Drift"
+	eventReasonDrift    = "NodeConfigDrifted"
+	eventActionEdit     = "ForeignEdit"
+	eventReasonEdit     = "OEMSettingsEdited"
+
+	kindNodeConfig = "NodeConfig"
 )
 
 type Controller struct {
@@ -31,18 +46,27 @@ type Controller struct {
 	NodeConfigs      ctlv1.NodeConfigController
 	NodeConfigsCache ctlv1.NodeConfigCache
 	NodeClient       ctlnode.NodeController
-	mtx              *sync.Mutex
+	Events           ctlnode.EventClient
+	Audit            *audit.Recorder
+
+	registry *Registry
+	// retries are the backoffs of the failed handlers, the NodeConfig of the
+	// node is only handled by one worker at a time
+	retries map[string]*handlerRetry
 }
 
-func Register(ctx context.Context, nodeName string, nodecfg ctlv1.NodeConfigController, nodes ctlnode.NodeController, mtx *sync.Mutex) (*Controller, error) {
+func Register(ctx context.Context, nodeName string, nodecfg ctlv1.NodeConfigController, nodes ctlnode.NodeController, events ctlnode.EventClient, recorder *audit.Recorder) (*Controller, error) {
 	ctl := &Controller{
 		ctx:              ctx,
 		NodeName:         nodeName,
 		NodeConfigs:      nodecfg,
 		NodeConfigsCache: nodecfg.Cache(),
 		NodeClient:       nodes,
-		mtx:              mtx,
+		Events:           events,
+		Audit:            recorder,
+		retries:          make(map[string]*handlerRetry),
 	}
+	ctl.registry = newRegistry(ctl)
 
 	ctl.NodeConfigs.OnChange(ctx, HandlerName, ctl.OnNodeConfigChange)
 	ctl.NodeConfigs.OnRemove(ctx, HandlerName, ctl.OnNodeConfigRemove)
@@ -56,83 +80,325 @@ func (c *Controller) OnNodeConfigChange(key string, nodecfg *nodeconfigv1.NodeCo
 		logrus.Infof("Skip this round (OnChange) with NodeConfigs (%s): %+v", confName, nodecfg)
 		return nil, nil
 	}
+	nodecfgCpy := nodecfg.DeepCopy()
+	req := &Request{
+		ConfName:   confName,
+		NodeConfig: nodecfg,
+		Status:     &nodecfgCpy.Status,
+		Applied:    getAppliedConfig(nodecfg),
+	}
+	appliedOrig := req.Applied.DeepCopy()
 
-	// V2 Data Engine related handling.  This is intentionally not bothering
-	// to check whether the engine is already enabled or not, it runs on any
-	// change to the node config, even if that change wasn't related to the
-	// longhorn settings.  This is mostly harmless, because if the engine is
-	// already in the state about to be applied, re-applying that state is
-	// effectively a no-op, and I'd rather keep the code simple than add
-	// annotations for whether or not we already enabled the engine.
-	// The one wrinkle is that when allocating (or deallocating) hugepages,
-	// the kubelet needs to be restarted to pick up the change and reflect
-	// that in node.status.capacity.hugepages-2Mi, so that Longhorn can
-	// query that value when lhs/v2-data-engine is set to true.  This restart
-	// logic is handled inside EnableV2DataEngine() and DisableV2DataEngine().
-	if nodecfg.Spec.LonghornConfig != nil && nodecfg.Spec.LonghornConfig.EnableV2DataEngine {
-		if err := config.EnableV2DataEngine(uint64(nodecfg.Spec.LonghornConfig.HugepagesToAllocate)); err != nil {
-			logrus.WithFields(logrus.Fields{
-				"err": err.Error(),
-			}).Error("Failed to enable V2 Data Engine")
-		}
-	} else {
-		if err := config.DisableV2DataEngine(); err != nil {
-			logrus.WithFields(logrus.Fields{
-				"err": err.Error(),
-			}).Error("Failed to disable V2 Data Engine")
+	c.detectDrift(req)
+	failed := false
+	var succeeded []string
+	for _, handler := range c.registry.Handlers() {
+		if err := c.runHandler(handler, req); err != nil {
+			failed = true
+			continue
 		}
+		succeeded = append(succeeded, handler.Name())
 	}
+	c.updateDriftStatus(req)
+	c.recordAudit(nodecfg, succeeded)
+	c.reportForeignEdits(nodecfg)
 
-	// NTP related handling
-	appliedConfig := nodecfg.ObjectMeta.Annotations[ConfigAppliedAnnotation]
-	ntpConfigHandler := config.NewNTPConfigHandler(c.mtx, c.NodeClient, confName, nodecfg.Spec.NTPConfig, appliedConfig)
-	updated, err := ntpConfigHandler.DoNTPUpdate(len(nodecfg.Status.NTPConditions) == 0)
-	if err != nil {
-		logrus.Errorf("Update NTP config fail. err: %v", err)
-		return nil, err
+	if !failed {
+		nodecfgCpy.Status.ObservedGeneration = nodecfg.Generation
 	}
-	if updated {
-		if err := ntpConfigHandler.RestartService(); err != nil {
-			logrus.Errorf("Restart systemd-timesyncd fail. err: %v", err)
-			return nil, err
-		}
-		if err := ntpConfigHandler.UpdateNTPConfigPersistence(); err != nil {
-			logrus.Errorf("Update NTP config to OEM fail. err: %v", err)
+	var err error
+	if !reflect.DeepEqual(nodecfg.Status, nodecfgCpy.Status) {
+		if nodecfg, err = c.NodeConfigs.UpdateStatus(nodecfgCpy); err != nil {
+			logrus.Errorf("Update NodeConfig Status fail, err: %v", err)
 			return nil, err
 		}
+	}
 
-		if err := ntpConfigHandler.UpdateNodeNTPAnnotation(); err != nil {
-			logrus.Errorf("Update Node NTP annotation fail. err: %v", err)
-			return nil, err
-		}
-		annoValue := generateAnnotationValue(nodecfg.Spec.NTPConfig.NTPServers)
-		bytes, err := json.Marshal(annoValue)
+	// the applied config is recorded even if other handlers failed, so the
+	// applied sections are not applied again on retry
+	if !reflect.DeepEqual(req.Applied, appliedOrig) {
+		bytes, err := json.Marshal(req.Applied)
 		if err != nil {
 			logrus.Errorf("Marshal annotation value fail, err: %v", err)
 			return nil, err
 		}
-
-		nodecfg, err := config.UpdateNTPConfigApplied(c.NodeConfigs, nodecfg)
-		if err != nil {
-			logrus.Errorf("Update NodeConfig Status fail, err: %v", err)
-			return nil, err
-		}
-
-		nodecfgCpy := nodecfg.DeepCopy()
+		nodecfgCpy = nodecfg.DeepCopy()
 		if nodecfgCpy.ObjectMeta.Annotations == nil {
 			nodecfgCpy.ObjectMeta.Annotations = make(map[string]string)
 		}
 		nodecfgCpy.ObjectMeta.Annotations[ConfigAppliedAnnotation] = string(bytes)
-		if !reflect.DeepEqual(nodecfg, nodecfgCpy) {
-			return c.NodeConfigs.Update(nodecfgCpy)
+		if _, err := c.NodeConfigs.Update(nodecfgCpy); err != nil {
+			logrus.Errorf("Update NodeConfig applied config annotation fail, err: %v", err)
+			return nil, err
 		}
-	} else {
-		logrus.Infof("NTP config is not changed")
 	}
 
+	c.enqueueRetries(nodecfg)
 	return nil, nil
 }
 
+// runHandler runs the handler unless it is backing off from a failure of the
+// same generation, in which case the last failure is returned. The section is
+// applied when it is changed or its drifted files are enforced, and the files
+// are recorded once it is applied, unless the drift is kept by the policy.
+func (c *Controller) runHandler(handler Handler, req *Request) error {
+	name := handler.Name()
+	if retry := c.retries[name]; retry.pending(req.Generation()) {
+		logrus.Debugf("Skip %s until %s, it is backing off from the last failure", name, retry.due)
+		return retry.err
+	}
+
+	restore, keep := c.driftAction(req, name)
+	err := handler.Validate(req)
+	// the section rolled back too many times would only fail again, it is not
+	// applied until the spec is changed
+	if rollback := req.exhaustedRollback(name); err == nil && rollback != nil {
+		logrus.Debugf("Skip %s, it is rolled back %d times at generation %d", name, rollback.Count, rollback.Generation)
+		err = fmt.Errorf("rolled back %d times until the spec is changed: %s", rollback.Count, rollback.Message)
+	}
+	if err == nil && !keep && (handler.Diff(req) || restore) {
+		if err = c.applyHandler(handler, req); err == nil {
+			req.recordSection(name)
+		}
+	}
+	if err == nil && !keep {
+		err = recordManagedFiles(handler, req)
+	}
+	if err != nil {
+		logrus.Errorf("Apply %s fail. err: %v", name, err)
+	}
+	if statusErr := handler.Status(req, err); statusErr != nil {
+		logrus.Errorf("Get %s status fail. err: %v", name, statusErr)
+		if err == nil {
+			err = statusErr
+		}
+	}
+
+	if err != nil && req.exhaustedRollback(name) != nil {
+		delete(c.retries, name)
+		return err
+	}
+	if err != nil {
+		c.retries[name] = newHandlerRetry(c.retries[name], req.Generation(), err)
+		return err
+	}
+	delete(c.retries, name)
+	req.Status.Rollbacks = slices.DeleteFunc(req.Status.Rollbacks, func(rollback nodeconfigv1.SectionRollback) bool {
+		return rollback.Section == name
+	})
+	return nil
+}
+
+// applyHandler applies and persists the section, it is rolled back when it
+// fails to apply or to become healthy. The OEM settings stages and the files of
+// the Snapshotters are restored from the snapshot taken before, then the
+// Snapshotters reload them while the other handlers apply the section last
+// recorded in the audit log again. The rollback is recorded in the status and
+// as an Event, along with the number of rollbacks of the generation.
+func (c *Controller) applyHandler(handler Handler, req *Request) error {
+	snapshotter, ok := handler.(Snapshotter)
+	var paths []string
+	if ok {
+		paths = snapshotter.Paths()
+	}
+	snapshot, err := config.TakeSnapshot(paths...)
+	if err != nil {
+		return fmt.Errorf("take snapshot failed: %v", err)
+	}
+	applied := req.Applied.DeepCopy()
+	err = handler.Apply(req)
+	if checker, ok := handler.(HealthChecker); ok && err == nil {
+		ctx, cancel := context.WithTimeout(c.ctx, healthCheckTimeout)
+		err = checker.HealthCheck(ctx, req)
+		cancel()
+	}
+	if err == nil {
+		err = handler.Persist(req)
+	}
+	if err == nil {
+		return nil
+	}
+
+	name := handler.Name()
+	logrus.Warnf("Rollback %s to the snapshot taken before it was applied, err: %v", name, err)
+	*req.Applied = *applied
+	rollback := nodeconfigv1.SectionRollback{
+		Section:    name,
+		Generation: req.Generation(),
+		Count:      1,
+		Message:    err.Error(),
+		Time:       metav1.Now(),
+	}
+	// the host is reloaded even if some files could not be restored, so it
+	// does not keep running the failed section
+	restoreErr := snapshot.Restore()
+	if snapshotter != nil {
+		restoreErr = errors.Join(restoreErr, snapshotter.Reload())
+	} else {
+		restoreErr = errors.Join(restoreErr, c.applyLastRecorded(handler, req))
+	}
+	if restoreErr != nil {
+		logrus.Errorf("Restore %s snapshot fail. err: %v", name, restoreErr)
+		rollback.RestoreError = restoreErr.Error()
+	}
+	if last := req.rollback(name); last != nil {
+		rollback.Count = last.Count + 1
+	}
+	if pos := slices.IndexFunc(req.Status.Rollbacks, func(existing nodeconfigv1.SectionRollback) bool { return existing.Section == name }); pos >= 0 {
+		req.Status.Rollbacks[pos] = rollback
+	} else {
+		req.Status.Rollbacks = append(req.Status.Rollbacks, rollback)
+	}
+	if eventErr := c.emitRollbackEvent(req.NodeConfig, rollback); eventErr != nil {
+		logrus.Warnf("Emit rollback event fail. err: %v", eventErr)
+	}
+	return err
+}
+
+// applyLastRecorded applies the sections of the handler and the ones it
+// depends on last recorded in the audit log, the sections which were never
+// recorded are unset. It fails when
+// they are not the sections last applied, e.g. the audit log is lost.
+func (c *Controller) applyLastRecorded(handler Handler, req *Request) error {
+	name := handler.Name()
+	recorded, ok := c.Audit.Applied(kindNodeConfig, req.NodeConfig)
+	if !ok {
+		return fmt.Errorf("the last applied %s is unknown without the audit log", name)
+	}
+	sections, err := audit.SpecSections(req.Spec())
+	if err != nil {
+		return err
+	}
+	for _, section := range handlerInputs(name) {
+		if value, found := recorded[section]; found {
+			sections[section] = value
+		} else {
+			delete(sections, section)
+		}
+	}
+	data, err := json.Marshal(sections)
+	if err != nil {
+		return err
+	}
+	nodecfg := req.NodeConfig.DeepCopy()
+	nodecfg.Spec = nodeconfigv1.NodeConfigSpec{}
+	if err := json.Unmarshal(data, &nodecfg.Spec); err != nil {
+		return err
+	}
+	last := &Request{
+		ConfName:   req.ConfName,
+		NodeConfig: nodecfg,
+		Status:     &nodecfg.Status,
+		Applied:    req.Applied.DeepCopy(),
+	}
+	if hash := req.Applied.Sections[name]; hash != "" && hash != last.sectionHash(name) {
+		return fmt.Errorf("the last applied %s is not recorded in the audit log", name)
+	}
+	logrus.Infof("Apply %s last recorded in the audit log", name)
+	return handler.Apply(last)
+}
+
+func (c *Controller) emitRollbackEvent(nodecfg *nodeconfigv1.NodeConfig, rollback nodeconfigv1.SectionRollback) error {
+	message := fmt.Sprintf("%s is rolled back on %s: %s", rollback.Section, c.NodeName, rollback.Message)
+	if rollback.RestoreError != "" {
+		message = fmt.Sprintf("%s, restore failed: %s", message, rollback.RestoreError)
+	}
+	return c.emitSectionEvent(nodecfg, eventActionRollback, eventReasonRollback, rollback.Section, message)
+}
+
+// emitSectionEvent records a warning of the section on the NodeConfig, the
+// event of the same action and section is updated on repeat.
+func (c *Controller) emitSectionEvent(nodecfg *nodeconfigv1.NodeConfig, action, reason, section, message string) error {
+	now := time.Now()
+
+	section = strings.ToLower(strings.ReplaceAll(section, " ", "-"))
+	eventName := fmt.Sprintf("nodeconfig-%s-%s.%s", strings.ToLower(action), section, c.NodeName)
+
+	event, err := c.Events.Get(nodecfg.Namespace, eventName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		event = &corev1.Event{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      eventName,
+				Namespace: nodecfg.Namespace,
+			},
+			InvolvedObject: corev1.ObjectReference{
+				APIVersion: nodeconfigv1.SchemeGroupVersion.String(),
+				Kind:       "NodeConfig",
+				Namespace:  nodecfg.Namespace,
+				Name:       nodecfg.Name,
+				UID:        nodecfg.UID,
+			},
+			Action:  action,
+			Reason:  reason,
+			Message: message,
+			Source: corev1.EventSource{
+				Component: "harvester-node-manager",
+				Host:      c.NodeName,
+			},
+			Type:                corev1.EventTypeWarning,
+			ReportingController: fmt.Sprintf("harvesterhci.io/%s", HandlerName),
+			ReportingInstance:   c.NodeName,
+			EventTime:           metav1.NewMicroTime(now),
+			FirstTimestamp:      metav1.NewTime(now),
+			LastTimestamp:       metav1.NewTime(now),
+			Count:               1,
+		}
+
+		_, err := c.Events.Create(event)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	event.Message = message
+	event.LastTimestamp = metav1.NewTime(now)
+	event.Count++
+
+	_, err = c.Events.Update(event)
+	return err
+}
+
+// reportForeignEdits emits an Event for the OEM settings files changed outside
+// of the node manager, the stages of the others are kept in the files while
+// the stages of the sections are overwritten when they are applied.
+func (c *Controller) reportForeignEdits(nodecfg *nodeconfigv1.NodeConfig) {
+	for _, path := range config.TakeOEMForeignEdits() {
+		message := fmt.Sprintf("%s is changed outside of the node manager on %s", path, c.NodeName)
+		if eventErr := c.emitSectionEvent(nodecfg, eventActionEdit, eventReasonEdit, "oem settings", message); eventErr != nil {
+			logrus.Warnf("Emit foreign edit event fail. err: %v", eventErr)
+		}
+	}
+}
+
+// enqueueRetries enqueues the NodeConfig when the first failed handler is due
+func (c *Controller) enqueueRetries(nodecfg *nodeconfigv1.NodeConfig) {
+	var due time.Time
+	for _, retry := range c.retries {
+		if due.IsZero() || retry.due.Before(due) {
+			due = retry.due
+		}
+	}
+	if !due.IsZero() {
+		c.NodeConfigs.EnqueueAfter(nodecfg.Namespace, nodecfg.Name, time.Until(due))
+	}
+}
+
+// getAppliedConfig returns the config recorded in the AppliedConfig
+// annotation, it is empty when nothing was applied.
+func getAppliedConfig(nodecfg *nodeconfigv1.NodeConfig) *nodeconfigv1.AppliedConfigAnnotation {
+	applied := &nodeconfigv1.AppliedConfigAnnotation{}
+	appliedConfig := nodecfg.ObjectMeta.Annotations[ConfigAppliedAnnotation]
+	if appliedConfig == "" {
+		return applied
+	}
+	if err := json.Unmarshal([]byte(appliedConfig), applied); err != nil {
+		logrus.Warnf("Unmarshal applied config from annotation failed, assume that is empty err: %v", err)
+		return &nodeconfigv1.AppliedConfigAnnotation{}
+	}
+	return applied
+}
+
 func (c *Controller) OnNodeConfigRemove(key string, nodecfg *nodeconfigv1.NodeConfig) (*nodeconfigv1.NodeConfig, error) {
 	if nodecfg == nil || nodecfg.DeletionTimestamp == nil {
 		logrus.Infof("Skip this round (OnRemove) with NodeConfigs :%+v", nodecfg)
@@ -144,26 +410,61 @@ func (c *Controller) OnNodeConfigRemove(key string, nodecfg *nodeconfigv1.NodeCo
 		return nil, fmt.Errorf("node name %s is not matched", confName)
 	}
 
-	logrus.Infof("Node config is removed, rollback and remove persistent NTP config")
-	if err := config.NTPConfigRollback(); err != nil {
-		logrus.Errorf("Rollback NTP config fail. err: %v", err)
-		c.NodeConfigs.EnqueueAfter(nodecfg.Namespace, nodecfg.Name, enqueueJitter())
-		return nil, err
-	}
-	if err := config.RemovePersistentNTPConfig(); err != nil {
-		logrus.Errorf("Remove persistent NTP config fail. err: %v", err)
-		c.NodeConfigs.EnqueueAfter(nodecfg.Namespace, nodecfg.Name, enqueueJitter())
-		return nil, err
+	handlers := c.registry.Handlers()
+	for i := len(handlers) - 1; i >= 0; i-- {
+		if err := handlers[i].Rollback(); err != nil {
+			logrus.Errorf("Rollback %s fail. err: %v", handlers[i].Name(), err)
+			c.NodeConfigs.EnqueueAfter(nodecfg.Namespace, nodecfg.Name, enqueueJitter())
+			return nil, err
+		}
 	}
-	if err := config.DisableV2DataEngine(); err != nil {
-		logrus.WithFields(logrus.Fields{
-			"err": err.Error(),
-		}).Error("Failed to disable V2 Data Engine")
-		c.NodeConfigs.EnqueueAfter(nodecfg.Namespace, nodecfg.Name, enqueueJitter())
+	clear(c.retries)
+	if err := c.Audit.RecordRemoval(kindNodeConfig, nodecfg); err != nil {
+		logrus.Warnf("Record the removal of NodeConfig %s in the audit log fail, err: %v", nodecfg.Name, err)
 	}
 	return nil, nil
 }
 
+// recordAudit records the sections of the handlers which succeeded in the
+// audit log, along with the drift policies. A section which could not be
+// recorded is recorded on the next round, as it still differs from the last
+// recorded one.
+func (c *Controller) recordAudit(nodecfg *nodeconfigv1.NodeConfig, succeeded []string) {
+	spec, err := audit.SpecSections(nodecfg.Spec)
+	if err != nil {
+		logrus.Warnf("Split NodeConfig %s into sections fail, err: %v", nodecfg.Name, err)
+		return
+	}
+	sections := map[string]json.RawMessage{"driftPolicies": spec["driftPolicies"]}
+	for _, name := range succeeded {
+		for _, section := range handlerSections[name] {
+			sections[section] = spec[section]
+		}
+	}
+	if err := c.Audit.Record(kindNodeConfig, nodecfg, sections); err != nil {
+		logrus.Warnf("Record NodeConfig %s in the audit log fail, err: %v", nodecfg.Name, err)
+	}
+}
+
+// updateNodeRebootRequired sets or clears the reboot required annotation of
+// the node, the annotation is only owned by the controller
+func (c *Controller) updateNodeRebootRequired(required bool) error {
+	node, err := c.NodeClient.Cache().Get(c.NodeName)
+	if err != nil {
+		return err
+	}
+	if _, found := node.Annotations[utils.AnnotationRebootRequired]; found == required {
+		return nil
+	}
+
+	var value *string
+	if required {
+		rebootRequired := "true"
+		value = &rebootRequired
+	}
+	return utils.PatchNodeAnnotation(c.NodeClient, c.NodeName, utils.AnnotationRebootRequired, value)
+}
+
 func enqueueJitter() time.Duration {
 	baseDelay := 7
 	randNum, err := common.GenRandNumber(3)
@@ -172,9 +473,3 @@ func enqueueJitter() time.Duration {
 	}
 	return time.Duration(int(randNum)+baseDelay) * time.Second
 }
-
-func generateAnnotationValue(ntpServers string) *nodeconfigv1.AppliedConfigAnnotation {
-	return &nodeconfigv1.AppliedConfigAnnotation{
-		NTPServers: ntpServers,
-	}
-}
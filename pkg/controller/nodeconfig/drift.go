@@ -0,0 +1,130 @@
+package nodeconfig
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/controller/nodeconfig/config"
+	"github.com/harvester/node-manager/pkg/metrics"
+)
+
+func (c *Controller) driftPolicy(req *Request, section string) nodeconfigv1.DriftPolicy {
+	return config.GetDriftPolicy(req.Spec().DriftPolicies, section)
+}
+
+// detectDrift compares the managed files with the content they were applied
+// with, the files which are newly drifted are reported unless their section
+// ignores the drift. The drift is cleared once the content is back.
+func (c *Controller) detectDrift(req *Request) {
+	now := metav1.Now()
+	for i := range req.Status.ManagedFiles {
+		file := &req.Status.ManagedFiles[i]
+		hash, err := config.HashManagedPath(file.Path)
+		if err != nil {
+			logrus.Warnf("Hash %s of %s fail, err: %v", file.Path, file.Section, err)
+			continue
+		}
+		drifted := hash != file.AppliedHash
+		if drifted == file.Drifted {
+			continue
+		}
+		file.Drifted = drifted
+		if !drifted {
+			logrus.Infof("%s of %s is back to the applied content", file.Path, file.Section)
+			file.DriftedTime = nil
+			continue
+		}
+		file.DriftedTime = &now
+
+		policy := c.driftPolicy(req, file.Section)
+		logrus.Warnf("%s of %s is changed outside of the node manager, the drift policy is %s", file.Path, file.Section, policy)
+		if policy == nodeconfigv1.DriftPolicyIgnore {
+			continue
+		}
+		metrics.NodeConfigDriftsCV.WithLabelValues(c.NodeName, file.Section, string(policy)).Inc()
+		message := fmt.Sprintf("%s of %s is changed outside of the node manager on %s", file.Path, file.Section, c.NodeName)
+		if policy == nodeconfigv1.DriftPolicyEnforce {
+			message += ", it is restored by the enforce policy"
+		} else {
+			message += ", it is kept until the NodeConfig is changed"
+		}
+		if eventErr := c.emitSectionEvent(req.NodeConfig, eventActionDrift, eventReasonDrift, file.Section, message); eventErr != nil {
+			logrus.Warnf("Emit drift event fail. err: %v", eventErr)
+		}
+	}
+}
+
+// driftAction decides how the drift of the section affects the round: the
+// drift is restored by applying the section with the enforce policy, and kept
+// with the other policies until the generation the files were applied with
+// is changed, then the section is applied again.
+func (c *Controller) driftAction(req *Request, section string) (restore, keep bool) {
+	idx := slices.IndexFunc(req.Status.ManagedFiles, func(file nodeconfigv1.ManagedFileStatus) bool {
+		return file.Section == section && file.Drifted
+	})
+	if idx < 0 {
+		return false, false
+	}
+	if c.driftPolicy(req, section) == nodeconfigv1.DriftPolicyEnforce || req.Status.ManagedFiles[idx].AppliedGeneration != req.Generation() {
+		return true, false
+	}
+	return false, true
+}
+
+// recordManagedFiles hashes the files of the applied section as the content
+// to detect the drift from, the files are kept in path order so the status is
+// stable between rounds.
+func recordManagedFiles(handler Handler, req *Request) error {
+	manager, ok := handler.(FileManager)
+	if !ok {
+		return nil
+	}
+	name := handler.Name()
+	files := slices.DeleteFunc(req.Status.ManagedFiles, func(file nodeconfigv1.ManagedFileStatus) bool {
+		return file.Section == name
+	})
+	for _, path := range manager.ManagedPaths(req) {
+		hash, err := config.HashManagedPath(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, nodeconfigv1.ManagedFileStatus{
+			Path:              path,
+			Section:           name,
+			AppliedHash:       hash,
+			AppliedGeneration: req.Generation(),
+		})
+	}
+	slices.SortFunc(files, func(a, b nodeconfigv1.ManagedFileStatus) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	req.Status.ManagedFiles = files
+	return nil
+}
+
+// updateDriftStatus sets the ConfigDrifted condition and the number of the
+// drifted files of each section managing files.
+func (c *Controller) updateDriftStatus(req *Request) {
+	req.SetCondition(config.NewConfigDriftedCondition(req.Generation(), req.Spec().DriftPolicies, req.Status.ManagedFiles))
+
+	for _, handler := range c.registry.Handlers() {
+		if _, ok := handler.(FileManager); !ok {
+			continue
+		}
+		name := handler.Name()
+		drifted := 0
+		for _, file := range req.Status.ManagedFiles {
+			if file.Section == name && file.Drifted {
+				drifted++
+			}
+		}
+		metrics.NodeConfigDriftedFilesGV.DeletePartialMatch(prometheus.Labels{"nodename": c.NodeName, "section": name})
+		metrics.NodeConfigDriftedFilesGV.WithLabelValues(c.NodeName, name, string(c.driftPolicy(req, name))).Set(float64(drifted))
+	}
+}
@@ -0,0 +1,149 @@
+package nodeconfig
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+// fileHandler writes its file on every apply, like the converging handlers
+type fileHandler struct {
+	fakeHandler
+	path string
+}
+
+func (h *fileHandler) Apply(*Request) error {
+	h.calls = append(h.calls, "apply")
+	return os.WriteFile(h.path, []byte("applied"), 0644)
+}
+
+func (h *fileHandler) ManagedPaths(*Request) []string {
+	return []string{h.path}
+}
+
+func newDriftTest(t *testing.T) (*Controller, *fakeEvents, *fileHandler, *Request) {
+	events := &fakeEvents{events: make(map[string]*corev1.Event)}
+	handler := &fileHandler{
+		fakeHandler: fakeHandler{baseHandler: baseHandler{"fake"}, changed: true},
+		path:        t.TempDir() + "/fake.conf",
+	}
+	c := &Controller{NodeName: "node1", Events: events, registry: &Registry{}, retries: make(map[string]*handlerRetry)}
+	c.registry.Register(handler)
+
+	req := newTestRequest(1)
+	req.NodeConfig.Namespace = "harvester-system"
+	req.NodeConfig.Name = "node1"
+	require.Nil(t, c.runHandler(handler, req))
+	require.Len(t, req.Status.ManagedFiles, 1)
+	handler.changed = false
+	handler.calls = nil
+	return c, events, handler, req
+}
+
+func TestDriftEnforce(t *testing.T) {
+	c, events, handler, req := newDriftTest(t)
+	hash, err := utils.HashFile(handler.path)
+	require.Nil(t, err)
+	assert.Equal(t, nodeconfigv1.ManagedFileStatus{Path: handler.path, Section: "fake", AppliedHash: hash, AppliedGeneration: 1}, req.Status.ManagedFiles[0])
+
+	// nothing changed
+	c.detectDrift(req)
+	assert.False(t, req.Status.ManagedFiles[0].Drifted)
+
+	// the drift is reported and restored although the section is unchanged
+	require.Nil(t, os.WriteFile(handler.path, []byte("manual"), 0644))
+	c.detectDrift(req)
+	assert.True(t, req.Status.ManagedFiles[0].Drifted)
+	assert.NotNil(t, req.Status.ManagedFiles[0].DriftedTime)
+	event := events.events["harvester-system/nodeconfig-drift-fake.node1"]
+	require.NotNil(t, event)
+	assert.Equal(t, eventReasonDrift, event.Reason)
+	assert.Contains(t, event.Message, "restored by the enforce policy")
+
+	assert.Nil(t, c.runHandler(handler, req))
+	assert.Equal(t, []string{"validate", "diff", "apply", "persist", "status"}, handler.calls)
+	assert.Equal(t, hash, req.Status.ManagedFiles[0].AppliedHash)
+	assert.False(t, req.Status.ManagedFiles[0].Drifted)
+	c.updateDriftStatus(req)
+	assert.True(t, meta.IsStatusConditionFalse(req.Status.Conditions, string(nodeconfigv1.ConfigDrifted)))
+}
+
+func TestDriftReport(t *testing.T) {
+	c, events, handler, req := newDriftTest(t)
+	req.NodeConfig.Spec.DriftPolicies = map[string]nodeconfigv1.DriftPolicy{"fake": nodeconfigv1.DriftPolicyReport}
+
+	// the drift is kept for the generation the file was applied with
+	require.Nil(t, os.WriteFile(handler.path, []byte("manual"), 0644))
+	c.detectDrift(req)
+	handler.changed = true
+	assert.Nil(t, c.runHandler(handler, req))
+	assert.Equal(t, []string{"validate", "status"}, handler.calls)
+	assert.True(t, req.Status.ManagedFiles[0].Drifted)
+	assert.Contains(t, events.events["harvester-system/nodeconfig-drift-fake.node1"].Message, "kept until the NodeConfig is changed")
+	c.updateDriftStatus(req)
+	cond := meta.FindStatusCondition(req.Status.Conditions, string(nodeconfigv1.ConfigDrifted))
+	require.NotNil(t, cond)
+	assert.Equal(t, metav1.ConditionTrue, cond.Status)
+	assert.Contains(t, cond.Message, handler.path)
+
+	// the drift is reported once
+	c.detectDrift(req)
+	assert.Equal(t, int32(1), events.events["harvester-system/nodeconfig-drift-fake.node1"].Count)
+
+	// the section is applied again once the NodeConfig is changed
+	handler.calls = nil
+	handler.changed = false
+	req.NodeConfig.Generation = 2
+	assert.Nil(t, c.runHandler(handler, req))
+	assert.Equal(t, []string{"validate", "diff", "apply", "persist", "status"}, handler.calls)
+	assert.False(t, req.Status.ManagedFiles[0].Drifted)
+	assert.Equal(t, int64(2), req.Status.ManagedFiles[0].AppliedGeneration)
+}
+
+func TestDriftIgnore(t *testing.T) {
+	c, events, handler, req := newDriftTest(t)
+	req.NodeConfig.Spec.DriftPolicies = map[string]nodeconfigv1.DriftPolicy{"fake": nodeconfigv1.DriftPolicyIgnore}
+
+	require.Nil(t, os.WriteFile(handler.path, []byte("manual"), 0644))
+	c.detectDrift(req)
+	assert.True(t, req.Status.ManagedFiles[0].Drifted)
+	assert.Empty(t, events.events)
+	c.updateDriftStatus(req)
+	assert.True(t, meta.IsStatusConditionFalse(req.Status.Conditions, string(nodeconfigv1.ConfigDrifted)))
+
+	// the drift is cleared once the content is back
+	require.Nil(t, os.WriteFile(handler.path, []byte("applied"), 0644))
+	c.detectDrift(req)
+	assert.False(t, req.Status.ManagedFiles[0].Drifted)
+	assert.Nil(t, req.Status.ManagedFiles[0].DriftedTime)
+}
+
+func TestRecordManagedFiles(t *testing.T) {
+	dir := t.TempDir()
+	req := newTestRequest(1)
+	req.Status.ManagedFiles = []nodeconfigv1.ManagedFileStatus{
+		{Path: dir + "/c", Section: "other", AppliedGeneration: 1},
+		{Path: dir + "/b", Section: "fake", AppliedGeneration: 1},
+	}
+
+	// the files of the section are replaced and kept in path order, the
+	// missing files are recorded as removed
+	handler := &fileHandler{fakeHandler: fakeHandler{baseHandler: baseHandler{"fake"}}, path: dir + "/a"}
+	require.Nil(t, recordManagedFiles(handler, req))
+	assert.Equal(t, []nodeconfigv1.ManagedFileStatus{
+		{Path: dir + "/a", Section: "fake", AppliedGeneration: 1},
+		{Path: dir + "/c", Section: "other", AppliedGeneration: 1},
+	}, req.Status.ManagedFiles)
+
+	// the handlers without files are not recorded
+	require.Nil(t, recordManagedFiles(&fakeHandler{baseHandler: baseHandler{"other"}}, req))
+	assert.Len(t, req.Status.ManagedFiles, 2)
+}
@@ -0,0 +1,247 @@
+package nodeconfig
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/audit"
+	"github.com/harvester/node-manager/pkg/controller/nodeconfig/config"
+)
+
+const (
+	retryBaseDelay = 10 * time.Second
+	retryMaxDelay  = 5 * time.Minute
+	// healthCheckTimeout is how long an applied section is waited for to
+	// become healthy before it is rolled back
+	healthCheckTimeout = 30 * time.Second
+	// maxSectionRollbacks is how many times in a row a section is rolled back
+	// at the same generation before it is no longer retried
+	maxSectionRollbacks = 5
+)
+
+// Request is a round of reconciling the NodeConfig of the node, it is shared by
+// the handlers of the round.
+type Request struct {
+	ConfName string
+	// NodeConfig is the object being reconciled, it must not be changed
+	NodeConfig *nodeconfigv1.NodeConfig
+	// Status is written back to the NodeConfig after all handlers are run
+	Status *nodeconfigv1.NodeConfigStatus
+	// Applied is written back to the AppliedConfig annotation, the handlers
+	// record the sections they fully applied in it
+	Applied *nodeconfigv1.AppliedConfigAnnotation
+
+	// sections are the spec split into the sections, on first use
+	sections map[string]json.RawMessage
+}
+
+func (r *Request) Spec() *nodeconfigv1.NodeConfigSpec {
+	return &r.NodeConfig.Spec
+}
+
+func (r *Request) Generation() int64 {
+	return r.NodeConfig.Generation
+}
+
+func (r *Request) SetCondition(cond metav1.Condition) {
+	meta.SetStatusCondition(&r.Status.Conditions, cond)
+}
+
+// rollback returns the rollback of the handler at the current generation
+func (r *Request) rollback(name string) *nodeconfigv1.SectionRollback {
+	pos := slices.IndexFunc(r.Status.Rollbacks, func(rollback nodeconfigv1.SectionRollback) bool {
+		return rollback.Section == name && rollback.Generation == r.Generation()
+	})
+	if pos < 0 {
+		return nil
+	}
+	return &r.Status.Rollbacks[pos]
+}
+
+// exhaustedRollback returns the rollback of the handler once it is rolled
+// back maxSectionRollbacks times at the current generation
+func (r *Request) exhaustedRollback(name string) *nodeconfigv1.SectionRollback {
+	if rollback := r.rollback(name); rollback != nil && rollback.Count >= maxSectionRollbacks {
+		return rollback
+	}
+	return nil
+}
+
+// sectionHash returns the hash of the spec sections applied by the handler,
+// along with the ones it depends on. It is empty when the spec could not be
+// split.
+func (r *Request) sectionHash(name string) string {
+	if r.sections == nil {
+		sections, err := audit.SpecSections(r.Spec())
+		if err != nil {
+			logrus.Warnf("Split NodeConfig %s into sections fail, err: %v", r.ConfName, err)
+			return ""
+		}
+		r.sections = sections
+	}
+	h := sha256.New()
+	for _, section := range handlerInputs(name) {
+		h.Write([]byte(section))
+		h.Write([]byte{0})
+		h.Write(r.sections[section])
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sectionChanged returns whether the spec sections of the handler differ
+// from the ones recorded when the handler last applied them
+func (r *Request) sectionChanged(name string) bool {
+	hash := r.sectionHash(name)
+	return hash == "" || r.Applied.Sections[name] != hash
+}
+
+// recordSection records the spec sections of the handler as applied
+func (r *Request) recordSection(name string) {
+	hash := r.sectionHash(name)
+	if hash == "" {
+		return
+	}
+	if r.Applied.Sections == nil {
+		r.Applied.Sections = make(map[string]string)
+	}
+	r.Applied.Sections[name] = hash
+}
+
+// enforced returns whether the host state drifted from the section is
+// restored, which is the drift policy of the section
+func (r *Request) enforced(name string) bool {
+	return config.GetDriftPolicy(r.Spec().DriftPolicies, name) == nodeconfigv1.DriftPolicyEnforce
+}
+
+// Handler applies a section of the NodeConfig to the host. The handlers are run
+// in the order they are registered, and rolled back in the reverse order once
+// the NodeConfig is removed.
+type Handler interface {
+	// Name identifies the handler in the logs and the retries
+	Name() string
+	// Validate checks the section against the host before it is applied, the
+	// webhook has already checked what could be checked without the host
+	Validate(req *Request) error
+	// Diff returns whether the section needs to be applied, it is changed
+	// since it was last applied, or the host state drifted from it and the
+	// drift is enforced. The drift of the managed files is handled apart.
+	Diff(req *Request) bool
+	Apply(req *Request) error
+	// Persist makes the applied section survive a reboot, it is only called
+	// when Apply and the health check succeeded
+	Persist(req *Request) error
+	// Rollback restores what the section changed on the host
+	Rollback() error
+	// Status records the status and the conditions of the section, err is the
+	// failure of Validate, Apply or Persist. It fails when the status could
+	// not be observed.
+	Status(req *Request, err error) error
+}
+
+// Snapshotter is implemented by the handlers whose section is entirely kept
+// in host files. The files are snapshotted before the section is applied, and
+// restored when it fails to apply or to become healthy. The other handlers are
+// rolled back by applying the section last recorded in the audit log.
+type Snapshotter interface {
+	// Paths are the host files written by the section
+	Paths() []string
+	// Reload makes the host pick up the restored files
+	Reload() error
+}
+
+// FileManager is implemented by the handlers which write host files, the
+// files are hashed once the section is applied, and the changes made outside
+// of the node manager are handled by the drift policy of the section.
+type FileManager interface {
+	// ManagedPaths are the host files written by the section, none when the
+	// section is not set
+	ManagedPaths(req *Request) []string
+}
+
+// HealthChecker is implemented by the handlers which could tell whether the
+// applied section works, e.g. the service is active. The check is given up
+// once the context is done.
+type HealthChecker interface {
+	HealthCheck(ctx context.Context, req *Request) error
+}
+
+// baseHandler is embedded by the handlers which persist the section as part
+// of Apply, the section is applied again once it is changed.
+type baseHandler struct {
+	name string
+}
+
+func (h baseHandler) Name() string {
+	return h.name
+}
+
+func (baseHandler) Validate(*Request) error {
+	return nil
+}
+
+func (h baseHandler) Diff(req *Request) bool {
+	return req.sectionChanged(h.name)
+}
+
+func (baseHandler) Persist(*Request) error {
+	return nil
+}
+
+// Registry keeps the handlers in the order they are run
+type Registry struct {
+	handlers []Handler
+}
+
+// Register appends the handlers, a name could only be registered once
+func (r *Registry) Register(handlers ...Handler) {
+	for _, handler := range handlers {
+		for _, registered := range r.handlers {
+			if registered.Name() == handler.Name() {
+				panic(fmt.Sprintf("NodeConfig handler %s is already registered", handler.Name()))
+			}
+		}
+		r.handlers = append(r.handlers, handler)
+	}
+}
+
+func (r *Registry) Handlers() []Handler {
+	return r.handlers
+}
+
+// handlerRetry is the backoff of a failed handler, the handler is not run
+// again for the same generation until it is due, so a failing section does
+// not hold the others back or retry with them.
+type handlerRetry struct {
+	generation int64
+	failures   int
+	due        time.Time
+	err        error
+}
+
+func newHandlerRetry(last *handlerRetry, generation int64, err error) *handlerRetry {
+	retry := &handlerRetry{generation: generation, failures: 1, err: err}
+	if last != nil && last.generation == generation {
+		retry.failures = last.failures + 1
+	}
+	delay := retryMaxDelay
+	if retry.failures <= 5 {
+		delay = min(retryBaseDelay<<(retry.failures-1), retryMaxDelay)
+	}
+	retry.due = time.Now().Add(delay)
+	return retry
+}
+
+func (r *handlerRetry) pending(generation int64) bool {
+	return r != nil && r.generation == generation && time.Now().Before(r.due)
+}
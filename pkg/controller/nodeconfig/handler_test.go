@@ -0,0 +1,455 @@
+package nodeconfig
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	ctlnode "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/audit"
+)
+
+type fakeHandler struct {
+	baseHandler
+	validateErr error
+	applyErr    error
+	changed     bool
+	calls       []string
+	statusErr   error
+}
+
+func (h *fakeHandler) Validate(*Request) error {
+	h.calls = append(h.calls, "validate")
+	return h.validateErr
+}
+
+func (h *fakeHandler) Diff(*Request) bool {
+	h.calls = append(h.calls, "diff")
+	return h.changed
+}
+
+func (h *fakeHandler) Apply(*Request) error {
+	h.calls = append(h.calls, "apply")
+	return h.applyErr
+}
+
+func (h *fakeHandler) Persist(*Request) error {
+	h.calls = append(h.calls, "persist")
+	return nil
+}
+
+func (h *fakeHandler) Rollback() error {
+	return nil
+}
+
+func (h *fakeHandler) Status(_ *Request, err error) error {
+	h.calls = append(h.calls, "status")
+	if err != nil {
+		h.calls = append(h.calls, err.Error())
+	}
+	return h.statusErr
+}
+
+// snapshotHandler writes a file, which is rolled back when it is not healthy
+type snapshotHandler struct {
+	fakeHandler
+	path      string
+	healthErr error
+	reloads   int
+}
+
+func (h *snapshotHandler) Apply(req *Request) error {
+	h.calls = append(h.calls, "apply")
+	req.Applied.NTPServers = "0.suse.pool.ntp.org"
+	return os.WriteFile(h.path, []byte("new"), 0644)
+}
+
+func (h *snapshotHandler) HealthCheck(context.Context, *Request) error {
+	h.calls = append(h.calls, "health")
+	return h.healthErr
+}
+
+func (h *snapshotHandler) Paths() []string {
+	return []string{h.path}
+}
+
+func (h *snapshotHandler) Reload() error {
+	h.reloads++
+	return nil
+}
+
+// fakeEvents keeps the events in memory, the other methods are not used
+type fakeEvents struct {
+	ctlnode.EventClient
+	events map[string]*corev1.Event
+}
+
+func (f *fakeEvents) Get(namespace, name string, _ metav1.GetOptions) (*corev1.Event, error) {
+	if event, found := f.events[namespace+"/"+name]; found {
+		return event.DeepCopy(), nil
+	}
+	return nil, apierrors.NewNotFound(corev1.Resource("events"), name)
+}
+
+func (f *fakeEvents) Create(event *corev1.Event) (*corev1.Event, error) {
+	f.events[event.Namespace+"/"+event.Name] = event
+	return event, nil
+}
+
+func (f *fakeEvents) Update(event *corev1.Event) (*corev1.Event, error) {
+	f.events[event.Namespace+"/"+event.Name] = event
+	return event, nil
+}
+
+func newTestRequest(generation int64) *Request {
+	nodecfg := &nodeconfigv1.NodeConfig{ObjectMeta: metav1.ObjectMeta{Generation: generation}}
+	return &Request{
+		NodeConfig: nodecfg,
+		Status:     &nodecfg.Status,
+		Applied:    &nodeconfigv1.AppliedConfigAnnotation{},
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	registry := &Registry{}
+	registry.Register(&fakeHandler{baseHandler: baseHandler{"a"}}, &fakeHandler{baseHandler: baseHandler{"b"}})
+	names := []string{}
+	for _, handler := range registry.Handlers() {
+		names = append(names, handler.Name())
+	}
+	assert.Equal(t, []string{"a", "b"}, names)
+	assert.Panics(t, func() {
+		registry.Register(&fakeHandler{baseHandler: baseHandler{"a"}})
+	})
+}
+
+func TestHandlerSections(t *testing.T) {
+	// every handler records its sections in the audit log, which are fields
+	// of the spec
+	fields := reflect.TypeOf(nodeconfigv1.NodeConfigSpec{})
+	keys := make(map[string]bool, fields.NumField())
+	for i := range fields.NumField() {
+		keys[strings.Split(fields.Field(i).Tag.Get("json"), ",")[0]] = true
+	}
+	for _, handler := range newRegistry(&Controller{}).Handlers() {
+		assert.NotEmpty(t, handlerSections[handler.Name()], handler.Name())
+		for _, section := range handlerInputs(handler.Name()) {
+			assert.True(t, keys[section], section)
+		}
+	}
+}
+
+func TestRunHandler(t *testing.T) {
+	events := &fakeEvents{events: make(map[string]*corev1.Event)}
+	c := &Controller{ctx: context.Background(), Events: events, retries: make(map[string]*handlerRetry)}
+
+	// unchanged
+	handler := &fakeHandler{baseHandler: baseHandler{"fake"}}
+	assert.Nil(t, c.runHandler(handler, newTestRequest(1)))
+	assert.Equal(t, []string{"validate", "diff", "status"}, handler.calls)
+
+	// changed
+	handler = &fakeHandler{baseHandler: baseHandler{"fake"}, changed: true}
+	assert.Nil(t, c.runHandler(handler, newTestRequest(1)))
+	assert.Equal(t, []string{"validate", "diff", "apply", "persist", "status"}, handler.calls)
+
+	// invalid, it is not applied
+	handler = &fakeHandler{baseHandler: baseHandler{"fake"}, changed: true, validateErr: errors.New("invalid")}
+	assert.NotNil(t, c.runHandler(handler, newTestRequest(1)))
+	assert.Equal(t, []string{"validate", "status", "invalid"}, handler.calls)
+	assert.Equal(t, 1, c.retries["fake"].failures)
+
+	// backing off from the failure of the same generation
+	handler.calls = nil
+	assert.EqualError(t, c.runHandler(handler, newTestRequest(1)), "invalid")
+	assert.Empty(t, handler.calls)
+
+	// retried when due, the backoff is doubled
+	c.retries["fake"].due = time.Now()
+	handler.calls = nil
+	assert.NotNil(t, c.runHandler(handler, newTestRequest(1)))
+	assert.Equal(t, []string{"validate", "status", "invalid"}, handler.calls)
+	assert.Equal(t, 2, c.retries["fake"].failures)
+	assert.WithinDuration(t, time.Now().Add(2*retryBaseDelay), c.retries["fake"].due, time.Second)
+
+	// a new generation is not held back by the backoff
+	handler.calls = nil
+	handler.validateErr = nil
+	assert.Nil(t, c.runHandler(handler, newTestRequest(2)))
+	assert.Equal(t, []string{"validate", "diff", "apply", "persist", "status"}, handler.calls)
+	assert.Empty(t, c.retries)
+
+	// failed to apply, it is rolled back and retried with the backoff
+	handler.calls = nil
+	handler.applyErr = errors.New("failed")
+	req := newTestRequest(3)
+	assert.EqualError(t, c.runHandler(handler, req), "failed")
+	assert.Equal(t, []string{"validate", "diff", "apply", "status", "failed"}, handler.calls)
+	assert.Equal(t, 1, c.retries["fake"].failures)
+	assert.Len(t, req.Status.Rollbacks, 1)
+	assert.Equal(t, int32(1), req.Status.Rollbacks[0].Count)
+	assert.Equal(t, "the last applied fake is unknown without the audit log", req.Status.Rollbacks[0].RestoreError)
+	handler.calls = nil
+	assert.EqualError(t, c.runHandler(handler, req), "failed")
+	assert.Empty(t, handler.calls)
+
+	// the failure is gone when retried, the rollback is cleared
+	c.retries["fake"].due = time.Now()
+	handler.calls = nil
+	handler.applyErr = nil
+	assert.Nil(t, c.runHandler(handler, req))
+	assert.Equal(t, []string{"validate", "diff", "apply", "persist", "status"}, handler.calls)
+	assert.Empty(t, c.retries)
+	assert.Empty(t, req.Status.Rollbacks)
+
+	// rolled back too many times in a row, it is not retried for the generation
+	handler.applyErr = errors.New("failed")
+	for range maxSectionRollbacks {
+		if retry := c.retries["fake"]; retry != nil {
+			retry.due = time.Now()
+		}
+		assert.EqualError(t, c.runHandler(handler, req), "failed")
+	}
+	assert.Equal(t, int32(maxSectionRollbacks), req.Status.Rollbacks[0].Count)
+	assert.Empty(t, c.retries)
+	handler.calls = nil
+	assert.EqualError(t, c.runHandler(handler, req), "rolled back 5 times until the spec is changed: failed")
+	assert.Equal(t, []string{"validate", "status", "rolled back 5 times until the spec is changed: failed"}, handler.calls)
+	assert.Empty(t, c.retries)
+
+	// the status could not be observed
+	handler = &fakeHandler{baseHandler: baseHandler{"fake"}, statusErr: errors.New("unknown")}
+	assert.EqualError(t, c.runHandler(handler, newTestRequest(2)), "unknown")
+	assert.NotNil(t, c.retries["fake"])
+}
+
+func TestSectionDiff(t *testing.T) {
+	applied := &nodeconfigv1.AppliedConfigAnnotation{}
+	newRequest := func(spec nodeconfigv1.NodeConfigSpec) *Request {
+		req := newTestRequest(1)
+		req.NodeConfig.Spec = spec
+		req.Applied = applied
+		return req
+	}
+	hostAliases := []nodeconfigv1.HostAlias{{IP: "10.0.0.1", Hostnames: []string{"registry.example.com"}}}
+	handler := &hostAliasesHandler{baseHandler{"host aliases"}}
+
+	// never applied
+	req := newRequest(nodeconfigv1.NodeConfigSpec{HostAliases: hostAliases})
+	assert.True(t, handler.Diff(req))
+	req.recordSection("host aliases")
+	assert.False(t, handler.Diff(req))
+
+	// the other sections are not compared
+	assert.False(t, handler.Diff(newRequest(nodeconfigv1.NodeConfigSpec{HostAliases: hostAliases, Timezone: "UTC"})))
+	assert.True(t, handler.Diff(newRequest(nodeconfigv1.NodeConfigSpec{})))
+
+	// the kernel args are applied until the node is rebooted with them
+	kernelArgs := &kernelArgsHandler{baseHandler: baseHandler{"kernel args"}}
+	req = newRequest(nodeconfigv1.NodeConfigSpec{KernelArgs: []string{"iommu=pt"}})
+	req.recordSection("kernel args")
+	assert.False(t, kernelArgs.Diff(req))
+	req.Status.KernelArgs = &nodeconfigv1.KernelArgsStatus{Missing: []string{"iommu=pt"}}
+	assert.True(t, kernelArgs.Diff(req))
+
+	// the CPU isolation kernel args are applied along with the kernel args
+	req = newRequest(nodeconfigv1.NodeConfigSpec{KernelArgs: []string{"iommu=pt"}})
+	req.recordSection("kernel args")
+	req = newRequest(nodeconfigv1.NodeConfigSpec{KernelArgs: []string{"iommu=pt"}, CPUIsolation: &nodeconfigv1.CPUIsolationConfig{ReservedCPUs: "0-1", IsolatedCPUs: "2-3"}})
+	assert.True(t, kernelArgs.Diff(req))
+}
+
+// sectionHandler counts the applies, it is diffed by the baseHandler
+type sectionHandler struct {
+	baseHandler
+	applies int
+}
+
+func (h *sectionHandler) Apply(*Request) error {
+	h.applies++
+	return nil
+}
+
+func (h *sectionHandler) Rollback() error {
+	return nil
+}
+
+func (h *sectionHandler) Status(*Request, error) error {
+	return nil
+}
+
+func TestRunHandlerRecordSection(t *testing.T) {
+	c := &Controller{retries: make(map[string]*handlerRetry)}
+	handler := &sectionHandler{baseHandler: baseHandler{"host aliases"}}
+	req := newTestRequest(1)
+	req.NodeConfig.Spec.HostAliases = []nodeconfigv1.HostAlias{{IP: "10.0.0.1", Hostnames: []string{"registry.example.com"}}}
+
+	// applied once, the section is recorded as applied
+	assert.Nil(t, c.runHandler(handler, req))
+	assert.Nil(t, c.runHandler(handler, req))
+	assert.Equal(t, 1, handler.applies)
+	assert.Len(t, req.Applied.Sections, 1)
+}
+
+func TestHandlerRetryBackoff(t *testing.T) {
+	var retry *handlerRetry
+	for range 10 {
+		retry = newHandlerRetry(retry, 1, errors.New("failed"))
+	}
+	assert.Equal(t, 10, retry.failures)
+	assert.WithinDuration(t, time.Now().Add(retryMaxDelay), retry.due, time.Second)
+	assert.True(t, retry.pending(1))
+	assert.False(t, retry.pending(2))
+}
+
+func TestRunHandlerRollback(t *testing.T) {
+	events := &fakeEvents{events: make(map[string]*corev1.Event)}
+	c := &Controller{ctx: context.Background(), NodeName: "node1", Events: events, retries: make(map[string]*handlerRetry)}
+	path := t.TempDir() + "/timesyncd.conf"
+	assert.Nil(t, os.WriteFile(path, []byte("old"), 0644))
+
+	// unhealthy, the file is restored and the section is not persisted
+	handler := &snapshotHandler{
+		fakeHandler: fakeHandler{baseHandler: baseHandler{"fake ntp"}, changed: true},
+		path:        path,
+		healthErr:   errors.New("not synchronized"),
+	}
+	req := newTestRequest(1)
+	req.NodeConfig.Namespace = "harvester-system"
+	req.NodeConfig.Name = "node1"
+	assert.EqualError(t, c.runHandler(handler, req), "not synchronized")
+	assert.Equal(t, []string{"validate", "diff", "apply", "health", "status", "not synchronized"}, handler.calls)
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "old", string(data))
+	assert.Equal(t, 1, handler.reloads)
+	assert.Empty(t, req.Applied.NTPServers)
+	assert.Len(t, req.Status.Rollbacks, 1)
+	assert.Equal(t, "fake ntp", req.Status.Rollbacks[0].Section)
+	assert.Equal(t, int64(1), req.Status.Rollbacks[0].Generation)
+	assert.Equal(t, "not synchronized", req.Status.Rollbacks[0].Message)
+	assert.Empty(t, req.Status.Rollbacks[0].RestoreError)
+	event := events.events["harvester-system/nodeconfig-rollback-fake-ntp.node1"]
+	assert.NotNil(t, event)
+	assert.Equal(t, "fake ntp is rolled back on node1: not synchronized", event.Message)
+	assert.Equal(t, "NodeConfig", event.InvolvedObject.Kind)
+	assert.Equal(t, corev1.EventTypeWarning, event.Type)
+
+	// the generation is retried with the backoff
+	assert.Equal(t, 1, c.retries["fake ntp"].failures)
+	handler.calls = nil
+	assert.NotNil(t, c.runHandler(handler, req))
+	assert.Empty(t, handler.calls)
+
+	// the spec is changed and it failed again, the rollback is replaced
+	req.NodeConfig.Generation = 2
+	assert.NotNil(t, c.runHandler(handler, req))
+	assert.Len(t, req.Status.Rollbacks, 1)
+	assert.Equal(t, int64(2), req.Status.Rollbacks[0].Generation)
+	assert.Equal(t, int32(1), req.Status.Rollbacks[0].Count)
+	assert.Equal(t, int32(2), events.events["harvester-system/nodeconfig-rollback-fake-ntp.node1"].Count)
+
+	// healthy, the rollback is cleared
+	req.NodeConfig.Generation = 3
+	handler.calls = nil
+	handler.healthErr = nil
+	assert.Nil(t, c.runHandler(handler, req))
+	assert.Equal(t, []string{"validate", "diff", "apply", "health", "persist", "status"}, handler.calls)
+	data, err = os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(data))
+	assert.Equal(t, "0.suse.pool.ntp.org", req.Applied.NTPServers)
+	assert.Empty(t, req.Status.Rollbacks)
+}
+
+// timezoneRecorder records the timezones applied, the invalid one fails
+type timezoneRecorder struct {
+	baseHandler
+	applied []string
+}
+
+func (h *timezoneRecorder) Apply(req *Request) error {
+	h.applied = append(h.applied, req.Spec().Timezone)
+	if req.Spec().Timezone == "Invalid/Zone" {
+		return errors.New("invalid timezone")
+	}
+	return nil
+}
+
+func (h *timezoneRecorder) Rollback() error {
+	return nil
+}
+
+func (h *timezoneRecorder) Status(*Request, error) error {
+	return nil
+}
+
+// newTestRecorder opens the audit log under a temp dir, the append only flag
+// set when the test runs as root is cleared so that the dir could be removed
+func newTestRecorder(t *testing.T) *audit.Recorder {
+	path := t.TempDir() + "/audit.log"
+	recorder, err := audit.NewRecorder("node1", path)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		f, err := os.Open(path)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		if flags, err := unix.IoctlGetInt(int(f.Fd()), unix.FS_IOC_GETFLAGS); err == nil {
+			_ = unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, flags&^0x20)
+		}
+	})
+	return recorder
+}
+
+func TestRunHandlerRollbackLastRecorded(t *testing.T) {
+	events := &fakeEvents{events: make(map[string]*corev1.Event)}
+	c := &Controller{ctx: context.Background(), NodeName: "node1", Events: events, Audit: newTestRecorder(t), retries: make(map[string]*handlerRetry)}
+	handler := &timezoneRecorder{baseHandler: baseHandler{"timezone"}}
+	applied := &nodeconfigv1.AppliedConfigAnnotation{}
+	newRequest := func(generation int64, timezone string) *Request {
+		req := newTestRequest(generation)
+		req.NodeConfig.Namespace = "harvester-system"
+		req.NodeConfig.Name = "node1"
+		req.NodeConfig.Spec.Timezone = timezone
+		req.Applied = applied
+		return req
+	}
+	req := newRequest(1, "Asia/Taipei")
+	assert.Nil(t, c.runHandler(handler, req))
+	c.recordAudit(req.NodeConfig, []string{"timezone"})
+
+	// the timezone last recorded is applied again
+	req = newRequest(2, "Invalid/Zone")
+	assert.EqualError(t, c.runHandler(handler, req), "invalid timezone")
+	assert.Equal(t, []string{"Asia/Taipei", "Invalid/Zone", "Asia/Taipei"}, handler.applied)
+	assert.Empty(t, req.Status.Rollbacks[0].RestoreError)
+
+	// the audit log is lost, the timezone last applied is unknown
+	c.Audit = newTestRecorder(t)
+	req = newRequest(3, "Invalid/Zone")
+	assert.NotNil(t, c.runHandler(handler, req))
+	assert.Equal(t, []string{"Asia/Taipei", "Invalid/Zone", "Asia/Taipei", "Invalid/Zone"}, handler.applied)
+	assert.Equal(t, "the last applied timezone is not recorded in the audit log", req.Status.Rollbacks[0].RestoreError)
+
+	// a section never applied is unset
+	handler.applied = nil
+	applied = &nodeconfigv1.AppliedConfigAnnotation{}
+	req = newRequest(1, "Invalid/Zone")
+	assert.NotNil(t, c.runHandler(handler, req))
+	assert.Equal(t, []string{"Invalid/Zone", ""}, handler.applied)
+	assert.Empty(t, req.Status.Rollbacks[0].RestoreError)
+}
@@ -0,0 +1,616 @@
+package nodeconfig
+
+import (
+	"context"
+	"reflect"
+	"slices"
+
+	ctlnode "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/controller/nodeconfig/config"
+)
+
+// newRegistry registers the handlers of the NodeConfig sections. The order
+// matters: the Longhorn kernel modules are loaded with the other modules, the
+// CPU isolation kernel args are applied with the other kernel args.
+func newRegistry(c *Controller) *Registry {
+	registry := &Registry{}
+	registry.Register(
+		&longhornHandler{baseHandler{"longhorn"}, c.NodeClient, c.NodeName},
+		&sysctlHandler{baseHandler{"sysctl"}},
+		&cpuPowerHandler{baseHandler{"cpu power"}},
+		&cpuIsolationHandler{baseHandler{"cpu isolation"}},
+		&swapHandler{baseHandler{"swap"}},
+		&journaldHandler{baseHandler{"journald"}},
+		&systemdUnitsHandler{baseHandler{"systemd units"}},
+		&kernelModulesHandler{baseHandler{"kernel modules"}},
+		&kernelArgsHandler{baseHandler{"kernel args"}, c.updateNodeRebootRequired},
+		&timezoneHandler{baseHandler{"timezone"}},
+		&dnsHandler{baseHandler{"DNS"}},
+		&hostAliasesHandler{baseHandler{"host aliases"}},
+		&containerRuntimeHandler{baseHandler: baseHandler{"container runtime"}},
+		&ntpHandler{baseHandler{"NTP"}, c.NodeClient},
+	)
+	return registry
+}
+
+// handlerSections are the spec fields applied by each handler, they are
+// recorded in the audit log once the handler succeeds
+var handlerSections = map[string][]string{
+	"longhorn":          {"longhornConfig"},
+	"sysctl":            {"sysctl"},
+	"cpu power":         {"cpuPower"},
+	"cpu isolation":     {"cpuIsolation"},
+	"swap":              {"swap"},
+	"journald":          {"journald"},
+	"systemd units":     {"systemdUnits"},
+	"kernel modules":    {"kernelModules"},
+	"kernel args":       {"kernelArgs"},
+	"timezone":          {"timezone"},
+	"DNS":               {"dns"},
+	"host aliases":      {"hostAliases"},
+	"container runtime": {"containerRuntime"},
+	"NTP":               {"ntpConfigs"},
+}
+
+// handlerDependencies are the spec fields read by a handler besides its own
+// sections, it is applied again once they are changed. They are recorded in
+// the audit log by the handler owning them.
+var handlerDependencies = map[string][]string{
+	"kernel args": {"cpuIsolation"},
+}
+
+// handlerInputs are all the spec fields the handler applies from
+func handlerInputs(name string) []string {
+	return slices.Concat(handlerSections[name], handlerDependencies[name])
+}
+
+// longhornHandler enables or disables the V2 Data Engine once the
+// longhornConfig is changed. This is intentionally not bothering to check
+// whether the engine is already enabled or not, re-applying the state is
+// effectively a no-op. When allocating (or deallocating) hugepages, the
+// kubelet is restarted inside
+// EnableV2DataEngine() and DisableV2DataEngine() to reflect that in
+// node.status.capacity.hugepages-2Mi, which Longhorn queries when
+// lhs/v2-data-engine is set to true.
+type longhornHandler struct {
+	baseHandler
+	nodes    ctlnode.NodeController
+	nodeName string
+}
+
+func (h *longhornHandler) Apply(req *Request) error {
+	longhornConfig := req.Spec().LonghornConfig
+	if longhornConfig != nil && longhornConfig.EnableV2DataEngine {
+		return config.EnableV2DataEngine(uint64(longhornConfig.HugepagesToAllocate))
+	}
+	return config.DisableV2DataEngine()
+}
+
+func (h *longhornHandler) Rollback() error {
+	return config.DisableV2DataEngine()
+}
+
+func (h *longhornHandler) ManagedPaths(req *Request) []string {
+	return config.LonghornManagedPaths(req.Spec().LonghornConfig)
+}
+
+func (h *longhornHandler) Status(req *Request, err error) error {
+	node, getErr := h.nodes.Cache().Get(h.nodeName)
+	if getErr != nil {
+		logrus.Errorf("Get node %s fail, err: %v", h.nodeName, getErr)
+		return getErr
+	}
+	for _, cond := range config.NewLonghornConditions(req.Generation(), req.Spec().LonghornConfig, node, err) {
+		req.SetCondition(cond)
+	}
+	return nil
+}
+
+type sysctlHandler struct {
+	baseHandler
+}
+
+func (h *sysctlHandler) Apply(req *Request) error {
+	return config.ApplySysctl(req.Spec().Sysctl)
+}
+
+// Diff also applies the sysctls when their values are changed on the host
+func (h *sysctlHandler) Diff(req *Request) bool {
+	if h.baseHandler.Diff(req) {
+		return true
+	}
+	return req.enforced(h.name) && slices.ContainsFunc(config.GetSysctlStatus(req.Spec().Sysctl), func(s nodeconfigv1.SysctlStatus) bool {
+		return s.Drifted
+	})
+}
+
+func (h *sysctlHandler) Rollback() error {
+	return config.RestoreSysctl()
+}
+
+func (h *sysctlHandler) ManagedPaths(req *Request) []string {
+	return config.SysctlManagedPaths(req.Spec().Sysctl)
+}
+
+func (h *sysctlHandler) Status(req *Request, err error) error {
+	req.Status.Sysctl = config.GetSysctlStatus(req.Spec().Sysctl)
+	req.SetCondition(config.NewSysctlAppliedCondition(req.Generation(), req.Status.Sysctl, err))
+	return nil
+}
+
+type cpuPowerHandler struct {
+	baseHandler
+}
+
+func (h *cpuPowerHandler) Apply(req *Request) error {
+	return config.ApplyCPUPower(req.Spec().CPUPower)
+}
+
+// Diff also applies the settings when they are changed on the host
+func (h *cpuPowerHandler) Diff(req *Request) bool {
+	if h.baseHandler.Diff(req) {
+		return true
+	}
+	return req.enforced(h.name) && slices.ContainsFunc(config.GetCPUPowerStatus(req.Spec().CPUPower), func(s nodeconfigv1.CPUPowerStatus) bool {
+		return s.Drifted
+	})
+}
+
+func (h *cpuPowerHandler) Rollback() error {
+	return config.RestoreCPUPower()
+}
+
+func (h *cpuPowerHandler) ManagedPaths(req *Request) []string {
+	return config.CPUPowerManagedPaths(req.Spec().CPUPower)
+}
+
+func (h *cpuPowerHandler) Status(req *Request, err error) error {
+	req.Status.CPUPower = config.GetCPUPowerStatus(req.Spec().CPUPower)
+	req.SetCondition(config.NewCPUPowerAppliedCondition(req.Generation(), req.Status.CPUPower, err))
+	return nil
+}
+
+// cpuIsolationHandler moves the IRQs off the isolated CPUs, the isolation
+// kernel args are applied by the kernelArgsHandler.
+type cpuIsolationHandler struct {
+	baseHandler
+}
+
+func (h *cpuIsolationHandler) Apply(req *Request) error {
+	return config.ApplyCPUIsolation(req.Spec().CPUIsolation)
+}
+
+func (h *cpuIsolationHandler) Rollback() error {
+	return config.RestoreCPUIsolation()
+}
+
+func (h *cpuIsolationHandler) ManagedPaths(req *Request) []string {
+	return config.CPUIsolationManagedPaths(req.Spec().CPUIsolation)
+}
+
+func (h *cpuIsolationHandler) Status(req *Request, err error) error {
+	req.Status.CPUIsolation = config.GetCPUIsolationStatus(req.Spec().CPUIsolation)
+	req.SetCondition(config.NewCPUIsolationAppliedCondition(req.Generation(), req.Spec().CPUIsolation, req.Status.CPUIsolation, err))
+	return nil
+}
+
+type swapHandler struct {
+	baseHandler
+}
+
+func (h *swapHandler) Apply(req *Request) error {
+	return config.ApplySwap(req.Spec().Swap)
+}
+
+// Diff also applies the swap when the devices are no longer active
+func (h *swapHandler) Diff(req *Request) bool {
+	if h.baseHandler.Diff(req) {
+		return true
+	}
+	swap := req.Spec().Swap
+	cond := config.NewSwapAppliedCondition(req.Generation(), swap, config.GetSwapStatus(swap), nil)
+	return req.enforced(h.name) && cond.Status != metav1.ConditionTrue
+}
+
+func (h *swapHandler) Rollback() error {
+	return config.RemoveSwap()
+}
+
+func (h *swapHandler) ManagedPaths(req *Request) []string {
+	return config.SwapManagedPaths(req.Spec().Swap)
+}
+
+func (h *swapHandler) Status(req *Request, err error) error {
+	req.Status.Swap = config.GetSwapStatus(req.Spec().Swap)
+	req.SetCondition(config.NewSwapAppliedCondition(req.Generation(), req.Spec().Swap, req.Status.Swap, err))
+	return nil
+}
+
+type journaldHandler struct {
+	baseHandler
+}
+
+func (h *journaldHandler) Apply(req *Request) error {
+	return config.ApplyJournald(req.Spec().Journald)
+}
+
+func (h *journaldHandler) HealthCheck(ctx context.Context, _ *Request) error {
+	return config.CheckJournaldHealth(ctx)
+}
+
+func (h *journaldHandler) Paths() []string {
+	return config.JournaldPaths()
+}
+
+func (h *journaldHandler) ManagedPaths(req *Request) []string {
+	return config.JournaldManagedPaths(req.Spec().Journald)
+}
+
+func (h *journaldHandler) Reload() error {
+	return config.ReloadJournald()
+}
+
+func (h *journaldHandler) Rollback() error {
+	return config.RemoveJournald()
+}
+
+func (h *journaldHandler) Status(req *Request, err error) error {
+	req.SetCondition(config.NewJournaldAppliedCondition(req.Generation(), req.Spec().Journald, err))
+	return nil
+}
+
+type systemdUnitsHandler struct {
+	baseHandler
+}
+
+func (h *systemdUnitsHandler) Apply(req *Request) error {
+	return config.ApplySystemdUnits(req.Spec().SystemdUnits)
+}
+
+// Diff also applies the units when their states are changed on the host
+func (h *systemdUnitsHandler) Diff(req *Request) bool {
+	if h.baseHandler.Diff(req) {
+		return true
+	}
+	units := req.Spec().SystemdUnits
+	cond := config.NewSystemdUnitsAppliedCondition(req.Generation(), units, config.GetSystemdUnitsStatus(units), nil)
+	return req.enforced(h.name) && cond.Status != metav1.ConditionTrue
+}
+
+func (h *systemdUnitsHandler) Rollback() error {
+	return config.RemoveSystemdUnits()
+}
+
+func (h *systemdUnitsHandler) ManagedPaths(req *Request) []string {
+	return config.SystemdUnitsManagedPaths(req.Spec().SystemdUnits)
+}
+
+func (h *systemdUnitsHandler) Status(req *Request, err error) error {
+	req.Status.SystemdUnits = config.GetSystemdUnitsStatus(req.Spec().SystemdUnits)
+	req.SetCondition(config.NewSystemdUnitsAppliedCondition(req.Generation(), req.Spec().SystemdUnits, req.Status.SystemdUnits, err))
+	return nil
+}
+
+type kernelModulesHandler struct {
+	baseHandler
+}
+
+func (h *kernelModulesHandler) Apply(req *Request) error {
+	status, err := config.ApplyKernelModules(req.Spec().KernelModules, config.LonghornKernelModules(req.Spec().LonghornConfig))
+	req.Status.KernelModules = status
+	return err
+}
+
+func (h *kernelModulesHandler) Rollback() error {
+	return config.RemoveKernelModules(nil)
+}
+
+func (h *kernelModulesHandler) ManagedPaths(req *Request) []string {
+	return config.KernelModulesManagedPaths(req.Spec().KernelModules)
+}
+
+func (h *kernelModulesHandler) Status(req *Request, err error) error {
+	req.SetCondition(config.NewKernelModulesLoadedCondition(req.Generation(), req.Status.KernelModules, err))
+	return nil
+}
+
+// kernelArgsHandler writes the kernel args to the boot config, they only take
+// effect after a reboot, which is flagged on the node.
+type kernelArgsHandler struct {
+	baseHandler
+	updateRebootRequired func(required bool) error
+}
+
+func (h *kernelArgsHandler) Apply(req *Request) error {
+	kernelArgs := slices.Concat(req.Spec().KernelArgs, config.CPUIsolationKernelArgs(req.Spec().CPUIsolation))
+	status, err := config.ApplyKernelArgs(kernelArgs)
+	req.Status.KernelArgs = status
+	if err != nil {
+		return err
+	}
+	return h.updateRebootRequired(status != nil)
+}
+
+// Diff also applies the kernel args until the node is rebooted with them,
+// the reboot is only noticed by applying them
+func (h *kernelArgsHandler) Diff(req *Request) bool {
+	return h.baseHandler.Diff(req) || req.Status.KernelArgs != nil
+}
+
+// Rollback removes the args from the boot config, nothing tracks the reboot
+// once the NodeConfig is gone, the args are dropped on next boot.
+func (h *kernelArgsHandler) Rollback() error {
+	if err := config.RemoveKernelArgs(); err != nil {
+		return err
+	}
+	return h.updateRebootRequired(false)
+}
+
+func (h *kernelArgsHandler) ManagedPaths(req *Request) []string {
+	return config.KernelArgsManagedPaths(slices.Concat(req.Spec().KernelArgs, config.CPUIsolationKernelArgs(req.Spec().CPUIsolation)))
+}
+
+func (h *kernelArgsHandler) Status(req *Request, err error) error {
+	req.SetCondition(config.NewRebootRequiredCondition(req.Generation(), req.Status.KernelArgs, err))
+	return nil
+}
+
+type timezoneHandler struct {
+	baseHandler
+}
+
+// Validate checks the host zoneinfo database, which could differ from the
+// one embedded in the webhook
+func (h *timezoneHandler) Validate(req *Request) error {
+	if req.Spec().Timezone == "" {
+		return nil
+	}
+	return config.ValidateTimezone(req.Spec().Timezone)
+}
+
+// Diff also applies the timezone when it is changed on the host
+func (h *timezoneHandler) Diff(req *Request) bool {
+	if h.baseHandler.Diff(req) {
+		return true
+	}
+	return req.enforced(h.name) && config.TimezoneDrifted(req.Spec().Timezone)
+}
+
+func (h *timezoneHandler) Apply(req *Request) error {
+	timezone, err := config.ApplyTimezone(req.Spec().Timezone)
+	req.Status.Timezone = timezone
+	return err
+}
+
+func (h *timezoneHandler) Rollback() error {
+	return config.RestoreTimezone()
+}
+
+func (h *timezoneHandler) ManagedPaths(req *Request) []string {
+	return config.TimezoneManagedPaths(req.Spec().Timezone)
+}
+
+func (h *timezoneHandler) Status(req *Request, err error) error {
+	req.SetCondition(config.NewTimezoneAppliedCondition(req.Generation(), req.Spec().Timezone, req.Status.Timezone, err))
+	return nil
+}
+
+type dnsHandler struct {
+	baseHandler
+}
+
+func (h *dnsHandler) Apply(req *Request) error {
+	return config.ApplyDNS(req.Spec().DNS)
+}
+
+func (h *dnsHandler) Paths() []string {
+	return config.DNSPaths()
+}
+
+func (h *dnsHandler) ManagedPaths(req *Request) []string {
+	return config.DNSManagedPaths(req.Spec().DNS)
+}
+
+func (h *dnsHandler) Reload() error {
+	return config.ReloadDNS()
+}
+
+func (h *dnsHandler) Rollback() error {
+	return config.RestoreDNS()
+}
+
+func (h *dnsHandler) Status(req *Request, err error) error {
+	req.SetCondition(config.NewDNSAppliedCondition(req.Generation(), req.Spec().DNS, err))
+	return nil
+}
+
+type hostAliasesHandler struct {
+	baseHandler
+}
+
+// Validate reports the /etc/hosts replaced on the host, which the pod no
+// longer writes to
+func (h *hostAliasesHandler) Validate(req *Request) error {
+	if len(req.Spec().HostAliases) == 0 {
+		return nil
+	}
+	return config.CheckHostsMount()
+}
+
+func (h *hostAliasesHandler) Apply(req *Request) error {
+	return config.ApplyHostAliases(req.Spec().HostAliases)
+}
+
+func (h *hostAliasesHandler) Paths() []string {
+	return config.HostAliasesPaths()
+}
+
+func (h *hostAliasesHandler) ManagedPaths(req *Request) []string {
+	return config.HostAliasesManagedPaths(req.Spec().HostAliases)
+}
+
+// Reload is a no-op, /etc/hosts is read on every lookup
+func (h *hostAliasesHandler) Reload() error {
+	return nil
+}
+
+func (h *hostAliasesHandler) Rollback() error {
+	return config.RemoveHostAliases()
+}
+
+func (h *hostAliasesHandler) Status(req *Request, err error) error {
+	req.SetCondition(config.NewHostAliasesAppliedCondition(req.Generation(), err))
+	return nil
+}
+
+// containerRuntimeHandler restarts rke2 once for both the proxy and the
+// registries, only when their files are changed. Restarting rke2-server takes
+// the apiserver down for a while, the retry of a config whose files are
+// already written does not restart it again.
+type containerRuntimeHandler struct {
+	baseHandler
+	// restarted is whether the last Apply restarted rke2 with the changed
+	// files, it is restarted again once they are restored
+	restarted bool
+}
+
+func (h *containerRuntimeHandler) Diff(req *Request) bool {
+	return !reflect.DeepEqual(req.Applied.ContainerRuntime, req.Spec().ContainerRuntime)
+}
+
+// Apply records the applied config on success, the files are persisted by
+// ApplyContainerRuntime
+func (h *containerRuntimeHandler) Apply(req *Request) error {
+	h.restarted = false
+	changed, err := config.ApplyContainerRuntime(req.Spec().ContainerRuntime)
+	if err != nil {
+		return err
+	}
+	if changed {
+		h.restarted = true
+		if err := config.RestartContainerRuntime(); err != nil {
+			return err
+		}
+	}
+	req.Applied.ContainerRuntime = req.Spec().ContainerRuntime.DeepCopy()
+	return nil
+}
+
+func (h *containerRuntimeHandler) Paths() []string {
+	return config.ContainerRuntimePaths()
+}
+
+func (h *containerRuntimeHandler) ManagedPaths(req *Request) []string {
+	return config.ContainerRuntimeManagedPaths(req.Spec().ContainerRuntime)
+}
+
+// Reload restarts rke2 only when it was restarted with the restored files,
+// otherwise it still runs with them
+func (h *containerRuntimeHandler) Reload() error {
+	if !h.restarted {
+		return nil
+	}
+	return config.RestartContainerRuntime()
+}
+
+func (h *containerRuntimeHandler) Rollback() error {
+	return config.RemoveContainerRuntime()
+}
+
+func (h *containerRuntimeHandler) Status(req *Request, err error) error {
+	req.SetCondition(config.NewContainerRuntimeAppliedCondition(req.Generation(), err))
+	return nil
+}
+
+// ntpHandler updates timesyncd or chrony, the NTP config is only applied when
+// it differs from the one recorded in the AppliedConfig annotation, or it was
+// never applied by this NodeConfig.
+type ntpHandler struct {
+	baseHandler
+	nodes ctlnode.NodeController
+}
+
+func (h *ntpHandler) newConfigHandler(req *Request) *config.NTPHandler {
+	appliedConfig := req.NodeConfig.ObjectMeta.Annotations[ConfigAppliedAnnotation]
+	return config.NewNTPConfigHandler(h.nodes, req.ConfName, req.Spec().NTPConfig, appliedConfig)
+}
+
+func (h *ntpHandler) Diff(req *Request) bool {
+	firstApply := meta.FindStatusCondition(req.NodeConfig.Status.Conditions, string(nodeconfigv1.NTPApplied)) == nil
+	changed := h.newConfigHandler(req).Changed(firstApply)
+	if !changed {
+		logrus.Infof("NTP config is not changed")
+	}
+	return changed
+}
+
+func (h *ntpHandler) Apply(req *Request) error {
+	ntpConfigHandler := h.newConfigHandler(req)
+	// the config is already compared by Diff
+	updated, err := ntpConfigHandler.DoNTPUpdate(true)
+	if err != nil || !updated {
+		return err
+	}
+	return ntpConfigHandler.RestartService()
+}
+
+// HealthCheck waits for the NTP service to be active and the clock to be
+// synchronized with the new servers, otherwise the previous NTP config is
+// restored
+func (h *ntpHandler) HealthCheck(ctx context.Context, req *Request) error {
+	return h.newConfigHandler(req).CheckHealth(ctx)
+}
+
+// Persist records the applied config once the NTP config is persisted, the
+// node annotation is only updated for the healthy config
+func (h *ntpHandler) Persist(req *Request) error {
+	ntpConfigHandler := h.newConfigHandler(req)
+	if err := ntpConfigHandler.UpdateNTPConfigPersistence(); err != nil {
+		return err
+	}
+	if err := ntpConfigHandler.UpdateNodeNTPAnnotation(); err != nil {
+		return err
+	}
+	setAppliedNTPConfig(req.Applied, ntpConfigHandler.NTPConfig, req.Generation())
+	return nil
+}
+
+func (h *ntpHandler) Paths() []string {
+	return config.NTPPaths()
+}
+
+func (h *ntpHandler) ManagedPaths(req *Request) []string {
+	return config.NTPManagedPaths(req.Spec().NTPConfig)
+}
+
+func (h *ntpHandler) Reload() error {
+	return config.ReloadNTP()
+}
+
+func (h *ntpHandler) Rollback() error {
+	logrus.Infof("Node config is removed, rollback and remove persistent NTP config")
+	if err := config.NTPConfigRollback(); err != nil {
+		return err
+	}
+	if err := config.RemoveChronyNTPConfig(); err != nil {
+		return err
+	}
+	return config.RemovePersistentNTPConfig()
+}
+
+func (h *ntpHandler) Status(req *Request, err error) error {
+	req.SetCondition(config.NewNTPAppliedCondition(req.Generation(), err))
+	return nil
+}
+
+func setAppliedNTPConfig(applied *nodeconfigv1.AppliedConfigAnnotation, ntpConfig *nodeconfigv1.NTPConfig, generation int64) {
+	applied.NTPServers = ntpConfig.NTPServers
+	applied.NTPGeneration = generation
+	applied.NTPBackend = ntpConfig.Backend
+	applied.NTPServerList = ntpConfig.Servers
+}
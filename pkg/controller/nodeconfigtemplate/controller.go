@@ -0,0 +1,259 @@
+package nodeconfigtemplate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	ctlnode "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	ctlv1 "github.com/harvester/node-manager/pkg/generated/controllers/node.harvesterhci.io/v1beta1"
+)
+
+const (
+	HandlerName = "harvester-node-config-template-controller"
+
+	// LabelTemplateManaged marks the NodeConfigs created from the templates,
+	// they are removed once the node matches no template.
+	LabelTemplateManaged = "node.harvesterhci.io/template-managed"
+	// AnnotationTemplates is the specs of the templates last written to the
+	// NodeConfig keyed by the template name, the fields which differ from
+	// them are the per-node overrides.
+	AnnotationTemplates = "node.harvesterhci.io/templates"
+
+	nodeConfigNamespace = "harvester-system"
+)
+
+// Controller writes the templates into the NodeConfigs of all nodes. It runs
+// on the leader only, so each NodeConfig has a single writer and the rollouts
+// are coordinated from one view of the cluster.
+type Controller struct {
+	Templates        ctlv1.NodeConfigTemplateController
+	TemplatesCache   ctlv1.NodeConfigTemplateCache
+	NodeConfigs      ctlv1.NodeConfigClient
+	NodeConfigsCache ctlv1.NodeConfigCache
+	Nodes            ctlnode.NodeController
+	NodesCache       ctlnode.NodeCache
+
+	// mu serializes the reconciles, so the slots of a rollout are not given
+	// out twice by the workers of the templates and the nodes
+	mu sync.Mutex
+}
+
+func Register(ctx context.Context, templates ctlv1.NodeConfigTemplateController, nodecfg ctlv1.NodeConfigController, nodes ctlnode.NodeController) *Controller {
+	ctl := &Controller{
+		Templates:        templates,
+		TemplatesCache:   templates.Cache(),
+		NodeConfigs:      nodecfg,
+		NodeConfigsCache: nodecfg.Cache(),
+		Nodes:            nodes,
+		NodesCache:       nodes.Cache(),
+	}
+
+	// a template change is reconciled on all nodes, the other changes on
+	// their node. The NodeConfigs and the nodes of a rollout advance it, so
+	// they also reconcile the templates rolled out to them.
+	templates.OnChange(ctx, HandlerName, ctl.OnTemplateChange)
+	nodecfg.OnChange(ctx, HandlerName, ctl.OnNodeConfigChange)
+	nodes.OnChange(ctx, HandlerName, ctl.OnNodeChange)
+
+	return ctl
+}
+
+// OnTemplateChange coordinates the rollout of the template: the plan is made
+// once for all the matching nodes, the nodes are reconciled with it, and the
+// state of every node is reported in the template status.
+func (c *Controller) OnTemplateChange(_ string, template *nodeconfigv1.NodeConfigTemplate) (*nodeconfigv1.NodeConfigTemplate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	nodes, err := c.NodesCache.List(labels.Everything())
+	if err != nil {
+		return template, err
+	}
+	plans := make(map[string]*rolloutPlan)
+	var errs []error
+	for _, node := range nodes {
+		if err := c.reconcileNode(node, plans); err != nil {
+			errs = append(errs, fmt.Errorf("node %s: %w", node.Name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return template, err
+	}
+	if template == nil || template.DeletionTimestamp != nil {
+		return template, nil
+	}
+	return template, c.updateRolloutStatus(template, plans)
+}
+
+func (c *Controller) OnNodeConfigChange(key string, nodecfg *nodeconfigv1.NodeConfig) (*nodeconfigv1.NodeConfig, error) {
+	if namespace, name, _ := strings.Cut(key, "/"); namespace == nodeConfigNamespace {
+		c.Nodes.Enqueue(name)
+	}
+	return nodecfg, nil
+}
+
+func (c *Controller) OnNodeChange(_ string, node *corev1.Node) (*corev1.Node, error) {
+	if node == nil || node.DeletionTimestamp != nil {
+		return node, nil
+	}
+	c.mu.Lock()
+	err := c.reconcileNode(node, make(map[string]*rolloutPlan))
+	c.mu.Unlock()
+	if err != nil {
+		return node, err
+	}
+	return node, c.enqueueRollouts(node)
+}
+
+// enqueueRollouts enqueues the templates with a rollout matching the node, the
+// state of the node could let the rollout proceed on the other nodes.
+func (c *Controller) enqueueRollouts(node *corev1.Node) error {
+	templates, err := c.TemplatesCache.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, template := range matchingTemplates(node, templates) {
+		if template.Spec.Rollout != nil {
+			c.Templates.Enqueue(template.Name)
+		}
+	}
+	return nil
+}
+
+// reconcileNode writes the matching templates into the NodeConfig of the node,
+// the templates with a rollout are only written once their plan allows it.
+// The plans are made on first use and shared by the nodes of the round.
+func (c *Controller) reconcileNode(node *corev1.Node, plans map[string]*rolloutPlan) error {
+	if node.DeletionTimestamp != nil {
+		return nil
+	}
+	templates, err := c.TemplatesCache.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	nodecfg, err := c.NodeConfigsCache.Get(nodeConfigNamespace, node.Name)
+	if apierrors.IsNotFound(err) {
+		nodecfg = nil
+	} else if err != nil {
+		return err
+	}
+	if nodecfg != nil && nodecfg.DeletionTimestamp != nil {
+		// it is created again from the templates once it is gone
+		return nil
+	}
+
+	applied, _, err := getAppliedTemplates(nodecfg)
+	if err != nil {
+		return err
+	}
+	wanted, err := wantedTemplates(matchingTemplates(node, templates), applied, time.Now(), func(template *nodeconfigv1.NodeConfigTemplate, spec sections) (bool, error) {
+		plan, err := c.getRolloutPlan(template, spec, plans)
+		if err != nil {
+			return false, err
+		}
+		return plan.proceed[node.Name], nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.syncNodeConfig(node, nodecfg, wanted)
+}
+
+func (c *Controller) syncNodeConfig(node *corev1.Node, nodecfg *nodeconfigv1.NodeConfig, wanted map[string]appliedTemplate) error {
+	desired, err := desiredNodeConfig(node, nodecfg, wanted)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case nodecfg == nil && desired == nil:
+	case nodecfg == nil:
+		logrus.Infof("Create NodeConfig %s from templates %s", node.Name, strings.Join(slices.Sorted(maps.Keys(wanted)), ","))
+		_, err = c.NodeConfigs.Create(desired)
+	case desired == nil:
+		logrus.Infof("Remove NodeConfig %s since the node matches no template", node.Name)
+		err = c.NodeConfigs.Delete(nodecfg.Namespace, nodecfg.Name, &metav1.DeleteOptions{})
+		if apierrors.IsNotFound(err) {
+			err = nil
+		}
+	case !reflect.DeepEqual(nodecfg.Spec, desired.Spec) ||
+		!reflect.DeepEqual(nodecfg.Labels, desired.Labels) ||
+		!reflect.DeepEqual(nodecfg.Annotations, desired.Annotations):
+		logrus.Infof("Update NodeConfig %s from templates %s", node.Name, strings.Join(slices.Sorted(maps.Keys(wanted)), ","))
+		_, err = c.NodeConfigs.Update(desired)
+	}
+	return err
+}
+
+// getRolloutPlan returns the plan of the template, it is made from the state
+// of the matching nodes in the caches. The template is reconciled again once
+// the pause before the next batch is over.
+func (c *Controller) getRolloutPlan(template *nodeconfigv1.NodeConfigTemplate, spec sections, plans map[string]*rolloutPlan) (*rolloutPlan, error) {
+	if plan, ok := plans[template.Name]; ok {
+		return plan, nil
+	}
+	nodes, err := c.NodesCache.List(labels.SelectorFromSet(template.Spec.MatchSelector))
+	if err != nil {
+		return nil, err
+	}
+	rolloutNodes := make([]rolloutNode, 0, len(nodes))
+	for _, node := range nodes {
+		nodecfg, err := c.NodeConfigsCache.Get(nodeConfigNamespace, node.Name)
+		if apierrors.IsNotFound(err) {
+			nodecfg = nil
+		} else if err != nil {
+			return nil, err
+		}
+		n, err := newRolloutNode(node, nodecfg, template.Name, spec)
+		if err != nil {
+			return nil, err
+		}
+		rolloutNodes = append(rolloutNodes, n)
+	}
+	plan := planRollout(template.Spec.Rollout, rolloutNodes, time.Now())
+	if plan.wait > 0 {
+		c.Templates.EnqueueAfter(template.Name, plan.wait)
+	}
+	plans[template.Name] = &plan
+	return &plan, nil
+}
+
+// updateRolloutStatus reports the state of the matching nodes in the status
+// of a template with a rollout. The nodes the current spec was just written
+// to are reported as updating, their sections are observed by the next round.
+func (c *Controller) updateRolloutStatus(template *nodeconfigv1.NodeConfigTemplate, plans map[string]*rolloutPlan) error {
+	var nodes map[string]nodeconfigv1.TemplateRolloutStatus
+	if template.Spec.Rollout != nil {
+		spec, err := toSections(&template.Spec.Template)
+		if err != nil {
+			return err
+		}
+		plan, err := c.getRolloutPlan(template, spec, plans)
+		if err != nil {
+			return err
+		}
+		nodes = plan.nodes
+	}
+
+	if maps.Equal(template.Status.Nodes, nodes) {
+		return nil
+	}
+	templateCpy := template.DeepCopy()
+	templateCpy.Status.Nodes = nodes
+	_, err := c.Templates.UpdateStatus(templateCpy)
+	return err
+}
@@ -0,0 +1,281 @@
+package nodeconfigtemplate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+// sections is a NodeConfigSpec keyed by the JSON names of its sections, the
+// templates are merged a whole section at a time since each section is applied
+// by its own handler.
+type sections map[string]json.RawMessage
+
+func toSections(spec *nodeconfigv1.NodeConfigSpec) (sections, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	result := sections{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	maps.DeleteFunc(result, func(_ string, value json.RawMessage) bool { return string(value) == "null" })
+	return result, nil
+}
+
+func (s sections) toSpec() (*nodeconfigv1.NodeConfigSpec, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	spec := &nodeconfigv1.NodeConfigSpec{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// matchingTemplates returns the templates whose selector matches the node,
+// sorted by name.
+func matchingTemplates(node *corev1.Node, templates []*nodeconfigv1.NodeConfigTemplate) []*nodeconfigv1.NodeConfigTemplate {
+	var matched []*nodeconfigv1.NodeConfigTemplate
+	for _, template := range templates {
+		if template.DeletionTimestamp != nil {
+			continue
+		}
+		if labels.SelectorFromSet(template.Spec.MatchSelector).Matches(labels.Set(node.Labels)) {
+			matched = append(matched, template)
+		}
+	}
+	slices.SortFunc(matched, func(a, b *nodeconfigv1.NodeConfigTemplate) int { return strings.Compare(a.Name, b.Name) })
+	return matched
+}
+
+// appliedTemplate is the spec of a template as it was written to the
+// NodeConfig.
+type appliedTemplate struct {
+	Spec sections `json:"spec"`
+	// Time is when the spec was written, the next batch of a rollout pauses
+	// from it.
+	Time metav1.Time `json:"time"`
+}
+
+// wantedTemplates returns the specs of the matching templates to write to the
+// NodeConfig. The spec of a template with a rollout is only written once
+// proceed allows it, until then the spec written before is kept.
+func wantedTemplates(matched []*nodeconfigv1.NodeConfigTemplate, applied map[string]appliedTemplate, now time.Time, proceed func(*nodeconfigv1.NodeConfigTemplate, sections) (bool, error)) (map[string]appliedTemplate, error) {
+	wanted := make(map[string]appliedTemplate, len(matched))
+	for _, template := range matched {
+		spec, err := toSections(&template.Spec.Template)
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %w", template.Name, err)
+		}
+		last, ok := applied[template.Name]
+		if ok && equalSections(last.Spec, spec) {
+			wanted[template.Name] = last
+			continue
+		}
+		if template.Spec.Rollout != nil {
+			allowed, err := proceed(template, spec)
+			if err != nil {
+				return nil, err
+			}
+			if !allowed {
+				if ok {
+					wanted[template.Name] = last
+				}
+				continue
+			}
+		}
+		wanted[template.Name] = appliedTemplate{Spec: spec, Time: metav1.NewTime(now)}
+	}
+	return wanted, nil
+}
+
+// mergeApplied merges the templates in name order, the sections of the later
+// templates replace the ones of the earlier templates.
+func mergeApplied(templates map[string]appliedTemplate) sections {
+	merged := sections{}
+	for _, name := range slices.Sorted(maps.Keys(templates)) {
+		maps.Copy(merged, templates[name].Spec)
+	}
+	return merged
+}
+
+func equalSections(a, b sections) bool {
+	return maps.EqualFunc(a, b, func(x, y json.RawMessage) bool { return bytes.Equal(x, y) })
+}
+
+func isObject(value json.RawMessage) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(value), []byte("{"))
+}
+
+// overrides returns the per-node changes of the NodeConfig to the last
+// applied templates. The changes of a section are the JSON merge patch from
+// the applied section, so only the fields set on the node override the
+// templates. The sections which are not objects, or not written by the
+// templates, are overridden as a whole.
+func overrides(current, lastApplied sections) (sections, error) {
+	result := sections{}
+	for name, value := range current {
+		applied, ok := lastApplied[name]
+		if ok && bytes.Equal(applied, value) {
+			continue
+		}
+		if !ok || !isObject(applied) || !isObject(value) {
+			result[name] = value
+			continue
+		}
+		patch, err := jsonpatch.CreateMergePatch(applied, value)
+		if err != nil {
+			return nil, fmt.Errorf("section %s: %w", name, err)
+		}
+		if string(patch) != "{}" {
+			result[name] = patch
+		}
+	}
+	return result, nil
+}
+
+// applyOverrides merges the per-node changes onto the sections of the
+// templates.
+func applyOverrides(merged, nodeOverrides sections) error {
+	for name, patch := range nodeOverrides {
+		value, ok := merged[name]
+		if !ok || !isObject(value) || !isObject(patch) {
+			merged[name] = patch
+			continue
+		}
+		value, err := jsonpatch.MergePatch(value, patch)
+		if err != nil {
+			return fmt.Errorf("section %s: %w", name, err)
+		}
+		merged[name] = value
+	}
+	return nil
+}
+
+// setSpec keeps the spec when its sections are unchanged, so an empty field
+// which is omitted from the sections does not make the spec differ.
+func setSpec(nodecfg *nodeconfigv1.NodeConfig, current, wanted sections) error {
+	if equalSections(current, wanted) {
+		return nil
+	}
+	spec, err := wanted.toSpec()
+	if err != nil {
+		return err
+	}
+	nodecfg.Spec = *spec
+	return nil
+}
+
+// getAppliedTemplates returns the templates last written to the NodeConfig,
+// false when the NodeConfig is not templated.
+func getAppliedTemplates(nodecfg *nodeconfigv1.NodeConfig) (map[string]appliedTemplate, bool, error) {
+	if nodecfg == nil {
+		return nil, false, nil
+	}
+	value, ok := nodecfg.Annotations[AnnotationTemplates]
+	if !ok {
+		return nil, false, nil
+	}
+	applied := map[string]appliedTemplate{}
+	if err := json.Unmarshal([]byte(value), &applied); err != nil {
+		return nil, false, fmt.Errorf("parse annotation %s failed: %w", AnnotationTemplates, err)
+	}
+	return applied, true, nil
+}
+
+// desiredNodeConfig returns the NodeConfig of the node with the wanted
+// templates merged into it, nodecfg is nil when the node has no NodeConfig
+// yet. The result is nil when the NodeConfig should not exist: no template is
+// wanted, and it was created from the templates without any per-node
+// override.
+func desiredNodeConfig(node *corev1.Node, nodecfg *nodeconfigv1.NodeConfig, wanted map[string]appliedTemplate) (*nodeconfigv1.NodeConfig, error) {
+	if nodecfg == nil {
+		if len(wanted) == 0 {
+			return nil, nil
+		}
+		nodecfg = &nodeconfigv1.NodeConfig{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      node.Name,
+				Namespace: nodeConfigNamespace,
+				Labels:    map[string]string{LabelTemplateManaged: "true"},
+				// the NodeConfig is removed along with the node
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "v1",
+					Kind:       "Node",
+					Name:       node.Name,
+					UID:        node.UID,
+				}},
+			},
+		}
+	} else {
+		nodecfg = nodecfg.DeepCopy()
+	}
+
+	applied, templated, err := getAppliedTemplates(nodecfg)
+	if err != nil {
+		return nil, err
+	}
+	if !templated && len(wanted) == 0 {
+		return nodecfg, nil
+	}
+
+	current, err := toSections(&nodecfg.Spec)
+	if err != nil {
+		return nil, err
+	}
+	nodeOverrides, err := overrides(current, mergeApplied(applied))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wanted) == 0 {
+		if nodecfg.Labels[LabelTemplateManaged] == "true" && len(nodeOverrides) == 0 {
+			return nil, nil
+		}
+		// the overridden sections are kept as a plain NodeConfig
+		kept := maps.Clone(current)
+		maps.DeleteFunc(kept, func(name string, _ json.RawMessage) bool {
+			_, ok := nodeOverrides[name]
+			return !ok
+		})
+		if err := setSpec(nodecfg, current, kept); err != nil {
+			return nil, err
+		}
+		delete(nodecfg.Labels, LabelTemplateManaged)
+		delete(nodecfg.Annotations, AnnotationTemplates)
+		return nodecfg, nil
+	}
+
+	merged := mergeApplied(wanted)
+	if err := applyOverrides(merged, nodeOverrides); err != nil {
+		return nil, err
+	}
+	if err := setSpec(nodecfg, current, merged); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(wanted)
+	if err != nil {
+		return nil, err
+	}
+	if nodecfg.Annotations == nil {
+		nodecfg.Annotations = make(map[string]string)
+	}
+	nodecfg.Annotations[AnnotationTemplates] = string(data)
+	return nodecfg, nil
+}
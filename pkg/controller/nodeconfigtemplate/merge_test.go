@@ -0,0 +1,169 @@
+package nodeconfigtemplate
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+func newTemplate(name string, selector map[string]string, spec nodeconfigv1.NodeConfigSpec) *nodeconfigv1.NodeConfigTemplate {
+	return &nodeconfigv1.NodeConfigTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       nodeconfigv1.NodeConfigTemplateSpec{MatchSelector: selector, Template: spec},
+	}
+}
+
+// desired merges the templates like the controller does without rollouts
+func desired(t *testing.T, node *corev1.Node, nodecfg *nodeconfigv1.NodeConfig, templates ...*nodeconfigv1.NodeConfigTemplate) *nodeconfigv1.NodeConfig {
+	applied, _, err := getAppliedTemplates(nodecfg)
+	require.NoError(t, err)
+	wanted, err := wantedTemplates(matchingTemplates(node, templates), applied, time.Now(), func(*nodeconfigv1.NodeConfigTemplate, sections) (bool, error) {
+		return true, nil
+	})
+	require.NoError(t, err)
+	result, err := desiredNodeConfig(node, nodecfg, wanted)
+	require.NoError(t, err)
+	return result
+}
+
+func appliedNames(t *testing.T, nodecfg *nodeconfigv1.NodeConfig) []string {
+	applied, _, err := getAppliedTemplates(nodecfg)
+	require.NoError(t, err)
+	return slices.Sorted(maps.Keys(applied))
+}
+
+func ntpConfig(server string) *nodeconfigv1.NTPConfig {
+	return &nodeconfigv1.NTPConfig{Servers: []nodeconfigv1.NTPServer{{Address: server}}}
+}
+
+func TestDesiredNodeConfig(t *testing.T) {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   "node1",
+		UID:    "uid1",
+		Labels: map[string]string{"zone": "a"},
+	}}
+	all := newTemplate("all", nil, nodeconfigv1.NodeConfigSpec{
+		NTPConfig: ntpConfig("pool.ntp.org"),
+		Timezone:  "UTC",
+	})
+	zoneA := newTemplate("zone-a", map[string]string{"zone": "a"}, nodeconfigv1.NodeConfigSpec{
+		NTPConfig: ntpConfig("a.ntp.example.com"),
+	})
+	zoneB := newTemplate("zone-b", map[string]string{"zone": "b"}, nodeconfigv1.NodeConfigSpec{
+		Timezone: "Asia/Taipei",
+	})
+
+	// no template matches
+	nodecfg := desired(t, node, nil, zoneB)
+	assert.Nil(t, nodecfg)
+
+	// the later templates win
+	nodecfg = desired(t, node, nil, zoneB, zoneA, all)
+	require.NotNil(t, nodecfg)
+	assert.Equal(t, "node1", nodecfg.Name)
+	assert.Equal(t, nodeConfigNamespace, nodecfg.Namespace)
+	assert.Equal(t, "true", nodecfg.Labels[LabelTemplateManaged])
+	assert.Equal(t, []string{"all", "zone-a"}, appliedNames(t, nodecfg))
+	assert.Equal(t, "Node", nodecfg.OwnerReferences[0].Kind)
+	assert.Equal(t, ntpConfig("a.ntp.example.com"), nodecfg.Spec.NTPConfig)
+	assert.Equal(t, "UTC", nodecfg.Spec.Timezone)
+
+	// it is stable once written
+	again := desired(t, node, nodecfg, all, zoneA)
+	assert.Equal(t, nodecfg, again)
+
+	// the per-node sections are kept when the templates change
+	nodecfg.Spec.Timezone = "Europe/Berlin"
+	nodecfg.Spec.KernelArgs = []string{"quiet"}
+	all.Spec.Template.Timezone = "Asia/Tokyo"
+	zoneA.Spec.Template.NTPConfig = ntpConfig("b.ntp.example.com")
+	nodecfg = desired(t, node, nodecfg, all, zoneA)
+	assert.Equal(t, ntpConfig("b.ntp.example.com"), nodecfg.Spec.NTPConfig)
+	assert.Equal(t, "Europe/Berlin", nodecfg.Spec.Timezone)
+	assert.Equal(t, []string{"quiet"}, nodecfg.Spec.KernelArgs)
+
+	// the sections removed from the templates are removed from the NodeConfig
+	nodecfg = desired(t, node, nodecfg, all)
+	assert.Equal(t, ntpConfig("pool.ntp.org"), nodecfg.Spec.NTPConfig)
+	assert.Equal(t, []string{"all"}, appliedNames(t, nodecfg))
+
+	// once the node leaves the selectors only the per-node sections are left
+	left := desired(t, node, nodecfg, zoneB)
+	require.NotNil(t, left)
+	assert.Equal(t, nodeconfigv1.NodeConfigSpec{Timezone: "Europe/Berlin", KernelArgs: []string{"quiet"}}, left.Spec)
+	assert.NotContains(t, left.Labels, LabelTemplateManaged)
+	assert.NotContains(t, left.Annotations, AnnotationTemplates)
+
+	// the NodeConfig created from the templates is removed without overrides
+	nodecfg.Spec.Timezone = "Asia/Tokyo"
+	nodecfg.Spec.KernelArgs = nil
+	left = desired(t, node, nodecfg)
+	assert.Nil(t, left)
+}
+
+func TestDesiredNodeConfigExisting(t *testing.T) {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	existing := &nodeconfigv1.NodeConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1", Namespace: nodeConfigNamespace},
+		Spec:       nodeconfigv1.NodeConfigSpec{NTPConfig: ntpConfig("10.0.0.1")},
+	}
+	all := newTemplate("all", nil, nodeconfigv1.NodeConfigSpec{
+		NTPConfig: ntpConfig("pool.ntp.org"),
+		Timezone:  "UTC",
+	})
+
+	// a NodeConfig which is not templated is left alone
+	nodecfg := desired(t, node, existing)
+	assert.Equal(t, existing, nodecfg)
+
+	// the sections of an existing NodeConfig override the templates
+	nodecfg = desired(t, node, existing, all)
+	assert.Equal(t, ntpConfig("10.0.0.1"), nodecfg.Spec.NTPConfig)
+	assert.Equal(t, "UTC", nodecfg.Spec.Timezone)
+	assert.Empty(t, nodecfg.OwnerReferences)
+
+	// and it is kept once no template matches
+	nodecfg = desired(t, node, nodecfg)
+	require.NotNil(t, nodecfg)
+	assert.Equal(t, existing.Spec, nodecfg.Spec)
+}
+
+func TestDesiredNodeConfigFieldOverrides(t *testing.T) {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	all := newTemplate("all", nil, nodeconfigv1.NodeConfigSpec{
+		NTPConfig: ntpConfig("pool.ntp.org"),
+		Sysctl:    map[string]string{"vm.swappiness": "10", "net.ipv4.ip_forward": "1"},
+	})
+	nodecfg := desired(t, node, nil, all)
+
+	// only the fields changed on the node override the template
+	nodecfg.Spec.NTPConfig.Backend = nodeconfigv1.NTPBackendChrony
+	nodecfg.Spec.Sysctl["vm.swappiness"] = "60"
+	delete(nodecfg.Spec.Sysctl, "net.ipv4.ip_forward")
+	all.Spec.Template.NTPConfig = ntpConfig("a.ntp.example.com")
+	all.Spec.Template.Sysctl = map[string]string{"vm.swappiness": "10", "net.ipv4.ip_forward": "1", "vm.max_map_count": "262144"}
+	nodecfg = desired(t, node, nodecfg, all)
+	assert.Equal(t, &nodeconfigv1.NTPConfig{
+		Servers: []nodeconfigv1.NTPServer{{Address: "a.ntp.example.com"}},
+		Backend: nodeconfigv1.NTPBackendChrony,
+	}, nodecfg.Spec.NTPConfig)
+	assert.Equal(t, map[string]string{"vm.swappiness": "60", "vm.max_map_count": "262144"}, nodecfg.Spec.Sysctl)
+
+	// it is stable once written
+	again := desired(t, node, nodecfg, all)
+	assert.Equal(t, nodecfg, again)
+
+	// the overridden sections are kept whole once the node leaves the templates
+	left := desired(t, node, nodecfg)
+	require.NotNil(t, left)
+	assert.Equal(t, nodecfg.Spec.NTPConfig, left.Spec.NTPConfig)
+	assert.Equal(t, nodecfg.Spec.Sysctl, left.Spec.Sysctl)
+}
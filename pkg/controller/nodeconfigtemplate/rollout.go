@@ -0,0 +1,211 @@
+package nodeconfigtemplate
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+// sectionConditions maps the sections to the condition which reports them as
+// applied, the sections without one are gated by the observed generation only.
+var sectionConditions = map[string]nodeconfigv1.ConditionTypeNodeConfig{
+	"ntpConfigs":       nodeconfigv1.NTPApplied,
+	"sysctl":           nodeconfigv1.SysctlApplied,
+	"kernelModules":    nodeconfigv1.KernelModulesLoaded,
+	"timezone":         nodeconfigv1.TimezoneApplied,
+	"dns":              nodeconfigv1.DNSApplied,
+	"hostAliases":      nodeconfigv1.HostAliasesApplied,
+	"containerRuntime": nodeconfigv1.ContainerRuntimeApplied,
+	"cpuPower":         nodeconfigv1.CPUPowerApplied,
+	"cpuIsolation":     nodeconfigv1.CPUIsolationApplied,
+	"swap":             nodeconfigv1.SwapApplied,
+	"journald":         nodeconfigv1.JournaldApplied,
+	"systemdUnits":     nodeconfigv1.SystemdUnitsApplied,
+}
+
+// rolloutNode is a node matching a template with a rollout
+type rolloutNode struct {
+	name     string
+	ready    bool
+	cordoned bool
+	// updated is set when the current spec of the template is written to the
+	// NodeConfig of the node, state and message are only set then
+	updated     bool
+	updatedTime time.Time
+	state       nodeconfigv1.TemplateRolloutState
+	message     string
+}
+
+func newRolloutNode(node *corev1.Node, nodecfg *nodeconfigv1.NodeConfig, templateName string, spec sections) (rolloutNode, error) {
+	n := rolloutNode{name: node.Name, cordoned: node.Spec.Unschedulable}
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			n.ready = cond.Status == corev1.ConditionTrue
+		}
+	}
+
+	applied, _, err := getAppliedTemplates(nodecfg)
+	if err != nil {
+		return n, fmt.Errorf("node %s: %w", node.Name, err)
+	}
+	last, ok := applied[templateName]
+	if !ok || !equalSections(last.Spec, spec) {
+		return n, nil
+	}
+	n.updated = true
+	n.updatedTime = last.Time.Time
+	n.state, n.message = sectionsState(nodecfg, spec)
+	return n, nil
+}
+
+// sectionsState is the state of the sections on the node, they are updated
+// once the NodeConfig generation is observed with their conditions true.
+func sectionsState(nodecfg *nodeconfigv1.NodeConfig, spec sections) (nodeconfigv1.TemplateRolloutState, string) {
+	var conditions []string
+	for name := range spec {
+		if conditionType, ok := sectionConditions[name]; ok {
+			conditions = append(conditions, string(conditionType))
+		}
+	}
+	slices.Sort(conditions)
+
+	for _, conditionType := range conditions {
+		cond := meta.FindStatusCondition(nodecfg.Status.Conditions, conditionType)
+		if cond != nil && cond.Status == metav1.ConditionFalse && cond.ObservedGeneration == nodecfg.Generation {
+			return nodeconfigv1.TemplateRolloutFailed, fmt.Sprintf("%s: %s", conditionType, cond.Message)
+		}
+	}
+	if nodecfg.Status.ObservedGeneration < nodecfg.Generation {
+		return nodeconfigv1.TemplateRolloutUpdating, fmt.Sprintf("generation %d is not applied yet", nodecfg.Generation)
+	}
+	for _, conditionType := range conditions {
+		cond := meta.FindStatusCondition(nodecfg.Status.Conditions, conditionType)
+		if cond == nil || cond.Status != metav1.ConditionTrue || cond.ObservedGeneration < nodecfg.Generation {
+			return nodeconfigv1.TemplateRolloutUpdating, fmt.Sprintf("%s is not true yet", conditionType)
+		}
+	}
+	return nodeconfigv1.TemplateRolloutUpdated, ""
+}
+
+// available is false for the nodes which could not apply the template right
+// now, they are skipped by the rollout.
+func (n rolloutNode) available() bool {
+	return n.ready && !n.cordoned
+}
+
+// rolloutPlan is the decision of the rollout for all the matching nodes
+type rolloutPlan struct {
+	// proceed are the nodes the current spec is written to
+	proceed map[string]bool
+	// nodes is the rollout status of each node
+	nodes map[string]nodeconfigv1.TemplateRolloutStatus
+	// wait is how long until the pause before the next batch is over
+	wait time.Duration
+}
+
+// planRollout decides which nodes the current spec of the template is written
+// to, nodes are the nodes matching the template. It runs on the leader only,
+// so the slots are given out from a single view of the cluster.
+//
+// The nodes which are not ready or cordoned are skipped: the batches do not
+// wait for them, but they are counted as unavailable along with the nodes
+// still updating. A skipped node catches up once it is back, before the next
+// batch starts.
+func planRollout(strategy *nodeconfigv1.RolloutStrategy, nodes []rolloutNode, now time.Time) rolloutPlan {
+	slices.SortFunc(nodes, func(a, b rolloutNode) int { return strings.Compare(a.name, b.name) })
+	plan := rolloutPlan{
+		proceed: make(map[string]bool),
+		nodes:   make(map[string]nodeconfigv1.TemplateRolloutStatus, len(nodes)),
+	}
+	pending := func(message string, args ...any) nodeconfigv1.TemplateRolloutStatus {
+		return nodeconfigv1.TemplateRolloutStatus{State: nodeconfigv1.TemplateRolloutPending, Message: fmt.Sprintf(message, args...)}
+	}
+
+	var waiting []rolloutNode
+	var failed *rolloutNode
+	unavailable := 0
+	for i, n := range nodes {
+		switch {
+		case n.updated:
+			plan.nodes[n.name] = nodeconfigv1.TemplateRolloutStatus{State: n.state, Message: n.message}
+			if n.state == nodeconfigv1.TemplateRolloutFailed && failed == nil {
+				failed = &nodes[i]
+			}
+		case !n.ready:
+			plan.nodes[n.name] = nodeconfigv1.TemplateRolloutStatus{State: nodeconfigv1.TemplateRolloutSkipped, Message: "node is not ready"}
+		case n.cordoned:
+			plan.nodes[n.name] = nodeconfigv1.TemplateRolloutStatus{State: nodeconfigv1.TemplateRolloutSkipped, Message: "node is cordoned"}
+		default:
+			waiting = append(waiting, n)
+		}
+		if !n.available() || (n.updated && n.state != nodeconfigv1.TemplateRolloutUpdated) {
+			unavailable++
+		}
+	}
+	if failed != nil {
+		for _, n := range waiting {
+			plan.nodes[n.name] = pending("rollout is halted, node %s failed: %s", failed.name, failed.message)
+		}
+		return plan
+	}
+
+	batchSize := max(1, int(strategy.BatchSize))
+	maxUnavailable := batchSize
+	if strategy.MaxUnavailable > 0 {
+		maxUnavailable = int(strategy.MaxUnavailable)
+	}
+	slots := maxUnavailable - unavailable
+	batchOf := func(name string) int {
+		return slices.IndexFunc(nodes, func(n rolloutNode) bool { return n.name == name }) / batchSize
+	}
+
+	// the current batch is the first one with nodes to update or updating,
+	// the skipped nodes are not waited for
+	batch := -1
+	var blocker string
+	for _, n := range nodes {
+		if n.available() && (!n.updated || n.state == nodeconfigv1.TemplateRolloutUpdating) {
+			batch, blocker = batchOf(n.name), n.name
+			break
+		}
+	}
+	if batch < 0 {
+		return plan
+	}
+
+	started := slices.ContainsFunc(nodes[batch*batchSize:min(len(nodes), (batch+1)*batchSize)], func(n rolloutNode) bool { return n.updated })
+	var wait time.Duration
+	if batch > 0 && !started && strategy.Pause != nil {
+		var last time.Time
+		for _, n := range nodes[:batch*batchSize] {
+			if n.updated && n.updatedTime.After(last) {
+				last = n.updatedTime
+			}
+		}
+		wait = last.Add(strategy.Pause.Duration).Sub(now)
+	}
+
+	for _, n := range waiting {
+		switch b := batchOf(n.name); {
+		case b > batch:
+			plan.nodes[n.name] = pending("waiting for node %s of batch %d", blocker, batch+1)
+		case wait > 0:
+			plan.nodes[n.name] = pending("pausing for %s before batch %d", wait.Round(time.Second), b+1)
+			plan.wait = wait
+		case slots <= 0:
+			plan.nodes[n.name] = pending("waiting for %d unavailable nodes", maxUnavailable-slots)
+		default:
+			slots--
+			plan.proceed[n.name] = true
+			plan.nodes[n.name] = nodeconfigv1.TemplateRolloutStatus{State: nodeconfigv1.TemplateRolloutUpdating, Message: fmt.Sprintf("batch %d", b+1)}
+		}
+	}
+	return plan
+}
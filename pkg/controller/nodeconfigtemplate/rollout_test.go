@@ -0,0 +1,149 @@
+package nodeconfigtemplate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+func pendingNode(name string) rolloutNode {
+	return rolloutNode{name: name, ready: true}
+}
+
+func updatedNode(name string, state nodeconfigv1.TemplateRolloutState, updated time.Time) rolloutNode {
+	return rolloutNode{name: name, ready: true, updated: true, updatedTime: updated, state: state}
+}
+
+func TestPlanRollout(t *testing.T) {
+	now := time.Now()
+	pause := &metav1.Duration{Duration: 10 * time.Minute}
+
+	tests := []struct {
+		name     string
+		strategy nodeconfigv1.RolloutStrategy
+		nodes    []rolloutNode
+		node     string
+		proceed  bool
+		state    nodeconfigv1.TemplateRolloutState
+		wait     time.Duration
+	}{
+		{"first batch", nodeconfigv1.RolloutStrategy{BatchSize: 2}, []rolloutNode{
+			pendingNode("n3"), pendingNode("n2"), pendingNode("n1"),
+		}, "n2", true, nodeconfigv1.TemplateRolloutUpdating, 0},
+		{"second batch waits for the first one", nodeconfigv1.RolloutStrategy{BatchSize: 2}, []rolloutNode{
+			pendingNode("n1"), pendingNode("n2"), pendingNode("n3"),
+		}, "n3", false, nodeconfigv1.TemplateRolloutPending, 0},
+		{"second batch waits for the updating nodes", nodeconfigv1.RolloutStrategy{BatchSize: 2}, []rolloutNode{
+			updatedNode("n1", nodeconfigv1.TemplateRolloutUpdated, now), updatedNode("n2", nodeconfigv1.TemplateRolloutUpdating, now), pendingNode("n3"),
+		}, "n3", false, nodeconfigv1.TemplateRolloutPending, 0},
+		{"max unavailable", nodeconfigv1.RolloutStrategy{BatchSize: 2, MaxUnavailable: 1}, []rolloutNode{
+			pendingNode("n1"), pendingNode("n2"),
+		}, "n2", false, nodeconfigv1.TemplateRolloutPending, 0},
+		{"max unavailable freed", nodeconfigv1.RolloutStrategy{BatchSize: 2, MaxUnavailable: 1}, []rolloutNode{
+			updatedNode("n1", nodeconfigv1.TemplateRolloutUpdated, now), pendingNode("n2"),
+		}, "n2", true, nodeconfigv1.TemplateRolloutUpdating, 0},
+		{"not ready nodes are unavailable", nodeconfigv1.RolloutStrategy{}, []rolloutNode{
+			pendingNode("n1"), {name: "n2"},
+		}, "n1", false, nodeconfigv1.TemplateRolloutPending, 0},
+		{"cordoned nodes are unavailable", nodeconfigv1.RolloutStrategy{MaxUnavailable: 2}, []rolloutNode{
+			{name: "n1", ready: true, cordoned: true}, pendingNode("n2"), {name: "n3"},
+		}, "n2", false, nodeconfigv1.TemplateRolloutPending, 0},
+		{"not ready nodes are skipped", nodeconfigv1.RolloutStrategy{}, []rolloutNode{
+			{name: "n1"}, pendingNode("n2"),
+		}, "n1", false, nodeconfigv1.TemplateRolloutSkipped, 0},
+		{"pause between batches", nodeconfigv1.RolloutStrategy{Pause: pause}, []rolloutNode{
+			updatedNode("n1", nodeconfigv1.TemplateRolloutUpdated, now.Add(-4*time.Minute)), pendingNode("n2"),
+		}, "n2", false, nodeconfigv1.TemplateRolloutPending, 6 * time.Minute},
+		{"pause is over", nodeconfigv1.RolloutStrategy{Pause: pause}, []rolloutNode{
+			updatedNode("n1", nodeconfigv1.TemplateRolloutUpdated, now.Add(-11*time.Minute)), pendingNode("n2"),
+		}, "n2", true, nodeconfigv1.TemplateRolloutUpdating, 0},
+		{"halted by a failed node", nodeconfigv1.RolloutStrategy{BatchSize: 2}, []rolloutNode{
+			updatedNode("n1", nodeconfigv1.TemplateRolloutFailed, now), pendingNode("n2"),
+		}, "n2", false, nodeconfigv1.TemplateRolloutPending, 0},
+		{"updated node", nodeconfigv1.RolloutStrategy{}, []rolloutNode{
+			updatedNode("n1", nodeconfigv1.TemplateRolloutFailed, now),
+		}, "n1", false, nodeconfigv1.TemplateRolloutFailed, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := planRollout(&tt.strategy, tt.nodes, now)
+			status := plan.nodes[tt.node]
+			assert.Equal(t, tt.proceed, plan.proceed[tt.node])
+			assert.Equal(t, tt.state, status.State, status.Message)
+			assert.Equal(t, tt.wait, plan.wait)
+		})
+	}
+}
+
+// TestPlanRolloutNotReady checks that a node which is not ready in an earlier
+// batch does not freeze the later batches, and catches up once it is back.
+func TestPlanRolloutNotReady(t *testing.T) {
+	now := time.Now()
+	strategy := &nodeconfigv1.RolloutStrategy{BatchSize: 2, MaxUnavailable: 2}
+
+	// n2 of the first batch is down, it holds one of the two slots
+	down := rolloutNode{name: "n2"}
+	plan := planRollout(strategy, []rolloutNode{pendingNode("n1"), down, pendingNode("n3"), pendingNode("n4")}, now)
+	assert.Equal(t, map[string]bool{"n1": true}, plan.proceed)
+	assert.Equal(t, nodeconfigv1.TemplateRolloutSkipped, plan.nodes["n2"].State)
+	assert.Equal(t, nodeconfigv1.TemplateRolloutPending, plan.nodes["n3"].State)
+
+	// the second batch starts once n1 is updated, without waiting for n2
+	plan = planRollout(strategy, []rolloutNode{
+		updatedNode("n1", nodeconfigv1.TemplateRolloutUpdated, now), down, pendingNode("n3"), pendingNode("n4"),
+	}, now)
+	assert.Equal(t, map[string]bool{"n3": true}, plan.proceed)
+	assert.Equal(t, "waiting for 2 unavailable nodes", plan.nodes["n4"].Message)
+
+	// n2 catches up once it is back
+	plan = planRollout(strategy, []rolloutNode{
+		updatedNode("n1", nodeconfigv1.TemplateRolloutUpdated, now), pendingNode("n2"),
+		updatedNode("n3", nodeconfigv1.TemplateRolloutUpdated, now), pendingNode("n4"),
+	}, now)
+	assert.Equal(t, map[string]bool{"n2": true}, plan.proceed)
+	assert.Equal(t, "waiting for node n2 of batch 1", plan.nodes["n4"].Message)
+}
+
+func TestSectionsState(t *testing.T) {
+	spec := sections{"ntpConfigs": []byte(`{}`), "kernelArgs": []byte(`["quiet"]`)}
+	nodecfg := &nodeconfigv1.NodeConfig{ObjectMeta: metav1.ObjectMeta{Generation: 2}}
+	nodecfg.Status.ObservedGeneration = 1
+
+	state, _ := sectionsState(nodecfg, spec)
+	assert.Equal(t, nodeconfigv1.TemplateRolloutUpdating, state)
+
+	nodecfg.Status.Conditions = []metav1.Condition{{
+		Type: string(nodeconfigv1.NTPApplied), Status: metav1.ConditionFalse, ObservedGeneration: 2, Message: "no route to host",
+	}}
+	state, message := sectionsState(nodecfg, spec)
+	assert.Equal(t, nodeconfigv1.TemplateRolloutFailed, state)
+	assert.Equal(t, "NTPApplied: no route to host", message)
+
+	nodecfg.Status.ObservedGeneration = 2
+	nodecfg.Status.Conditions[0].Status = metav1.ConditionTrue
+	state, _ = sectionsState(nodecfg, spec)
+	assert.Equal(t, nodeconfigv1.TemplateRolloutUpdated, state)
+}
+
+func TestWantedTemplatesRollout(t *testing.T) {
+	template := newTemplate("all", nil, nodeconfigv1.NodeConfigSpec{Timezone: "UTC"})
+	template.Spec.Rollout = &nodeconfigv1.RolloutStrategy{}
+	last := appliedTemplate{Spec: sections{"timezone": []byte(`"Asia/Taipei"`)}}
+	hold := func(*nodeconfigv1.NodeConfigTemplate, sections) (bool, error) { return false, nil }
+
+	// the spec written before is kept until the rollout reaches the node
+	wanted, err := wantedTemplates([]*nodeconfigv1.NodeConfigTemplate{template}, map[string]appliedTemplate{"all": last}, time.Now(), hold)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]appliedTemplate{"all": last}, wanted)
+
+	// a node new to the template gets nothing
+	wanted, err = wantedTemplates([]*nodeconfigv1.NodeConfigTemplate{template}, nil, time.Now(), hold)
+	require.NoError(t, err)
+	assert.Empty(t, wanted)
+}
@@ -32,6 +32,10 @@ func (c *FakeNodeV1beta1) CloudInits() v1beta1.CloudInitInterface {
 	return newFakeCloudInits(c)
 }
 
+func (c *FakeNodeV1beta1) HostConfigChanges() v1beta1.HostConfigChangeInterface {
+	return newFakeHostConfigChanges(c)
+}
+
 func (c *FakeNodeV1beta1) Hugepages() v1beta1.HugepageInterface {
 	return newFakeHugepages(c)
 }
@@ -44,6 +48,10 @@ func (c *FakeNodeV1beta1) NodeConfigs(namespace string) v1beta1.NodeConfigInterf
 	return newFakeNodeConfigs(c, namespace)
 }
 
+func (c *FakeNodeV1beta1) NodeConfigTemplates() v1beta1.NodeConfigTemplateInterface {
+	return newFakeNodeConfigTemplates(c)
+}
+
 // RESTClient returns a RESTClient that is used to communicate
 // with API server by this client implementation.
 func (c *FakeNodeV1beta1) RESTClient() rest.Interface {
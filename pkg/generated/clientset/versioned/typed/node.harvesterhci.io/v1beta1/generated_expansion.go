@@ -20,8 +20,12 @@ package v1beta1
 
 type CloudInitExpansion interface{}
 
+type HostConfigChangeExpansion interface{}
+
 type HugepageExpansion interface{}
 
 type KsmtunedExpansion interface{}
 
 type NodeConfigExpansion interface{}
+
+type NodeConfigTemplateExpansion interface{}
@@ -29,9 +29,11 @@ import (
 type NodeV1beta1Interface interface {
 	RESTClient() rest.Interface
 	CloudInitsGetter
+	HostConfigChangesGetter
 	HugepagesGetter
 	KsmtunedsGetter
 	NodeConfigsGetter
+	NodeConfigTemplatesGetter
 }
 
 // NodeV1beta1Client is used to interact with features provided by the node.harvesterhci.io group.
@@ -43,6 +45,10 @@ func (c *NodeV1beta1Client) CloudInits() CloudInitInterface {
 	return newCloudInits(c)
 }
 
+func (c *NodeV1beta1Client) HostConfigChanges() HostConfigChangeInterface {
+	return newHostConfigChanges(c)
+}
+
 func (c *NodeV1beta1Client) Hugepages() HugepageInterface {
 	return newHugepages(c)
 }
@@ -55,6 +61,10 @@ func (c *NodeV1beta1Client) NodeConfigs(namespace string) NodeConfigInterface {
 	return newNodeConfigs(c, namespace)
 }
 
+func (c *NodeV1beta1Client) NodeConfigTemplates() NodeConfigTemplateInterface {
+	return newNodeConfigTemplates(c)
+}
+
 // NewForConfig creates a new NodeV1beta1Client for the given config.
 // NewForConfig is equivalent to NewForConfigAndClient(c, httpClient),
 // where httpClient was generated with rest.HTTPClientFor(c).
@@ -32,9 +32,11 @@ func init() {
 
 type Interface interface {
 	CloudInit() CloudInitController
+	HostConfigChange() HostConfigChangeController
 	Hugepage() HugepageController
 	Ksmtuned() KsmtunedController
 	NodeConfig() NodeConfigController
+	NodeConfigTemplate() NodeConfigTemplateController
 }
 
 func New(controllerFactory controller.SharedControllerFactory) Interface {
@@ -51,6 +53,10 @@ func (v *version) CloudInit() CloudInitController {
 	return generic.NewNonNamespacedController[*v1beta1.CloudInit, *v1beta1.CloudInitList](schema.GroupVersionKind{Group: "node.harvesterhci.io", Version: "v1beta1", Kind: "CloudInit"}, "cloudinits", v.controllerFactory)
 }
 
+func (v *version) HostConfigChange() HostConfigChangeController {
+	return generic.NewNonNamespacedController[*v1beta1.HostConfigChange, *v1beta1.HostConfigChangeList](schema.GroupVersionKind{Group: "node.harvesterhci.io", Version: "v1beta1", Kind: "HostConfigChange"}, "hostconfigchanges", v.controllerFactory)
+}
+
 func (v *version) Hugepage() HugepageController {
 	return generic.NewNonNamespacedController[*v1beta1.Hugepage, *v1beta1.HugepageList](schema.GroupVersionKind{Group: "node.harvesterhci.io", Version: "v1beta1", Kind: "Hugepage"}, "hugepages", v.controllerFactory)
 }
@@ -62,3 +68,7 @@ func (v *version) Ksmtuned() KsmtunedController {
 func (v *version) NodeConfig() NodeConfigController {
 	return generic.NewController[*v1beta1.NodeConfig, *v1beta1.NodeConfigList](schema.GroupVersionKind{Group: "node.harvesterhci.io", Version: "v1beta1", Kind: "NodeConfig"}, "nodeconfigs", true, v.controllerFactory)
 }
+
+func (v *version) NodeConfigTemplate() NodeConfigTemplateController {
+	return generic.NewNonNamespacedController[*v1beta1.NodeConfigTemplate, *v1beta1.NodeConfigTemplateList](schema.GroupVersionKind{Group: "node.harvesterhci.io", Version: "v1beta1", Kind: "NodeConfigTemplate"}, "nodeconfigtemplates", v.controllerFactory)
+}
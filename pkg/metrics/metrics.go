@@ -19,11 +19,48 @@ var (
 		Name: "ksmd_utilization",
 		Help: "ksmd utilization of cpu in second",
 	}, []string{"nodename"})
+
+	NTPOffsetGV = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntp_offset_seconds",
+		Help: "estimated offset of the current ntp server clock relative to the local clock in second",
+	}, []string{"nodename"})
+
+	NTPStratumGV = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntp_stratum",
+		Help: "stratum of the current ntp server",
+	}, []string{"nodename"})
+
+	NTPJitterGV = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntp_jitter_seconds",
+		Help: "jitter of the ntp measurements in second",
+	}, []string{"nodename"})
+
+	NTPRootDistanceGV = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntp_root_distance_seconds",
+		Help: "estimated maximum error to the reference clock in second",
+	}, []string{"nodename"})
+
+	NTPServerInfoGV = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntp_server_info",
+		Help: "ntp server the node is currently synchronized with, the value is always 1",
+	}, []string{"nodename", "server"})
+
+	NodeConfigDriftedFilesGV = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nodeconfig_drifted_files",
+		Help: "number of files of the nodeconfig section which are changed outside of the node manager",
+	}, []string{"nodename", "section", "policy"})
+
+	NodeConfigDriftsCV = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nodeconfig_drifts_total",
+		Help: "number of changes detected on the files of the nodeconfig section",
+	}, []string{"nodename", "section", "policy"})
 )
 
 func Run() {
 	logrus.Info("starting metrics server")
 	prometheus.MustRegister(KsmdUtilizationGV)
+	prometheus.MustRegister(NTPOffsetGV, NTPStratumGV, NTPJitterGV, NTPRootDistanceGV, NTPServerInfoGV)
+	prometheus.MustRegister(NodeConfigDriftedFilesGV, NodeConfigDriftsCV)
 
 	http.Handle(MetricPath, promhttp.Handler())
 	metricServer := &http.Server{
@@ -3,7 +3,6 @@ package monitor
 import (
 	"context"
 	"strings"
-	"sync"
 	"time"
 
 	ctlnode "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
@@ -28,17 +27,15 @@ type Template struct {
 	nodecfgctl   ctlv1.NodeConfigController
 	nodesctl     ctlnode.NodeController
 	cloudinitctl ctlv1.CloudInitController
-	mtx          *sync.Mutex
 }
 
-func NewMonitorTemplate(ctx context.Context, mtx *sync.Mutex, nodecfg ctlv1.NodeConfigController, nodes ctlnode.NodeController, cloudinits ctlv1.CloudInitController, nodeName string) *Template {
+func NewMonitorTemplate(ctx context.Context, nodecfg ctlv1.NodeConfigController, nodes ctlnode.NodeController, cloudinits ctlv1.CloudInitController, nodeName string) *Template {
 	return &Template{
 		context:      ctx,
 		nodeName:     nodeName,
 		nodecfgctl:   nodecfg,
 		nodesctl:     nodes,
 		cloudinitctl: cloudinits,
-		mtx:          mtx,
 	}
 }
 
@@ -51,7 +48,7 @@ func InitServiceMonitor(template *Template, monitorName string) interface{} {
 	// Implement service monitor here
 	switch strings.ToLower(monitorName) {
 	case "ntp":
-		return NewNTPMonitor(template.context, template.mtx, template.nodecfgctl, template.nodesctl, template.nodeName, monitorName)
+		return NewNTPMonitor(template.context, template.nodecfgctl, template.nodesctl, template.nodeName, monitorName)
 	case "configfile":
 		return NewConfigFileMonitor(template.context, template.nodecfgctl, template.nodeName, monitorName)
 	case "cloudinit":
@@ -2,89 +2,142 @@ package monitor
 
 import (
 	"context"
+	"path/filepath"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/harvester/go-common/sys"
 	"github.com/sirupsen/logrus"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/controller/nodeconfig/config"
 	ctlv1 "github.com/harvester/node-manager/pkg/generated/controllers/node.harvesterhci.io/v1beta1"
-	"github.com/harvester/node-manager/pkg/utils"
 )
 
-var monitorTargets = []string{utils.SystemdConfigPath}
-var timesyncdConfigPath = utils.SystemdConfigPath + utils.TimesyncdConfigName
-
+// ConfigFileMonitor watches the files managed by the NodeConfig of the node,
+// which are listed in its status, and enqueues the NodeConfig once one of them
+// no longer matches the drift recorded for it, so the controller handles the
+// drift by the policy of the section. The directories are watched rather than
+// the files, as the files are usually replaced by a rename, and they are
+// synced with the status on every tick, which also catches the missed events.
 type ConfigFileMonitor struct {
-	Context        context.Context
-	MonitorName    string
-	NodeName       string
-	MonitorTargets []string
+	Context     context.Context
+	MonitorName string
+	NodeName    string
 
 	NodeConfigCtl ctlv1.NodeConfigController
+
+	// watchedDirs are the directories added to the watcher
+	watchedDirs map[string]bool
 }
 
 func NewConfigFileMonitor(ctx context.Context, nodecfg ctlv1.NodeConfigController, nodeName, monitorName string) *ConfigFileMonitor {
 	return &ConfigFileMonitor{
-		Context:        ctx,
-		MonitorName:    monitorName,
-		NodeConfigCtl:  nodecfg,
-		NodeName:       nodeName,
-		MonitorTargets: []string{},
+		Context:       ctx,
+		MonitorName:   monitorName,
+		NodeConfigCtl: nodecfg,
+		NodeName:      nodeName,
+		watchedDirs:   make(map[string]bool),
 	}
 }
 
 func (monitor *ConfigFileMonitor) startMonitor() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.Errorf("Create the watcher of the managed files fail, err: %v", err)
+		return
+	}
 	go func() {
-		handler := sys.FSNotifyHandlerFunc(func(event fsnotify.Event) {
-			monitor.genericHandler(event.Name)
-		})
-		sys.WatchFileChange(monitor.Context, sys.AnyOf(sys.FSNotifyHandlerFunc(handler), fsnotify.Write), monitorTargets)
+		defer watcher.Close()
+		ticker := time.NewTicker(defaultInterval)
+		defer ticker.Stop()
+
+		monitor.syncWatches(watcher)
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				logrus.Debugf("Prepare to handle the event: %s", event)
+				monitor.checkDrift(event.Name)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logrus.Warnf("Watch the managed files fail, err: %v", err)
+			case <-ticker.C:
+				monitor.syncWatches(watcher)
+				monitor.checkDrift("")
+			case <-monitor.Context.Done():
+				return
+			}
+		}
 	}()
 }
 
-func (monitor *ConfigFileMonitor) handleNTPConfigChange() {
-	wantedNTPServers := ""
-	nodeconfig, err := monitor.NodeConfigCtl.Get(HarvesterNS, monitor.NodeName, metav1.GetOptions{})
+// getManagedFiles returns the NodeConfig of the node and its managed files,
+// the NodeConfig is nil when it does not exist
+func (monitor *ConfigFileMonitor) getManagedFiles() (*nodeconfigv1.NodeConfig, []nodeconfigv1.ManagedFileStatus) {
+	nodecfg, err := monitor.NodeConfigCtl.Cache().Get(HarvesterNS, monitor.NodeName)
 	if err != nil {
-		logrus.Warnf("Get NodeConfig fail, err: %v", err)
-	} else {
-		wantedNTPServers = nodeconfig.Spec.NTPConfig.NTPServers
-		logrus.Debugf("Get the wanted NTP Servers: %s", wantedNTPServers)
+		if !apierrors.IsNotFound(err) {
+			logrus.Warnf("Get NodeConfig fail, err: %v", err)
+		}
+		return nil, nil
 	}
-	currentNTPServers := getNTPServersOnNode()
-	logrus.Debugf("Current NTP Servers: %s, Config NTP Servers %s", currentNTPServers, wantedNTPServers)
-
-	if wantedNTPServers != "" && wantedNTPServers != currentNTPServers {
-		logrus.Infof("Enqueue to make controller to update NTP Servers")
-		monitor.NodeConfigCtl.Enqueue(nodeconfig.Namespace, nodeconfig.Name)
-	}
-
+	return nodecfg, nodecfg.Status.ManagedFiles
 }
 
-func (monitor *ConfigFileMonitor) genericHandler(eventName string) {
-	logrus.Debugf("Prepare to handle the event: %s", eventName)
-	eventType := parserEventType(eventName)
-	if eventType != "" {
-		monitor.doGenericHandler(eventType)
+// syncWatches watches the directories of the managed files, the directories
+// which do not exist yet are added once they are created.
+func (monitor *ConfigFileMonitor) syncWatches(watcher *fsnotify.Watcher) {
+	_, files := monitor.getManagedFiles()
+	wanted := make(map[string]bool)
+	for _, file := range files {
+		wanted[filepath.Dir(config.ManagedFile(file.Path))] = true
 	}
-}
 
-func (monitor *ConfigFileMonitor) doGenericHandler(eventType string) {
-	switch eventType {
-	case "NTP":
-		monitor.handleNTPConfigChange()
-	default:
-		logrus.Errorf("unknown event type: %s", eventType)
+	for dir := range monitor.watchedDirs {
+		if wanted[dir] {
+			continue
+		}
+		if err := watcher.Remove(dir); err != nil {
+			logrus.Debugf("Remove the watch of %s fail, err: %v", dir, err)
+		}
+		delete(monitor.watchedDirs, dir)
+	}
+	for dir := range wanted {
+		if monitor.watchedDirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			logrus.Debugf("Watch %s fail, err: %v", dir, err)
+			continue
+		}
+		monitor.watchedDirs[dir] = true
 	}
 }
 
-func parserEventType(path string) string {
-	switch path {
-	case timesyncdConfigPath:
-		return "NTP"
-	default:
-		logrus.Errorf("unknown supported path: %s", path)
+// checkDrift enqueues the NodeConfig when the content of a managed file no
+// longer matches the drift recorded for it, path limits the check to the file
+// changed, along with the stages and the variables kept in it. All managed
+// files are checked when it is empty.
+func (monitor *ConfigFileMonitor) checkDrift(path string) {
+	nodecfg, files := monitor.getManagedFiles()
+	for _, file := range files {
+		if path != "" && config.ManagedFile(file.Path) != path {
+			continue
+		}
+		hash, err := config.HashManagedPath(file.Path)
+		if err != nil {
+			logrus.Warnf("Hash %s fail, err: %v", file.Path, err)
+			continue
+		}
+		if (hash != file.AppliedHash) != file.Drifted {
+			logrus.Infof("Enqueue to make controller to handle the drift of %s of %s", file.Path, file.Section)
+			monitor.NodeConfigCtl.Enqueue(nodecfg.Namespace, nodecfg.Name)
+			return
+		}
 	}
-	return ""
 }
@@ -3,7 +3,6 @@ package monitor
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"reflect"
 	"slices"
 	"sync"
@@ -11,11 +10,16 @@ import (
 
 	"github.com/godbus/dbus/v5"
 	"github.com/harvester/go-common/sys"
+	"github.com/prometheus/client_golang/prometheus"
 	ctlnode "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
 	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
 	ctlv1 "github.com/harvester/node-manager/pkg/generated/controllers/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/metrics"
 	"github.com/harvester/node-manager/pkg/utils"
 )
 
@@ -30,6 +34,24 @@ var NTPSyncTimeout = 45 * time.Minute
 var DefaultNTPCheckInterval = 15 * time.Minute
 var MAXNTPCheckInterval = 24 * 365 * time.Hour
 
+// NTPStatusUpdateInterval throttles how often a new measurement is written to
+// the NodeConfig status, the metrics are always updated.
+var NTPStatusUpdateInterval = 5 * time.Minute
+
+// NTPMeasurementInterval is how often chronyd is polled for a measurement and
+// the metrics are checked for expiry, timesyncd reports its measurements by
+// D-Bus signals.
+var NTPMeasurementInterval = 30 * time.Second
+
+// ChronyMeasurementExpiry and TimesyncdMeasurementExpiry are how long the
+// metrics of the last measurement are kept, the series are deleted once no
+// new measurement arrives in time. timesyncd polls its server at most every
+// 2048s.
+var (
+	ChronyMeasurementExpiry    = 3 * NTPMeasurementInterval
+	TimesyncdMeasurementExpiry = NTPSyncTimeout
+)
+
 type NTPStatusAnnotation utils.NTPStatusAnnotation
 
 type NTPMonitor struct {
@@ -40,8 +62,25 @@ type NTPMonitor struct {
 
 	NodeClient    ctlnode.NodeClient
 	NodeConfigCtl ctlv1.NodeConfigController
-	mtx           *sync.Mutex
-	ticker        *time.Ticker
+	// mtx serializes the D-Bus signal handlers and the ticker, which share
+	// the annotation and the measurement
+	mtx    sync.Mutex
+	ticker *time.Ticker
+
+	// measurement is the latest measurement reported to the NodeConfig status
+	measurement *ntpMeasurement
+	// metricsTime is when the metrics were last updated with a measurement,
+	// zero when there are no series of the node
+	metricsTime time.Time
+}
+
+type ntpMeasurement struct {
+	Server       string
+	Stratum      uint32
+	Offset       time.Duration
+	Jitter       time.Duration
+	RootDistance time.Duration
+	Time         time.Time
 }
 
 type NTPMessage struct {
@@ -62,7 +101,7 @@ type NTPMessage struct {
 	Jitter               uint64
 }
 
-func NewNTPMonitor(ctx context.Context, mtx *sync.Mutex, nodecfg ctlv1.NodeConfigController, nodes ctlnode.NodeController, nodeName, monitorName string) *NTPMonitor {
+func NewNTPMonitor(ctx context.Context, nodecfg ctlv1.NodeConfigController, nodes ctlnode.NodeController, nodeName, monitorName string) *NTPMonitor {
 	ticker := time.NewTicker(DefaultNTPCheckInterval)
 	return &NTPMonitor{
 		Context:       ctx,
@@ -74,7 +113,6 @@ func NewNTPMonitor(ctx context.Context, mtx *sync.Mutex, nodecfg ctlv1.NodeConfi
 			NTPSyncStatus:     "",
 			CurrentNTPServers: "",
 		},
-		mtx:    mtx,
 		ticker: ticker,
 	}
 }
@@ -93,6 +131,18 @@ func (monitor *NTPMonitor) startMonitor() {
 	go func() {
 		sys.WatchDBusSignal(monitor.Context, utils.DbusPropertiesIface, utils.DbusTimesync1ObjectPath, monitor.handleTimesync1Signal)
 	}()
+	go func() {
+		ticker := time.NewTicker(NTPMeasurementInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				monitor.updateNTPMeasurement()
+			case <-monitor.Context.Done():
+				return
+			}
+		}
+	}()
 	go func() {
 		defer monitor.ticker.Stop()
 		for {
@@ -155,6 +205,68 @@ func checkNTPSynced() bool {
 	return output
 }
 
+// getCurrentNTPSource returns the server the host is synchronized with and
+// whether that server is authenticated by NTS.
+func getCurrentNTPSource(backend nodeconfigv1.NTPBackend) (string, bool) {
+	if backend == nodeconfigv1.NTPBackendChrony {
+		return getChronyCurrentSource()
+	}
+
+	server, err := utils.GetTimesync1PropertiesServerName()
+	if err != nil {
+		logrus.Warnf("Get current timesyncd server failed with err: %v, skip this round.", err)
+		return "", false
+	}
+	// systemd-timesyncd does not support NTS
+	return server, false
+}
+
+func getChronyCurrentSource() (string, bool) {
+	sources, err := utils.GetChronySources()
+	if err != nil {
+		logrus.Warnf("Get chrony sources failed with err: %v, skip this round.", err)
+		return "", false
+	}
+	current := selectedChronySource(sources)
+	if current == "" {
+		logrus.Debugf("No chrony source is selected.")
+		return "", false
+	}
+
+	authData, err := utils.GetChronyAuthData()
+	if err != nil {
+		logrus.Warnf("Get chrony authdata failed with err: %v, skip this round.", err)
+		return current, false
+	}
+	return current, chronySourceAuthenticated(authData, current)
+}
+
+func selectedChronySource(sources []utils.ChronySource) string {
+	pos := slices.IndexFunc(sources, func(s utils.ChronySource) bool {
+		return s.Selected
+	})
+	if pos < 0 {
+		return ""
+	}
+	return sources[pos].Address
+}
+
+// chronySourceAuthenticated returns whether the source is authenticated by
+// NTS, i.e. it has NTS keys
+func chronySourceAuthenticated(authData []utils.ChronyAuthData, source string) bool {
+	return slices.ContainsFunc(authData, func(a utils.ChronyAuthData) bool {
+		return a.Address == source && a.Mode == "NTS" && a.KeyLength > 0
+	})
+}
+
+func (monitor *NTPMonitor) getNTPBackend() nodeconfigv1.NTPBackend {
+	nodecfg, err := monitor.NodeConfigCtl.Cache().Get(HarvesterNS, monitor.NodeName)
+	if err != nil || nodecfg.Spec.NTPConfig == nil || nodecfg.Spec.NTPConfig.Backend == "" {
+		return nodeconfigv1.NTPBackendTimesyncd
+	}
+	return nodecfg.Spec.NTPConfig.Backend
+}
+
 func generateAnnotationValue(syncStatus, current string) *NTPStatusAnnotation {
 	return &NTPStatusAnnotation{
 		NTPSyncStatus:     syncStatus,
@@ -162,8 +274,34 @@ func generateAnnotationValue(syncStatus, current string) *NTPStatusAnnotation {
 	}
 }
 
+// updateNTPMeasurement polls chronyd for a measurement, as it does not emit
+// any signal, and expires the metrics once no measurement arrives.
+func (monitor *NTPMonitor) updateNTPMeasurement() {
+	expiry := TimesyncdMeasurementExpiry
+	if monitor.getNTPBackend() == nodeconfigv1.NTPBackendChrony {
+		expiry = ChronyMeasurementExpiry
+		measurement, err := getChronyMeasurement()
+		if err != nil {
+			logrus.Warnf("Get chrony tracking failed with err: %v, skip this round.", err)
+		} else if measurement != nil {
+			monitor.reportNTPMeasurement(measurement)
+		}
+	}
+	monitor.expireNTPMetrics(time.Now(), expiry)
+}
+
+// updateNTPSyncStatus updates the annotation once the sync status or the
+// source is changed, the annotation is compared under the lock as the D-Bus
+// signal handlers update it.
 func (monitor *NTPMonitor) updateNTPSyncStatus() error {
-	if monitor.NodeNTPAnnotation.NTPSyncStatus == checkNTPSyncStatus() {
+	syncStatus := checkNTPSyncStatus()
+	source, authenticated := getCurrentNTPSource(monitor.getNTPBackend())
+	monitor.mtx.Lock()
+	unchanged := monitor.NodeNTPAnnotation.NTPSyncStatus == syncStatus &&
+		monitor.NodeNTPAnnotation.CurrentNTPSource == source &&
+		monitor.NodeNTPAnnotation.Authenticated == authenticated
+	monitor.mtx.Unlock()
+	if unchanged {
 		return nil
 	}
 	logrus.Infof("Prepare update the NTPSync Status...")
@@ -194,11 +332,15 @@ func (monitor *NTPMonitor) handleTimesync1Signal(signal *dbus.Signal) {
 					&ntpMessage.TransmitTimestamp, &ntpMessage.DestinationTimestamp, &ntpMessage.Ignored, &ntpMessage.PacketCount, &ntpMessage.Jitter)
 				if err != nil {
 					logrus.Errorf("Failed to convert the dbus.Variant to NTPMessage: %v", err)
+					continue
 				}
 				monitor.postponeTheNTPSyncStatusPolling(ntpMessage)
 				if err := monitor.prepareUpdateAnnotation(true); err != nil {
 					logrus.Errorf("Failed to update annotation with err: %v", err)
 				}
+				if measurement := getTimesyncdMeasurement(ntpMessage); measurement != nil {
+					monitor.reportNTPMeasurement(measurement)
+				}
 			default:
 				logrus.Warnf("Do Not handle the un-supported key: %v, val: %v", k, v)
 			}
@@ -244,80 +386,112 @@ func (monitor *NTPMonitor) handleTimedate1Signal(signal *dbus.Signal) {
 	}
 }
 
+// doAnnotationUpdate writes the fields owned by the monitor, the servers are
+// owned by the NodeConfig controller once the annotation is created.
 func (monitor *NTPMonitor) doAnnotationUpdate(annoValue *NTPStatusAnnotation) error {
 	logrus.Debugf("Node: %s, annotation update: %+v", monitor.NodeName, annoValue)
-	node, err := monitor.NodeClient.Get(monitor.NodeName, metav1.GetOptions{})
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"node": monitor.NodeName,
-		}).Errorf("Failed to get node, skip this round NTP check: %+v", err)
-		return err
-	}
+	return utils.UpdateNTPStatusAnnotation(monitor.NodeClient, monitor.NodeName, func(value *utils.NTPStatusAnnotation, found bool) bool {
+		if found {
+			annoValue.CurrentNTPServers = value.CurrentNTPServers
+		}
+		if *value == utils.NTPStatusAnnotation(*annoValue) {
+			return false
+		}
+		logrus.Infof("Try to update with Node: %s, annotation update: %+v", monitor.NodeName, annoValue)
+		*value = utils.NTPStatusAnnotation(*annoValue)
+		return true
+	})
+}
 
-	bytes, err := json.Marshal(annoValue)
+func (monitor *NTPMonitor) prepareUpdateAnnotation(ntpEnable bool) error {
+	monitor.mtx.Lock()
+	defer monitor.mtx.Unlock()
+	if ntpEnable {
+		ntpSyncStatus := checkNTPSyncStatus()
+		monitor.updateAnnotationNTPStatus(ntpSyncStatus)
+		monitor.updateAnnotationNTPSource(getCurrentNTPSource(monitor.getNTPBackend()))
+	} else {
+		monitor.updateAnnotationNTPStatus(Disabled)
+		monitor.updateAnnotationNTPSource("", false)
+	}
+	err := monitor.updateAnnotation()
 	if err != nil {
-		logrus.Errorf("Marshal annotation value fail, skip this round NTP check: %+v", err)
+		logrus.Errorf("Update annotation failed with err: %v", err)
 		return err
 	}
-
-	nodeCpy := node.DeepCopy()
-	nodeCpy.Annotations[utils.AnnotationNTP] = string(bytes)
-	if !reflect.DeepEqual(node, nodeCpy) {
-		logrus.Infof("Try to update with Node: %s, annotation update: %+v", monitor.NodeName, annoValue)
-		if _, err := monitor.NodeClient.Update(nodeCpy); err != nil {
-			return err
-		}
+	if err := monitor.updateNodeConfigNTPStatus(); err != nil {
+		// the annotation is already updated, the status would be retried on next round
+		logrus.Warnf("Update NodeConfig NTP status failed with err: %v", err)
 	}
 	return nil
 }
 
-func (monitor *NTPMonitor) updateLatestNodeNTPAnnotation() error {
-	node, err := monitor.NodeClient.Get(monitor.NodeName, metav1.GetOptions{})
+func (monitor *NTPMonitor) updateNodeConfigNTPStatus() error {
+	nodecfg, err := monitor.NodeConfigCtl.Cache().Get(HarvesterNS, monitor.NodeName)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"node": monitor.NodeName,
-		}).Errorf("Failed to get node: %+v", err)
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
 		return err
 	}
 
-	if _, found := node.Annotations[utils.AnnotationNTP]; !found {
-		logrus.Debugf("Should not failure here, we only failed on first round!")
-		return fmt.Errorf("ntp annotation not found")
+	nodecfgCpy := nodecfg.DeepCopy()
+	ntpStatus := &nodeconfigv1.NTPStatus{
+		CurrentServer: monitor.NodeNTPAnnotation.CurrentNTPSource,
+		Authenticated: monitor.NodeNTPAnnotation.Authenticated,
 	}
-	annoNTPValue := node.Annotations[utils.AnnotationNTP]
-	var ntpValue NTPStatusAnnotation
-	if err := json.Unmarshal([]byte(annoNTPValue), &ntpValue); err != nil {
-		logrus.Errorf("Unmarshal annotation value failed. err: %v", err)
-		return err
+	if m := monitor.measurement; m != nil {
+		ntpStatus.Stratum = m.Stratum
+		ntpStatus.Offset = &metav1.Duration{Duration: m.Offset}
+		ntpStatus.Jitter = &metav1.Duration{Duration: m.Jitter}
+		ntpStatus.RootDistance = &metav1.Duration{Duration: m.RootDistance}
+		ntpStatus.LastMeasurementTime = &metav1.Time{Time: m.Time}
+	}
+	nodecfgCpy.Status.NTPStatus = ntpStatus
+	meta.SetStatusCondition(&nodecfgCpy.Status.Conditions, newNTPSynchronizedCondition(appliedNTPGeneration(nodecfg), monitor.NodeNTPAnnotation.NTPSyncStatus))
+	if !reflect.DeepEqual(nodecfg.Status, nodecfgCpy.Status) {
+		if _, err := monitor.NodeConfigCtl.UpdateStatus(nodecfgCpy); err != nil {
+			return err
+		}
 	}
-	logrus.Debugf("Current annotation value: %+v", ntpValue)
-
-	monitor.updateAnnotationNTPServers(ntpValue.CurrentNTPServers)
-	monitor.updateAnnotationNTPStatus(ntpValue.NTPSyncStatus)
-
 	return nil
 }
 
-func (monitor *NTPMonitor) prepareUpdateAnnotation(ntpEnable bool) error {
-	monitor.mtx.Lock()
-	defer monitor.mtx.Unlock()
-	if err := monitor.updateLatestNodeNTPAnnotation(); err != nil {
-		logrus.Errorf("Failed to update latest node NTP annotation with err: %v", err)
-		return err
+// appliedNTPGeneration returns the generation of the NTP config the controller
+// applied, the sync status belongs to that config rather than the latest spec.
+// It is 0 when the applied config is unknown, which leaves it out.
+func appliedNTPGeneration(nodecfg *nodeconfigv1.NodeConfig) int64 {
+	raw := nodecfg.Annotations[utils.AnnotationAppliedConfig]
+	if raw == "" {
+		return 0
+	}
+	applied := &nodeconfigv1.AppliedConfigAnnotation{}
+	if err := json.Unmarshal([]byte(raw), applied); err != nil {
+		logrus.Warnf("Unmarshal applied config from annotation failed, err: %v", err)
+		return 0
 	}
+	return applied.NTPGeneration
+}
 
-	if ntpEnable {
-		ntpSyncStatus := checkNTPSyncStatus()
-		monitor.updateAnnotationNTPStatus(ntpSyncStatus)
-	} else {
-		monitor.updateAnnotationNTPStatus(Disabled)
+func newNTPSynchronizedCondition(generation int64, syncStatus string) metav1.Condition {
+	cond := metav1.Condition{
+		Type:               string(nodeconfigv1.NTPSynchronized),
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: generation,
 	}
-	err := monitor.updateAnnotation()
-	if err != nil {
-		logrus.Errorf("Update annotation failed with err: %v", err)
-		return err
+	switch syncStatus {
+	case Synced:
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "NTPSynchronized"
+		cond.Message = "Clock is synchronized by NTP"
+	case Disabled:
+		cond.Reason = "NTPDisabled"
+		cond.Message = "NTP is disabled on the host"
+	default:
+		cond.Reason = "NTPUnsynchronized"
+		cond.Message = "Clock is not synchronized by NTP"
 	}
-	return nil
+	return cond
 }
 
 // updateAnnotation only called directly on the init, we need lock with other caller.
@@ -327,6 +501,7 @@ func (monitor *NTPMonitor) updateAnnotation() error {
 		ntpSyncStatus := checkNTPSyncStatus()
 		currentNtpServers := getNTPServersOnNode()
 		monitor.NodeNTPAnnotation = generateAnnotationValue(ntpSyncStatus, currentNtpServers)
+		monitor.updateAnnotationNTPSource(getCurrentNTPSource(monitor.getNTPBackend()))
 	}
 	return monitor.doAnnotationUpdate(monitor.NodeNTPAnnotation)
 }
@@ -335,8 +510,9 @@ func (monitor *NTPMonitor) updateAnnotationNTPStatus(status string) {
 	monitor.NodeNTPAnnotation.NTPSyncStatus = status
 }
 
-func (monitor *NTPMonitor) updateAnnotationNTPServers(servers string) {
-	monitor.NodeNTPAnnotation.CurrentNTPServers = servers
+func (monitor *NTPMonitor) updateAnnotationNTPSource(source string, authenticated bool) {
+	monitor.NodeNTPAnnotation.CurrentNTPSource = source
+	monitor.NodeNTPAnnotation.Authenticated = authenticated
 }
 
 func (monitor *NTPMonitor) postponeTheNTPSyncStatusPolling(message NTPMessage) {
@@ -357,3 +533,104 @@ func (monitor *NTPMonitor) postponeTheNTPSyncStatusPolling(message NTPMessage) {
 func nodeNTPAnnotationEmpty(anno *NTPStatusAnnotation) bool {
 	return anno.NTPSyncStatus == "" && anno.CurrentNTPServers == ""
 }
+
+// getTimesyncdMeasurement calculates the measurement from the NTPMessage of
+// systemd-timesyncd, all the timestamps and delays there are in microseconds.
+func getTimesyncdMeasurement(message NTPMessage) *ntpMeasurement {
+	if message.Ignored || message.OriginateTimestamp == 0 || message.DestinationTimestamp == 0 {
+		return nil
+	}
+
+	server, err := utils.GetTimesync1PropertiesServerName()
+	if err != nil {
+		logrus.Warnf("Get current timesyncd server failed with err: %v", err)
+	}
+	return newTimesyncdMeasurement(message, server)
+}
+
+// newTimesyncdMeasurement calculates the offset of the server clock relative
+// to the local clock as ((T2 - T1) + (T3 - T4)) / 2 of RFC 5905.
+func newTimesyncdMeasurement(message NTPMessage, server string) *ntpMeasurement {
+	//nolint:gosec
+	offset := ((int64(message.ReceiveTimestamp) - int64(message.OriginateTimestamp)) +
+		(int64(message.TransmitTimestamp) - int64(message.DestinationTimestamp))) / 2
+	return &ntpMeasurement{
+		Server:       server,
+		Stratum:      message.Stratum,
+		Offset:       time.Duration(offset) * time.Microsecond,
+		Jitter:       time.Duration(message.Jitter) * time.Microsecond,                             //nolint:gosec
+		RootDistance: time.Duration(message.RootDelay/2+message.RootDispersion) * time.Microsecond, //nolint:gosec
+		Time:         time.Unix(0, int64(message.DestinationTimestamp)*1000),                       //nolint:gosec
+	}
+}
+
+// getChronyMeasurement returns nil when chronyd is not synchronized to any
+// server yet
+func getChronyMeasurement() (*ntpMeasurement, error) {
+	tracking, err := utils.GetChronyTracking()
+	if err != nil {
+		return nil, err
+	}
+	return newChronyMeasurement(tracking, time.Now()), nil
+}
+
+func newChronyMeasurement(tracking *utils.ChronyTracking, now time.Time) *ntpMeasurement {
+	// the reference is unset, with stratum 0, until a source is selected
+	if tracking.Stratum == 0 {
+		return nil
+	}
+	seconds := func(s float64) time.Duration {
+		return time.Duration(s * float64(time.Second))
+	}
+	return &ntpMeasurement{
+		Server:  tracking.Address,
+		Stratum: tracking.Stratum,
+		// chrony reports the offset of the local clock, which is the opposite of the NTP one
+		Offset:       seconds(-tracking.LastOffset),
+		Jitter:       seconds(tracking.RMSOffset),
+		RootDistance: seconds(tracking.RootDelay/2 + tracking.RootDispersion),
+		Time:         now,
+	}
+}
+
+func (monitor *NTPMonitor) reportNTPMeasurement(measurement *ntpMeasurement) {
+	logrus.Debugf("NTP measurement: %+v", measurement)
+	monitor.mtx.Lock()
+	defer monitor.mtx.Unlock()
+	monitor.metricsTime = measurement.Time
+	metrics.NTPOffsetGV.WithLabelValues(monitor.NodeName).Set(measurement.Offset.Seconds())
+	metrics.NTPStratumGV.WithLabelValues(monitor.NodeName).Set(float64(measurement.Stratum))
+	metrics.NTPJitterGV.WithLabelValues(monitor.NodeName).Set(measurement.Jitter.Seconds())
+	metrics.NTPRootDistanceGV.WithLabelValues(monitor.NodeName).Set(measurement.RootDistance.Seconds())
+	metrics.NTPServerInfoGV.DeletePartialMatch(prometheus.Labels{"nodename": monitor.NodeName})
+	if measurement.Server != "" {
+		metrics.NTPServerInfoGV.WithLabelValues(monitor.NodeName, measurement.Server).Set(1)
+	}
+
+	if last := monitor.measurement; last != nil &&
+		last.Server == measurement.Server &&
+		last.Stratum == measurement.Stratum &&
+		measurement.Time.Sub(last.Time) < NTPStatusUpdateInterval {
+		return
+	}
+	monitor.measurement = measurement
+	if err := monitor.updateNodeConfigNTPStatus(); err != nil {
+		logrus.Warnf("Update NodeConfig NTP status failed with err: %v", err)
+	}
+}
+
+// expireNTPMetrics deletes the series of the node once the last measurement
+// is older than the expiry, so that the alerts do not fire on a stale value.
+func (monitor *NTPMonitor) expireNTPMetrics(now time.Time, expiry time.Duration) {
+	monitor.mtx.Lock()
+	defer monitor.mtx.Unlock()
+	if monitor.metricsTime.IsZero() || now.Sub(monitor.metricsTime) <= expiry {
+		return
+	}
+	logrus.Warnf("No NTP measurement since %s, delete the NTP metrics of the node", monitor.metricsTime.Format(time.RFC3339))
+	labels := prometheus.Labels{"nodename": monitor.NodeName}
+	for _, gv := range []*prometheus.GaugeVec{metrics.NTPOffsetGV, metrics.NTPStratumGV, metrics.NTPJitterGV, metrics.NTPRootDistanceGV, metrics.NTPServerInfoGV} {
+		gv.DeletePartialMatch(labels)
+	}
+	monitor.metricsTime = time.Time{}
+}
@@ -0,0 +1,210 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/metrics"
+	"github.com/harvester/node-manager/pkg/utils"
+)
+
+func TestNewTimesyncdMeasurement(t *testing.T) {
+	// the timestamps are in microseconds, the requests and responses take
+	// 100us each way unless the delay is asymmetric
+	tests := []struct {
+		name    string
+		message NTPMessage
+		offset  time.Duration
+	}{
+		{"server in sync", NTPMessage{
+			OriginateTimestamp: 1_000_000, ReceiveTimestamp: 1_000_100,
+			TransmitTimestamp: 1_000_110, DestinationTimestamp: 1_000_210,
+		}, 0},
+		{"server ahead", NTPMessage{
+			OriginateTimestamp: 1_000_000, ReceiveTimestamp: 1_000_600,
+			TransmitTimestamp: 1_000_610, DestinationTimestamp: 1_000_210,
+		}, 500 * time.Microsecond},
+		{"server behind", NTPMessage{
+			OriginateTimestamp: 1_000_000, ReceiveTimestamp: 999_600,
+			TransmitTimestamp: 999_610, DestinationTimestamp: 1_000_210,
+		}, -500 * time.Microsecond},
+		{"asymmetric delay", NTPMessage{
+			OriginateTimestamp: 1_000_000, ReceiveTimestamp: 1_000_300,
+			TransmitTimestamp: 1_000_310, DestinationTimestamp: 1_000_410,
+		}, 100 * time.Microsecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.message.Stratum = 2
+			tt.message.Jitter = 250
+			tt.message.RootDelay = 2000
+			tt.message.RootDispersion = 500
+			m := newTimesyncdMeasurement(tt.message, "0.suse.pool.ntp.org")
+			assert.Equal(t, tt.offset, m.Offset)
+			assert.Equal(t, "0.suse.pool.ntp.org", m.Server)
+			assert.Equal(t, uint32(2), m.Stratum)
+			assert.Equal(t, 250*time.Microsecond, m.Jitter)
+			assert.Equal(t, 1500*time.Microsecond, m.RootDistance)
+			assert.Equal(t, time.UnixMicro(int64(tt.message.DestinationTimestamp)), m.Time)
+		})
+	}
+
+	// the ignored and the incomplete messages are no measurements
+	assert.Nil(t, getTimesyncdMeasurement(NTPMessage{Ignored: true, OriginateTimestamp: 1, DestinationTimestamp: 1}))
+	assert.Nil(t, getTimesyncdMeasurement(NTPMessage{DestinationTimestamp: 1}))
+}
+
+func TestChronyTracking(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		output      string
+		measurement *ntpMeasurement
+		wantErr     bool
+	}{
+		{"synchronized",
+			"A29FC801,162.159.200.1,3,1760832000.123456789,-0.000012000,0.000250000,0.000100000,-4.484,-0.000,0.020,0.004000000,0.001000000,1031.9,Normal\n",
+			&ntpMeasurement{
+				Server:       "162.159.200.1",
+				Stratum:      3,
+				Offset:       -250 * time.Microsecond,
+				Jitter:       100 * time.Microsecond,
+				RootDistance: 3 * time.Millisecond,
+				Time:         now,
+			}, false},
+		{"local clock behind",
+			"A29FC801,162.159.200.1,3,1760832000.123456789,0.000012000,-0.001500000,0.000100000,-4.484,-0.000,0.020,0.004000000,0.001000000,1031.9,Normal\n",
+			&ntpMeasurement{
+				Server:       "162.159.200.1",
+				Stratum:      3,
+				Offset:       1500 * time.Microsecond,
+				Jitter:       100 * time.Microsecond,
+				RootDistance: 3 * time.Millisecond,
+				Time:         now,
+			}, false},
+		{"not synchronized",
+			"00000000,,0,0.000000000,0.000000000,0.000000000,0.000000000,0.000,0.000,0.000,1.000000000,1.000000000,0.0,Not synchronised\n",
+			nil, false},
+		{"truncated", "A29FC801,162.159.200.1,3\n", nil, true},
+		{"invalid offset",
+			"A29FC801,162.159.200.1,3,1760832000.123456789,0.0,offset,0.0,-4.484,-0.000,0.020,0.0,0.0,1031.9,Normal\n",
+			nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracking, err := utils.ParseChronyTracking(tt.output)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			m := newChronyMeasurement(tracking, now)
+			if tt.measurement == nil {
+				assert.Nil(t, m)
+				return
+			}
+			require.NotNil(t, m)
+			assert.Equal(t, tt.measurement.Server, m.Server)
+			assert.Equal(t, tt.measurement.Stratum, m.Stratum)
+			assert.InDelta(t, tt.measurement.Offset, m.Offset, float64(time.Nanosecond))
+			assert.InDelta(t, tt.measurement.Jitter, m.Jitter, float64(time.Nanosecond))
+			assert.InDelta(t, tt.measurement.RootDistance, m.RootDistance, float64(time.Nanosecond))
+			assert.Equal(t, now, m.Time)
+		})
+	}
+}
+
+func TestChronyCurrentSource(t *testing.T) {
+	sources := `^,-,10.0.0.1,2,6,377,12,0.000123000,0.000123000,0.000500000
+^,*,162.159.200.1,3,6,377,33,-0.000012000,-0.000011000,0.012345000
+^,?,time.example.com,0,6,0,-,0.000000000,0.000000000,0.000000000
+`
+	tests := []struct {
+		name          string
+		sources       string
+		authData      string
+		current       string
+		authenticated bool
+	}{
+		{"NTS source", sources,
+			"162.159.200.1,NTS,1,15,256,33,0,0,8,100\n10.0.0.1,-,0,0,0,0,0,0,0,0\n",
+			"162.159.200.1", true},
+		{"NTS source without keys", sources,
+			"162.159.200.1,NTS,0,0,0,33,5,1,0,0\n",
+			"162.159.200.1", false},
+		{"plain source", sources,
+			"162.159.200.1,-,0,0,0,0,0,0,0,0\n",
+			"162.159.200.1", false},
+		{"no selected source",
+			"^,?,10.0.0.1,0,6,0,-,0.000000000,0.000000000,0.000000000\n",
+			"", "", false},
+		{"no sources", "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := utils.ParseChronySources(tt.sources)
+			require.Nil(t, err)
+			authData, err := utils.ParseChronyAuthData(tt.authData)
+			require.Nil(t, err)
+			current := selectedChronySource(parsed)
+			assert.Equal(t, tt.current, current)
+			assert.Equal(t, tt.authenticated, chronySourceAuthenticated(authData, current))
+		})
+	}
+}
+
+func countSeries(collector prometheus.Collector) int {
+	ch := make(chan prometheus.Metric, 16)
+	collector.Collect(ch)
+	close(ch)
+	return len(ch)
+}
+
+func TestExpireNTPMetrics(t *testing.T) {
+	now := time.Now()
+	monitor := &NTPMonitor{NodeName: "expire-node", metricsTime: now.Add(-time.Minute)}
+	metrics.NTPOffsetGV.WithLabelValues(monitor.NodeName).Set(0.001)
+	metrics.NTPServerInfoGV.WithLabelValues(monitor.NodeName, "162.159.200.1").Set(1)
+	t.Cleanup(func() {
+		metrics.NTPOffsetGV.Reset()
+		metrics.NTPServerInfoGV.Reset()
+	})
+
+	// the series are kept until the measurement expires
+	monitor.expireNTPMetrics(now, ChronyMeasurementExpiry)
+	assert.Equal(t, 1, countSeries(metrics.NTPOffsetGV))
+	assert.Equal(t, 1, countSeries(metrics.NTPServerInfoGV))
+
+	monitor.expireNTPMetrics(now.Add(ChronyMeasurementExpiry), ChronyMeasurementExpiry)
+	assert.Equal(t, 0, countSeries(metrics.NTPOffsetGV))
+	assert.Equal(t, 0, countSeries(metrics.NTPServerInfoGV))
+	assert.True(t, monitor.metricsTime.IsZero())
+}
+
+func TestNTPSynchronizedConditionGeneration(t *testing.T) {
+	nodecfg := &nodeconfigv1.NodeConfig{}
+	nodecfg.Generation = 3
+
+	// nothing applied yet, the generation is left out
+	assert.Equal(t, int64(0), newNTPSynchronizedCondition(appliedNTPGeneration(nodecfg), Synced).ObservedGeneration)
+
+	// the spec is updated to generation 3 but the controller applied 2
+	nodecfg.Annotations = map[string]string{
+		utils.AnnotationAppliedConfig: `{"ntpServers":"0.suse.pool.ntp.org","ntpGeneration":2}`,
+	}
+	cond := newNTPSynchronizedCondition(appliedNTPGeneration(nodecfg), Synced)
+	assert.Equal(t, int64(2), cond.ObservedGeneration)
+	assert.Equal(t, metav1.ConditionTrue, cond.Status)
+
+	nodecfg.Annotations[utils.AnnotationAppliedConfig] = "invalid"
+	assert.Equal(t, int64(0), appliedNTPGeneration(nodecfg))
+}
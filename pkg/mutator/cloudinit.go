@@ -3,6 +3,7 @@ package mutator
 import (
 	"fmt"
 	"path/filepath"
+	"reflect"
 
 	"github.com/harvester/webhook/pkg/server/admission"
 	admissionregv1 "k8s.io/api/admissionregistration/v1"
@@ -19,14 +20,24 @@ func NewCloudInitMutator() *CloudInit {
 	return &CloudInit{}
 }
 
-func (m *CloudInit) Create(_ *admission.Request, newObj runtime.Object) (admission.Patch, error) {
+func (m *CloudInit) Create(req *admission.Request, newObj runtime.Object) (admission.Patch, error) {
 	newCloudInit := newObj.(*v1beta1.CloudInit)
-	return patchFilenameIfNecessary(newCloudInit)
+	patch, err := patchFilenameIfNecessary(newCloudInit)
+	if err != nil {
+		return nil, err
+	}
+	return append(patch, requesterPatch(req, nil, newCloudInit, true)...), nil
 }
 
-func (m *CloudInit) Update(_ *admission.Request, _ runtime.Object, newObj runtime.Object) (admission.Patch, error) {
+func (m *CloudInit) Update(req *admission.Request, oldObj runtime.Object, newObj runtime.Object) (admission.Patch, error) {
+	oldCloudInit := oldObj.(*v1beta1.CloudInit)
 	newCloudInit := newObj.(*v1beta1.CloudInit)
-	return patchFilenameIfNecessary(newCloudInit)
+	patch, err := patchFilenameIfNecessary(newCloudInit)
+	if err != nil {
+		return nil, err
+	}
+	specChanged := !reflect.DeepEqual(oldCloudInit.Spec, newCloudInit.Spec)
+	return append(patch, requesterPatch(req, oldCloudInit, newCloudInit, specChanged)...), nil
 }
 
 func patchFilenameIfNecessary(newCloudInit *v1beta1.CloudInit) (admission.Patch, error) {
@@ -8,6 +8,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/audit"
 )
 
 func TestCreate(t *testing.T) {
@@ -35,7 +36,8 @@ func TestCreate(t *testing.T) {
 			m := NewCloudInitMutator()
 			cloudinit := &v1beta1.CloudInit{
 				ObjectMeta: metav1.ObjectMeta{
-					Name: "test",
+					Name:        "test",
+					Annotations: map[string]string{audit.AnnotationRequester: "admin"},
 				},
 				Spec: v1beta1.CloudInitSpec{
 					MatchSelector: map[string]string{},
@@ -43,7 +45,7 @@ func TestCreate(t *testing.T) {
 					Contents:      "hello, world",
 				},
 			}
-			got, err := m.Create(new(admission.Request), cloudinit)
+			got, err := m.Create(newRequest("admin"), cloudinit)
 			if err != nil {
 				t.Errorf("want err=<nil>, got err=%v", err)
 			}
@@ -81,7 +83,8 @@ func TestUpdate(t *testing.T) {
 
 			cloudinit := &v1beta1.CloudInit{
 				ObjectMeta: metav1.ObjectMeta{
-					Name: "test",
+					Name:        "test",
+					Annotations: map[string]string{audit.AnnotationRequester: "admin"},
 				},
 				Spec: v1beta1.CloudInitSpec{
 					MatchSelector: map[string]string{},
@@ -101,7 +104,7 @@ func TestUpdate(t *testing.T) {
 				},
 			}
 
-			got, err := m.Update(new(admission.Request), old, cloudinit)
+			got, err := m.Update(newRequest("admin"), old, cloudinit)
 			if err != nil {
 				t.Errorf("want err=<nil>, got err=%v", err)
 			}
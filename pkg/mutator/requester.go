@@ -0,0 +1,101 @@
+package mutator
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/harvester/webhook/pkg/server/admission"
+	admissionregv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/audit"
+)
+
+// requesterPatch records the user of the request as the requester of the
+// object when it is created or its spec is changed, the audit log reports it
+// as the user of the change. Otherwise the requester is kept as it was, so
+// the updates of the controllers do not take it over.
+func requesterPatch(req *admission.Request, oldObj, newObj metav1.Object, specChanged bool) admission.Patch {
+	var requester string
+	if oldObj == nil || specChanged {
+		requester = req.Username()
+	} else {
+		requester = oldObj.GetAnnotations()[audit.AnnotationRequester]
+	}
+
+	annotations := newObj.GetAnnotations()
+	current, found := annotations[audit.AnnotationRequester]
+	switch {
+	case current == requester && (found || requester == ""):
+		return nil
+	case requester == "":
+		return admission.Patch{{Op: admission.PatchOpRemove, Path: requesterPath()}}
+	case annotations == nil:
+		return admission.Patch{{Op: admission.PatchOpAdd, Path: "/metadata/annotations", Value: map[string]string{audit.AnnotationRequester: requester}}}
+	default:
+		return admission.Patch{{Op: admission.PatchOpAdd, Path: requesterPath(), Value: requester}}
+	}
+}
+
+// requesterPath escapes the annotation as a JSON pointer
+func requesterPath() string {
+	return "/metadata/annotations/" + strings.ReplaceAll(audit.AnnotationRequester, "/", "~1")
+}
+
+// Requester records the requester of the objects which are recorded in the
+// audit log by their spec, the CloudInits record it in their own mutator.
+type Requester struct {
+	admission.DefaultMutator
+	resource admission.Resource
+	spec     func(runtime.Object) any
+}
+
+func NewNodeConfigRequesterMutator() *Requester {
+	return &Requester{
+		resource: requesterResource(v1beta1.NodeConfigResourceName, admissionregv1.NamespacedScope, &v1beta1.NodeConfig{}),
+		spec:     func(obj runtime.Object) any { return obj.(*v1beta1.NodeConfig).Spec },
+	}
+}
+
+func NewKsmtunedRequesterMutator() *Requester {
+	return &Requester{
+		resource: requesterResource(v1beta1.KsmtunedResourceName, admissionregv1.ClusterScope, &v1beta1.Ksmtuned{}),
+		spec:     func(obj runtime.Object) any { return obj.(*v1beta1.Ksmtuned).Spec },
+	}
+}
+
+func NewHugepageRequesterMutator() *Requester {
+	return &Requester{
+		resource: requesterResource(v1beta1.HugepageResourceName, admissionregv1.ClusterScope, &v1beta1.Hugepage{}),
+		spec:     func(obj runtime.Object) any { return obj.(*v1beta1.Hugepage).Spec },
+	}
+}
+
+func (m *Requester) Create(req *admission.Request, newObj runtime.Object) (admission.Patch, error) {
+	return requesterPatch(req, nil, newObj.(metav1.Object), true), nil
+}
+
+func (m *Requester) Update(req *admission.Request, oldObj runtime.Object, newObj runtime.Object) (admission.Patch, error) {
+	specChanged := !reflect.DeepEqual(m.spec(oldObj), m.spec(newObj))
+	return requesterPatch(req, oldObj.(metav1.Object), newObj.(metav1.Object), specChanged), nil
+}
+
+func (m *Requester) Resource() admission.Resource {
+	return m.resource
+}
+
+func requesterResource(name string, scope admissionregv1.ScopeType, objectType runtime.Object) admission.Resource {
+	return admission.Resource{
+		Names:      []string{name},
+		Scope:      scope,
+		APIGroup:   v1beta1.SchemeGroupVersion.Group,
+		APIVersion: v1beta1.SchemeGroupVersion.Version,
+		ObjectType: objectType,
+		OperationTypes: []admissionregv1.OperationType{
+			admissionregv1.Create,
+			admissionregv1.Update,
+		},
+	}
+}
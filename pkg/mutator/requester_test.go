@@ -0,0 +1,60 @@
+package mutator
+
+import (
+	"testing"
+
+	"github.com/harvester/webhook/pkg/server/admission"
+	"github.com/rancher/wrangler/v3/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+	"github.com/harvester/node-manager/pkg/audit"
+)
+
+func newRequest(username string) *admission.Request {
+	return admission.NewRequest(&webhook.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{UserInfo: authenticationv1.UserInfo{Username: username}},
+	}, nil)
+}
+
+func TestRequester(t *testing.T) {
+	m := NewNodeConfigRequesterMutator()
+	newNodeConfig := func(requester, timezone string) *v1beta1.NodeConfig {
+		nodecfg := &v1beta1.NodeConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: "node1", Namespace: "harvester-system"},
+			Spec:       v1beta1.NodeConfigSpec{Timezone: timezone},
+		}
+		if requester != "" {
+			nodecfg.Annotations = map[string]string{audit.AnnotationRequester: requester}
+		}
+		return nodecfg
+	}
+	path := "/metadata/annotations/node.harvesterhci.io~1requester"
+
+	// the creator is recorded
+	patch, err := m.Create(newRequest("admin"), newNodeConfig("", "UTC"))
+	require.NoError(t, err)
+	assert.Equal(t, admission.Patch{{Op: admission.PatchOpAdd, Path: "/metadata/annotations", Value: map[string]string{audit.AnnotationRequester: "admin"}}}, patch)
+
+	// the user changing the spec is recorded
+	patch, err = m.Update(newRequest("alice"), newNodeConfig("admin", "UTC"), newNodeConfig("admin", "Asia/Taipei"))
+	require.NoError(t, err)
+	assert.Equal(t, admission.Patch{{Op: admission.PatchOpAdd, Path: path, Value: "alice"}}, patch)
+
+	// the updates of the controllers keep the requester
+	patch, err = m.Update(newRequest("system:serviceaccount:harvester-system:harvester-node-manager"), newNodeConfig("alice", "UTC"), newNodeConfig("alice", "UTC"))
+	require.NoError(t, err)
+	assert.Nil(t, patch)
+
+	// and it could not be changed without changing the spec
+	patch, err = m.Update(newRequest("bob"), newNodeConfig("alice", "UTC"), newNodeConfig("admin", "UTC"))
+	require.NoError(t, err)
+	assert.Equal(t, admission.Patch{{Op: admission.PatchOpAdd, Path: path, Value: "alice"}}, patch)
+	patch, err = m.Update(newRequest("bob"), newNodeConfig("", "UTC"), newNodeConfig("admin", "UTC"))
+	require.NoError(t, err)
+	assert.Equal(t, admission.Patch{{Op: admission.PatchOpRemove, Path: path}}, patch)
+}
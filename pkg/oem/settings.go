@@ -0,0 +1,578 @@
+// Package oem manages the Elemental OEM settings files, e.g.
+// `/oem/99_settings.yaml`, which are applied by yip on every boot.
+package oem
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/sirupsen/logrus"
+	"go.yaml.in/yaml/v4"
+)
+
+const (
+	settingsName  = "oem_settings"
+	settingsPerms = 0644
+	stateSuffix   = ".state"
+)
+
+var (
+	ErrInvalidStage = errors.New("invalid yip stage")
+	ErrStageOwned   = errors.New("stage is owned by another owner")
+	ErrFileOwned    = errors.New("file is owned by another owner")
+
+	// locks serialize the stores of the same file in the process
+	locks sync.Map
+
+	yipStages = []string{
+		"rootfs",
+		"initramfs",
+		"boot",
+		"fs",
+		"network",
+		"reconcile",
+		"post-install",
+		"after-install-chroot",
+		"after-install",
+		"post-upgrade",
+		"after-upgrade-chroot",
+		"after-upgrade",
+		"post-reset",
+		"after-reset-chroot",
+		"after-reset",
+		"before-install",
+		"before-upgrade",
+		"before-reset",
+	}
+)
+
+// Store owns the stages of an OEM settings file on behalf of multiple owners.
+// Every stage is identified by its yip stage and name, and could only be
+// changed by the owner which wrote it first. The stages which are not written
+// through a store are kept as they are.
+//
+// A file which is not made of stages, e.g. a cloud-init file, is written as a
+// whole by a single owner instead.
+//
+// The owners and the checksum of the file last written are kept in a state
+// file next to it, so edits made by anything else are detected. The file is
+// replaced atomically, and the previous versions are kept as `<backup>`,
+// `<backup>.1`, ... up to history versions.
+type Store struct {
+	path       string
+	backupPath string
+	history    int
+	// adopted are the owners whose stages are taken over by the next owner
+	// writing them, e.g. an owner which is split into several
+	adopted []string
+}
+
+func NewStore(path, backupPath string, history int) *Store {
+	return &Store{
+		path:       path,
+		backupPath: backupPath,
+		history:    max(history, 1),
+	}
+}
+
+// Adopt lets the stages of the owners be taken over by the next owner writing
+// them, instead of failing with ErrStageOwned
+func (s *Store) Adopt(owners ...string) *Store {
+	s.adopted = append(s.adopted, owners...)
+	return s
+}
+
+type ChangeOp string
+
+const (
+	ChangeAdd    ChangeOp = "add"
+	ChangeUpdate ChangeOp = "update"
+	ChangeRemove ChangeOp = "remove"
+)
+
+// Change is a stage which is added, updated or removed, Before and After are
+// the YAML of the stage. The stage is empty for the change of a whole file,
+// Before and After are the file content then.
+type Change struct {
+	Op     ChangeOp
+	Stage  string
+	Name   string
+	Before string
+	After  string
+}
+
+func (c Change) String() string {
+	if c.Stage == "" {
+		return fmt.Sprintf("%s %s", c.Op, c.Name)
+	}
+	return fmt.Sprintf("%s %s/%s", c.Op, c.Stage, c.Name)
+}
+
+// Result is the outcome of an update
+type Result struct {
+	Changes []Change
+	// ForeignEdit is set when the file was changed by anything else since it
+	// was last written by a store, the edited file is backed up before it is
+	// overwritten.
+	ForeignEdit bool
+}
+
+// Tx collects the changes of an owner to the stages
+type Tx struct {
+	owner   string
+	adopted []string
+	config  *schema.YipConfig
+	state   *storeState
+}
+
+type storeState struct {
+	// Checksum is the sha256 of the file last written, empty when the file
+	// was removed
+	Checksum string `json:"checksum"`
+	// Owners maps `<stage>/<name>` to the owner of the stage
+	Owners map[string]string `json:"owners"`
+	// FileOwner is the owner of the file written as a whole
+	FileOwner string `json:"fileOwner,omitempty"`
+}
+
+func stageKey(stage, name string) string {
+	return stage + "/" + name
+}
+
+// Put adds or replaces the named stage of the yip stage
+func (tx *Tx) Put(stage string, s schema.Stage) error {
+	if !slices.Contains(yipStages, stage) {
+		return fmt.Errorf("%w: %q", ErrInvalidStage, stage)
+	}
+	if err := tx.own(stage, s.Name); err != nil {
+		return err
+	}
+	if tx.config.Stages == nil {
+		tx.config.Stages = make(map[string][]schema.Stage)
+	}
+	stages := tx.config.Stages[stage]
+	if pos := slices.IndexFunc(stages, func(existing schema.Stage) bool { return existing.Name == s.Name }); pos >= 0 {
+		stages[pos] = s
+	} else {
+		tx.config.Stages[stage] = append(stages, s)
+	}
+	return nil
+}
+
+// Delete removes the named stage of the yip stage, it is not an error when the
+// stage does not exist.
+func (tx *Tx) Delete(stage, name string) error {
+	if err := tx.own(stage, name); err != nil {
+		return err
+	}
+	stages := slices.DeleteFunc(tx.config.Stages[stage], func(existing schema.Stage) bool { return existing.Name == name })
+	if len(stages) == 0 {
+		delete(tx.config.Stages, stage)
+	} else {
+		tx.config.Stages[stage] = stages
+	}
+	delete(tx.state.Owners, stageKey(stage, name))
+	return nil
+}
+
+// Stages returns the stages of the yip stage as they are in the transaction
+func (tx *Tx) Stages(stage string) []schema.Stage {
+	return slices.Clone(tx.config.Stages[stage])
+}
+
+// own takes the ownership of the stage, the stages without an owner, e.g. the
+// ones written before the store was used, are adopted.
+func (tx *Tx) own(stage, name string) error {
+	key := stageKey(stage, name)
+	if owner, found := tx.state.Owners[key]; found && owner != tx.owner && !slices.Contains(tx.adopted, owner) {
+		return fmt.Errorf("%w %s: %s", ErrStageOwned, owner, key)
+	}
+	tx.state.Owners[key] = tx.owner
+	return nil
+}
+
+// Update runs fn on the stages of the file, then writes the changes made by
+// it. Nothing is written when fn fails.
+func (s *Store) Update(owner string, fn func(tx *Tx) error) (*Result, error) {
+	return s.update(owner, fn, false)
+}
+
+// Plan runs fn on the stages of the file like Update, and returns the changes
+// it would make without writing them.
+func (s *Store) Plan(owner string, fn func(tx *Tx) error) (*Result, error) {
+	return s.update(owner, fn, true)
+}
+
+func (s *Store) update(owner string, fn func(tx *Tx) error, dryRun bool) (*Result, error) {
+	lock, _ := locks.LoadOrStore(s.path, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	current, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read %s failed: %v", s.path, err)
+	}
+	exists := err == nil
+	state, found, err := s.loadState()
+	if err != nil {
+		return nil, err
+	}
+	if state.FileOwner != "" {
+		return nil, fmt.Errorf("%w %s: %s", ErrFileOwned, state.FileOwner, s.path)
+	}
+
+	before := &schema.YipConfig{Name: settingsName}
+	if exists {
+		if err := yaml.Unmarshal(current, before); err != nil {
+			return nil, fmt.Errorf("unmarshal %s failed: %v", s.path, err)
+		}
+	}
+	// without a state, the file is never written by a store
+	result := &Result{
+		ForeignEdit: found && checksum(current, exists) != state.Checksum,
+	}
+	if result.ForeignEdit {
+		logrus.Warnf("%s is changed since it was last written by node-manager", s.path)
+	}
+	savedOwners := maps.Clone(state.Owners)
+	pruneOwners(state, before)
+
+	tx := &Tx{owner: owner, adopted: s.adopted, config: cloneConfig(before), state: state}
+	if err := fn(tx); err != nil {
+		return nil, err
+	}
+	if result.Changes, err = diffStages(before, tx.config); err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	if len(result.Changes) > 0 {
+		logrus.Infof("Update %s: %v", s.path, result.Changes)
+		if exists {
+			if err := s.backup(current); err != nil {
+				return nil, err
+			}
+		}
+		if len(tx.config.Stages) == 0 {
+			if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("remove %s failed: %v", s.path, err)
+			}
+			return result, s.saveState(&storeState{})
+		}
+		data, err := yaml.Marshal(tx.config)
+		if err != nil {
+			return nil, fmt.Errorf("marshal %s failed: %v", s.path, err)
+		}
+		if err := writeFileAtomic(s.path, data, settingsPerms); err != nil {
+			return nil, err
+		}
+		current, exists = data, true
+	} else if !result.ForeignEdit && maps.Equal(savedOwners, state.Owners) {
+		return result, nil
+	}
+
+	// the foreign edit is only reported once, it is accepted as the new base
+	state.Checksum = checksum(current, exists)
+	return result, s.saveState(state)
+}
+
+// Write replaces the whole file with data on behalf of the owner, the file is
+// owned by the owner until it is removed. The file written before the store
+// was used is adopted.
+func (s *Store) Write(owner string, data []byte) (*Result, error) {
+	return s.replace(owner, data, false, false)
+}
+
+// PlanWrite returns the change Write would make without writing it
+func (s *Store) PlanWrite(owner string, data []byte) (*Result, error) {
+	return s.replace(owner, data, false, true)
+}
+
+// Remove removes the file written by the owner, it is not an error when the
+// file does not exist.
+func (s *Store) Remove(owner string) (*Result, error) {
+	return s.replace(owner, nil, true, false)
+}
+
+func (s *Store) replace(owner string, data []byte, remove, dryRun bool) (*Result, error) {
+	lock, _ := locks.LoadOrStore(s.path, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	current, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read %s failed: %v", s.path, err)
+	}
+	exists := err == nil
+	state, found, err := s.loadState()
+	if err != nil {
+		return nil, err
+	}
+	if state.FileOwner != "" && state.FileOwner != owner && !slices.Contains(s.adopted, state.FileOwner) {
+		return nil, fmt.Errorf("%w %s: %s", ErrFileOwned, state.FileOwner, s.path)
+	}
+	if len(state.Owners) > 0 {
+		return nil, fmt.Errorf("%w: %s has owned stages", ErrStageOwned, s.path)
+	}
+
+	result := &Result{
+		ForeignEdit: found && checksum(current, exists) != state.Checksum,
+	}
+	if result.ForeignEdit {
+		logrus.Warnf("%s is changed since it was last written by node-manager", s.path)
+	}
+	change := Change{Name: filepath.Base(s.path), Before: string(current), After: string(data)}
+	switch {
+	case remove && exists:
+		change.Op = ChangeRemove
+	case remove:
+	case !exists:
+		change.Op = ChangeAdd
+	case !bytes.Equal(current, data):
+		change.Op = ChangeUpdate
+	}
+	if change.Op != "" {
+		result.Changes = []Change{change}
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	if remove {
+		if exists {
+			logrus.Infof("Remove %s", s.path)
+			if err := s.backup(current); err != nil {
+				return nil, err
+			}
+			if err := os.Remove(s.path); err != nil {
+				return nil, fmt.Errorf("remove %s failed: %v", s.path, err)
+			}
+		}
+		return result, s.saveState(&storeState{})
+	}
+	if change.Op != "" {
+		logrus.Infof("Update %s: %v", s.path, change)
+		if exists {
+			if err := s.backup(current); err != nil {
+				return nil, err
+			}
+		}
+		if err := writeFileAtomic(s.path, data, settingsPerms); err != nil {
+			return nil, err
+		}
+	} else if !result.ForeignEdit && state.FileOwner == owner {
+		return result, nil
+	}
+	state.FileOwner = owner
+	state.Checksum = checksum(data, true)
+	return result, s.saveState(state)
+}
+
+// Owners returns the owners of the named stages of the yip stage
+func (s *Store) Owners(stage string) (map[string]string, error) {
+	state, _, err := s.loadState()
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string]string)
+	for key, owner := range state.Owners {
+		if yipStage, name, _ := strings.Cut(key, "/"); yipStage == stage {
+			owners[name] = owner
+		}
+	}
+	return owners, nil
+}
+
+// Stages returns the stages of the file
+func (s *Store) Stages() (map[string][]schema.Stage, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read %s failed: %v", s.path, err)
+	}
+	config := &schema.YipConfig{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("unmarshal %s failed: %v", s.path, err)
+	}
+	return config.Stages, nil
+}
+
+func checksum(data []byte, exists bool) string {
+	if !exists {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// pruneOwners drops the owners of the stages which were removed from the file
+// by anything else
+func pruneOwners(state *storeState, config *schema.YipConfig) {
+	for key := range state.Owners {
+		stage, name, _ := strings.Cut(key, "/")
+		if !slices.ContainsFunc(config.Stages[stage], func(s schema.Stage) bool { return s.Name == name }) {
+			delete(state.Owners, key)
+		}
+	}
+}
+
+func cloneConfig(config *schema.YipConfig) *schema.YipConfig {
+	clone := *config
+	clone.Stages = make(map[string][]schema.Stage, len(config.Stages))
+	for stage, stages := range config.Stages {
+		clone.Stages[stage] = slices.Clone(stages)
+	}
+	return &clone
+}
+
+// diffStages compares the stages by their YAML, the changes are sorted by the
+// yip stage and then the name.
+func diffStages(before, after *schema.YipConfig) ([]Change, error) {
+	type stageYAML map[string]string
+	render := func(config *schema.YipConfig) (stageYAML, error) {
+		rendered := make(stageYAML)
+		for stage, stages := range config.Stages {
+			for _, s := range stages {
+				data, err := yaml.Marshal(s)
+				if err != nil {
+					return nil, fmt.Errorf("marshal stage %s failed: %v", s.Name, err)
+				}
+				rendered[stageKey(stage, s.Name)] = string(data)
+			}
+		}
+		return rendered, nil
+	}
+	old, err := render(before)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := render(after)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	for key, data := range cur {
+		stage, name, _ := strings.Cut(key, "/")
+		switch previous, found := old[key]; {
+		case !found:
+			changes = append(changes, Change{Op: ChangeAdd, Stage: stage, Name: name, After: data})
+		case previous != data:
+			changes = append(changes, Change{Op: ChangeUpdate, Stage: stage, Name: name, Before: previous, After: data})
+		}
+	}
+	for key, data := range old {
+		if _, found := cur[key]; !found {
+			stage, name, _ := strings.Cut(key, "/")
+			changes = append(changes, Change{Op: ChangeRemove, Stage: stage, Name: name, Before: data})
+		}
+	}
+	slices.SortFunc(changes, func(a, b Change) int {
+		return strings.Compare(stageKey(a.Stage, a.Name), stageKey(b.Stage, b.Name))
+	})
+	return changes, nil
+}
+
+// loadState returns the state of the file, and whether it is found
+func (s *Store) loadState() (*storeState, bool, error) {
+	state := &storeState{}
+	data, err := os.ReadFile(s.path + stateSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, fmt.Errorf("read %s failed: %v", s.path+stateSuffix, err)
+	}
+	found := err == nil
+	if found {
+		if err := json.Unmarshal(data, state); err != nil {
+			logrus.Warnf("Unmarshal %s failed, assume that is empty. err: %v", s.path+stateSuffix, err)
+			state = &storeState{}
+		}
+	}
+	if state.Owners == nil {
+		state.Owners = make(map[string]string)
+	}
+	return state, found, nil
+}
+
+func (s *Store) saveState(state *storeState) error {
+	if state.Checksum == "" && len(state.Owners) == 0 && state.FileOwner == "" {
+		if err := os.Remove(s.path + stateSuffix); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s failed: %v", s.path+stateSuffix, err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("marshal %s failed: %v", s.path+stateSuffix, err)
+	}
+	return writeFileAtomic(s.path+stateSuffix, data, settingsPerms)
+}
+
+// backup rotates the backups, the newest one is always backupPath
+func (s *Store) backup(data []byte) error {
+	if existing, err := os.ReadFile(s.backupPath); err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+	for i := s.history - 1; i >= 1; i-- {
+		src := s.backupPath
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", s.backupPath, i-1)
+		}
+		if err := os.Rename(src, fmt.Sprintf("%s.%d", s.backupPath, i)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("rotate backup %s failed: %v", src, err)
+		}
+	}
+	return writeFileAtomic(s.backupPath, data, settingsPerms)
+}
+
+// writeFileAtomic replaces the file with a fully synced temp file, then syncs
+// the directory, so either the old or the new file is found after a crash.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("create temp file for %s failed: %v", path, err)
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close() //nolint:errcheck
+		return fmt.Errorf("write temp file for %s failed: %v", path, err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close() //nolint:errcheck
+		return fmt.Errorf("chmod temp file for %s failed: %v", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close() //nolint:errcheck
+		return fmt.Errorf("sync temp file for %s failed: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file for %s failed: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename temp file to %s failed: %v", path, err)
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open %s failed: %v", dir, err)
+	}
+	defer d.Close() //nolint:errcheck
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync %s failed: %v", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package oem
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/mudler/yip/pkg/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func put(stage string, s schema.Stage) func(tx *Tx) error {
+	return func(tx *Tx) error {
+		return tx.Put(stage, s)
+	}
+}
+
+func TestStoreOwners(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := tmpDir + "/99_settings.yaml"
+	store := NewStore(path, path+".bak", 3)
+
+	sysctl := schema.Stage{Name: "Runtime Sysctl", Commands: []string{"sysctl --system"}}
+	result, err := store.Update("nodeconfig", put("initramfs", sysctl))
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{{Op: ChangeAdd, Stage: "initramfs", Name: "Runtime Sysctl", After: "commands:\n    - sysctl --system\nname: Runtime Sysctl\n"}}, result.Changes)
+	assert.False(t, result.ForeignEdit)
+	// nothing to back up for a new file
+	_, err = os.Stat(path + ".bak")
+	assert.True(t, os.IsNotExist(err))
+
+	// stages of the other owners are kept
+	ksm := schema.Stage{Name: "Runtime KSM", Commands: []string{"echo 1 > /sys/kernel/mm/ksm/run"}}
+	_, err = store.Update("ksmtuned", put("boot", ksm))
+	assert.Nil(t, err)
+	stages, err := store.Stages()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]schema.Stage{"initramfs": {sysctl}, "boot": {ksm}}, stages)
+
+	// the stage could not be changed by the other owners
+	_, err = store.Update("ksmtuned", put("initramfs", schema.Stage{Name: "Runtime Sysctl"}))
+	assert.True(t, errors.Is(err, ErrStageOwned))
+	_, err = store.Update("ksmtuned", func(tx *Tx) error {
+		return tx.Delete("initramfs", "Runtime Sysctl")
+	})
+	assert.True(t, errors.Is(err, ErrStageOwned))
+	_, err = store.Update("nodeconfig", put("initrd", sysctl))
+	assert.True(t, errors.Is(err, ErrInvalidStage))
+
+	// unchanged
+	result, err = store.Update("nodeconfig", put("initramfs", sysctl))
+	assert.Nil(t, err)
+	assert.Empty(t, result.Changes)
+
+	_, err = store.Update("ksmtuned", func(tx *Tx) error {
+		return tx.Delete("boot", "Runtime KSM")
+	})
+	assert.Nil(t, err)
+	result, err = store.Update("nodeconfig", func(tx *Tx) error {
+		return tx.Delete("initramfs", "Runtime Sysctl")
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ChangeRemove, result.Changes[0].Op)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path + stateSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStoreForeignEdit(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := tmpDir + "/99_settings.yaml"
+	store := NewStore(path, path+".bak", 3)
+
+	// the stages written before the store was used are adopted
+	legacy := "name: oem_settings\nstages:\n    initramfs:\n        - name: Runtime Sysctl\n"
+	assert.Nil(t, os.WriteFile(path, []byte(legacy), 0644))
+	result, err := store.Update("nodeconfig", put("initramfs", schema.Stage{Name: "Runtime Sysctl", Commands: []string{"sysctl --system"}}))
+	assert.Nil(t, err)
+	assert.False(t, result.ForeignEdit)
+	assert.Equal(t, ChangeUpdate, result.Changes[0].Op)
+	assert.Equal(t, "name: Runtime Sysctl\n", result.Changes[0].Before)
+
+	// the foreign stage is kept, and the edit is only reported once
+	edited, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	edited = append(edited, []byte("    boot:\n        - name: Custom\n")...)
+	assert.Nil(t, os.WriteFile(path, edited, 0644))
+	result, err = store.Update("nodeconfig", put("initramfs", schema.Stage{Name: "Runtime Sysctl", Commands: []string{"sysctl --system"}}))
+	assert.Nil(t, err)
+	assert.True(t, result.ForeignEdit)
+	assert.Empty(t, result.Changes)
+	result, err = store.Update("nodeconfig", put("initramfs", schema.Stage{Name: "Runtime Sysctl", Commands: []string{"sysctl --system"}}))
+	assert.Nil(t, err)
+	assert.False(t, result.ForeignEdit)
+
+	stages, err := store.Stages()
+	assert.Nil(t, err)
+	assert.Equal(t, "Custom", stages["boot"][0].Name)
+	// the foreign stage is not owned
+	_, err = store.Update("ksmtuned", func(tx *Tx) error {
+		return tx.Delete("boot", "Custom")
+	})
+	assert.Nil(t, err)
+}
+
+func TestStorePlanAndHistory(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := tmpDir + "/99_settings.yaml"
+	store := NewStore(path, path+".bak", 3)
+
+	result, err := store.Plan("nodeconfig", put("initramfs", schema.Stage{Name: "Runtime DNS"}))
+	assert.Nil(t, err)
+	assert.Equal(t, "add initramfs/Runtime DNS", result.Changes[0].String())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	for i := range 5 {
+		_, err := store.Update("nodeconfig", put("initramfs", schema.Stage{Name: "Runtime DNS", Commands: []string{fmt.Sprintf("echo %d", i)}}))
+		assert.Nil(t, err)
+	}
+	// the newest backup is the previous version, up to 3 versions are kept
+	for i, backup := range []string{path + ".bak", path + ".bak.1", path + ".bak.2"} {
+		data, err := os.ReadFile(backup)
+		assert.Nil(t, err)
+		assert.Contains(t, string(data), fmt.Sprintf("echo %d", 3-i))
+	}
+	_, err = os.Stat(path + ".bak.3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStoreWriteFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := tmpDir + "/90_custom.yaml"
+	store := NewStore(path, path+".bak", 3)
+
+	// the file written before the store was used is adopted
+	assert.Nil(t, os.WriteFile(path, []byte("legacy"), 0644))
+	result, err := store.PlanWrite("cloudinit/a", []byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{{Op: ChangeUpdate, Name: "90_custom.yaml", Before: "legacy", After: "a"}}, result.Changes)
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "legacy", string(data))
+
+	result, err = store.Write("cloudinit/a", []byte("a"))
+	assert.Nil(t, err)
+	assert.False(t, result.ForeignEdit)
+	assert.Equal(t, ChangeUpdate, result.Changes[0].Op)
+	backup, err := os.ReadFile(path + ".bak")
+	assert.Nil(t, err)
+	assert.Equal(t, "legacy", string(backup))
+
+	// the file could not be written or removed by the other owners
+	_, err = store.Write("cloudinit/b", []byte("b"))
+	assert.True(t, errors.Is(err, ErrFileOwned))
+	_, err = store.Remove("cloudinit/b")
+	assert.True(t, errors.Is(err, ErrFileOwned))
+	_, err = store.Update("nodeconfig", put("initramfs", schema.Stage{Name: "Runtime Sysctl"}))
+	assert.True(t, errors.Is(err, ErrFileOwned))
+
+	// the edit is reported and overwritten
+	assert.Nil(t, os.WriteFile(path, []byte("edited"), 0644))
+	result, err = store.PlanWrite("cloudinit/a", []byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, result.ForeignEdit)
+	result, err = store.Write("cloudinit/a", []byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, result.ForeignEdit)
+	assert.Equal(t, ChangeUpdate, result.Changes[0].Op)
+	result, err = store.Write("cloudinit/a", []byte("a"))
+	assert.Nil(t, err)
+	assert.False(t, result.ForeignEdit)
+	assert.Empty(t, result.Changes)
+
+	result, err = store.Remove("cloudinit/a")
+	assert.Nil(t, err)
+	assert.Equal(t, ChangeRemove, result.Changes[0].Op)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path + stateSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	// once removed the file could be written by the other owners
+	result, err = store.Remove("cloudinit/a")
+	assert.Nil(t, err)
+	assert.Empty(t, result.Changes)
+	_, err = store.Write("cloudinit/b", []byte("b"))
+	assert.Nil(t, err)
+}
@@ -1,11 +1,19 @@
 package option
 
+import "time"
+
 type Option struct {
 	KubeConfig  string
 	MasterURL   string
 	NodeName    string
+	Namespace   string
 	Threadiness int
 
+	ClockSkewThreshold time.Duration
+
+	AuditLog     string
+	AuditHistory bool
+
 	Debug           bool
 	Trace           bool
 	LogFormat       string
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	ChronyConfigPath = "/host/etc/chrony.d/"
+	ChronyConfigName = "harvester-ntp.conf"
+	chronycBinary    = "/usr/bin/chronyc"
+)
+
+// ChronySource is the subset of `chronyc sources` we are interested in
+type ChronySource struct {
+	Address  string
+	State    string
+	Selected bool
+}
+
+// ChronyAuthData is the subset of `chronyc authdata` we are interested in
+type ChronyAuthData struct {
+	Address   string
+	Mode      string
+	KeyLength int
+}
+
+func chronyc(args ...string) (string, error) {
+	// -c for CSV output, -n to skip resolving addresses back to hostnames
+	args = append([]string{"-c", "-n"}, args...)
+	out, err := exec.Command(chronycBinary, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("chronyc failed: %v (output: '%s')", err, out)
+	}
+	return string(out), nil
+}
+
+func parseChronyCSV(out string) ([][]string, error) {
+	reader := csv.NewReader(strings.NewReader(out))
+	// the number of fields differs between the chrony versions
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("parse chronyc output failed: %v", err)
+	}
+	return records, nil
+}
+
+func GetChronySources() ([]ChronySource, error) {
+	out, err := chronyc("sources")
+	if err != nil {
+		return nil, err
+	}
+	return ParseChronySources(out)
+}
+
+// ParseChronySources parses the CSV output of `chronyc -c sources`
+func ParseChronySources(out string) ([]ChronySource, error) {
+	records, err := parseChronyCSV(out)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make([]ChronySource, 0, len(records))
+	for _, record := range records {
+		// Mode, State, Name/IP address, Stratum, Poll, Reach, LastRx, ...
+		if len(record) < 3 {
+			continue
+		}
+		sources = append(sources, ChronySource{
+			Address:  record[2],
+			State:    record[1],
+			Selected: record[1] == "*",
+		})
+	}
+	return sources, nil
+}
+
+func GetChronyAuthData() ([]ChronyAuthData, error) {
+	out, err := chronyc("authdata")
+	if err != nil {
+		return nil, err
+	}
+	return ParseChronyAuthData(out)
+}
+
+// ParseChronyAuthData parses the CSV output of `chronyc -c authdata`
+func ParseChronyAuthData(out string) ([]ChronyAuthData, error) {
+	records, err := parseChronyCSV(out)
+	if err != nil {
+		return nil, err
+	}
+
+	authData := make([]ChronyAuthData, 0, len(records))
+	for _, record := range records {
+		// Name/IP address, Mode, KeyID, Type, KLen, Last, Atmp, NAK, Cook, CLen
+		if len(record) < 5 {
+			continue
+		}
+		keyLength, err := strconv.Atoi(record[4])
+		if err != nil {
+			keyLength = 0
+		}
+		authData = append(authData, ChronyAuthData{
+			Address:   record[0],
+			Mode:      record[1],
+			KeyLength: keyLength,
+		})
+	}
+	return authData, nil
+}
+
+// ChronyTracking is the subset of `chronyc tracking` we are interested in,
+// the offsets and delays are in seconds.
+type ChronyTracking struct {
+	Address        string
+	Stratum        uint32
+	LastOffset     float64
+	RMSOffset      float64
+	RootDelay      float64
+	RootDispersion float64
+}
+
+func GetChronyTracking() (*ChronyTracking, error) {
+	out, err := chronyc("tracking")
+	if err != nil {
+		return nil, err
+	}
+	return ParseChronyTracking(out)
+}
+
+// ParseChronyTracking parses the CSV output of `chronyc -c tracking`
+func ParseChronyTracking(out string) (*ChronyTracking, error) {
+	records, err := parseChronyCSV(out)
+	if err != nil {
+		return nil, err
+	}
+	// Ref ID, Name/IP address, Stratum, Ref time, System time, Last offset,
+	// RMS offset, Frequency, Residual freq, Skew, Root delay, Root dispersion, ...
+	if len(records) == 0 || len(records[0]) < 12 {
+		return nil, fmt.Errorf("unexpected chronyc tracking output: %v", records)
+	}
+	record := records[0]
+
+	stratum, err := strconv.ParseUint(record[2], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("parse chrony stratum %q failed: %v", record[2], err)
+	}
+	tracking := &ChronyTracking{
+		Address: record[1],
+		Stratum: uint32(stratum),
+	}
+	for target, field := range map[*float64]string{
+		&tracking.LastOffset:     record[5],
+		&tracking.RMSOffset:      record[6],
+		&tracking.RootDelay:      record[10],
+		&tracking.RootDispersion: record[11],
+	} {
+		if *target, err = strconv.ParseFloat(field, 64); err != nil {
+			return nil, fmt.Errorf("parse chrony tracking field %q failed: %v", field, err)
+		}
+	}
+	return tracking, nil
+}
@@ -17,9 +17,19 @@ const (
 	DbusTimesync1ObjectPath = "/org/freedesktop/timesync1"
 )
 
+// AnnotationRebootRequired is set to "true" on the node until it is rebooted
+// with the kernel args of the NodeConfig
+const AnnotationRebootRequired = "node.harvesterhci.io/reboot-required"
+
+// AnnotationAppliedConfig records the config the NodeConfig controller
+// applied on the host
+const AnnotationAppliedConfig = "AppliedConfig"
+
 type NTPStatusAnnotation struct {
 	NTPSyncStatus     string `json:"ntpSyncStatus"`
 	CurrentNTPServers string `json:"currentNtpServers"`
+	CurrentNTPSource  string `json:"currentNtpSource,omitempty"`
+	Authenticated     bool   `json:"authenticated"`
 }
 
 func GetTimesyncdConf() (*viper.Viper, error) {
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ParseCPUList parses the kernel cpulist format, e.g. `0-3,8,10-11`, into the
+// sorted list of the CPUs.
+func ParseCPUList(cpuList string) ([]int, error) {
+	var cpus []int
+	cpuList = strings.TrimSpace(cpuList)
+	if cpuList == "" {
+		return cpus, nil
+	}
+
+	for _, part := range strings.Split(cpuList, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid cpu %q in cpu list %q", first, cpuList)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return nil, fmt.Errorf("invalid cpu range %q in cpu list %q", part, cpuList)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	slices.Sort(cpus)
+	return slices.Compact(cpus), nil
+}
+
+// FormatCPUList formats the CPUs into the kernel cpulist format, consecutive
+// CPUs are folded into ranges.
+func FormatCPUList(cpus []int) string {
+	cpus = slices.Compact(slices.Sorted(slices.Values(cpus)))
+	var parts []string
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(cpus[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", cpus[i], cpus[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseCPUMask parses the kernel cpumask format, e.g. `ff` or
+// `00000000,000000ff`, into the sorted list of the CPUs.
+func ParseCPUMask(cpuMask string) ([]int, error) {
+	var cpus []int
+	groups := strings.Split(strings.TrimSpace(cpuMask), ",")
+	for i, group := range groups {
+		bits, err := strconv.ParseUint(group, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu mask %q", cpuMask)
+		}
+		offset := (len(groups) - 1 - i) * 32
+		for bit := 0; bit < 32; bit++ {
+			if bits&(1<<bit) != 0 {
+				cpus = append(cpus, offset+bit)
+			}
+		}
+	}
+	slices.Sort(cpus)
+	return cpus, nil
+}
+
+// FormatCPUMask formats the CPUs into the kernel cpumask format, the mask is
+// split into 32 bit groups, the most significant one first.
+func FormatCPUMask(cpus []int) string {
+	groups := make([]uint32, 1)
+	for _, cpu := range cpus {
+		for cpu/32 >= len(groups) {
+			groups = append(groups, 0)
+		}
+		groups[cpu/32] |= 1 << (cpu % 32)
+	}
+	parts := make([]string, 0, len(groups))
+	for i := len(groups) - 1; i >= 0; i-- {
+		if i == len(groups)-1 {
+			parts = append(parts, strconv.FormatUint(uint64(groups[i]), 16))
+		} else {
+			parts = append(parts, fmt.Sprintf("%08x", groups[i]))
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -39,6 +39,41 @@ func GetTimeDate1PropertiesNTPSynchronized() (bool, error) {
 	return output, nil
 }
 
+func GetTimeDate1PropertiesTimezone() (string, error) {
+	conn, err := generateDBUSConnection()
+	if err != nil {
+		return "", err
+	}
+
+	obj := conn.Object(DbusTimedate1Name, DbusTimedate1ObjectPath)
+
+	var output string
+	err = obj.Call(DbusPropertiesGet(), 0, DbusTimedate1Name, "Timezone").Store(&output)
+	if err != nil {
+		logrus.Warnf("Get timedate1 properties failed. err: %v", err)
+		return "", err
+	}
+	return output, nil
+}
+
+// SetTimeDate1Timezone sets the host timezone, timedate1 validates it against
+// the host zoneinfo database and updates /etc/localtime.
+func SetTimeDate1Timezone(timezone string) error {
+	conn, err := generateDBUSConnection()
+	if err != nil {
+		return err
+	}
+
+	obj := conn.Object(DbusTimedate1Name, DbusTimedate1ObjectPath)
+
+	// the second argument is `interactive`, no polkit authentication is asked
+	if err := obj.Call(DbusTimedate1Name+".SetTimezone", 0, timezone, false).Err; err != nil {
+		logrus.Warnf("Set timedate1 timezone failed. err: %v", err)
+		return err
+	}
+	return nil
+}
+
 // Do not close this return connection because SystemBus() will return a shared connection
 func generateDBUSConnection() (*dbus.Conn, error) {
 	conn, err := dbus.SystemBus()
@@ -49,3 +84,20 @@ func generateDBUSConnection() (*dbus.Conn, error) {
 
 	return conn, nil
 }
+
+func GetTimesync1PropertiesServerName() (string, error) {
+	conn, err := generateDBUSConnection()
+	if err != nil {
+		return "", err
+	}
+
+	obj := conn.Object(DbusTimesync1Name, DbusTimesync1ObjectPath)
+
+	var output string
+	err = obj.Call(DbusPropertiesGet(), 0, DbusTimesync1Name, "ServerName").Store(&output)
+	if err != nil {
+		logrus.Warnf("Get timesync1 properties failed. err: %v", err)
+		return "", err
+	}
+	return output, nil
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/harvester/go-common/files"
+)
+
+func parseEnvFileLine(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	key, value, found := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+	if !found {
+		return "", "", false
+	}
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		value = unquoted
+	} else {
+		value = strings.Trim(value, `'`)
+	}
+	return strings.TrimSpace(key), value, true
+}
+
+// ReadEnvFile returns the variables in keys of a shell style environment
+// file, the missing file is treated as empty.
+func ReadEnvFile(path string, keys []string) (map[string]string, error) {
+	values := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return values, nil
+		}
+		return nil, fmt.Errorf("read %s failed: %v", path, err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if key, value, ok := parseEnvFileLine(scanner.Text()); ok && slices.Contains(keys, key) {
+			values[key] = value
+		}
+	}
+	return values, scanner.Err()
+}
+
+// UpdateEnvFile updates the variables in keys of a shell style environment
+// file in place, the variables which are not in values are removed. The
+// comments and the other variables are kept.
+func UpdateEnvFile(path string, values map[string]string, keys []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read %s failed: %v", path, err)
+	}
+
+	var lines []string
+	updated := make(map[string]bool, len(values))
+	if len(data) > 0 {
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			key, _, ok := parseEnvFileLine(line)
+			if ok && slices.Contains(keys, key) {
+				value, found := values[key]
+				if !found || updated[key] {
+					continue
+				}
+				line = fmt.Sprintf("%s=%q", key, value)
+				updated[key] = true
+			}
+			lines = append(lines, line)
+		}
+	}
+	for _, key := range keys {
+		if value, found := values[key]; found && !updated[key] {
+			lines = append(lines, fmt.Sprintf("%s=%q", key, value))
+		}
+	}
+
+	raw := strings.Join(lines, "\n")
+	if raw != "" {
+		raw += "\n"
+	}
+	if raw == string(data) {
+		return nil
+	}
+	tmpFileName, err := files.GenerateTempFileWithDir([]byte(raw), filepath.Base(path), filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("generate temp %s failed: %v", path, err)
+	}
+	if err := os.Rename(tmpFileName, path); err != nil {
+		return fmt.Errorf("rename temp %s failed: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+const (
+	JournaldDropInName     = "99-harvester-node-manager.conf"
+	HostJournaldDropInPath = "/etc/systemd/journald.conf.d/" + JournaldDropInName
+)
+
+// JournaldDropInPath is the journald drop-in on the host, it would ordinarily
+// be const, but we need to override it in unit tests
+var JournaldDropInPath = SystemdConfigPath + "journald.conf.d/" + JournaldDropInName
+
+func journaldBool(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+// GenerateJournaldConfig renders the journald drop-in, it is empty when
+// journald is nil.
+func GenerateJournaldConfig(journald *nodeconfigv1.JournaldConfig) string {
+	if journald == nil {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("# Generated by harvester-node-manager, do not edit\n")
+	sb.WriteString("[Journal]\n")
+	if journald.SystemMaxUse != nil {
+		fmt.Fprintf(&sb, "SystemMaxUse=%d\n", journald.SystemMaxUse.Value())
+	}
+	if journald.MaxRetentionSec != nil {
+		fmt.Fprintf(&sb, "MaxRetentionSec=%ds\n", int64(journald.MaxRetentionSec.Seconds()))
+	}
+	if journald.ForwardToSyslog != nil {
+		fmt.Fprintf(&sb, "ForwardToSyslog=%s\n", journaldBool(*journald.ForwardToSyslog))
+	}
+	if journald.ForwardToKMsg != nil {
+		fmt.Fprintf(&sb, "ForwardToKMsg=%s\n", journaldBool(*journald.ForwardToKMsg))
+	}
+	if journald.ForwardToConsole != nil {
+		fmt.Fprintf(&sb, "ForwardToConsole=%s\n", journaldBool(*journald.ForwardToConsole))
+	}
+	return sb.String()
+}
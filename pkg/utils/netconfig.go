@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+const (
+	NetconfigDNSServers = "NETCONFIG_DNS_STATIC_SERVERS"
+	NetconfigDNSSearch  = "NETCONFIG_DNS_STATIC_SEARCHLIST"
+	NetconfigDNSOptions = "NETCONFIG_DNS_RESOLVER_OPTIONS"
+	HostNetconfigPath   = "/etc/sysconfig/network/config"
+)
+
+// NetconfigPath is the host netconfig config, it would ordinarily be const,
+// but we need to override it in unit tests
+var NetconfigPath = "/host" + HostNetconfigPath
+
+// NetconfigDNSKeys are the netconfig variables managed by the DNS config
+var NetconfigDNSKeys = []string{NetconfigDNSServers, NetconfigDNSSearch, NetconfigDNSOptions}
+
+// DNSConfigToNetconfig converts the DNS config to the netconfig variables, the
+// variables are empty when dns is nil.
+func DNSConfigToNetconfig(dns *nodeconfigv1.DNSConfig) map[string]string {
+	if dns == nil {
+		dns = &nodeconfigv1.DNSConfig{}
+	}
+	return map[string]string{
+		NetconfigDNSServers: strings.Join(dns.Nameservers, " "),
+		NetconfigDNSSearch:  strings.Join(dns.Search, " "),
+		NetconfigDNSOptions: strings.Join(dns.Options, " "),
+	}
+}
+
+// ReadNetconfigDNS returns the DNS variables of the host netconfig config
+func ReadNetconfigDNS() (map[string]string, error) {
+	// the config is shipped with the OS, it is never created by us
+	if _, err := os.Stat(NetconfigPath); err != nil {
+		return nil, fmt.Errorf("read %s failed: %v", NetconfigPath, err)
+	}
+	current, err := ReadEnvFile(NetconfigPath, NetconfigDNSKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	values := DNSConfigToNetconfig(nil)
+	maps.Copy(values, current)
+	return values, nil
+}
+
+// WriteNetconfig updates the DNS variables of the host netconfig config in
+// place, the comments and the other variables are kept.
+func WriteNetconfig(values map[string]string) error {
+	return UpdateEnvFile(NetconfigPath, values, NetconfigDNSKeys)
+}
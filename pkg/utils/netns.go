@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// HostNetNSPath is the network namespace of the host init process, the host
+// /proc is mounted to /host/proc.
+var HostNetNSPath = "/host/proc/1/ns/net"
+
+// RunInHostNetNS runs fn in the network namespace of the host, which is
+// needed for the network namespaced sysctls because node-manager is not
+// running with the host network.
+func RunInHostNetNS(fn func() error) error {
+	hostNS, err := os.Open(HostNetNSPath)
+	if err != nil {
+		return fmt.Errorf("open host network namespace failed: %v", err)
+	}
+	defer hostNS.Close()
+
+	origNS, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		return fmt.Errorf("open current network namespace failed: %v", err)
+	}
+	defer origNS.Close()
+
+	// the namespace belongs to the thread, keep the goroutine on it
+	runtime.LockOSThread()
+	if err := unix.Setns(int(hostNS.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("enter host network namespace failed: %v", err)
+	}
+
+	fnErr := fn()
+
+	if err := unix.Setns(int(origNS.Fd()), unix.CLONE_NEWNET); err != nil {
+		// keep the thread locked, it is terminated with the goroutine
+		// instead of being reused in the wrong namespace
+		logrus.Errorf("Restore network namespace failed. err: %v", err)
+		return fnErr
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"encoding/json"
+
+	ctlnode "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+// nodeAnnotationPatch is the JSON merge patch of a node annotation, a nil
+// value removes the annotation. The resourceVersion makes the patch
+// conditional, it fails with a conflict when the node was changed since it was
+// read.
+type nodeAnnotationPatch struct {
+	Metadata struct {
+		ResourceVersion string             `json:"resourceVersion,omitempty"`
+		Annotations     map[string]*string `json:"annotations"`
+	} `json:"metadata"`
+}
+
+func patchNodeAnnotation(nodes ctlnode.NodeClient, nodeName, resourceVersion, key string, value *string) error {
+	patch := nodeAnnotationPatch{}
+	patch.Metadata.ResourceVersion = resourceVersion
+	patch.Metadata.Annotations = map[string]*string{key: value}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = nodes.Patch(nodeName, types.MergePatchType, data)
+	return err
+}
+
+// PatchNodeAnnotation sets the annotation of the node, nil removes it. The
+// patch only carries the annotation, so it never overwrites what the other
+// writers changed on the node, and the annotation needs only one owner.
+func PatchNodeAnnotation(nodes ctlnode.NodeClient, nodeName, key string, value *string) error {
+	return patchNodeAnnotation(nodes, nodeName, "", key, value)
+}
+
+// UpdateNodeAnnotation updates an annotation whose value is shared by several
+// writers, each of them owns some fields of the value. update is called with
+// the current value and returns the wanted one, nil removes the annotation.
+// The patch is conditional on the node it was read from, it is retried with the
+// fresh value on conflict, so the concurrent writes of the other fields are
+// not lost.
+func UpdateNodeAnnotation(nodes ctlnode.NodeClient, nodeName, key string, update func(value string, found bool) (*string, error)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := nodes.Get(nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		value, found := node.Annotations[key]
+		wanted, err := update(value, found)
+		if err != nil {
+			return err
+		}
+		if (wanted == nil && !found) || (wanted != nil && found && *wanted == value) {
+			return nil
+		}
+		return patchNodeAnnotation(nodes, nodeName, node.ResourceVersion, key, wanted)
+	})
+}
+
+// UpdateNTPStatusAnnotation updates the NTP annotation of the node. update
+// changes the fields owned by the caller and returns false to leave the
+// annotation alone: CurrentNTPServers is owned by the NodeConfig controller,
+// the other fields by the NTP monitor.
+func UpdateNTPStatusAnnotation(nodes ctlnode.NodeClient, nodeName string, update func(value *NTPStatusAnnotation, found bool) bool) error {
+	return UpdateNodeAnnotation(nodes, nodeName, AnnotationNTP, func(raw string, found bool) (*string, error) {
+		value := &NTPStatusAnnotation{}
+		if found {
+			if err := json.Unmarshal([]byte(raw), value); err != nil {
+				return nil, err
+			}
+		}
+		if !update(value, found) {
+			if !found {
+				return nil, nil
+			}
+			return &raw, nil
+		}
+		bytes, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		wanted := string(bytes)
+		return &wanted, nil
+	})
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"slices"
+	"strings"
+
+	nodeconfigv1 "github.com/harvester/node-manager/pkg/apis/node.harvesterhci.io/v1beta1"
+)
+
+// GetNTPServers returns the NTP servers wanted by the config. The structured
+// Servers list takes precedence over the legacy NTPServers string, which is
+// only split on whitespace, and duplicated addresses are dropped.
+func GetNTPServers(ntpConfig *nodeconfigv1.NTPConfig) []nodeconfigv1.NTPServer {
+	if ntpConfig == nil {
+		return nil
+	}
+
+	servers := ntpConfig.Servers
+	if len(servers) == 0 {
+		for _, address := range strings.Fields(ntpConfig.NTPServers) {
+			servers = append(servers, nodeconfigv1.NTPServer{Address: address})
+		}
+	}
+
+	parsed := make([]nodeconfigv1.NTPServer, 0, len(servers))
+	for _, server := range servers {
+		if slices.ContainsFunc(parsed, func(s nodeconfigv1.NTPServer) bool {
+			return strings.EqualFold(s.Address, server.Address)
+		}) {
+			continue
+		}
+		parsed = append(parsed, server)
+	}
+	return parsed
+}
+
+// NTPServersToString joins the server addresses the way timesyncd expects them
+func NTPServersToString(servers []nodeconfigv1.NTPServer) string {
+	addresses := make([]string, 0, len(servers))
+	for _, server := range servers {
+		addresses = append(addresses, server.Address)
+	}
+	return strings.Join(addresses, " ")
+}
@@ -1,47 +1,12 @@
 package utils
 
 import (
-	"fmt"
-
 	"github.com/mudler/yip/pkg/schema"
 	"github.com/sirupsen/logrus"
 	govfs "github.com/twpayne/go-vfs"
 	"go.yaml.in/yaml/v4"
 )
 
-var validateStages = []string{
-	"rootfs",
-	"initramfs",
-	"boot",
-	"fs",
-	"network",
-	"reconcile",
-	"post-install",
-	"after-install-chroot",
-	"after-install",
-	"post-upgrade",
-	"after-upgrade-chroot",
-	"after-upgrade",
-	"post-reset",
-	"after-reset-chroot",
-	"after-reset",
-	"before-install",
-	"before-upgrade",
-	"before-reset",
-}
-
-func validateStage(stageName string) bool {
-	if stageName == "" {
-		return false
-	}
-	for _, stage := range validateStages {
-		if stageName == stage {
-			return true
-		}
-	}
-	return false
-}
-
 // return the empty OEM template for later use
 func GenerateOEMTemplate() *schema.YipConfig {
 	return &schema.YipConfig{
@@ -49,16 +14,6 @@ func GenerateOEMTemplate() *schema.YipConfig {
 	}
 }
 
-func UpdateToOEMTemplate(stageName string, stage schema.Stage, oem *schema.YipConfig) (*schema.YipConfig, error) {
-	if !validateStage(stageName) {
-		return nil, fmt.Errorf("invalid stage name: %s", stageName)
-	}
-	oem.Stages = map[string][]schema.Stage{
-		stageName: {stage},
-	}
-	return oem, nil
-}
-
 func LoadYipConfig(path string) (*schema.YipConfig, error) {
 	yipConfig := GenerateOEMTemplate()
 	yipConfig.Stages = make(map[string][]schema.Stage)
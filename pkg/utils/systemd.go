@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	"github.com/sirupsen/logrus"
+)
+
+// StopService stops a service, a service that isn't running won't be affected.
+func StopService(unit string) error {
+	ctx := context.Background()
+	conn, err := dbus.NewWithContext(ctx)
+	if err != nil {
+		logrus.Errorf("Failed to create new connection for systemd. err: %v", err)
+		return err
+	}
+	defer conn.Close()
+	responseChan := make(chan string, 1)
+	if _, err := conn.StopUnitContext(ctx, unit, "fail", responseChan); err != nil {
+		logrus.Errorf("Failed to stop service %s. err: %v", unit, err)
+		return err
+	}
+	return nil
+}
+
+// RunHostCommand runs the command on the host as a transient oneshot service,
+// and waits for it to exit.
+func RunHostCommand(unit string, command []string) error {
+	ctx := context.Background()
+	conn, err := dbus.NewWithContext(ctx)
+	if err != nil {
+		logrus.Errorf("Failed to create new connection for systemd. err: %v", err)
+		return err
+	}
+	defer conn.Close()
+
+	// the failed transient service is kept until it is reset, which
+	// prevents it from being started again
+	_ = conn.ResetFailedUnitContext(ctx, unit)
+
+	properties := []dbus.Property{
+		dbus.PropDescription(strings.Join(command, " ")),
+		dbus.PropType("oneshot"),
+		dbus.PropExecStart(command, true),
+	}
+	responseChan := make(chan string, 1)
+	if _, err := conn.StartTransientUnitContext(ctx, unit, "replace", properties, responseChan); err != nil {
+		logrus.Errorf("Failed to start service %s. err: %v", unit, err)
+		return err
+	}
+	if result := <-responseChan; result != "done" {
+		return fmt.Errorf("run %q failed: %s", strings.Join(command, " "), result)
+	}
+	return nil
+}
+
+// ReloadSystemd reloads the unit files, like `systemctl daemon-reload`.
+func ReloadSystemd() error {
+	ctx := context.Background()
+	conn, err := dbus.NewWithContext(ctx)
+	if err != nil {
+		logrus.Errorf("Failed to create new connection for systemd. err: %v", err)
+		return err
+	}
+	defer conn.Close()
+	return conn.ReloadContext(ctx)
+}
+
+// SetUnitState enables, disables or masks the unit and starts or stops it
+// accordingly, like `systemctl enable|disable|mask --now`.
+func SetUnitState(unit, state string) error {
+	ctx := context.Background()
+	conn, err := dbus.NewWithContext(ctx)
+	if err != nil {
+		logrus.Errorf("Failed to create new connection for systemd. err: %v", err)
+		return err
+	}
+	defer conn.Close()
+
+	units := []string{unit}
+	start := false
+	switch state {
+	case "enabled":
+		if _, err := conn.UnmaskUnitFilesContext(ctx, units, false); err != nil {
+			return fmt.Errorf("unmask %s failed: %v", unit, err)
+		}
+		if _, _, err := conn.EnableUnitFilesContext(ctx, units, false, true); err != nil {
+			return fmt.Errorf("enable %s failed: %v", unit, err)
+		}
+		start = true
+	case "disabled":
+		if _, err := conn.UnmaskUnitFilesContext(ctx, units, false); err != nil {
+			return fmt.Errorf("unmask %s failed: %v", unit, err)
+		}
+		if _, err := conn.DisableUnitFilesContext(ctx, units, false); err != nil {
+			return fmt.Errorf("disable %s failed: %v", unit, err)
+		}
+	case "masked":
+		if _, err := conn.MaskUnitFilesContext(ctx, units, false, true); err != nil {
+			return fmt.Errorf("mask %s failed: %v", unit, err)
+		}
+	default:
+		return fmt.Errorf("unknown state %q of %s", state, unit)
+	}
+	if err := conn.ReloadContext(ctx); err != nil {
+		return fmt.Errorf("reload systemd failed: %v", err)
+	}
+
+	responseChan := make(chan string, 1)
+	if start {
+		_, err = conn.StartUnitContext(ctx, unit, "replace", responseChan)
+	} else {
+		_, err = conn.StopUnitContext(ctx, unit, "replace", responseChan)
+	}
+	if err != nil {
+		return fmt.Errorf("set %s to %s failed: %v", unit, state, err)
+	}
+	if result := <-responseChan; result != "done" {
+		return fmt.Errorf("set %s to %s failed: %s", unit, state, result)
+	}
+	return nil
+}
+
+// UnitStatus is the state of a unit reported by systemd
+type UnitStatus struct {
+	LoadState     string
+	ActiveState   string
+	SubState      string
+	UnitFileState string
+}
+
+// GetUnitStatus returns the state of the unit, units which are not found are
+// reported with the `not-found` load state.
+func GetUnitStatus(unit string) (UnitStatus, error) {
+	ctx := context.Background()
+	conn, err := dbus.NewWithContext(ctx)
+	if err != nil {
+		logrus.Errorf("Failed to create new connection for systemd. err: %v", err)
+		return UnitStatus{}, err
+	}
+	defer conn.Close()
+
+	properties, err := conn.GetUnitPropertiesContext(ctx, unit)
+	if err != nil {
+		return UnitStatus{}, fmt.Errorf("get properties of %s failed: %v", unit, err)
+	}
+	property := func(name string) string {
+		value, _ := properties[name].(string)
+		return value
+	}
+	return UnitStatus{
+		LoadState:     property("LoadState"),
+		ActiveState:   property("ActiveState"),
+		SubState:      property("SubState"),
+		UnitFileState: property("UnitFileState"),
+	}, nil
+}